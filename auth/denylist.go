@@ -0,0 +1,141 @@
+package auth
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"sync"
+	"time"
+)
+
+// denylistSyncInterval bounds how long a revocation made by another instance
+// takes to reach this one. denylistSkew widens each incremental sync so that
+// rows written by instances with a slightly late clock are not missed.
+const (
+	denylistSyncInterval = 10 * time.Second
+	denylistSkew         = 30 * time.Second
+)
+
+// Denylist keeps the revoked key pairs in memory so access token validation
+// never waits on the database. Entries are only kept until the access token
+// of the pair expires, after which the token is rejected anyway.
+type Denylist struct {
+	mu        sync.RWMutex
+	entries   map[string]time.Time
+	watermark time.Time
+	lastSync  time.Time
+	db        *sql.DB
+}
+
+func NewDenylist(DB *sql.DB) (*Denylist, error) {
+	denylist := &Denylist{
+		entries: map[string]time.Time{},
+		db:      DB,
+	}
+	err := denylist.sync(context.Background())
+	if err != nil {
+		return nil, err
+	}
+	return denylist, nil
+}
+
+func (d *Denylist) Revoke(ctx context.Context, keyPairID string, expiresAt time.Time) error {
+	err := d.store(ctx, d.db, keyPairID, expiresAt)
+	if err != nil {
+		return err
+	}
+	d.remember(keyPairID, expiresAt)
+	return nil
+}
+
+// store records a revocation on db without adding it to memory, for callers
+// whose transaction may still roll back. Once committed, sync picks it up.
+func (d *Denylist) store(ctx context.Context, db execQueryer, keyPairID string, expiresAt time.Time) error {
+	if !expiresAt.After(time.Now()) {
+		return nil
+	}
+	_, err := db.ExecContext(
+		ctx,
+		"insert into revoked_key_pairs (keyPairId, expires_at, revoked_at) values($1, $2, $3) on conflict (keyPairId) do nothing",
+		keyPairID, expiresAt, time.Now(),
+	)
+	if err != nil {
+		return fmt.Errorf("Failed to revoke key pair: %w", err)
+	}
+	return nil
+}
+
+func (d *Denylist) remember(keyPairID string, expiresAt time.Time) {
+	if !expiresAt.After(time.Now()) {
+		return
+	}
+	d.mu.Lock()
+	d.entries[keyPairID] = expiresAt
+	d.mu.Unlock()
+}
+
+func (d *Denylist) IsRevoked(keyPairID string) bool {
+	d.mu.RLock()
+	stale := time.Since(d.lastSync) > denylistSyncInterval
+	d.mu.RUnlock()
+	if stale {
+		d.sync(context.Background())
+	}
+
+	d.mu.RLock()
+	defer d.mu.RUnlock()
+	expiresAt, ok := d.entries[keyPairID]
+	return ok && time.Now().Before(expiresAt)
+}
+
+// sync loads revocations recorded since the last sync and drops entries
+// whose tokens have expired, both from memory and from the table.
+func (d *Denylist) sync(ctx context.Context) error {
+	now := time.Now()
+
+	d.mu.Lock()
+	since := d.watermark.Add(-denylistSkew)
+	d.lastSync = now
+	d.mu.Unlock()
+
+	_, err := d.db.ExecContext(
+		ctx,
+		"delete from revoked_key_pairs where expires_at <= $1",
+		now,
+	)
+	if err != nil {
+		return fmt.Errorf("Failed to prune revoked key pairs: %w", err)
+	}
+
+	rows, err := d.db.QueryContext(
+		ctx,
+		"select keyPairId, expires_at, revoked_at from revoked_key_pairs where revoked_at > $1",
+		since,
+	)
+	if err != nil {
+		return fmt.Errorf("Failed to load revoked key pairs: %w", err)
+	}
+	defer rows.Close()
+
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	for rows.Next() {
+		var keyPairID string
+		var expiresAt, revokedAt time.Time
+		err = rows.Scan(&keyPairID, &expiresAt, &revokedAt)
+		if err != nil {
+			return err
+		}
+		d.entries[keyPairID] = expiresAt
+		if revokedAt.After(d.watermark) {
+			d.watermark = revokedAt
+		}
+	}
+	for keyPairID, expiresAt := range d.entries {
+		if !now.Before(expiresAt) {
+			delete(d.entries, keyPairID)
+		}
+	}
+	return rows.Err()
+}
@@ -0,0 +1,104 @@
+package auth
+
+import (
+	"context"
+	"database/sql"
+	"regexp"
+	"testing"
+	"time"
+
+	"github.com/DATA-DOG/go-sqlmock"
+)
+
+// newTestDenylist returns an empty denylist that counts as freshly synced.
+func newTestDenylist(db *sql.DB) *Denylist {
+	return &Denylist{entries: map[string]time.Time{}, db: db, lastSync: time.Now()}
+}
+
+func expectDenylistSync(mock sqlmock.Sqlmock, rows *sqlmock.Rows) {
+	mock.ExpectExec(regexp.QuoteMeta("delete from revoked_key_pairs where expires_at <= $1")).
+		WillReturnResult(sqlmock.NewResult(0, 0))
+	mock.ExpectQuery(regexp.QuoteMeta("select keyPairId, expires_at, revoked_at from revoked_key_pairs where revoked_at > $1")).
+		WillReturnRows(rows)
+}
+
+func TestDenylistRevoke(t *testing.T) {
+	db, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	denylist := newTestDenylist(db)
+	ctx := context.Background()
+
+	expiresAt := time.Now().Add(time.Minute)
+	mock.ExpectExec(regexp.QuoteMeta("insert into revoked_key_pairs (keyPairId, expires_at, revoked_at)")).
+		WithArgs("pair-1", expiresAt, sqlmock.AnyArg()).
+		WillReturnResult(sqlmock.NewResult(0, 1))
+	err = denylist.Revoke(ctx, "pair-1", expiresAt)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !denylist.IsRevoked("pair-1") {
+		t.Fatal("IsRevoked(pair-1) = false after Revoke()")
+	}
+
+	// Access tokens that have already expired need no entry.
+	err = denylist.Revoke(ctx, "pair-2", time.Now().Add(-time.Minute))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if denylist.IsRevoked("pair-2") {
+		t.Fatal("IsRevoked(pair-2) = true for an expired key pair")
+	}
+
+	err = mock.ExpectationsWereMet()
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+// TestDenylistStoreWaitsForSync checks that a revocation stored as part of a
+// transaction only takes effect once sync finds it committed, and that sync
+// forgets entries whose access tokens have expired.
+func TestDenylistStoreWaitsForSync(t *testing.T) {
+	db, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	denylist := newTestDenylist(db)
+	ctx := context.Background()
+
+	expiresAt := time.Now().Add(time.Minute)
+	mock.ExpectExec(regexp.QuoteMeta("insert into revoked_key_pairs (keyPairId, expires_at, revoked_at)")).
+		WithArgs("pair-1", expiresAt, sqlmock.AnyArg()).
+		WillReturnResult(sqlmock.NewResult(0, 1))
+	err = denylist.store(ctx, db, "pair-1", expiresAt)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if denylist.IsRevoked("pair-1") {
+		t.Fatal("IsRevoked(pair-1) = true before the revocation was synced")
+	}
+
+	denylist.remember("pair-2", time.Now().Add(time.Millisecond))
+	expectDenylistSync(mock, sqlmock.NewRows([]string{"keyPairId", "expires_at", "revoked_at"}).
+		AddRow("pair-1", expiresAt, time.Now()))
+	time.Sleep(2 * time.Millisecond)
+	err = denylist.sync(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !denylist.IsRevoked("pair-1") {
+		t.Fatal("IsRevoked(pair-1) = false after sync")
+	}
+	if _, ok := denylist.entries["pair-2"]; ok {
+		t.Fatal("sync kept the expired pair-2")
+	}
+
+	err = mock.ExpectationsWereMet()
+	if err != nil {
+		t.Fatal(err)
+	}
+}
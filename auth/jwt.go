@@ -5,9 +5,12 @@ import (
 	"crypto/rand"
 	"database/sql"
 	"encoding/base64"
+	"errors"
 	"fmt"
 	"jwt-auth/config"
 	"jwt-auth/webhook"
+	"log"
+	"strconv"
 	"strings"
 	"time"
 
@@ -17,60 +20,186 @@ import (
 )
 
 type JWTManager struct {
-	secretKey            string
+	keyRing              *KeyRing
+	denylist             *Denylist
 	accessTokenDuration  time.Duration
 	refreshTokenLength   int
 	refreshTokenDuration time.Duration
+	issuer               string
+	authorizations       *authorizationCache
 	db                   *sql.DB
 }
 
+// ErrClientToken is returned where a user is required but the access token
+// was issued to a client through the client_credentials grant.
+var ErrClientToken = errors.New("Token was issued to a client, not a user")
+
+// ErrAudienceRestricted is returned when a token exchanged for another
+// service is presented to this one.
+var ErrAudienceRestricted = errors.New("Token is restricted to another audience")
+
+// ErrThirdPartyToken is returned where the user must have signed in to this
+// service directly but the access token was issued to an OAuth client on
+// their behalf.
+var ErrThirdPartyToken = errors.New("Token was issued to an OAuth client")
+
 type Claims struct {
-	UserID    int64 `json:"user_id"`
-	KeyPairID string
+	UserID      int64 `json:"user_id,omitempty"`
+	KeyPairID   string
+	OrgID       int64    `json:"org_id,omitempty"`
+	ClientID    string   `json:"client_id,omitempty"`
+	Scope       string   `json:"scope,omitempty"`
+	Roles       []string `json:"roles,omitempty"`
+	Permissions []string `json:"permissions,omitempty"`
+	Act         *Actor   `json:"act,omitempty"`
 	jwt.RegisteredClaims
 }
 
-func NewJWTManager(jwtConfig *config.JWTConfig, DB *sql.DB) *JWTManager {
+// Actor is the RFC 8693 act claim of an exchanged token: the client acting
+// on the subject's behalf and, for tokens exchanged more than once, the
+// actor before it.
+type Actor struct {
+	Sub string `json:"sub"`
+	Act *Actor `json:"act,omitempty"`
+}
+
+// IsClient reports whether the token's subject is a client rather than a
+// user. Client tokens carry no user id.
+func (c *Claims) IsClient() bool {
+	return c.UserID == 0 && c.ClientID != ""
+}
+
+func NewJWTManager(jwtConfig *config.JWTConfig, DB *sql.DB) (*JWTManager, error) {
+	signingKey, err := LoadSigningKey(jwtConfig)
+	if err != nil {
+		return nil, err
+	}
+	encryptionKey, err := LoadKeyEncryptionKey(jwtConfig)
+	if err != nil {
+		return nil, err
+	}
+	keyRing, err := NewKeyRing(DB, signingKey, jwtConfig.AccessDuration, encryptionKey)
+	if err != nil {
+		return nil, err
+	}
+	denylist, err := NewDenylist(DB)
+	if err != nil {
+		return nil, err
+	}
 	return &JWTManager{
-		secretKey:            jwtConfig.Secret,
+		keyRing:              keyRing,
+		denylist:             denylist,
 		accessTokenDuration:  jwtConfig.AccessDuration,
 		refreshTokenLength:   jwtConfig.RefreshLength,
 		refreshTokenDuration: jwtConfig.RefreshDuration,
+		issuer:               jwtConfig.Issuer,
+		authorizations:       newAuthorizationCache(),
 		db:                   DB,
-	}
+	}, nil
 }
 
-func (j *JWTManager) GenerateAccessToken(userID int64, keyPairID string) (string, error) {
-	claims := &Claims{
+func (j *JWTManager) GenerateAccessToken(ctx context.Context, userID int64, keyPairID string) (string, error) {
+	return j.IssueAccessToken(ctx, &Claims{
 		UserID:    userID,
 		KeyPairID: keyPairID,
-		RegisteredClaims: jwt.RegisteredClaims{
-			ExpiresAt: jwt.NewNumericDate(time.Now().Add(j.accessTokenDuration)),
-			IssuedAt:  jwt.NewNumericDate(time.Now()),
-		},
+	})
+}
+
+// IssueAccessToken signs the given claims, filling in the registered claims
+// every access token carries unless the caller has already set them. Tokens
+// issued to a user also carry the user's organization and, unless the caller
+// set them, current roles and permissions, narrowed to the token's scope as
+// ScopePermissions does.
+func (j *JWTManager) IssueAccessToken(ctx context.Context, claims *Claims) (string, error) {
+	if claims.UserID != 0 {
+		orgID, err := j.userOrganization(ctx, claims.UserID)
+		if err != nil {
+			return "", fmt.Errorf("Failed to load organization: %w", err)
+		}
+		claims.OrgID = orgID
+	}
+	if claims.UserID != 0 && claims.Roles == nil && claims.Permissions == nil {
+		roles, permissions, err := j.userAuthorization(ctx, claims.UserID)
+		if err != nil {
+			return "", fmt.Errorf("Failed to load roles: %w", err)
+		}
+		claims.Roles, claims.Permissions = ScopePermissions(roles, permissions, claims.Scope)
 	}
 
-	token := jwt.NewWithClaims(jwt.SigningMethodHS512, claims)
+	now := time.Now()
+	if claims.Issuer == "" {
+		claims.Issuer = j.issuer
+	}
+	if claims.Subject == "" {
+		claims.Subject = strconv.FormatInt(claims.UserID, 10)
+	}
+	if claims.ID == "" {
+		claims.ID = uuid.New().String()
+	}
+	if claims.ExpiresAt == nil {
+		claims.ExpiresAt = jwt.NewNumericDate(now.Add(j.accessTokenDuration))
+	}
+	claims.IssuedAt = jwt.NewNumericDate(now)
 
-	return token.SignedString([]byte(j.secretKey))
+	return j.sign(claims)
 }
 
-func (j *JWTManager) GenerateRefreshToken(userID int64, keyPairID, userAgent, agentIp string) (string, error) {
-	bytes := make([]byte, 32)
-	_, err := rand.Read(bytes)
+func (j *JWTManager) sign(claims jwt.Claims) (string, error) {
+	signingKey, err := j.keyRing.SigningKey()
 	if err != nil {
-		return "", fmt.Errorf("Failed to generate random bytes: %w", err)
+		return "", err
 	}
 
-	token := base64.StdEncoding.EncodeToString(bytes)
-	hashedToken, err := bcrypt.GenerateFromPassword(bytes, bcrypt.DefaultCost)
+	token := jwt.NewWithClaims(signingKey.Method, claims)
+	token.Header["kid"] = signingKey.ID
+
+	return token.SignedString(signingKey.PrivateKey)
+}
+
+func (j *JWTManager) AccessTokenDuration() time.Duration {
+	return j.accessTokenDuration
+}
+
+func (j *JWTManager) Issuer() string {
+	return j.issuer
+}
+
+// SigningAlgorithm names the JWA algorithm new tokens are signed with.
+func (j *JWTManager) SigningAlgorithm() (string, error) {
+	signingKey, err := j.keyRing.SigningKey()
 	if err != nil {
-		return "", fmt.Errorf("Failed to hash random bytes: %w", err)
+		return "", err
 	}
+	return signingKey.Method.Alg(), nil
+}
 
-	tokenId := uuid.New().String()
+func (j *JWTManager) GenerateRefreshToken(userID int64, keyPairID, userAgent, agentIp string) (string, error) {
+	return j.storeRefreshToken(&RefreshTokenRecord{
+		UserID:    userID,
+		KeyPairID: keyPairID,
+		UserAgent: userAgent,
+		AgentIp:   agentIp,
+	})
+}
 
+// GenerateClientRefreshToken issues a refresh token bound to an OAuth client
+// and the scope it was granted.
+func (j *JWTManager) GenerateClientRefreshToken(userID int64, keyPairID, clientID, scope, userAgent, agentIp string) (string, error) {
+	return j.storeRefreshToken(&RefreshTokenRecord{
+		UserID:    userID,
+		KeyPairID: keyPairID,
+		ClientID:  clientID,
+		Scope:     scope,
+		UserAgent: userAgent,
+		AgentIp:   agentIp,
+	})
+}
+
+func (j *JWTManager) storeRefreshToken(record *RefreshTokenRecord) (string, error) {
 	tx, err := j.db.Begin()
+	if err != nil {
+		return "", err
+	}
 
 	defer func() {
 		if p := recover(); p != nil {
@@ -83,9 +212,41 @@ func (j *JWTManager) GenerateRefreshToken(userID int64, keyPairID, userAgent, ag
 		}
 	}()
 
-	_, err = tx.Exec(
-		"insert into refresh_tokens (id, token, userId, keyPairId, userAgent, agentIp, issued_at, expires_at) values($1, $2, $3, $4, $5, $6, $7, $8)",
-		tokenId, hashedToken, userID, keyPairID, userAgent, agentIp, time.Now(), time.Now().Add(j.refreshTokenDuration),
+	token, err := j.insertRefreshToken(context.Background(), tx, record)
+	if err != nil {
+		return "", err
+	}
+
+	return token, nil
+}
+
+// insertRefreshToken stores a new refresh token described by record. An
+// empty FamilyID starts a new family named after the token itself.
+func (j *JWTManager) insertRefreshToken(ctx context.Context, tx *sql.Tx, record *RefreshTokenRecord) (string, error) {
+	bytes := make([]byte, 32)
+	_, err := rand.Read(bytes)
+	if err != nil {
+		return "", fmt.Errorf("Failed to generate random bytes: %w", err)
+	}
+
+	token := base64.StdEncoding.EncodeToString(bytes)
+	hashedToken, err := bcrypt.GenerateFromPassword(bytes, bcrypt.DefaultCost)
+	if err != nil {
+		return "", fmt.Errorf("Failed to hash random bytes: %w", err)
+	}
+
+	tokenId := uuid.New().String()
+	familyID := record.FamilyID
+	if familyID == "" {
+		familyID = tokenId
+	}
+
+	_, err = tx.ExecContext(
+		ctx,
+		"insert into refresh_tokens (id, token, userId, keyPairId, userAgent, agentIp, family_id, parent_id, client_id, scope, issued_at, expires_at, org_id) values($1, $2, $3, $4, $5, $6, $7, $8, $9, $10, $11, $12, (select org_id from users where id = $3))",
+		tokenId, hashedToken, record.UserID, record.KeyPairID, record.UserAgent, record.AgentIp,
+		familyID, nullString(record.ParentID), nullString(record.ClientID), nullString(record.Scope),
+		time.Now(), time.Now().Add(j.refreshTokenDuration),
 	)
 	if err != nil {
 		return "", fmt.Errorf("Failed to save refresh token: %w", err)
@@ -95,14 +256,76 @@ func (j *JWTManager) GenerateRefreshToken(userID int64, keyPairID, userAgent, ag
 }
 
 func (j *JWTManager) ValidateAccessToken(accessToken string) (int64, string, error) {
+	claims, err := j.ParseAccessToken(accessToken)
+	if err != nil {
+		return 0, "", err
+	}
+	if claims.IsClient() {
+		return 0, "", ErrClientToken
+	}
+	if len(claims.Audience) > 0 {
+		return 0, "", ErrAudienceRestricted
+	}
+
+	return claims.UserID, claims.KeyPairID, nil
+}
+
+// ValidateFirstPartyAccessToken is ValidateAccessToken for account
+// management, such as enrolling credentials, which OAuth clients may not do
+// whatever scope the user granted them.
+func (j *JWTManager) ValidateFirstPartyAccessToken(accessToken string) (int64, string, error) {
+	claims, err := j.ParseAccessToken(accessToken)
+	if err != nil {
+		return 0, "", err
+	}
+	if claims.IsClient() {
+		return 0, "", ErrClientToken
+	}
+	if len(claims.Audience) > 0 {
+		return 0, "", ErrAudienceRestricted
+	}
+	if claims.ClientID != "" {
+		return 0, "", ErrThirdPartyToken
+	}
+
+	return claims.UserID, claims.KeyPairID, nil
+}
+
+// ParseAccessToken validates an access token like ValidateAccessToken and
+// returns all of its claims. Unlike ValidateAccessToken it also accepts
+// client tokens and tokens exchanged for another audience.
+func (j *JWTManager) ParseAccessToken(accessToken string) (*Claims, error) {
 	claims := &Claims{}
 
-	token, err := jwt.ParseWithClaims(accessToken, claims, func(token *jwt.Token) (interface{}, error) {
-		if _, ok := token.Method.(*jwt.SigningMethodHMAC); !ok {
-			return nil, fmt.Errorf("unexpected signing method: %v", token.Header["alg"])
-		}
-		return []byte(j.secretKey), nil
-	})
+	token, err := jwt.ParseWithClaims(accessToken, claims, j.verificationKey)
+
+	if err != nil {
+		return nil, err
+	}
+
+	if !token.Valid {
+		return nil, fmt.Errorf("invalid token")
+	}
+
+	// ID tokens share the signing keys but carry no key pair.
+	if claims.KeyPairID == "" {
+		return nil, fmt.Errorf("Not an access token")
+	}
+
+	if j.denylist.IsRevoked(claims.KeyPairID) {
+		return nil, fmt.Errorf("Token revoked")
+	}
+
+	return claims, nil
+}
+
+// ValidateRefreshableAccessToken checks the signature of an access token
+// presented alongside a refresh token. Its expiry is not enforced, since an
+// expired access token is the reason to refresh in the first place.
+func (j *JWTManager) ValidateRefreshableAccessToken(accessToken string) (int64, string, error) {
+	claims := &Claims{}
+
+	token, err := jwt.ParseWithClaims(accessToken, claims, j.verificationKey, jwt.WithoutClaimsValidation())
 
 	if err != nil {
 		return 0, "", err
@@ -112,65 +335,198 @@ func (j *JWTManager) ValidateAccessToken(accessToken string) (int64, string, err
 		return 0, "", fmt.Errorf("invalid token")
 	}
 
+	if claims.KeyPairID == "" {
+		return 0, "", fmt.Errorf("Not an access token")
+	}
+	if claims.IsClient() {
+		return 0, "", ErrClientToken
+	}
+	if len(claims.Audience) > 0 {
+		return 0, "", ErrAudienceRestricted
+	}
+
+	if j.denylist.IsRevoked(claims.KeyPairID) {
+		return 0, "", fmt.Errorf("Token revoked")
+	}
+
 	return claims.UserID, claims.KeyPairID, nil
 }
 
-func (j *JWTManager) ValidateRefreshToken(ctx context.Context, userId int64, keyPairID, userAgent, agentIp, refreshTokenString string) error {
-	parts := strings.Split(refreshTokenString, ":")
-	if len(parts) != 2 {
-		return fmt.Errorf("Invalid token format")
+// verificationKey resolves the key named by the kid header. Tokens issued
+// before key ids were introduced carry no kid and are checked against the
+// current signing key.
+func (j *JWTManager) verificationKey(token *jwt.Token) (interface{}, error) {
+	var key *RingKey
+	var err error
+	kid, _ := token.Header["kid"].(string)
+	if kid == "" {
+		key, err = j.keyRing.SigningKey()
+	} else {
+		key, err = j.keyRing.VerificationKey(kid)
 	}
-	tokenId := parts[0]
-	refreshTokenBase64 := parts[1]
-	refreshToken, err := base64.StdEncoding.DecodeString(refreshTokenBase64)
 	if err != nil {
-		return fmt.Errorf("Failed base64 decode")
+		return nil, err
 	}
+	if token.Method.Alg() != key.Method.Alg() {
+		return nil, fmt.Errorf("unexpected signing method: %v", token.Header["alg"])
+	}
+	return key.PublicKey, nil
+}
 
-	var extractedUserId int64
-	var hashedToken []byte
-	var expires_at time.Time
-	var extractedKeyPairId, extractedUserAgent, extractedAgentIp string
+func (j *JWTManager) PublicJWKS() JWKS {
+	return j.keyRing.PublicKeys()
+}
+
+func (j *JWTManager) SigningKeys(ctx context.Context) ([]KeyInfo, error) {
+	return j.keyRing.Keys(ctx)
+}
+
+func (j *JWTManager) RotateSigningKey(ctx context.Context, activateAt time.Time) (KeyInfo, error) {
+	return j.keyRing.Rotate(ctx, activateAt)
+}
+
+// RotateRefreshToken consumes the presented refresh token and issues its
+// successor in the same family. Presenting a token that has already been
+// consumed means it was copied, so the whole family is revoked.
+func (j *JWTManager) RotateRefreshToken(ctx context.Context, userId int64, keyPairID, newKeyPairID, userAgent, agentIp, refreshTokenString string) (string, error) {
+	_, newToken, err := j.rotateRefreshToken(ctx, refreshTokenString, newKeyPairID, userAgent, agentIp, func(record *RefreshTokenRecord) error {
+		if record.UserID != userId {
+			return fmt.Errorf("User mismatch")
+		}
+		if record.KeyPairID != keyPairID {
+			return fmt.Errorf("Key pair mismatch")
+		}
+		if record.UserAgent != userAgent {
+			return fmt.Errorf("User-Agent mismatch")
+		}
+		return nil
+	})
+	return newToken, err
+}
+
+// RotateClientRefreshToken is RotateRefreshToken for the OAuth token
+// endpoint, where the authenticated client vouches for the refresh token
+// instead of an access token.
+func (j *JWTManager) RotateClientRefreshToken(ctx context.Context, clientID, newKeyPairID, userAgent, agentIp, refreshTokenString string) (*RefreshTokenRecord, string, error) {
+	return j.rotateRefreshToken(ctx, refreshTokenString, newKeyPairID, userAgent, agentIp, func(record *RefreshTokenRecord) error {
+		if record.ClientID != clientID {
+			return fmt.Errorf("Client mismatch")
+		}
+		return nil
+	})
+}
+
+func (j *JWTManager) rotateRefreshToken(ctx context.Context, refreshTokenString, newKeyPairID, userAgent, agentIp string, check func(*RefreshTokenRecord) error) (*RefreshTokenRecord, string, error) {
+	tokenId, refreshToken, err := splitRefreshToken(refreshTokenString)
+	if err != nil {
+		return nil, "", err
+	}
 
-	err = j.db.QueryRowContext(
+	record, newToken, err := j.consumeRefreshToken(ctx, tokenId, refreshToken, newKeyPairID, userAgent, agentIp, check)
+	if errors.Is(err, ErrRefreshTokenReused) {
+		revokeErr := j.RevokeRefreshTokenFamily(ctx, record.FamilyID)
+		if revokeErr != nil {
+			log.Printf("Failed to revoke refresh token family %s: %v", record.FamilyID, revokeErr)
+		}
+		log.Printf("Refresh token reuse detected for user %d, family %s revoked", record.UserID, record.FamilyID)
+		go webhook.NotifySecurityEvent("refresh_token_reuse", record.UserID, agentIp, map[string]interface{}{
+			"family_id": record.FamilyID,
+			"token_id":  record.ID,
+		})
+		return nil, "", err
+	}
+	return record, newToken, err
+}
+
+func (j *JWTManager) consumeRefreshToken(ctx context.Context, tokenId string, refreshToken []byte, newKeyPairID, userAgent, agentIp string, check func(*RefreshTokenRecord) error) (record *RefreshTokenRecord, newToken string, err error) {
+	tx, err := j.db.BeginTx(ctx, nil)
+	if err != nil {
+		return nil, "", err
+	}
+
+	defer func() {
+		if p := recover(); p != nil {
+			tx.Rollback()
+			panic(p)
+		} else if err != nil {
+			tx.Rollback()
+		} else {
+			err = tx.Commit()
+		}
+	}()
+
+	var hashedToken []byte
+	record, err = scanRefreshToken(tx.QueryRowContext(
 		ctx,
-		"select token, userId, keyPairId, userAgent, agentIp, expires_at from refresh_tokens where id = $1",
+		"select "+refreshTokenColumns+", token from refresh_tokens where id = $1 for update",
 		tokenId,
-	).Scan(&hashedToken, &extractedUserId, &keyPairID, &userAgent, &extractedAgentIp, &expires_at)
+	), &hashedToken)
+	if err != nil {
+		return nil, "", fmt.Errorf("Invalid token")
+	}
 
-	if extractedUserId != userId {
-		return fmt.Errorf("User mismatch")
+	err = bcrypt.CompareHashAndPassword(hashedToken, refreshToken)
+	if err != nil {
+		return nil, "", fmt.Errorf("Invalid token")
+	}
+	if record.UsedAt != nil {
+		return record, "", ErrRefreshTokenReused
 	}
-	if extractedKeyPairId != keyPairID {
-		return fmt.Errorf("Key pair mismatch")
+	if time.Now().After(record.ExpiresAt) {
+		return nil, "", fmt.Errorf("Invalid token")
 	}
-	if extractedUserAgent != userAgent {
-		return fmt.Errorf("User-Agent mismatch")
+	err = check(record)
+	if err != nil {
+		return nil, "", err
 	}
-	if extractedAgentIp != agentIp {
-		go webhook.NotifyWebhook(userId, agentIp)
+	if record.AgentIp != agentIp {
+		go webhook.NotifyWebhook(record.UserID, agentIp)
 	}
-	err = bcrypt.CompareHashAndPassword(hashedToken, refreshToken)
-	if err != nil || time.Now().After(expires_at) {
-		_, err = j.db.ExecContext(
-			ctx,
-			"delete from refresh_tokens where id = $1",
-			tokenId,
-		)
-		return fmt.Errorf("Invalid token")
+
+	_, err = tx.ExecContext(
+		ctx,
+		"update refresh_tokens set used_at = $1 where id = $2",
+		time.Now(), tokenId,
+	)
+	if err != nil {
+		return nil, "", fmt.Errorf("Failed to consume refresh token: %w", err)
+	}
+
+	newToken, err = j.insertRefreshToken(ctx, tx, &RefreshTokenRecord{
+		FamilyID:  record.FamilyID,
+		ParentID:  record.ID,
+		UserID:    record.UserID,
+		KeyPairID: newKeyPairID,
+		ClientID:  record.ClientID,
+		Scope:     record.Scope,
+		UserAgent: userAgent,
+		AgentIp:   agentIp,
+	})
+	if err != nil {
+		return nil, "", err
+	}
+	return record, newToken, nil
+}
+
+func (j *JWTManager) RevokeRefreshTokenFamily(ctx context.Context, familyID string) error {
+	_, err := j.revokeRefreshTokens(ctx, "family_id = $1", familyID)
+	if err != nil {
+		return fmt.Errorf("Failed to revoke refresh token family: %w", err)
 	}
 	return nil
 }
 
+// InvalidateRefreshToken ends the session the token belongs to, including
+// the consumed tokens kept in its family for reuse detection.
 func (j *JWTManager) InvalidateRefreshToken(ctx context.Context, refreshTokenString string) error {
 	parts := strings.Split(refreshTokenString, ":")
 	if len(parts) != 2 {
 		return fmt.Errorf("Invalid token format")
 	}
 	tokenId := parts[0]
-	_, err := j.db.ExecContext(
+	_, err := j.revokeRefreshTokens(
 		ctx,
-		"delete from refresh_tokens where id = $1",
+		"family_id = (select family_id from refresh_tokens where id = $1)",
 		tokenId,
 	)
 	if err != nil {
@@ -179,3 +535,194 @@ func (j *JWTManager) InvalidateRefreshToken(ctx context.Context, refreshTokenStr
 	return nil
 }
 
+// InspectRefreshToken returns the stored record of a refresh token that is
+// still usable, without consuming it.
+func (j *JWTManager) InspectRefreshToken(ctx context.Context, refreshTokenString string) (*RefreshTokenRecord, error) {
+	tokenId, refreshToken, err := splitRefreshToken(refreshTokenString)
+	if err != nil {
+		return nil, err
+	}
+
+	var hashedToken []byte
+	record, err := scanRefreshToken(j.db.QueryRowContext(
+		ctx,
+		"select "+refreshTokenColumns+", token from refresh_tokens where id = $1",
+		tokenId,
+	), &hashedToken)
+	if err != nil {
+		return nil, fmt.Errorf("Invalid token")
+	}
+
+	err = bcrypt.CompareHashAndPassword(hashedToken, refreshToken)
+	if err != nil || record.UsedAt != nil || time.Now().After(record.ExpiresAt) {
+		return nil, fmt.Errorf("Invalid token")
+	}
+	return record, nil
+}
+
+// execQueryer is a database or a transaction.
+type execQueryer interface {
+	QueryContext(ctx context.Context, query string, args ...interface{}) (*sql.Rows, error)
+	ExecContext(ctx context.Context, query string, args ...interface{}) (sql.Result, error)
+}
+
+// revokeRefreshTokens deletes the matching refresh tokens and denylists the
+// key pairs whose access tokens may still be unexpired. It returns the ids
+// of the affected families.
+func (j *JWTManager) revokeRefreshTokens(ctx context.Context, where string, args ...interface{}) ([]string, error) {
+	familyIDs, accessExpiry, err := j.deleteRefreshTokens(ctx, j.db, where, args...)
+	if err != nil {
+		return nil, err
+	}
+	for keyPairID, expiresAt := range accessExpiry {
+		j.denylist.remember(keyPairID, expiresAt)
+	}
+	return familyIDs, nil
+}
+
+// deleteRefreshTokens is revokeRefreshTokens on db, leaving the in-memory
+// denylist alone. It returns the revoked key pairs with the expiry of their
+// access tokens.
+func (j *JWTManager) deleteRefreshTokens(ctx context.Context, db execQueryer, where string, args ...interface{}) ([]string, map[string]time.Time, error) {
+	rows, err := db.QueryContext(
+		ctx,
+		"delete from refresh_tokens where "+where+" returning family_id, keyPairId, issued_at",
+		args...,
+	)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	seen := map[string]bool{}
+	familyIDs := []string{}
+	accessExpiry := map[string]time.Time{}
+	for rows.Next() {
+		var familyID, keyPairID string
+		var issuedAt time.Time
+		err = rows.Scan(&familyID, &keyPairID, &issuedAt)
+		if err != nil {
+			rows.Close()
+			return nil, nil, err
+		}
+		if !seen[familyID] {
+			seen[familyID] = true
+			familyIDs = append(familyIDs, familyID)
+		}
+		accessExpiry[keyPairID] = issuedAt.Add(j.accessTokenDuration)
+	}
+	rows.Close()
+	if err = rows.Err(); err != nil {
+		return nil, nil, err
+	}
+
+	for keyPairID, expiresAt := range accessExpiry {
+		err = j.denylist.store(ctx, db, keyPairID, expiresAt)
+		if err != nil {
+			return nil, nil, err
+		}
+	}
+	return familyIDs, accessExpiry, nil
+}
+
+// RevokeKeyPair denylists a key pair until its access token expires.
+func (j *JWTManager) RevokeKeyPair(ctx context.Context, keyPairID string, expiresAt time.Time) error {
+	return j.denylist.Revoke(ctx, keyPairID, expiresAt)
+}
+
+// ListRefreshTokens returns the unconsumed, unexpired refresh token of every
+// session the user has, newest first.
+func (j *JWTManager) ListRefreshTokens(ctx context.Context, userId int64) ([]*RefreshTokenRecord, error) {
+	return j.listRefreshTokens(ctx, "userId = $1", userId)
+}
+
+// ListOrganizationRefreshTokens is ListRefreshTokens for every user of an
+// organization.
+func (j *JWTManager) ListOrganizationRefreshTokens(ctx context.Context, orgID int64) ([]*RefreshTokenRecord, error) {
+	return j.listRefreshTokens(ctx, "org_id = $1", orgID)
+}
+
+func (j *JWTManager) listRefreshTokens(ctx context.Context, where string, arg interface{}) ([]*RefreshTokenRecord, error) {
+	rows, err := j.db.QueryContext(
+		ctx,
+		`select `+refreshTokenColumns+`,
+			(select min(family.issued_at) from refresh_tokens family where family.family_id = refresh_tokens.family_id)
+		from refresh_tokens where `+where+` and used_at is null and expires_at > $2 order by issued_at desc`,
+		arg, time.Now(),
+	)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	records := []*RefreshTokenRecord{}
+	for rows.Next() {
+		var familyStartedAt time.Time
+		record, err := scanRefreshToken(rows, &familyStartedAt)
+		if err != nil {
+			return nil, err
+		}
+		record.FamilyStartedAt = familyStartedAt
+		records = append(records, record)
+	}
+	return records, rows.Err()
+}
+
+// RevokeUserRefreshTokenFamily revokes a family only if it belongs to the
+// user, reporting whether anything was revoked.
+func (j *JWTManager) RevokeUserRefreshTokenFamily(ctx context.Context, userId int64, familyID string) (bool, error) {
+	familyIDs, err := j.revokeRefreshTokens(ctx, "family_id = $1 and userId = $2", familyID, userId)
+	if err != nil {
+		return false, fmt.Errorf("Failed to revoke refresh token family: %w", err)
+	}
+	return len(familyIDs) > 0, nil
+}
+
+// RevokeOrganizationRefreshTokenFamily revokes a family only if it belongs to
+// a user of the organization, reporting whether anything was revoked.
+func (j *JWTManager) RevokeOrganizationRefreshTokenFamily(ctx context.Context, orgID int64, familyID string) (bool, error) {
+	familyIDs, err := j.revokeRefreshTokens(ctx, "family_id = $1 and org_id = $2", familyID, orgID)
+	if err != nil {
+		return false, fmt.Errorf("Failed to revoke refresh token family: %w", err)
+	}
+	return len(familyIDs) > 0, nil
+}
+
+// RevokeOtherRefreshTokenFamilies revokes every family of the user except the
+// one holding keepKeyPairID and returns the ids of the revoked families.
+func (j *JWTManager) RevokeOtherRefreshTokenFamilies(ctx context.Context, userId int64, keepKeyPairID string) ([]string, error) {
+	familyIDs, err := j.revokeRefreshTokens(
+		ctx,
+		"userId = $1 and family_id <> coalesce((select family_id from refresh_tokens where keyPairId = $2), '')",
+		userId, keepKeyPairID,
+	)
+	if err != nil {
+		return nil, fmt.Errorf("Failed to revoke refresh token families: %w", err)
+	}
+	return familyIDs, nil
+}
+
+// RevokeUserRefreshTokens signs the user out of every session.
+func (j *JWTManager) RevokeUserRefreshTokens(ctx context.Context, userId int64) ([]string, error) {
+	familyIDs, err := j.revokeRefreshTokens(ctx, "userId = $1", userId)
+	if err != nil {
+		return nil, fmt.Errorf("Failed to revoke refresh tokens: %w", err)
+	}
+	return familyIDs, nil
+}
+
+// RevokeUserRefreshTokensTx is RevokeUserRefreshTokens as part of tx, so that
+// the sessions end only if the caller's changes are committed. Their access
+// tokens are denylisted on commit; callers then call SyncDenylist for this
+// instance to reject them right away.
+func (j *JWTManager) RevokeUserRefreshTokensTx(ctx context.Context, tx *sql.Tx, userId int64) ([]string, error) {
+	familyIDs, _, err := j.deleteRefreshTokens(ctx, tx, "userId = $1", userId)
+	if err != nil {
+		return nil, fmt.Errorf("Failed to revoke refresh tokens: %w", err)
+	}
+	return familyIDs, nil
+}
+
+// SyncDenylist loads revocations committed since the last sync.
+func (j *JWTManager) SyncDenylist(ctx context.Context) error {
+	return j.denylist.sync(ctx)
+}
@@ -0,0 +1,152 @@
+package auth
+
+import (
+	"context"
+	"database/sql"
+	"encoding/base64"
+	"errors"
+	"regexp"
+	"testing"
+	"time"
+
+	"github.com/DATA-DOG/go-sqlmock"
+	"github.com/golang-jwt/jwt/v5"
+	"golang.org/x/crypto/bcrypt"
+)
+
+const testAccessDuration = 15 * time.Minute
+
+// newTestJWTManager returns a JWTManager signing with one in-memory HS256
+// key, so that only the queries a test is about reach mock.
+func newTestJWTManager(t *testing.T) (*JWTManager, sqlmock.Sqlmock) {
+	t.Helper()
+	db, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { db.Close() })
+	key := &RingKey{
+		SigningKey:  &SigningKey{Method: jwt.SigningMethodHS256, PrivateKey: []byte("test-secret"), PublicKey: []byte("test-secret")},
+		ID:          "test-key",
+		State:       KeyStateActive,
+		ActivatesAt: time.Now().Add(-time.Hour),
+	}
+	return &JWTManager{
+		keyRing:              newTestKeyRing(db, key),
+		denylist:             newTestDenylist(db),
+		accessTokenDuration:  testAccessDuration,
+		refreshTokenLength:   32,
+		refreshTokenDuration: 24 * time.Hour,
+		issuer:               "http://localhost",
+		authorizations:       newAuthorizationCache(),
+		db:                   db,
+	}, mock
+}
+
+var refreshTokenRowColumns = []string{
+	"id", "family_id", "parent_id", "userId", "org_id", "keyPairId", "client_id", "scope",
+	"userAgent", "agentIp", "issued_at", "expires_at", "used_at", "token",
+}
+
+// storedRefreshToken returns a refresh token string and the row stored for
+// it, with usedAt set once the token has been rotated.
+func storedRefreshToken(t *testing.T, id, familyID string, usedAt interface{}) (string, *sqlmock.Rows) {
+	t.Helper()
+	secret := []byte("refresh-token-secret")
+	hashed, err := bcrypt.GenerateFromPassword(secret, bcrypt.MinCost)
+	if err != nil {
+		t.Fatal(err)
+	}
+	rows := sqlmock.NewRows(refreshTokenRowColumns).AddRow(
+		id, familyID, nil, int64(7), int64(1), "pair-1", nil, nil,
+		"test-agent", "127.0.0.1", time.Now().Add(-time.Minute), time.Now().Add(time.Hour), usedAt, hashed,
+	)
+	return id + ":" + base64.StdEncoding.EncodeToString(secret), rows
+}
+
+// TestRefreshTokenFamilyReuse rotates a refresh token and then presents it
+// again, which must end the whole family and denylist its access tokens.
+func TestRefreshTokenFamilyReuse(t *testing.T) {
+	j, mock := newTestJWTManager(t)
+	ctx := context.Background()
+	selectToken := regexp.QuoteMeta("select " + refreshTokenColumns + ", token from refresh_tokens where id = $1 for update")
+
+	token, rows := storedRefreshToken(t, "token-1", "family-1", nil)
+	mock.ExpectBegin()
+	mock.ExpectQuery(selectToken).WithArgs("token-1").WillReturnRows(rows)
+	mock.ExpectExec(regexp.QuoteMeta("update refresh_tokens set used_at = $1 where id = $2")).
+		WithArgs(sqlmock.AnyArg(), "token-1").
+		WillReturnResult(sqlmock.NewResult(0, 1))
+	mock.ExpectExec(regexp.QuoteMeta("insert into refresh_tokens")).
+		WithArgs(sqlmock.AnyArg(), sqlmock.AnyArg(), int64(7), "pair-2", "test-agent", "127.0.0.1",
+			"family-1", sql.NullString{String: "token-1", Valid: true}, sql.NullString{}, sql.NullString{},
+			sqlmock.AnyArg(), sqlmock.AnyArg()).
+		WillReturnResult(sqlmock.NewResult(0, 1))
+	mock.ExpectCommit()
+	_, err := j.RotateRefreshToken(ctx, 7, "pair-1", "pair-2", "test-agent", "127.0.0.1", token)
+	if err != nil {
+		t.Fatalf("first RotateRefreshToken() error = %v", err)
+	}
+
+	token, rows = storedRefreshToken(t, "token-1", "family-1", time.Now())
+	mock.ExpectBegin()
+	mock.ExpectQuery(selectToken).WithArgs("token-1").WillReturnRows(rows)
+	mock.ExpectRollback()
+	mock.ExpectQuery(regexp.QuoteMeta("delete from refresh_tokens where family_id = $1 returning family_id, keyPairId, issued_at")).
+		WithArgs("family-1").
+		WillReturnRows(sqlmock.NewRows([]string{"family_id", "keyPairId", "issued_at"}).
+			AddRow("family-1", "pair-1", time.Now().Add(-time.Minute)).
+			AddRow("family-1", "pair-2", time.Now()))
+	mock.ExpectExec(regexp.QuoteMeta("insert into revoked_key_pairs")).
+		WithArgs(sqlmock.AnyArg(), sqlmock.AnyArg(), sqlmock.AnyArg()).
+		WillReturnResult(sqlmock.NewResult(0, 1))
+	mock.ExpectExec(regexp.QuoteMeta("insert into revoked_key_pairs")).
+		WithArgs(sqlmock.AnyArg(), sqlmock.AnyArg(), sqlmock.AnyArg()).
+		WillReturnResult(sqlmock.NewResult(0, 1))
+	_, err = j.RotateRefreshToken(ctx, 7, "pair-1", "pair-3", "test-agent", "127.0.0.1", token)
+	if !errors.Is(err, ErrRefreshTokenReused) {
+		t.Fatalf("second RotateRefreshToken() error = %v, want %v", err, ErrRefreshTokenReused)
+	}
+	for _, keyPairID := range []string{"pair-1", "pair-2"} {
+		if !j.denylist.IsRevoked(keyPairID) {
+			t.Errorf("key pair %s is not revoked", keyPairID)
+		}
+	}
+
+	err = mock.ExpectationsWereMet()
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+// TestValidateFirstPartyAccessToken checks that account management only
+// accepts tokens the user signed in for directly.
+func TestValidateFirstPartyAccessToken(t *testing.T) {
+	j, _ := newTestJWTManager(t)
+	tests := []struct {
+		name    string
+		claims  Claims
+		wantErr error
+	}{
+		{"first party", Claims{UserID: 7, KeyPairID: "pair-1"}, nil},
+		{"OAuth client", Claims{UserID: 7, KeyPairID: "pair-1", ClientID: "client-1"}, ErrThirdPartyToken},
+		{"client credentials", Claims{KeyPairID: "pair-1", ClientID: "client-1"}, ErrClientToken},
+		{"exchanged", Claims{UserID: 7, KeyPairID: "pair-1", RegisteredClaims: jwt.RegisteredClaims{Audience: jwt.ClaimStrings{"https://api.example.com"}}}, ErrAudienceRestricted},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			claims := test.claims
+			token, err := j.sign(&claims)
+			if err != nil {
+				t.Fatal(err)
+			}
+			userId, _, err := j.ValidateFirstPartyAccessToken(token)
+			if !errors.Is(err, test.wantErr) {
+				t.Fatalf("ValidateFirstPartyAccessToken() error = %v, want %v", err, test.wantErr)
+			}
+			if err == nil && userId != 7 {
+				t.Fatalf("ValidateFirstPartyAccessToken() = %d, want 7", userId)
+			}
+		})
+	}
+}
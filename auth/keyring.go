@@ -0,0 +1,585 @@
+package auth
+
+import (
+	"context"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"database/sql"
+	"encoding/base64"
+	"encoding/pem"
+	"fmt"
+	"log"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/golang-jwt/jwt/v5"
+	"github.com/google/uuid"
+)
+
+type KeyState string
+
+const (
+	KeyStateActive     KeyState = "active"
+	KeyStateVerifyOnly KeyState = "verify-only"
+	KeyStateRetired    KeyState = "retired"
+)
+
+// keyRingSyncInterval bounds how stale the in-memory ring may get when
+// another instance rotates keys, keyRingMissInterval rate limits the reloads
+// triggered by tokens carrying an unknown kid.
+const (
+	keyRingSyncInterval = time.Minute
+	keyRingMissInterval = 5 * time.Second
+)
+
+// encryptedKeyPrefix marks key material sealed with the key encryption key.
+const encryptedKeyPrefix = "enc:"
+
+type RingKey struct {
+	*SigningKey
+	ID          string
+	State       KeyState
+	ActivatesAt time.Time
+	ExpiresAt   *time.Time
+}
+
+type KeyInfo struct {
+	ID          string     `json:"id"`
+	Algorithm   string     `json:"algorithm"`
+	State       KeyState   `json:"state"`
+	ActivatesAt time.Time  `json:"activates_at"`
+	ExpiresAt   *time.Time `json:"expires_at,omitempty"`
+}
+
+type KeyRing struct {
+	mu       sync.RWMutex
+	keys     map[string]*RingKey
+	method   jwt.SigningMethod
+	overlap  time.Duration
+	lastSync time.Time
+	db       *sql.DB
+	// aead encrypts key material at rest; nil stores it in plain text.
+	aead cipher.AEAD
+}
+
+// NewKeyRing loads the signing keys stored in the database. When the table
+// is empty the configured key is stored as the first active key, so an
+// existing deployment keeps validating the tokens it has already issued. A
+// configured key that was never stored, because JWT_ALGORITHM or the key
+// changed since, replaces the active key the way a rotation does.
+// With an encryptionKey, key material is stored encrypted with AES-GCM and
+// keys stored in plain text before are encrypted.
+func NewKeyRing(DB *sql.DB, bootstrap *SigningKey, overlap time.Duration, encryptionKey []byte) (*KeyRing, error) {
+	ring := &KeyRing{
+		keys:    map[string]*RingKey{},
+		method:  bootstrap.Method,
+		overlap: overlap,
+		db:      DB,
+	}
+	if encryptionKey != nil {
+		block, err := aes.NewCipher(encryptionKey)
+		if err != nil {
+			return nil, fmt.Errorf("Invalid key encryption key: %w", err)
+		}
+		ring.aead, err = cipher.NewGCM(block)
+		if err != nil {
+			return nil, err
+		}
+	} else {
+		log.Printf("JWT_KEY_ENCRYPTION_KEY is unset, signing keys are stored unencrypted")
+	}
+
+	ctx := context.Background()
+	stored, err := ring.storesKey(ctx, bootstrap)
+	if err != nil {
+		return nil, err
+	}
+	if !stored {
+		var count int
+		err = DB.QueryRow("select count(*) from signing_keys").Scan(&count)
+		if err != nil {
+			return nil, fmt.Errorf("Failed to count signing keys: %w", err)
+		}
+		if count == 0 {
+			err = ring.insertKey(ctx, uuid.New().String(), bootstrap, time.Now())
+		} else {
+			log.Printf("The configured %s signing key is new, rotating it in", bootstrap.Method.Alg())
+			err = ring.storeRotation(ctx, uuid.New().String(), bootstrap, time.Now())
+		}
+		if err != nil {
+			return nil, err
+		}
+	}
+	if ring.aead != nil {
+		err = ring.encryptStoredKeys(ctx)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	err = ring.sync(ctx)
+	if err != nil {
+		return nil, err
+	}
+	return ring, nil
+}
+
+// SigningKey returns the most recently activated key that may still sign.
+func (r *KeyRing) SigningKey() (*RingKey, error) {
+	r.syncIfStale()
+
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+
+	now := time.Now()
+	var current *RingKey
+	for _, key := range r.keys {
+		if key.State != KeyStateActive || key.ActivatesAt.After(now) || key.expired(now) {
+			continue
+		}
+		if current == nil || key.ActivatesAt.After(current.ActivatesAt) {
+			current = key
+		}
+	}
+	if current == nil {
+		return nil, fmt.Errorf("No active signing key")
+	}
+	return current, nil
+}
+
+// VerificationKey looks a key up by its kid. Unknown ids trigger a reload so
+// keys rotated by another instance are picked up without a restart.
+func (r *KeyRing) VerificationKey(kid string) (*RingKey, error) {
+	key, ok := r.lookup(kid)
+	if !ok && r.syncIfOlderThan(keyRingMissInterval) {
+		key, ok = r.lookup(kid)
+	}
+	if !ok {
+		return nil, fmt.Errorf("Unknown signing key: %s", kid)
+	}
+	return key, nil
+}
+
+func (r *KeyRing) lookup(kid string) (*RingKey, bool) {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+
+	key, ok := r.keys[kid]
+	if !ok || !key.verifiable(time.Now()) {
+		return nil, false
+	}
+	return key, true
+}
+
+// PublicKeys returns every key that can currently verify a token, including
+// keys scheduled for future activation, so that verifiers can cache them early.
+func (r *KeyRing) PublicKeys() JWKS {
+	r.syncIfStale()
+
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+
+	now := time.Now()
+	jwks := JWKS{Keys: []JWK{}}
+	for _, key := range r.sortedKeys() {
+		if key.State == KeyStateRetired || key.expired(now) {
+			continue
+		}
+		if jwk, ok := key.JWK(); ok {
+			jwk.Kid = key.ID
+			jwks.Keys = append(jwks.Keys, jwk)
+		}
+	}
+	return jwks
+}
+
+func (r *KeyRing) Keys(ctx context.Context) ([]KeyInfo, error) {
+	err := r.sync(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+
+	infos := []KeyInfo{}
+	for _, key := range r.sortedKeys() {
+		infos = append(infos, key.info())
+	}
+	return infos, nil
+}
+
+// Rotate generates a new key that starts signing at activateAt. Keys that
+// are active until then keep verifying for one more access token lifetime,
+// so tokens signed right before the switch stay valid until they expire.
+func (r *KeyRing) Rotate(ctx context.Context, activateAt time.Time) (KeyInfo, error) {
+	signingKey, err := GenerateSigningKey(r.method)
+	if err != nil {
+		return KeyInfo{}, err
+	}
+
+	keyId := uuid.New().String()
+	err = r.storeRotation(ctx, keyId, signingKey, activateAt)
+	if err != nil {
+		return KeyInfo{}, err
+	}
+	err = r.sync(ctx)
+	if err != nil {
+		return KeyInfo{}, err
+	}
+
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	return r.keys[keyId].info(), nil
+}
+
+func (r *KeyRing) storeRotation(ctx context.Context, keyId string, signingKey *SigningKey, activateAt time.Time) (err error) {
+	material, err := r.sealKeyMaterial(keyId, signingKey)
+	if err != nil {
+		return err
+	}
+
+	tx, err := r.db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+
+	defer func() {
+		if p := recover(); p != nil {
+			tx.Rollback()
+			panic(p)
+		} else if err != nil {
+			tx.Rollback()
+		} else {
+			err = tx.Commit()
+		}
+	}()
+
+	_, err = tx.ExecContext(
+		ctx,
+		"update signing_keys set expires_at = $1 where state = $2 and activates_at <= $3 and (expires_at is null or expires_at > $1)",
+		activateAt.Add(r.overlap), KeyStateActive, activateAt,
+	)
+	if err != nil {
+		return fmt.Errorf("Failed to schedule previous keys: %w", err)
+	}
+
+	_, err = tx.ExecContext(
+		ctx,
+		"insert into signing_keys (id, algorithm, key_material, state, activates_at) values($1, $2, $3, $4, $5)",
+		keyId, signingKey.Method.Alg(), material, KeyStateActive, activateAt,
+	)
+	if err != nil {
+		return fmt.Errorf("Failed to save signing key: %w", err)
+	}
+	return nil
+}
+
+func (r *KeyRing) syncIfStale() bool {
+	return r.syncIfOlderThan(keyRingSyncInterval)
+}
+
+func (r *KeyRing) syncIfOlderThan(interval time.Duration) bool {
+	r.mu.RLock()
+	stale := time.Since(r.lastSync) > interval
+	r.mu.RUnlock()
+	if !stale {
+		return false
+	}
+	return r.sync(context.Background()) == nil
+}
+
+// sync persists state transitions that are due and reloads every key that
+// has not been retired yet.
+func (r *KeyRing) sync(ctx context.Context) error {
+	now := time.Now()
+	_, err := r.db.ExecContext(
+		ctx,
+		"update signing_keys set state = $1 where state <> $1 and expires_at is not null and expires_at <= $2",
+		KeyStateRetired, now,
+	)
+	if err != nil {
+		return fmt.Errorf("Failed to retire signing keys: %w", err)
+	}
+	_, err = r.db.ExecContext(
+		ctx,
+		`update signing_keys set state = $1 where state = $2 and activates_at < (
+			select max(activates_at) from signing_keys where state = $2 and activates_at <= $3
+		)`,
+		KeyStateVerifyOnly, KeyStateActive, now,
+	)
+	if err != nil {
+		return fmt.Errorf("Failed to demote signing keys: %w", err)
+	}
+
+	rows, err := r.db.QueryContext(
+		ctx,
+		"select id, algorithm, key_material, state, activates_at, expires_at from signing_keys where state <> $1",
+		KeyStateRetired,
+	)
+	if err != nil {
+		return fmt.Errorf("Failed to load signing keys: %w", err)
+	}
+	defer rows.Close()
+
+	keys := map[string]*RingKey{}
+	for rows.Next() {
+		var id, algorithm, material string
+		var state KeyState
+		var activatesAt time.Time
+		var expiresAt sql.NullTime
+		err = rows.Scan(&id, &algorithm, &material, &state, &activatesAt, &expiresAt)
+		if err != nil {
+			return err
+		}
+		material, err = r.openKeyMaterial(id, material)
+		if err != nil {
+			return fmt.Errorf("Failed to decrypt signing key %s: %w", id, err)
+		}
+		signingKey, err := decodeKeyMaterial(algorithm, material)
+		if err != nil {
+			return fmt.Errorf("Failed to decode signing key %s: %w", id, err)
+		}
+		key := &RingKey{SigningKey: signingKey, ID: id, State: state, ActivatesAt: activatesAt}
+		if expiresAt.Valid {
+			key.ExpiresAt = &expiresAt.Time
+		}
+		keys[id] = key
+	}
+	if err = rows.Err(); err != nil {
+		return err
+	}
+
+	r.mu.Lock()
+	r.keys = keys
+	r.lastSync = now
+	r.mu.Unlock()
+	return nil
+}
+
+func (r *KeyRing) insertKey(ctx context.Context, id string, signingKey *SigningKey, activateAt time.Time) error {
+	material, err := r.sealKeyMaterial(id, signingKey)
+	if err != nil {
+		return err
+	}
+	_, err = r.db.ExecContext(
+		ctx,
+		"insert into signing_keys (id, algorithm, key_material, state, activates_at) values($1, $2, $3, $4, $5)",
+		id, signingKey.Method.Alg(), material, KeyStateActive, activateAt,
+	)
+	if err != nil {
+		return fmt.Errorf("Failed to save signing key: %w", err)
+	}
+	return nil
+}
+
+// storesKey reports whether signingKey was ever stored, retired keys
+// included.
+func (r *KeyRing) storesKey(ctx context.Context, signingKey *SigningKey) (bool, error) {
+	want, err := encodeKeyMaterial(signingKey)
+	if err != nil {
+		return false, err
+	}
+	rows, err := r.db.QueryContext(ctx,
+		"select id, key_material from signing_keys where algorithm = $1",
+		signingKey.Method.Alg(),
+	)
+	if err != nil {
+		return false, fmt.Errorf("Failed to load signing keys: %w", err)
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var id, material string
+		err = rows.Scan(&id, &material)
+		if err != nil {
+			return false, err
+		}
+		material, err = r.openKeyMaterial(id, material)
+		if err != nil {
+			return false, fmt.Errorf("Failed to decrypt signing key %s: %w", id, err)
+		}
+		if material == want {
+			return true, nil
+		}
+	}
+	return false, rows.Err()
+}
+
+// encryptStoredKeys encrypts the key material stored in plain text.
+func (r *KeyRing) encryptStoredKeys(ctx context.Context) error {
+	rows, err := r.db.QueryContext(ctx,
+		"select id, key_material from signing_keys where key_material not like $1",
+		encryptedKeyPrefix+"%",
+	)
+	if err != nil {
+		return fmt.Errorf("Failed to load signing keys: %w", err)
+	}
+	plain := map[string]string{}
+	for rows.Next() {
+		var id, material string
+		err = rows.Scan(&id, &material)
+		if err != nil {
+			rows.Close()
+			return err
+		}
+		plain[id] = material
+	}
+	rows.Close()
+	if err = rows.Err(); err != nil {
+		return err
+	}
+
+	for id, material := range plain {
+		_, err = r.db.ExecContext(ctx,
+			"update signing_keys set key_material = $1 where id = $2 and key_material = $3",
+			r.seal(id, material), id, material,
+		)
+		if err != nil {
+			return fmt.Errorf("Failed to encrypt signing key %s: %w", id, err)
+		}
+	}
+	return nil
+}
+
+func (r *KeyRing) sealKeyMaterial(id string, signingKey *SigningKey) (string, error) {
+	material, err := encodeKeyMaterial(signingKey)
+	if err != nil {
+		return "", err
+	}
+	if r.aead == nil {
+		return material, nil
+	}
+	return r.seal(id, material), nil
+}
+
+// seal encrypts material with the key id as additional data, so that
+// material cannot be moved to another key's row.
+func (r *KeyRing) seal(id, material string) string {
+	nonce := make([]byte, r.aead.NonceSize())
+	rand.Read(nonce)
+	sealed := r.aead.Seal(nonce, nonce, []byte(material), []byte(id))
+	return encryptedKeyPrefix + base64.StdEncoding.EncodeToString(sealed)
+}
+
+func (r *KeyRing) openKeyMaterial(id, material string) (string, error) {
+	encoded, encrypted := strings.CutPrefix(material, encryptedKeyPrefix)
+	if !encrypted {
+		return material, nil
+	}
+	if r.aead == nil {
+		return "", fmt.Errorf("Signing key is encrypted but JWT_KEY_ENCRYPTION_KEY is unset")
+	}
+	sealed, err := base64.StdEncoding.DecodeString(encoded)
+	if err != nil || len(sealed) < r.aead.NonceSize() {
+		return "", fmt.Errorf("Invalid encrypted signing key")
+	}
+	nonce, ciphertext := sealed[:r.aead.NonceSize()], sealed[r.aead.NonceSize():]
+	plain, err := r.aead.Open(nil, nonce, ciphertext, []byte(id))
+	if err != nil {
+		return "", fmt.Errorf("Signing key does not match JWT_KEY_ENCRYPTION_KEY")
+	}
+	return string(plain), nil
+}
+
+func (r *KeyRing) sortedKeys() []*RingKey {
+	keys := make([]*RingKey, 0, len(r.keys))
+	for _, key := range r.keys {
+		keys = append(keys, key)
+	}
+	sort.Slice(keys, func(i, j int) bool {
+		return keys[i].ActivatesAt.After(keys[j].ActivatesAt)
+	})
+	return keys
+}
+
+func (k *RingKey) expired(now time.Time) bool {
+	return k.ExpiresAt != nil && !now.Before(*k.ExpiresAt)
+}
+
+func (k *RingKey) verifiable(now time.Time) bool {
+	return k.State != KeyStateRetired && !k.ActivatesAt.After(now) && !k.expired(now)
+}
+
+func (k *RingKey) info() KeyInfo {
+	return KeyInfo{
+		ID:          k.ID,
+		Algorithm:   k.Method.Alg(),
+		State:       k.State,
+		ActivatesAt: k.ActivatesAt,
+		ExpiresAt:   k.ExpiresAt,
+	}
+}
+
+func GenerateSigningKey(method jwt.SigningMethod) (*SigningKey, error) {
+	var privateKey interface{}
+	var err error
+	switch m := method.(type) {
+	case *jwt.SigningMethodHMAC:
+		secret := make([]byte, 64)
+		_, err = rand.Read(secret)
+		if err != nil {
+			return nil, fmt.Errorf("Failed to generate random bytes: %w", err)
+		}
+		return &SigningKey{Method: method, PrivateKey: secret, PublicKey: secret}, nil
+	case *jwt.SigningMethodRSA, *jwt.SigningMethodRSAPSS:
+		privateKey, err = rsa.GenerateKey(rand.Reader, 2048)
+	case *jwt.SigningMethodECDSA:
+		var curve elliptic.Curve
+		switch m.CurveBits {
+		case 256:
+			curve = elliptic.P256()
+		case 384:
+			curve = elliptic.P384()
+		default:
+			curve = elliptic.P521()
+		}
+		privateKey, err = ecdsa.GenerateKey(curve, rand.Reader)
+	case *jwt.SigningMethodEd25519:
+		_, privateKey, err = ed25519.GenerateKey(rand.Reader)
+	default:
+		return nil, fmt.Errorf("Unsupported signing algorithm: %s", method.Alg())
+	}
+	if err != nil {
+		return nil, fmt.Errorf("Failed to generate signing key: %w", err)
+	}
+
+	der, err := x509.MarshalPKCS8PrivateKey(privateKey)
+	if err != nil {
+		return nil, fmt.Errorf("Failed to encode signing key: %w", err)
+	}
+	return ParseSigningKey(method, pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: der}))
+}
+
+func encodeKeyMaterial(signingKey *SigningKey) (string, error) {
+	if secret, ok := signingKey.PrivateKey.([]byte); ok {
+		return base64.StdEncoding.EncodeToString(secret), nil
+	}
+	der, err := x509.MarshalPKCS8PrivateKey(signingKey.PrivateKey)
+	if err != nil {
+		return "", fmt.Errorf("Failed to encode signing key: %w", err)
+	}
+	return string(pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: der})), nil
+}
+
+func decodeKeyMaterial(algorithm, material string) (*SigningKey, error) {
+	method := jwt.GetSigningMethod(algorithm)
+	if method == nil {
+		return nil, fmt.Errorf("Unsupported signing algorithm: %s", algorithm)
+	}
+	if _, ok := method.(*jwt.SigningMethodHMAC); ok {
+		secret, err := base64.StdEncoding.DecodeString(material)
+		if err != nil {
+			return nil, err
+		}
+		return &SigningKey{Method: method, PrivateKey: secret, PublicKey: secret}, nil
+	}
+	return ParseSigningKey(method, []byte(material))
+}
@@ -0,0 +1,191 @@
+package auth
+
+import (
+	"context"
+	"crypto/aes"
+	"crypto/cipher"
+	"database/sql"
+	"database/sql/driver"
+	"regexp"
+	"testing"
+	"time"
+
+	"github.com/DATA-DOG/go-sqlmock"
+	"github.com/golang-jwt/jwt/v5"
+)
+
+// newTestKeyRing returns a ring holding keys that counts as freshly synced,
+// so that it only reaches db when a test asks for it.
+func newTestKeyRing(db *sql.DB, keys ...*RingKey) *KeyRing {
+	ring := &KeyRing{
+		keys:     map[string]*RingKey{},
+		method:   jwt.SigningMethodHS256,
+		overlap:  testAccessDuration,
+		lastSync: time.Now(),
+		db:       db,
+	}
+	for _, key := range keys {
+		ring.keys[key.ID] = key
+	}
+	return ring
+}
+
+// testRingKey returns an ES256 key, which unlike HMAC keys is published.
+func testRingKey(t *testing.T, id string, activatesAt time.Time, expiresAt *time.Time) *RingKey {
+	t.Helper()
+	signingKey, err := GenerateSigningKey(jwt.SigningMethodES256)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return &RingKey{SigningKey: signingKey, ID: id, State: KeyStateActive, ActivatesAt: activatesAt, ExpiresAt: expiresAt}
+}
+
+// capture is a sqlmock argument that matches anything and keeps it.
+type capture struct {
+	value *driver.Value
+}
+
+func (c capture) Match(value driver.Value) bool {
+	*c.value = value
+	return true
+}
+
+// TestKeyRingRotationOverlap checks which keys sign and verify while a
+// rotation is scheduled, in progress and over.
+func TestKeyRingRotationOverlap(t *testing.T) {
+	now := time.Now()
+	overlapEnd := now.Add(10 * time.Minute)
+	previous := testRingKey(t, "previous", now.Add(-2*time.Hour), &overlapEnd)
+	current := testRingKey(t, "current", now.Add(-time.Minute), nil)
+	scheduled := testRingKey(t, "scheduled", now.Add(time.Hour), nil)
+	ring := newTestKeyRing(nil, previous, current, scheduled)
+
+	signingKey, err := ring.SigningKey()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if signingKey.ID != "current" {
+		t.Fatalf("SigningKey() = %s, want current", signingKey.ID)
+	}
+	for id, want := range map[string]bool{"previous": true, "current": true, "scheduled": false} {
+		_, err = ring.VerificationKey(id)
+		if (err == nil) != want {
+			t.Errorf("VerificationKey(%s) error = %v, want it to verify: %v", id, err, want)
+		}
+	}
+	// Verifiers may cache the scheduled key before it signs anything.
+	published := map[string]bool{}
+	for _, jwk := range ring.PublicKeys().Keys {
+		published[jwk.Kid] = true
+	}
+	if len(published) != 3 {
+		t.Fatalf("PublicKeys() = %v, want all three keys", published)
+	}
+
+	expired := now.Add(-time.Second)
+	previous.ExpiresAt = &expired
+	_, err = ring.VerificationKey("previous")
+	if err == nil {
+		t.Fatal("VerificationKey(previous) verifies after the overlap ended")
+	}
+	for _, jwk := range ring.PublicKeys().Keys {
+		if jwk.Kid == "previous" {
+			t.Fatal("PublicKeys() still publishes the expired key")
+		}
+	}
+}
+
+// storedKey matches the material of a key being inserted and adds the row
+// sync will load for it, since its id and material are only known then.
+type storedKey struct {
+	rows        *sqlmock.Rows
+	id          *driver.Value
+	activatesAt time.Time
+}
+
+func (k storedKey) Match(material driver.Value) bool {
+	k.rows.AddRow(*k.id, "HS256", material, string(KeyStateActive), k.activatesAt, nil)
+	return true
+}
+
+// TestKeyRingRotate checks that a rotation keeps the keys active until then
+// verifying for one access token lifetime past the switch.
+func TestKeyRingRotate(t *testing.T) {
+	db, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	current := testRingKey(t, "current", time.Now().Add(-time.Hour), nil)
+	ring := newTestKeyRing(db, current)
+	activateAt := time.Now().Add(time.Hour)
+	overlapEnd := activateAt.Add(testAccessDuration)
+
+	currentMaterial, err := encodeKeyMaterial(current.SigningKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	rows := sqlmock.NewRows([]string{"id", "algorithm", "key_material", "state", "activates_at", "expires_at"}).
+		AddRow("current", "ES256", currentMaterial, string(KeyStateActive), current.ActivatesAt, overlapEnd)
+	var id driver.Value
+	mock.ExpectBegin()
+	mock.ExpectExec(regexp.QuoteMeta("update signing_keys set expires_at = $1 where state = $2 and activates_at <= $3")).
+		WithArgs(overlapEnd, KeyStateActive, activateAt).
+		WillReturnResult(sqlmock.NewResult(0, 1))
+	mock.ExpectExec(regexp.QuoteMeta("insert into signing_keys (id, algorithm, key_material, state, activates_at)")).
+		WithArgs(capture{&id}, "HS256", storedKey{rows, &id, activateAt}, KeyStateActive, activateAt).
+		WillReturnResult(sqlmock.NewResult(0, 1))
+	mock.ExpectCommit()
+	mock.ExpectExec(regexp.QuoteMeta("update signing_keys set state = $1 where state <> $1 and expires_at is not null")).
+		WillReturnResult(sqlmock.NewResult(0, 0))
+	mock.ExpectExec(regexp.QuoteMeta("update signing_keys set state = $1 where state = $2 and activates_at < (")).
+		WillReturnResult(sqlmock.NewResult(0, 0))
+	mock.ExpectQuery(regexp.QuoteMeta("select id, algorithm, key_material, state, activates_at, expires_at from signing_keys")).
+		WillReturnRows(rows)
+
+	info, err := ring.Rotate(context.Background(), activateAt)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if info.ID != id || info.State != KeyStateActive || !info.ActivatesAt.Equal(activateAt) {
+		t.Fatalf("Rotate() = %+v", info)
+	}
+	// Until activateAt the current key keeps signing.
+	signingKey, err := ring.SigningKey()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if signingKey.ID != "current" || signingKey.ExpiresAt == nil || !signingKey.ExpiresAt.Equal(overlapEnd) {
+		t.Fatalf("SigningKey() = %s expiring at %v, want current expiring at %v", signingKey.ID, signingKey.ExpiresAt, overlapEnd)
+	}
+
+	err = mock.ExpectationsWereMet()
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+// TestKeyRingSealBindsKeyID checks that encrypted key material only opens
+// for the key it was sealed for.
+func TestKeyRingSealBindsKeyID(t *testing.T) {
+	block, err := aes.NewCipher(make([]byte, 32))
+	if err != nil {
+		t.Fatal(err)
+	}
+	aead, err := cipher.NewGCM(block)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ring := newTestKeyRing(nil)
+	ring.aead = aead
+
+	sealed := ring.seal("key-1", "material")
+	material, err := ring.openKeyMaterial("key-1", sealed)
+	if err != nil || material != "material" {
+		t.Fatalf("openKeyMaterial() = %q, %v, want material", material, err)
+	}
+	_, err = ring.openKeyMaterial("key-2", sealed)
+	if err == nil {
+		t.Fatal("openKeyMaterial() opened material sealed for another key")
+	}
+}
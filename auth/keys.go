@@ -0,0 +1,153 @@
+package auth
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/rsa"
+	"encoding/base64"
+	"fmt"
+	"jwt-auth/config"
+	"math/big"
+	"os"
+
+	"github.com/golang-jwt/jwt/v5"
+)
+
+type SigningKey struct {
+	Method     jwt.SigningMethod
+	PrivateKey interface{}
+	PublicKey  interface{}
+}
+
+type JWK struct {
+	Kty string `json:"kty"`
+	Use string `json:"use,omitempty"`
+	Alg string `json:"alg,omitempty"`
+	Kid string `json:"kid,omitempty"`
+	N   string `json:"n,omitempty"`
+	E   string `json:"e,omitempty"`
+	Crv string `json:"crv,omitempty"`
+	X   string `json:"x,omitempty"`
+	Y   string `json:"y,omitempty"`
+}
+
+type JWKS struct {
+	Keys []JWK `json:"keys"`
+}
+
+func LoadSigningKey(jwtConfig *config.JWTConfig) (*SigningKey, error) {
+	method := jwt.GetSigningMethod(jwtConfig.Algorithm)
+	if method == nil {
+		return nil, fmt.Errorf("Unsupported signing algorithm: %s", jwtConfig.Algorithm)
+	}
+
+	if _, ok := method.(*jwt.SigningMethodHMAC); ok {
+		if jwtConfig.Secret == "" {
+			return nil, fmt.Errorf("JWT_SECRET is required for %s", jwtConfig.Algorithm)
+		}
+		return &SigningKey{
+			Method:     method,
+			PrivateKey: []byte(jwtConfig.Secret),
+			PublicKey:  []byte(jwtConfig.Secret),
+		}, nil
+	}
+
+	if jwtConfig.PrivateKeyPath == "" {
+		return nil, fmt.Errorf("JWT_PRIVATE_KEY_PATH is required for %s", jwtConfig.Algorithm)
+	}
+	pemBytes, err := os.ReadFile(jwtConfig.PrivateKeyPath)
+	if err != nil {
+		return nil, fmt.Errorf("Failed to read private key: %w", err)
+	}
+
+	return ParseSigningKey(method, pemBytes)
+}
+
+// LoadKeyEncryptionKey decodes JWT_KEY_ENCRYPTION_KEY, returning nil when it
+// is unset.
+func LoadKeyEncryptionKey(jwtConfig *config.JWTConfig) ([]byte, error) {
+	if jwtConfig.KeyEncryptionKey == "" {
+		return nil, nil
+	}
+	key, err := base64.StdEncoding.DecodeString(jwtConfig.KeyEncryptionKey)
+	if err != nil || len(key) != 32 {
+		return nil, fmt.Errorf("JWT_KEY_ENCRYPTION_KEY must be 32 bytes encoded in base64")
+	}
+	return key, nil
+}
+
+func ParseSigningKey(method jwt.SigningMethod, pemBytes []byte) (*SigningKey, error) {
+	switch m := method.(type) {
+	case *jwt.SigningMethodRSA, *jwt.SigningMethodRSAPSS:
+		privateKey, err := jwt.ParseRSAPrivateKeyFromPEM(pemBytes)
+		if err != nil {
+			return nil, fmt.Errorf("Failed to parse RSA private key: %w", err)
+		}
+		return &SigningKey{Method: method, PrivateKey: privateKey, PublicKey: &privateKey.PublicKey}, nil
+	case *jwt.SigningMethodECDSA:
+		privateKey, err := jwt.ParseECPrivateKeyFromPEM(pemBytes)
+		if err != nil {
+			return nil, fmt.Errorf("Failed to parse ECDSA private key: %w", err)
+		}
+		if privateKey.Curve.Params().BitSize != m.CurveBits {
+			return nil, fmt.Errorf("ECDSA key curve %s does not match %s", privateKey.Curve.Params().Name, m.Alg())
+		}
+		return &SigningKey{Method: method, PrivateKey: privateKey, PublicKey: &privateKey.PublicKey}, nil
+	case *jwt.SigningMethodEd25519:
+		privateKey, err := jwt.ParseEdPrivateKeyFromPEM(pemBytes)
+		if err != nil {
+			return nil, fmt.Errorf("Failed to parse Ed25519 private key: %w", err)
+		}
+		return &SigningKey{Method: method, PrivateKey: privateKey, PublicKey: privateKey.(crypto.Signer).Public()}, nil
+	}
+	return nil, fmt.Errorf("Unsupported signing algorithm: %s", method.Alg())
+}
+
+// JWK returns the public half of the key, or false for symmetric keys
+// which must never be published.
+func (k *SigningKey) JWK() (JWK, bool) {
+	encode := base64.RawURLEncoding.EncodeToString
+	switch publicKey := k.PublicKey.(type) {
+	case *rsa.PublicKey:
+		return JWK{
+			Kty: "RSA",
+			Use: "sig",
+			Alg: k.Method.Alg(),
+			N:   encode(publicKey.N.Bytes()),
+			E:   encode(big.NewInt(int64(publicKey.E)).Bytes()),
+		}, true
+	case *ecdsa.PublicKey:
+		size := (publicKey.Curve.Params().BitSize + 7) / 8
+		return JWK{
+			Kty: "EC",
+			Use: "sig",
+			Alg: k.Method.Alg(),
+			Crv: curveName(publicKey.Curve),
+			X:   encode(publicKey.X.FillBytes(make([]byte, size))),
+			Y:   encode(publicKey.Y.FillBytes(make([]byte, size))),
+		}, true
+	case ed25519.PublicKey:
+		return JWK{
+			Kty: "OKP",
+			Use: "sig",
+			Alg: k.Method.Alg(),
+			Crv: "Ed25519",
+			X:   encode(publicKey),
+		}, true
+	}
+	return JWK{}, false
+}
+
+func curveName(curve elliptic.Curve) string {
+	switch curve {
+	case elliptic.P256():
+		return "P-256"
+	case elliptic.P384():
+		return "P-384"
+	case elliptic.P521():
+		return "P-521"
+	}
+	return curve.Params().Name
+}
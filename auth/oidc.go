@@ -0,0 +1,49 @@
+package auth
+
+import (
+	"errors"
+	"time"
+
+	"github.com/golang-jwt/jwt/v5"
+)
+
+// IDTokenClaims are the claims of an OpenID Connect ID token. The audience
+// is the client the token is issued to.
+type IDTokenClaims struct {
+	Nonce             string           `json:"nonce,omitempty"`
+	AuthTime          *jwt.NumericDate `json:"auth_time,omitempty"`
+	Name              string           `json:"name,omitempty"`
+	PreferredUsername string           `json:"preferred_username,omitempty"`
+	Email             string           `json:"email,omitempty"`
+	EmailVerified     *bool            `json:"email_verified,omitempty"`
+	jwt.RegisteredClaims
+}
+
+// ErrIDTokenUnsupported is returned while the signing key is symmetric: relying
+// parties could not verify ID tokens MACed with the server's secret.
+var ErrIDTokenUnsupported = errors.New("ID tokens need an asymmetric signing algorithm")
+
+// SignsIDTokens reports whether the current signing key is asymmetric, so
+// that ID tokens can be verified against the published JWKS.
+func (j *JWTManager) SignsIDTokens() bool {
+	signingKey, err := j.keyRing.SigningKey()
+	if err != nil {
+		return false
+	}
+	_, ok := signingKey.JWK()
+	return ok
+}
+
+// IssueIDToken signs an ID token with the current signing key. It lives as
+// long as an access token.
+func (j *JWTManager) IssueIDToken(claims *IDTokenClaims) (string, error) {
+	if !j.SignsIDTokens() {
+		return "", ErrIDTokenUnsupported
+	}
+	now := time.Now()
+	claims.Issuer = j.issuer
+	claims.IssuedAt = jwt.NewNumericDate(now)
+	claims.ExpiresAt = jwt.NewNumericDate(now.Add(j.accessTokenDuration))
+
+	return j.sign(claims)
+}
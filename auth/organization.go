@@ -0,0 +1,11 @@
+package auth
+
+import "context"
+
+// userOrganization returns the organization the user belongs to, which access
+// tokens carry as their tenant.
+func (j *JWTManager) userOrganization(ctx context.Context, userID int64) (int64, error) {
+	var orgID int64
+	err := j.db.QueryRowContext(ctx, "SELECT org_id FROM users WHERE id = $1", userID).Scan(&orgID)
+	return orgID, err
+}
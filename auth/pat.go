@@ -0,0 +1,202 @@
+package auth
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/golang-jwt/jwt/v5"
+	"github.com/google/uuid"
+)
+
+// PersonalAccessTokenPrefix starts every personal access token, so that
+// secret scanners can spot leaked ones with jwtpat_[A-Za-z0-9_-]{43}.
+const PersonalAccessTokenPrefix = "jwtpat_"
+
+// personalAccessTokenHintLength is how much of a token is kept in clear to
+// tell a user's tokens apart.
+const personalAccessTokenHintLength = len(PersonalAccessTokenPrefix) + 5
+
+// personalAccessTokenUseInterval limits how often using a token from the same
+// address rewrites its last use.
+const personalAccessTokenUseInterval = time.Minute
+
+var (
+	ErrInvalidPersonalAccessToken = errors.New("Invalid personal access token")
+	ErrPersonalAccessTokenExists  = errors.New("Personal access token already exists")
+)
+
+type PersonalAccessTokenRecord struct {
+	ID         string
+	UserID     int64
+	Name       string
+	Prefix     string
+	Scope      string
+	CreatedAt  time.Time
+	ExpiresAt  *time.Time
+	LastUsedAt *time.Time
+	LastUsedIp string
+}
+
+const personalAccessTokenColumns = "id, userId, name, token_prefix, scope, created_at, expires_at, last_used_at, last_used_ip"
+
+func scanPersonalAccessToken(row rowScanner) (*PersonalAccessTokenRecord, error) {
+	record := &PersonalAccessTokenRecord{}
+	var expiresAt, lastUsedAt sql.NullTime
+	var lastUsedIp sql.NullString
+	err := row.Scan(&record.ID, &record.UserID, &record.Name, &record.Prefix, &record.Scope, &record.CreatedAt, &expiresAt, &lastUsedAt, &lastUsedIp)
+	if err != nil {
+		return nil, err
+	}
+	if expiresAt.Valid {
+		record.ExpiresAt = &expiresAt.Time
+	}
+	if lastUsedAt.Valid {
+		record.LastUsedAt = &lastUsedAt.Time
+	}
+	record.LastUsedIp = lastUsedIp.String
+	return record, nil
+}
+
+// IsPersonalAccessToken reports whether token looks like a personal access
+// token rather than a JWT.
+func IsPersonalAccessToken(token string) bool {
+	return strings.HasPrefix(token, PersonalAccessTokenPrefix)
+}
+
+// hashPersonalAccessToken derives the stored value of a token. Tokens carry
+// 256 random bits, so a fast hash suffices and lets them be looked up by it.
+func hashPersonalAccessToken(token string) string {
+	sum := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(sum[:])
+}
+
+// CreatePersonalAccessToken stores a new token for the user and returns it.
+// Only its hash is kept, so the token cannot be shown again.
+func (j *JWTManager) CreatePersonalAccessToken(ctx context.Context, userID int64, name, scope string, expiresAt *time.Time) (string, *PersonalAccessTokenRecord, error) {
+	bytes := make([]byte, 32)
+	_, err := rand.Read(bytes)
+	if err != nil {
+		return "", nil, fmt.Errorf("Failed to generate random bytes: %w", err)
+	}
+	token := PersonalAccessTokenPrefix + base64.RawURLEncoding.EncodeToString(bytes)
+
+	record, err := scanPersonalAccessToken(j.db.QueryRowContext(ctx,
+		`INSERT INTO personal_access_tokens (id, userId, name, token_hash, token_prefix, scope, expires_at)
+		VALUES ($1, $2, $3, $4, $5, $6, $7)
+		ON CONFLICT (userId, name) DO NOTHING
+		RETURNING `+personalAccessTokenColumns,
+		uuid.New().String(), userID, name, hashPersonalAccessToken(token), token[:personalAccessTokenHintLength], scope, expiresAt,
+	))
+	if err == sql.ErrNoRows {
+		return "", nil, ErrPersonalAccessTokenExists
+	}
+	if err != nil {
+		return "", nil, fmt.Errorf("Failed to save personal access token: %w", err)
+	}
+	return token, record, nil
+}
+
+func (j *JWTManager) ListPersonalAccessTokens(ctx context.Context, userID int64) ([]*PersonalAccessTokenRecord, error) {
+	rows, err := j.db.QueryContext(ctx,
+		"SELECT "+personalAccessTokenColumns+" FROM personal_access_tokens WHERE userId = $1 ORDER BY created_at",
+		userID,
+	)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var records []*PersonalAccessTokenRecord
+	for rows.Next() {
+		record, err := scanPersonalAccessToken(rows)
+		if err != nil {
+			return nil, err
+		}
+		records = append(records, record)
+	}
+	return records, rows.Err()
+}
+
+// RevokePersonalAccessToken deletes one of the user's tokens, reporting
+// whether it existed.
+func (j *JWTManager) RevokePersonalAccessToken(ctx context.Context, userID int64, id string) (bool, error) {
+	result, err := j.db.ExecContext(ctx,
+		"DELETE FROM personal_access_tokens WHERE id = $1 AND userId = $2",
+		id, userID,
+	)
+	if err != nil {
+		return false, err
+	}
+	affected, err := result.RowsAffected()
+	return affected > 0, err
+}
+
+// ParsePersonalAccessToken checks a personal access token and returns claims
+// like those of an access token issued to its user, limited to the token's
+// scope. Tokens of banned users are rejected. The use is recorded along with
+// agentIp, when known.
+func (j *JWTManager) ParsePersonalAccessToken(ctx context.Context, token, agentIp string) (*Claims, error) {
+	if !IsPersonalAccessToken(token) {
+		return nil, ErrInvalidPersonalAccessToken
+	}
+
+	now := time.Now()
+	record, err := scanPersonalAccessToken(j.db.QueryRowContext(ctx,
+		`SELECT p.id, p.userId, p.name, p.token_prefix, p.scope, p.created_at, p.expires_at, p.last_used_at, p.last_used_ip
+		FROM personal_access_tokens p JOIN users u ON u.id = p.userId
+		WHERE p.token_hash = $1 AND u.banned_at IS NULL AND (p.expires_at IS NULL OR p.expires_at > $2)`,
+		hashPersonalAccessToken(token), now,
+	))
+	if err == sql.ErrNoRows {
+		return nil, ErrInvalidPersonalAccessToken
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	_, err = j.db.ExecContext(ctx,
+		`UPDATE personal_access_tokens SET last_used_at = $2, last_used_ip = COALESCE(NULLIF($3, ''), last_used_ip)
+		WHERE id = $1 AND (last_used_at IS NULL OR last_used_at < $4 OR ($3 <> '' AND last_used_ip IS DISTINCT FROM $3))`,
+		record.ID, now, agentIp, now.Add(-personalAccessTokenUseInterval),
+	)
+	if err != nil {
+		return nil, fmt.Errorf("Failed to record token use: %w", err)
+	}
+
+	orgID, err := j.userOrganization(ctx, record.UserID)
+	if err != nil {
+		return nil, fmt.Errorf("Failed to load organization: %w", err)
+	}
+	roles, permissions, err := j.userAuthorization(ctx, record.UserID)
+	if err != nil {
+		return nil, fmt.Errorf("Failed to load roles: %w", err)
+	}
+
+	roles, permissions = ScopePermissions(roles, permissions, record.Scope)
+	claims := &Claims{
+		UserID:      record.UserID,
+		OrgID:       orgID,
+		Scope:       record.Scope,
+		Roles:       roles,
+		Permissions: permissions,
+		RegisteredClaims: jwt.RegisteredClaims{
+			Issuer:   j.issuer,
+			Subject:  strconv.FormatInt(record.UserID, 10),
+			ID:       record.ID,
+			IssuedAt: jwt.NewNumericDate(record.CreatedAt),
+		},
+	}
+	if record.ExpiresAt != nil {
+		claims.ExpiresAt = jwt.NewNumericDate(*record.ExpiresAt)
+	}
+	return claims, nil
+}
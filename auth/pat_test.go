@@ -0,0 +1,100 @@
+package auth
+
+import (
+	"context"
+	"database/sql"
+	"database/sql/driver"
+	"errors"
+	"regexp"
+	"slices"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/DATA-DOG/go-sqlmock"
+)
+
+var personalAccessTokenRowColumns = []string{
+	"id", "userId", "name", "token_prefix", "scope", "created_at", "expires_at", "last_used_at", "last_used_ip",
+}
+
+// TestPersonalAccessToken creates a token and uses it, which must give the
+// user's permissions narrowed to the token's scope.
+func TestPersonalAccessToken(t *testing.T) {
+	j, mock := newTestJWTManager(t)
+	ctx := context.Background()
+
+	var tokenHash driver.Value
+	mock.ExpectQuery(regexp.QuoteMeta("INSERT INTO personal_access_tokens")).
+		WithArgs(sqlmock.AnyArg(), int64(7), "ci", capture{&tokenHash}, sqlmock.AnyArg(), "reports:read", nil).
+		WillReturnRows(sqlmock.NewRows(personalAccessTokenRowColumns).
+			AddRow("pat-1", int64(7), "ci", "jwtpat_abcde", "reports:read", time.Now(), nil, nil, nil))
+	token, _, err := j.CreatePersonalAccessToken(ctx, 7, "ci", "reports:read", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !IsPersonalAccessToken(token) || len(token) != len(PersonalAccessTokenPrefix)+43 {
+		t.Fatalf("CreatePersonalAccessToken() = %q, want jwtpat_ and 43 characters", token)
+	}
+	// Only the hash is stored.
+	if tokenHash != hashPersonalAccessToken(token) {
+		t.Fatalf("stored %v, want the token's hash", tokenHash)
+	}
+
+	mock.ExpectQuery(regexp.QuoteMeta("FROM personal_access_tokens p JOIN users u ON u.id = p.userId")).
+		WithArgs(hashPersonalAccessToken(token), sqlmock.AnyArg()).
+		WillReturnRows(sqlmock.NewRows(personalAccessTokenRowColumns).
+			AddRow("pat-1", int64(7), "ci", "jwtpat_abcde", "reports:read", time.Now(), nil, nil, nil))
+	mock.ExpectExec(regexp.QuoteMeta("UPDATE personal_access_tokens SET last_used_at = $2")).
+		WithArgs("pat-1", sqlmock.AnyArg(), "127.0.0.1", sqlmock.AnyArg()).
+		WillReturnResult(sqlmock.NewResult(0, 1))
+	mock.ExpectQuery(regexp.QuoteMeta("SELECT org_id FROM users WHERE id = $1")).
+		WithArgs(int64(7)).
+		WillReturnRows(sqlmock.NewRows([]string{"org_id"}).AddRow(int64(1)))
+	mock.ExpectQuery(regexp.QuoteMeta("WITH RECURSIVE member_groups")).
+		WithArgs(int64(7)).
+		WillReturnRows(sqlmock.NewRows([]string{"name", "permission"}).
+			AddRow("editor", "reports:read").
+			AddRow("editor", "reports:write"))
+	claims, err := j.ParsePersonalAccessToken(ctx, token, "127.0.0.1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if claims.UserID != 7 || claims.OrgID != 1 || claims.ExpiresAt != nil {
+		t.Fatalf("ParsePersonalAccessToken() = %+v", claims)
+	}
+	if len(claims.Roles) != 0 || !slices.Equal(claims.Permissions, []string{"reports:read"}) {
+		t.Fatalf("ParsePersonalAccessToken() roles %v, permissions %v, want none and [reports:read]", claims.Roles, claims.Permissions)
+	}
+
+	err = mock.ExpectationsWereMet()
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+// TestParsePersonalAccessTokenRejected covers tokens that are malformed,
+// unknown, expired or of a banned user; the latter are filtered by the query.
+func TestParsePersonalAccessTokenRejected(t *testing.T) {
+	j, mock := newTestJWTManager(t)
+	ctx := context.Background()
+
+	_, err := j.ParsePersonalAccessToken(ctx, "not-a-token", "127.0.0.1")
+	if !errors.Is(err, ErrInvalidPersonalAccessToken) {
+		t.Fatalf("ParsePersonalAccessToken(JWT) error = %v, want %v", err, ErrInvalidPersonalAccessToken)
+	}
+
+	token := PersonalAccessTokenPrefix + strings.Repeat("a", 43)
+	mock.ExpectQuery(regexp.QuoteMeta("FROM personal_access_tokens p JOIN users u ON u.id = p.userId")).
+		WithArgs(hashPersonalAccessToken(token), sqlmock.AnyArg()).
+		WillReturnError(sql.ErrNoRows)
+	_, err = j.ParsePersonalAccessToken(ctx, token, "127.0.0.1")
+	if !errors.Is(err, ErrInvalidPersonalAccessToken) {
+		t.Fatalf("ParsePersonalAccessToken(unknown) error = %v, want %v", err, ErrInvalidPersonalAccessToken)
+	}
+
+	err = mock.ExpectationsWereMet()
+	if err != nil {
+		t.Fatal(err)
+	}
+}
@@ -0,0 +1,153 @@
+package auth
+
+import (
+	"context"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+)
+
+// authorizationCacheTTL bounds how long a role or group change made through
+// another instance takes to reach the tokens this one issues.
+const authorizationCacheTTL = 10 * time.Second
+
+// authorizationCache keeps the effective roles and permissions of recently
+// seen users, which for members of nested groups take a recursive query to
+// compute.
+type authorizationCache struct {
+	mu        sync.Mutex
+	entries   map[int64]cachedAuthorization
+	lastPrune time.Time
+}
+
+type cachedAuthorization struct {
+	roles       []string
+	permissions []string
+	loadedAt    time.Time
+}
+
+func newAuthorizationCache() *authorizationCache {
+	return &authorizationCache{
+		entries: map[int64]cachedAuthorization{},
+	}
+}
+
+func (c *authorizationCache) get(userID int64) ([]string, []string, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	entry, ok := c.entries[userID]
+	if !ok || time.Since(entry.loadedAt) > authorizationCacheTTL {
+		return nil, nil, false
+	}
+	return slices.Clone(entry.roles), slices.Clone(entry.permissions), true
+}
+
+func (c *authorizationCache) put(userID int64, roles, permissions []string) {
+	now := time.Now()
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if now.Sub(c.lastPrune) > authorizationCacheTTL {
+		for id, entry := range c.entries {
+			if now.Sub(entry.loadedAt) > authorizationCacheTTL {
+				delete(c.entries, id)
+			}
+		}
+		c.lastPrune = now
+	}
+	c.entries[userID] = cachedAuthorization{
+		roles:       slices.Clone(roles),
+		permissions: slices.Clone(permissions),
+		loadedAt:    now,
+	}
+}
+
+func (c *authorizationCache) clear() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.entries = map[int64]cachedAuthorization{}
+}
+
+// InvalidateAuthorizations drops the cached roles and permissions so that
+// the next tokens issued by this instance reflect a role or group change.
+func (j *JWTManager) InvalidateAuthorizations() {
+	j.authorizations.clear()
+}
+
+// ScopePermissions narrows the roles and permissions of a user to a token's
+// scope. Tokens without a scope keep them all. Scoped tokens keep the
+// permissions the scope names and no roles, which cannot be split by scope.
+func ScopePermissions(roles, permissions []string, scope string) ([]string, []string) {
+	if scope == "" {
+		return roles, permissions
+	}
+	scopes := strings.Fields(scope)
+	narrowed := []string{}
+	for _, permission := range permissions {
+		if slices.Contains(scopes, permission) {
+			narrowed = append(narrowed, permission)
+		}
+	}
+	return []string{}, narrowed
+}
+
+// userAuthorization returns the effective roles of a user and the
+// permissions they grant, both sorted, for embedding in an access token.
+// Roles are those assigned to the user directly and those of every group
+// the user belongs to, directly or through member groups.
+func (j *JWTManager) userAuthorization(ctx context.Context, userID int64) ([]string, []string, error) {
+	if roles, permissions, ok := j.authorizations.get(userID); ok {
+		return roles, permissions, nil
+	}
+
+	// UNION rather than UNION ALL stops the recursion at groups already
+	// visited, should a cycle ever make it into group_subgroups.
+	rows, err := j.db.QueryContext(ctx,
+		`WITH RECURSIVE member_groups(group_id) AS (
+			SELECT group_id FROM group_members WHERE userId = $1
+			UNION
+			SELECT gs.group_id FROM group_subgroups gs JOIN member_groups mg ON gs.member_group_id = mg.group_id
+		), member_roles(role_id) AS (
+			SELECT role_id FROM user_roles WHERE userId = $1
+			UNION
+			SELECT gr.role_id FROM group_roles gr JOIN member_groups mg ON gr.group_id = mg.group_id
+		)
+		SELECT r.name, COALESCE(p.name, '')
+		FROM member_roles mr
+		JOIN roles r ON r.id = mr.role_id
+		LEFT JOIN role_permissions rp ON rp.role_id = r.id
+		LEFT JOIN permissions p ON p.id = rp.permission_id`,
+		userID,
+	)
+	if err != nil {
+		return nil, nil, err
+	}
+	defer rows.Close()
+
+	var roles, permissions []string
+	for rows.Next() {
+		var role, permission string
+		err = rows.Scan(&role, &permission)
+		if err != nil {
+			return nil, nil, err
+		}
+		roles = append(roles, role)
+		if permission != "" {
+			permissions = append(permissions, permission)
+		}
+	}
+	if err = rows.Err(); err != nil {
+		return nil, nil, err
+	}
+
+	slices.Sort(roles)
+	slices.Sort(permissions)
+	roles, permissions = slices.Compact(roles), slices.Compact(permissions)
+	j.authorizations.put(userID, roles, permissions)
+	return roles, permissions, nil
+}
+
+// HasPermission reports whether the token grants permission.
+func (c *Claims) HasPermission(permission string) bool {
+	return slices.Contains(c.Permissions, permission)
+}
@@ -0,0 +1,83 @@
+package auth
+
+import (
+	"context"
+	"regexp"
+	"slices"
+	"testing"
+
+	"github.com/DATA-DOG/go-sqlmock"
+)
+
+func TestScopePermissions(t *testing.T) {
+	roles := []string{"admin", "editor"}
+	permissions := []string{"reports:read", "reports:write", "users:read"}
+	tests := []struct {
+		name            string
+		scope           string
+		wantRoles       []string
+		wantPermissions []string
+	}{
+		{"no scope", "", roles, permissions},
+		{"subset", "openid reports:read users:read", []string{}, []string{"reports:read", "users:read"}},
+		{"unheld permission", "reports:delete", []string{}, []string{}},
+		{"role name", "admin", []string{}, []string{}},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			gotRoles, gotPermissions := ScopePermissions(roles, permissions, test.scope)
+			if !slices.Equal(gotRoles, test.wantRoles) || !slices.Equal(gotPermissions, test.wantPermissions) {
+				t.Fatalf("ScopePermissions() = %v, %v, want %v, %v", gotRoles, gotPermissions, test.wantRoles, test.wantPermissions)
+			}
+		})
+	}
+}
+
+// TestIssueAccessTokenNarrowsToScope checks that a scoped token carries only
+// the permissions of the user its scope names, loaded once for both tokens.
+func TestIssueAccessTokenNarrowsToScope(t *testing.T) {
+	j, mock := newTestJWTManager(t)
+	ctx := context.Background()
+	expectOrganization := func() {
+		mock.ExpectQuery(regexp.QuoteMeta("SELECT org_id FROM users WHERE id = $1")).
+			WithArgs(int64(7)).
+			WillReturnRows(sqlmock.NewRows([]string{"org_id"}).AddRow(int64(1)))
+	}
+
+	expectOrganization()
+	mock.ExpectQuery(regexp.QuoteMeta("WITH RECURSIVE member_groups")).
+		WithArgs(int64(7)).
+		WillReturnRows(sqlmock.NewRows([]string{"name", "permission"}).
+			AddRow("editor", "reports:write").
+			AddRow("editor", "reports:read").
+			AddRow("viewer", "reports:read"))
+	token, err := j.IssueAccessToken(ctx, &Claims{UserID: 7, KeyPairID: "pair-1"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	claims, err := j.ParseAccessToken(token)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !slices.Equal(claims.Roles, []string{"editor", "viewer"}) || !slices.Equal(claims.Permissions, []string{"reports:read", "reports:write"}) {
+		t.Fatalf("unscoped token roles %v, permissions %v", claims.Roles, claims.Permissions)
+	}
+
+	expectOrganization()
+	token, err = j.IssueAccessToken(ctx, &Claims{UserID: 7, KeyPairID: "pair-2", Scope: "openid reports:read"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	claims, err = j.ParseAccessToken(token)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(claims.Roles) != 0 || !slices.Equal(claims.Permissions, []string{"reports:read"}) {
+		t.Fatalf("scoped token roles %v, permissions %v, want none and [reports:read]", claims.Roles, claims.Permissions)
+	}
+
+	err = mock.ExpectationsWereMet()
+	if err != nil {
+		t.Fatal(err)
+	}
+}
@@ -0,0 +1,77 @@
+package auth
+
+import (
+	"database/sql"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+)
+
+var ErrRefreshTokenReused = errors.New("Refresh token reuse detected")
+
+type RefreshTokenRecord struct {
+	ID        string
+	FamilyID  string
+	ParentID  string
+	UserID    int64
+	OrgID     int64
+	KeyPairID string
+	ClientID  string
+	Scope     string
+	UserAgent string
+	AgentIp   string
+	IssuedAt  time.Time
+	ExpiresAt time.Time
+	UsedAt    *time.Time
+
+	// FamilyStartedAt is only filled in when listing refresh tokens.
+	FamilyStartedAt time.Time
+}
+
+const refreshTokenColumns = "id, family_id, parent_id, userId, coalesce(org_id, 0), keyPairId, client_id, scope, userAgent, agentIp, issued_at, expires_at, used_at"
+
+type rowScanner interface {
+	Scan(dest ...interface{}) error
+}
+
+// scanRefreshToken reads refreshTokenColumns followed by any extra columns
+// selected after them.
+func scanRefreshToken(row rowScanner, extra ...interface{}) (*RefreshTokenRecord, error) {
+	record := &RefreshTokenRecord{}
+	var parentID, clientID, scope sql.NullString
+	var usedAt sql.NullTime
+	dest := []interface{}{
+		&record.ID, &record.FamilyID, &parentID, &record.UserID, &record.OrgID, &record.KeyPairID, &clientID, &scope,
+		&record.UserAgent, &record.AgentIp, &record.IssuedAt, &record.ExpiresAt, &usedAt,
+	}
+	err := row.Scan(append(dest, extra...)...)
+	if err != nil {
+		return nil, err
+	}
+	record.ParentID = parentID.String
+	record.ClientID = clientID.String
+	record.Scope = scope.String
+	if usedAt.Valid {
+		record.UsedAt = &usedAt.Time
+	}
+	return record, nil
+}
+
+// splitRefreshToken splits the "tokenId:secret" value handed to clients.
+func splitRefreshToken(refreshTokenString string) (string, []byte, error) {
+	parts := strings.Split(refreshTokenString, ":")
+	if len(parts) != 2 {
+		return "", nil, fmt.Errorf("Invalid token format")
+	}
+	refreshToken, err := base64.StdEncoding.DecodeString(parts[1])
+	if err != nil {
+		return "", nil, fmt.Errorf("Failed base64 decode")
+	}
+	return parts[0], refreshToken, nil
+}
+
+func nullString(value string) sql.NullString {
+	return sql.NullString{String: value, Valid: value != ""}
+}
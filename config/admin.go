@@ -0,0 +1,7 @@
+package config
+
+// GetAdminAPIKey returns the key guarding the /admin endpoints. An empty key
+// disables them.
+func GetAdminAPIKey() string {
+	return GetEnvOrDefault("ADMIN_API_KEY", "")
+}
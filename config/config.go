@@ -7,7 +7,9 @@ import (
 	"github.com/joho/godotenv"
 )
 
-func init() {
+// LoadEnvFile reads .env into the environment. It is called by main rather
+// than on import, so packages such as middleware can be used elsewhere.
+func LoadEnvFile() {
 	if err := godotenv.Load(); err != nil {
 		log.Fatal("No .env file found")
 	}
@@ -20,3 +22,11 @@ func GetEnv(key string) string {
 	}
 	return value
 }
+
+func GetEnvOrDefault(key, fallback string) string {
+	value := os.Getenv(key)
+	if value == "" {
+		return fallback
+	}
+	return value
+}
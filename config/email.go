@@ -0,0 +1,31 @@
+package config
+
+type MailConfig struct {
+	Transport        string
+	From             string
+	SMTPHost         string
+	SMTPPort         string
+	SMTPUsername     string
+	SMTPPassword     string
+	DropDir          string
+	VerifyEmailURL   string
+	PasswordResetURL string
+	UnlockAccountURL string
+}
+
+// LoadMailConfig returns how account emails are sent. The smtp transport
+// needs SMTP_HOST; the file transport writes them to MAIL_DROP_DIR.
+func LoadMailConfig() *MailConfig {
+	return &MailConfig{
+		Transport:        GetEnvOrDefault("MAIL_TRANSPORT", "file"),
+		From:             GetEnvOrDefault("MAIL_FROM", "jwt-auth@localhost"),
+		SMTPHost:         GetEnvOrDefault("SMTP_HOST", ""),
+		SMTPPort:         GetEnvOrDefault("SMTP_PORT", "587"),
+		SMTPUsername:     GetEnvOrDefault("SMTP_USERNAME", ""),
+		SMTPPassword:     GetEnvOrDefault("SMTP_PASSWORD", ""),
+		DropDir:          GetEnvOrDefault("MAIL_DROP_DIR", "mail"),
+		VerifyEmailURL:   GetEnvOrDefault("VERIFY_EMAIL_URL", "http://localhost:"+GetServerPort()+"/verify-email"),
+		PasswordResetURL: GetEnvOrDefault("PASSWORD_RESET_URL", ""),
+		UnlockAccountURL: GetEnvOrDefault("UNLOCK_ACCOUNT_URL", "http://localhost:"+GetServerPort()+"/account/unlock"),
+	}
+}
@@ -0,0 +1,6 @@
+package config
+
+// GetGRPCPort returns the port of the gRPC API. An empty port disables it.
+func GetGRPCPort() string {
+	return GetEnvOrDefault("GRPC_PORT", "")
+}
@@ -7,9 +7,15 @@ import (
 
 type JWTConfig struct {
 	Secret          string
+	Algorithm       string
+	PrivateKeyPath  string
 	AccessDuration  time.Duration
 	RefreshDuration time.Duration
 	RefreshLength   int
+	Issuer          string
+	// KeyEncryptionKey is the base64 AES-256 key signing keys are encrypted
+	// with in the database.
+	KeyEncryptionKey string
 }
 
 func LoadJWTConfig() (*JWTConfig, error) {
@@ -27,10 +33,14 @@ func LoadJWTConfig() (*JWTConfig, error) {
 	}
 
 	config := &JWTConfig{
-		Secret:          GetEnv("JWT_SECRET"),
-		AccessDuration:  time.Duration(accessDuration),
-		RefreshDuration: time.Duration(refreshDuration),
-		RefreshLength:   refreshLength,
+		Secret:           GetEnvOrDefault("JWT_SECRET", ""),
+		Algorithm:        GetEnvOrDefault("JWT_ALGORITHM", "HS512"),
+		PrivateKeyPath:   GetEnvOrDefault("JWT_PRIVATE_KEY_PATH", ""),
+		AccessDuration:   time.Duration(accessDuration) * time.Second,
+		RefreshDuration:  time.Duration(refreshDuration) * time.Second,
+		RefreshLength:    refreshLength,
+		Issuer:           GetEnvOrDefault("JWT_ISSUER", "http://localhost:"+GetServerPort()),
+		KeyEncryptionKey: GetEnvOrDefault("JWT_KEY_ENCRYPTION_KEY", ""),
 	}
 	return config, nil
 }
@@ -0,0 +1,45 @@
+package config
+
+import (
+	"strconv"
+	"time"
+)
+
+type LoginThrottleConfig struct {
+	AccountThreshold int
+	IPThreshold      int
+	BackoffBase      time.Duration
+	BackoffMax       time.Duration
+	LockoutDuration  time.Duration
+}
+
+func LoadLoginThrottleConfig() (*LoginThrottleConfig, error) {
+	accountThreshold, err := strconv.Atoi(GetEnvOrDefault("LOGIN_LOCKOUT_THRESHOLD", "10"))
+	if err != nil {
+		return nil, err
+	}
+	ipThreshold, err := strconv.Atoi(GetEnvOrDefault("LOGIN_IP_LOCKOUT_THRESHOLD", "100"))
+	if err != nil {
+		return nil, err
+	}
+	backoffBase, err := strconv.Atoi(GetEnvOrDefault("LOGIN_BACKOFF_BASE", "1"))
+	if err != nil {
+		return nil, err
+	}
+	backoffMax, err := strconv.Atoi(GetEnvOrDefault("LOGIN_BACKOFF_MAX", "60"))
+	if err != nil {
+		return nil, err
+	}
+	lockoutDuration, err := strconv.Atoi(GetEnvOrDefault("LOGIN_LOCKOUT_DURATION", "900"))
+	if err != nil {
+		return nil, err
+	}
+
+	return &LoginThrottleConfig{
+		AccountThreshold: accountThreshold,
+		IPThreshold:      ipThreshold,
+		BackoffBase:      time.Duration(backoffBase) * time.Second,
+		BackoffMax:       time.Duration(backoffMax) * time.Second,
+		LockoutDuration:  time.Duration(lockoutDuration) * time.Second,
+	}, nil
+}
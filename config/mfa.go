@@ -0,0 +1,6 @@
+package config
+
+// GetMFAIssuer returns the account issuer shown by authenticator apps.
+func GetMFAIssuer() string {
+	return GetEnvOrDefault("MFA_ISSUER", "jwt-auth")
+}
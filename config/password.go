@@ -0,0 +1,99 @@
+package config
+
+import "strconv"
+
+type PasswordPolicyConfig struct {
+	MinLength           int
+	MaxLength           int
+	MinCharacterClasses int
+	RejectUsername      bool
+	HistorySize         int
+	BreachedListPath    string
+}
+
+func LoadPasswordPolicyConfig() (*PasswordPolicyConfig, error) {
+	minLength, err := strconv.Atoi(GetEnvOrDefault("PASSWORD_MIN_LENGTH", "8"))
+	if err != nil {
+		return nil, err
+	}
+	maxLength, err := strconv.Atoi(GetEnvOrDefault("PASSWORD_MAX_LENGTH", "64"))
+	if err != nil {
+		return nil, err
+	}
+	minCharacterClasses, err := strconv.Atoi(GetEnvOrDefault("PASSWORD_MIN_CHARACTER_CLASSES", "1"))
+	if err != nil {
+		return nil, err
+	}
+	rejectUsername, err := strconv.ParseBool(GetEnvOrDefault("PASSWORD_REJECT_USERNAME", "true"))
+	if err != nil {
+		return nil, err
+	}
+	historySize, err := strconv.Atoi(GetEnvOrDefault("PASSWORD_HISTORY", "5"))
+	if err != nil {
+		return nil, err
+	}
+
+	return &PasswordPolicyConfig{
+		MinLength:           minLength,
+		MaxLength:           maxLength,
+		MinCharacterClasses: minCharacterClasses,
+		RejectUsername:      rejectUsername,
+		HistorySize:         historySize,
+		BreachedListPath:    GetEnvOrDefault("PASSWORD_BREACHED_LIST", ""),
+	}, nil
+}
+
+type PasswordHashConfig struct {
+	Algorithm     string
+	Argon2Memory  uint32
+	Argon2Time    uint32
+	Argon2Threads uint8
+	BcryptCost    int
+	ScryptLogN    int
+	ScryptR       int
+	ScryptP       int
+	Pepper        string
+}
+
+func LoadPasswordHashConfig() (*PasswordHashConfig, error) {
+	argon2Memory, err := strconv.ParseUint(GetEnvOrDefault("PASSWORD_ARGON2_MEMORY", "19456"), 10, 32)
+	if err != nil {
+		return nil, err
+	}
+	argon2Time, err := strconv.ParseUint(GetEnvOrDefault("PASSWORD_ARGON2_TIME", "2"), 10, 32)
+	if err != nil {
+		return nil, err
+	}
+	argon2Threads, err := strconv.ParseUint(GetEnvOrDefault("PASSWORD_ARGON2_THREADS", "1"), 10, 8)
+	if err != nil {
+		return nil, err
+	}
+	bcryptCost, err := strconv.Atoi(GetEnvOrDefault("PASSWORD_BCRYPT_COST", "10"))
+	if err != nil {
+		return nil, err
+	}
+	scryptLogN, err := strconv.Atoi(GetEnvOrDefault("PASSWORD_SCRYPT_LN", "17"))
+	if err != nil {
+		return nil, err
+	}
+	scryptR, err := strconv.Atoi(GetEnvOrDefault("PASSWORD_SCRYPT_R", "8"))
+	if err != nil {
+		return nil, err
+	}
+	scryptP, err := strconv.Atoi(GetEnvOrDefault("PASSWORD_SCRYPT_P", "1"))
+	if err != nil {
+		return nil, err
+	}
+
+	return &PasswordHashConfig{
+		Algorithm:     GetEnvOrDefault("PASSWORD_HASH_ALGORITHM", "argon2id"),
+		Argon2Memory:  uint32(argon2Memory),
+		Argon2Time:    uint32(argon2Time),
+		Argon2Threads: uint8(argon2Threads),
+		BcryptCost:    bcryptCost,
+		ScryptLogN:    scryptLogN,
+		ScryptR:       scryptR,
+		ScryptP:       scryptP,
+		Pepper:        GetEnvOrDefault("PASSWORD_PEPPER", ""),
+	}, nil
+}
@@ -0,0 +1,25 @@
+package config
+
+import "strings"
+
+type WebAuthnConfig struct {
+	RPID    string
+	RPName  string
+	Origins []string
+}
+
+// LoadWebAuthnConfig returns the relying party passkeys are registered
+// with. Its ID must be the host name of the origins, or a suffix of it.
+func LoadWebAuthnConfig() *WebAuthnConfig {
+	var origins []string
+	for _, origin := range strings.Split(GetEnvOrDefault("WEBAUTHN_ORIGINS", "http://localhost:"+GetServerPort()), ",") {
+		if origin = strings.TrimSpace(origin); origin != "" {
+			origins = append(origins, origin)
+		}
+	}
+	return &WebAuthnConfig{
+		RPID:    GetEnvOrDefault("WEBAUTHN_RP_ID", "localhost"),
+		RPName:  GetEnvOrDefault("WEBAUTHN_RP_NAME", "jwt-auth"),
+		Origins: origins,
+	}
+}
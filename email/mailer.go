@@ -0,0 +1,46 @@
+// Package email sends the account emails of the service through a pluggable
+// Mailer: SMTP in production, a drop directory or memory for development and
+// tests.
+package email
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"mime"
+	"strings"
+	"time"
+)
+
+type Message struct {
+	To      string
+	Subject string
+	Body    string
+}
+
+type Mailer interface {
+	Send(ctx context.Context, message Message) error
+}
+
+// format renders a plain text message in RFC 5322 form.
+func format(from string, message Message) []byte {
+	var buffer bytes.Buffer
+	fmt.Fprintf(&buffer, "From: %s\r\n", headerValue(from))
+	fmt.Fprintf(&buffer, "To: %s\r\n", headerValue(message.To))
+	fmt.Fprintf(&buffer, "Subject: %s\r\n", mime.QEncoding.Encode("utf-8", headerValue(message.Subject)))
+	fmt.Fprintf(&buffer, "Date: %s\r\n", time.Now().Format(time.RFC1123Z))
+	buffer.WriteString("MIME-Version: 1.0\r\n")
+	buffer.WriteString("Content-Type: text/plain; charset=utf-8\r\n")
+	buffer.WriteString("Content-Transfer-Encoding: 8bit\r\n\r\n")
+	body := strings.ReplaceAll(strings.ReplaceAll(message.Body, "\r\n", "\n"), "\n", "\r\n")
+	buffer.WriteString(body)
+	if !strings.HasSuffix(body, "\r\n") {
+		buffer.WriteString("\r\n")
+	}
+	return buffer.Bytes()
+}
+
+// headerValue keeps a value on one header line.
+func headerValue(value string) string {
+	return strings.NewReplacer("\r", "", "\n", "").Replace(value)
+}
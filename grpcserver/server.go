@@ -0,0 +1,257 @@
+package grpcserver
+
+import (
+	"context"
+	"errors"
+	"jwt-auth/middleware"
+	"jwt-auth/model"
+	"jwt-auth/proto/authpb"
+	"jwt-auth/service"
+	"net"
+	"net/mail"
+	"strings"
+
+	"google.golang.org/genproto/googleapis/rpc/errdetails"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/peer"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/types/known/durationpb"
+	"google.golang.org/protobuf/types/known/timestamppb"
+)
+
+// publicMethods authenticate with the credentials in their request rather
+// than an access token in the metadata.
+var publicMethods = []string{
+	authpb.AuthService_Register_FullMethodName,
+	authpb.AuthService_Login_FullMethodName,
+	authpb.AuthService_CompleteMFALogin_FullMethodName,
+	authpb.AuthService_Refresh_FullMethodName,
+	authpb.AuthService_Logout_FullMethodName,
+	authpb.AuthService_ValidateToken_FullMethodName,
+}
+
+type Server struct {
+	authpb.UnimplementedAuthServiceServer
+	authService         service.AuthService
+	organizationService service.OrganizationService
+	mfaService          service.MFAService
+}
+
+// NewServer returns a gRPC server exposing service.AuthService, with the
+// token interceptors of the middleware package in front of it.
+func NewServer(authService service.AuthService, organizationService service.OrganizationService, mfaService service.MFAService) *grpc.Server {
+	verifier := &serviceVerifier{authService: authService}
+	server := grpc.NewServer(
+		grpc.ChainUnaryInterceptor(middleware.UnaryServerInterceptor(verifier, publicMethods...)),
+		grpc.ChainStreamInterceptor(middleware.StreamServerInterceptor(verifier, publicMethods...)),
+	)
+	authpb.RegisterAuthServiceServer(server, &Server{
+		authService:         authService,
+		organizationService: organizationService,
+		mfaService:          mfaService,
+	})
+	return server
+}
+
+func (s *Server) Register(ctx context.Context, req *authpb.RegisterRequest) (*authpb.RegisterResponse, error) {
+	if req.Email != "" {
+		_, err := mail.ParseAddress(req.Email)
+		if err != nil {
+			return nil, status.Error(codes.InvalidArgument, "Invalid email")
+		}
+	}
+	organization, err := s.resolveOrganization(ctx, req.Organization)
+	if err != nil {
+		return nil, err
+	}
+
+	userId, err := s.authService.RegisterUser(ctx, model.User{
+		Username: req.Username,
+		Password: req.Password,
+		Name:     req.Name,
+		Email:    req.Email,
+		OrgID:    organization.ID,
+	})
+	var policyErr *service.PasswordPolicyError
+	if errors.As(err, &policyErr) {
+		return nil, passwordPolicyStatus(policyErr)
+	}
+	if err != nil {
+		return nil, status.Error(codes.Internal, "Internal error")
+	}
+	return &authpb.RegisterResponse{UserId: userId}, nil
+}
+
+func (s *Server) Login(ctx context.Context, req *authpb.LoginRequest) (*authpb.LoginResponse, error) {
+	organization, err := s.resolveOrganization(ctx, req.Organization)
+	if err != nil {
+		return nil, err
+	}
+
+	userAgent, agentIp := callOrigin(ctx)
+	userId, accessToken, refreshToken, err := s.authService.LoginUser(ctx, model.User{
+		Username: req.Username,
+		Password: req.Password,
+		OrgID:    organization.ID,
+	}, userAgent, agentIp)
+	var challenge *service.MFARequiredError
+	if errors.As(err, &challenge) {
+		return &authpb.LoginResponse{MfaToken: challenge.ChallengeToken}, nil
+	}
+	var throttled *service.LoginThrottledError
+	if errors.As(err, &throttled) {
+		return nil, loginThrottledStatus(throttled)
+	}
+	if err != nil {
+		return nil, status.Error(codes.Unauthenticated, "Invalid username or password")
+	}
+	return &authpb.LoginResponse{
+		UserId:       userId,
+		AccessToken:  accessToken,
+		RefreshToken: refreshToken,
+	}, nil
+}
+
+func (s *Server) CompleteMFALogin(ctx context.Context, req *authpb.CompleteMFALoginRequest) (*authpb.LoginResponse, error) {
+	userAgent, agentIp := callOrigin(ctx)
+	userId, accessToken, refreshToken, err := s.mfaService.CompleteLogin(ctx, req.MfaToken, req.Code, userAgent, agentIp)
+	var throttled *service.LoginThrottledError
+	if errors.As(err, &throttled) {
+		return nil, loginThrottledStatus(throttled)
+	}
+	if errors.Is(err, service.ErrInvalidMFAChallenge) {
+		return nil, status.Error(codes.Unauthenticated, "Invalid or expired MFA token")
+	}
+	if err != nil {
+		return nil, status.Error(codes.Unauthenticated, "Invalid authentication code")
+	}
+	return &authpb.LoginResponse{
+		UserId:       userId,
+		AccessToken:  accessToken,
+		RefreshToken: refreshToken,
+	}, nil
+}
+
+func (s *Server) Refresh(ctx context.Context, req *authpb.RefreshRequest) (*authpb.TokenPair, error) {
+	userAgent, agentIp := callOrigin(ctx)
+	accessToken, refreshToken, err := s.authService.RefreshTokens(ctx, req.AccessToken, userAgent, agentIp, req.RefreshToken)
+	if err != nil {
+		return nil, status.Error(codes.Unauthenticated, "Access denied")
+	}
+	return &authpb.TokenPair{
+		AccessToken:  accessToken,
+		RefreshToken: refreshToken,
+	}, nil
+}
+
+func (s *Server) Logout(ctx context.Context, req *authpb.LogoutRequest) (*authpb.LogoutResponse, error) {
+	err := s.authService.LogoutUser(ctx, req.RefreshToken)
+	if err != nil {
+		return nil, status.Error(codes.Internal, "Internal error")
+	}
+	return &authpb.LogoutResponse{}, nil
+}
+
+// ValidateToken answers whether an access token is valid for this service,
+// checking revocation and bans like the HTTP endpoints do.
+func (s *Server) ValidateToken(ctx context.Context, req *authpb.ValidateTokenRequest) (*authpb.ValidateTokenResponse, error) {
+	_, agentIp := callOrigin(ctx)
+	claims, err := s.authService.AuthenticateBearerToken(ctx, req.AccessToken, agentIp)
+	if err != nil {
+		return nil, status.Error(codes.Unauthenticated, "Access denied")
+	}
+	response := &authpb.ValidateTokenResponse{
+		Subject:     claims.Subject,
+		UserId:      claims.UserID,
+		ClientId:    claims.ClientID,
+		OrgId:       claims.OrgID,
+		Scope:       claims.Scope,
+		Roles:       claims.Roles,
+		Permissions: claims.Permissions,
+	}
+	if claims.ExpiresAt != nil {
+		response.ExpiresAt = timestamppb.New(claims.ExpiresAt.Time)
+	}
+	return response, nil
+}
+
+func (s *Server) ListSessions(ctx context.Context, req *authpb.ListSessionsRequest) (*authpb.ListSessionsResponse, error) {
+	sessions, err := s.authService.ListSessions(ctx, middleware.BearerTokenFromMetadata(ctx))
+	if err != nil {
+		return nil, status.Error(codes.Unauthenticated, "Access denied")
+	}
+
+	response := &authpb.ListSessionsResponse{}
+	for _, session := range sessions {
+		response.Sessions = append(response.Sessions, &authpb.Session{
+			Id:         session.ID,
+			UserAgent:  session.UserAgent,
+			AgentIp:    session.AgentIp,
+			SignedInAt: timestamppb.New(session.SignedInAt),
+			IssuedAt:   timestamppb.New(session.IssuedAt),
+			ExpiresAt:  timestamppb.New(session.ExpiresAt),
+			Current:    session.Current,
+		})
+	}
+	return response, nil
+}
+
+// resolveOrganization picks the named organization, or the default one.
+// Unlike HTTP requests, calls have no host name to take it from.
+func (s *Server) resolveOrganization(ctx context.Context, slug string) (model.Organization, error) {
+	if slug == "" {
+		slug = service.DefaultOrganization
+	}
+	organization, err := s.organizationService.ResolveOrganization(ctx, slug)
+	if errors.Is(err, service.ErrOrganizationNotFound) {
+		return model.Organization{}, status.Error(codes.InvalidArgument, "Unknown organization")
+	}
+	if err != nil {
+		return model.Organization{}, status.Error(codes.Internal, "Internal error")
+	}
+	return organization, nil
+}
+
+// callOrigin returns the user agent and address of the caller, which refresh
+// tokens are bound to as they are for HTTP requests.
+func callOrigin(ctx context.Context) (string, string) {
+	var userAgent, agentIp string
+	if md, ok := metadata.FromIncomingContext(ctx); ok {
+		userAgent = strings.Join(md.Get("user-agent"), " ")
+	}
+	if p, ok := peer.FromContext(ctx); ok && p.Addr != nil {
+		agentIp, _, _ = net.SplitHostPort(p.Addr.String())
+	}
+	return userAgent, agentIp
+}
+
+// passwordPolicyStatus reports the broken rules as BadRequest field
+// violations of the password.
+func passwordPolicyStatus(policyErr *service.PasswordPolicyError) error {
+	badRequest := &errdetails.BadRequest{}
+	for _, violation := range policyErr.Violations {
+		badRequest.FieldViolations = append(badRequest.FieldViolations, &errdetails.BadRequest_FieldViolation{
+			Field:       "password",
+			Description: violation.Message,
+			Reason:      violation.Rule,
+		})
+	}
+	st, err := status.New(codes.InvalidArgument, "Password does not meet the policy").WithDetails(badRequest)
+	if err != nil {
+		return status.Error(codes.InvalidArgument, policyErr.Error())
+	}
+	return st.Err()
+}
+
+// loginThrottledStatus tells when to retry as RetryInfo.
+func loginThrottledStatus(throttled *service.LoginThrottledError) error {
+	st, err := status.New(codes.ResourceExhausted, throttled.Error()).WithDetails(&errdetails.RetryInfo{
+		RetryDelay: durationpb.New(throttled.RetryAfter),
+	})
+	if err != nil {
+		return status.Error(codes.ResourceExhausted, throttled.Error())
+	}
+	return st.Err()
+}
@@ -0,0 +1,289 @@
+package handler
+
+import (
+	"crypto/subtle"
+	"encoding/json"
+	"errors"
+	"jwt-auth/model"
+	"jwt-auth/service"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+// RegisterClientRequest describes a new client. Scope lists the scopes the
+// client may request for itself with the client_credentials grant, and
+// AccessTokenLifetime (in seconds) overrides JWT_ACCESS_EXPIRATION for
+// those tokens.
+type RegisterClientRequest struct {
+	Name                string   `json:"name"`
+	Confidential        bool     `json:"confidential"`
+	RedirectURIs        []string `json:"redirect_uris"`
+	Scope               string   `json:"scope"`
+	AccessTokenLifetime int64    `json:"access_token_lifetime"`
+}
+
+type RotateKeyRequest struct {
+	ActivateAt *time.Time `json:"activate_at,omitempty"`
+}
+
+// requireAdmin checks the X-Admin-Key header against the configured admin
+// key and writes the error response when it does not match.
+func (h *Handler) requireAdmin(writer http.ResponseWriter, request *http.Request) bool {
+	if h.AdminAPIKey == "" {
+		http.Error(writer, "Admin API disabled", http.StatusForbidden)
+		return false
+	}
+	key := request.Header.Get("X-Admin-Key")
+	if subtle.ConstantTimeCompare([]byte(key), []byte(h.AdminAPIKey)) != 1 {
+		http.Error(writer, "Access denied", http.StatusUnauthorized)
+		return false
+	}
+	return true
+}
+
+// SigningKeysHandler godoc
+// @Summary      List signing keys
+// @Description  Lists the access token signing keys that have not been retired
+// @Tags         admin
+// @Produce      json
+// @Param        X-Admin-Key header string true "Admin API key"
+// @Success      200  {array}   auth.KeyInfo
+// @Failure      401  {object}  HTTPError
+// @Failure      403  {object}  HTTPError
+// @Failure      500  {object}  HTTPError
+// @Router       /admin/keys [get]
+func (h *Handler) SigningKeysHandler(writer http.ResponseWriter, request *http.Request) {
+	if request.Method != http.MethodGet {
+		http.Error(writer, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	if !h.requireAdmin(writer, request) {
+		return
+	}
+
+	keys, err := h.AuthService.ListSigningKeys(request.Context())
+	if err != nil {
+		http.Error(writer, "Internal error", http.StatusInternalServerError)
+		return
+	}
+	writer.Header().Set("Content-Type", "application/json")
+	writer.WriteHeader(http.StatusOK)
+	json.NewEncoder(writer).Encode(keys)
+}
+
+// RotateSigningKeyHandler godoc
+// @Summary      Rotate signing key
+// @Description  Generates a new signing key, active now or at activate_at. Previous keys keep verifying for one access token lifetime
+// @Tags         admin
+// @Accept       json
+// @Produce      json
+// @Param        X-Admin-Key header string true "Admin API key"
+// @Param        rotateKeyRequest body RotateKeyRequest false "Activation time"
+// @Success      201  {object}  auth.KeyInfo
+// @Failure      400  {object}  HTTPError
+// @Failure      401  {object}  HTTPError
+// @Failure      403  {object}  HTTPError
+// @Failure      500  {object}  HTTPError
+// @Router       /admin/keys/rotate [post]
+func (h *Handler) RotateSigningKeyHandler(writer http.ResponseWriter, request *http.Request) {
+	if request.Method != http.MethodPost {
+		http.Error(writer, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	if !h.requireAdmin(writer, request) {
+		return
+	}
+
+	var req RotateKeyRequest
+	if request.ContentLength != 0 {
+		err := json.NewDecoder(request.Body).Decode(&req)
+		if err != nil {
+			http.Error(writer, "Invalid JSON", http.StatusBadRequest)
+			return
+		}
+	}
+	activateAt := time.Now()
+	if req.ActivateAt != nil {
+		if req.ActivateAt.Before(activateAt) {
+			http.Error(writer, "activate_at must not be in the past", http.StatusBadRequest)
+			return
+		}
+		activateAt = *req.ActivateAt
+	}
+
+	key, err := h.AuthService.RotateSigningKey(request.Context(), activateAt)
+	if err != nil {
+		http.Error(writer, "Internal error", http.StatusInternalServerError)
+		return
+	}
+	writer.Header().Set("Content-Type", "application/json")
+	writer.WriteHeader(http.StatusCreated)
+	json.NewEncoder(writer).Encode(key)
+}
+
+// BanUserHandler godoc
+// @Summary      Ban or unban a user
+// @Description  POST bans the user, revoking every session and access token. DELETE lifts the ban
+// @Tags         admin
+// @Produce      json
+// @Param        X-Admin-Key header string true "Admin API key"
+// @Param        id path int true "User ID"
+// @Success      200  {object}  map[string]interface{}
+// @Failure      400  {object}  HTTPError
+// @Failure      401  {object}  HTTPError
+// @Failure      403  {object}  HTTPError
+// @Failure      404  {object}  HTTPError
+// @Failure      500  {object}  HTTPError
+// @Router       /admin/users/{id}/ban [post]
+// @Router       /admin/users/{id}/ban [delete]
+func (h *Handler) BanUserHandler(writer http.ResponseWriter, request *http.Request) {
+	if request.Method != http.MethodPost && request.Method != http.MethodDelete {
+		http.Error(writer, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	if !h.requireAdmin(writer, request) {
+		return
+	}
+
+	userId, err := strconv.ParseInt(request.PathValue("id"), 10, 64)
+	if err != nil {
+		http.Error(writer, "Invalid user ID", http.StatusBadRequest)
+		return
+	}
+
+	if request.Method == http.MethodPost {
+		err = h.AuthService.BanUser(request.Context(), userId)
+	} else {
+		err = h.AuthService.UnbanUser(request.Context(), userId)
+	}
+	if errors.Is(err, service.ErrUserNotFound) {
+		http.Error(writer, "User not found", http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		http.Error(writer, "Internal error", http.StatusInternalServerError)
+		return
+	}
+	writer.Header().Set("Content-Type", "application/json")
+	writer.WriteHeader(http.StatusOK)
+	json.NewEncoder(writer).Encode(map[string]interface{}{})
+}
+
+// UnlockUserHandler godoc
+// @Summary      Unlock a user
+// @Description  Clears the failed logins of the user's account, lifting a lockout or backoff. Blocks of IP addresses stay
+// @Tags         admin
+// @Produce      json
+// @Param        X-Admin-Key header string true "Admin API key"
+// @Param        id path int true "User ID"
+// @Success      200  {object}  map[string]interface{}
+// @Failure      400  {object}  HTTPError
+// @Failure      401  {object}  HTTPError
+// @Failure      403  {object}  HTTPError
+// @Failure      404  {object}  HTTPError
+// @Failure      500  {object}  HTTPError
+// @Router       /admin/users/{id}/lockout [delete]
+func (h *Handler) UnlockUserHandler(writer http.ResponseWriter, request *http.Request) {
+	if request.Method != http.MethodDelete {
+		http.Error(writer, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	if !h.requireAdmin(writer, request) {
+		return
+	}
+
+	userId, err := strconv.ParseInt(request.PathValue("id"), 10, 64)
+	if err != nil {
+		http.Error(writer, "Invalid user ID", http.StatusBadRequest)
+		return
+	}
+	err = h.AuthService.UnlockUser(request.Context(), userId)
+	if errors.Is(err, service.ErrUserNotFound) {
+		http.Error(writer, "User not found", http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		http.Error(writer, "Internal error", http.StatusInternalServerError)
+		return
+	}
+	writer.Header().Set("Content-Type", "application/json")
+	writer.WriteHeader(http.StatusOK)
+	json.NewEncoder(writer).Encode(map[string]interface{}{})
+}
+
+// ClientsHandler godoc
+// @Summary      List or register OAuth clients
+// @Description  GET lists the registered clients. POST registers a client; the secret of a confidential client is only returned once
+// @Tags         admin
+// @Accept       json
+// @Produce      json
+// @Param        X-Admin-Key header string true "Admin API key"
+// @Param        registerClientRequest body RegisterClientRequest false "Client info"
+// @Success      200  {array}   model.Client
+// @Success      201  {object}  map[string]interface{}
+// @Failure      400  {object}  HTTPError
+// @Failure      401  {object}  HTTPError
+// @Failure      403  {object}  HTTPError
+// @Failure      500  {object}  HTTPError
+// @Router       /admin/clients [get]
+// @Router       /admin/clients [post]
+func (h *Handler) ClientsHandler(writer http.ResponseWriter, request *http.Request) {
+	if request.Method != http.MethodGet && request.Method != http.MethodPost {
+		http.Error(writer, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	if !h.requireAdmin(writer, request) {
+		return
+	}
+
+	if request.Method == http.MethodGet {
+		clients, err := h.ClientService.ListClients(request.Context())
+		if err != nil {
+			http.Error(writer, "Internal error", http.StatusInternalServerError)
+			return
+		}
+		writer.Header().Set("Content-Type", "application/json")
+		writer.WriteHeader(http.StatusOK)
+		json.NewEncoder(writer).Encode(clients)
+		return
+	}
+
+	var req RegisterClientRequest
+	err := json.NewDecoder(request.Body).Decode(&req)
+	if err != nil || req.Name == "" || req.AccessTokenLifetime < 0 {
+		http.Error(writer, "Invalid JSON", http.StatusBadRequest)
+		return
+	}
+	client, secret, err := h.ClientService.RegisterClient(request.Context(), model.Client{
+		Name:                req.Name,
+		Confidential:        req.Confidential,
+		RedirectURIs:        req.RedirectURIs,
+		Scope:               req.Scope,
+		AccessTokenLifetime: req.AccessTokenLifetime,
+	})
+	if errors.Is(err, service.ErrInvalidRedirectURI) {
+		http.Error(writer, "Invalid redirect URI", http.StatusBadRequest)
+		return
+	}
+	if err != nil {
+		http.Error(writer, "Internal error", http.StatusInternalServerError)
+		return
+	}
+	response := map[string]interface{}{
+		"client_id":     client.ID,
+		"name":          client.Name,
+		"confidential":  client.Confidential,
+		"redirect_uris": client.RedirectURIs,
+		"scope":         client.Scope,
+	}
+	if client.AccessTokenLifetime > 0 {
+		response["access_token_lifetime"] = client.AccessTokenLifetime
+	}
+	if secret != "" {
+		response["client_secret"] = secret
+	}
+	writer.Header().Set("Content-Type", "application/json")
+	writer.WriteHeader(http.StatusCreated)
+	json.NewEncoder(writer).Encode(response)
+}
@@ -2,25 +2,43 @@ package handler
 
 import (
 	"encoding/json"
+	"errors"
 	"jwt-auth/model"
 	"jwt-auth/service"
+	"math"
 	"net"
 	"net/http"
+	"net/mail"
+	"strconv"
 	"strings"
 	"time"
 )
 
 type RegisterRequest struct {
-	Username string `json:"username"`
-	Password string `json:"password"`
+	Username     string `json:"username"`
+	Password     string `json:"password"`
+	Name         string `json:"name,omitempty"`
+	Email        string `json:"email,omitempty"`
+	Organization string `json:"organization,omitempty"`
 }
 
 type LoginRequest struct {
-	Username string `json:"username"`
-	Password string `json:"password"`
+	Username     string `json:"username"`
+	Password     string `json:"password"`
+	Organization string `json:"organization,omitempty"`
 }
 type Handler struct {
-	AuthService service.AuthService
+	AuthService                service.AuthService
+	ClientService              service.ClientService
+	OAuthService               service.OAuthService
+	RBACService                service.RBACService
+	GroupService               service.GroupService
+	OrganizationService        service.OrganizationService
+	PersonalAccessTokenService service.PersonalAccessTokenService
+	MFAService                 service.MFAService
+	PasskeyService             service.PasskeyService
+	EmailService               service.EmailService
+	AdminAPIKey                string
 }
 
 type HTTPError struct {
@@ -29,13 +47,13 @@ type HTTPError struct {
 
 // RegisterHandler godoc
 // @Summary      Register new user
-// @Description  Registers a new user with username and password
+// @Description  Registers a new user with username and password, and optionally a name and email, which is sent a verification link. Usernames are unique per organization
 // @Tags         auth
 // @Accept       json
 // @Produce      json
 // @Param        registerRequest body RegisterRequest true "User registration info"
 // @Success      201  {object}  map[string]interface{}
-// @Failure      400  {object}  HTTPError
+// @Failure      400  {object}  PasswordPolicyHTTPError
 // @Failure      500  {object}  HTTPError
 // @Router       /register [post]
 func (h *Handler) RegisterHandler(writer http.ResponseWriter, request *http.Request) {
@@ -51,12 +69,36 @@ func (h *Handler) RegisterHandler(writer http.ResponseWriter, request *http.Requ
 		return
 	}
 
+	if req.Email != "" {
+		_, err = mail.ParseAddress(req.Email)
+		if err != nil {
+			http.Error(writer, "Invalid email", http.StatusBadRequest)
+			return
+		}
+	}
+
+	organization, err := h.resolveTenant(request, req.Organization)
+	if errors.Is(err, service.ErrOrganizationNotFound) {
+		http.Error(writer, "Unknown organization", http.StatusBadRequest)
+		return
+	}
+	if err != nil {
+		http.Error(writer, "Internal error", http.StatusInternalServerError)
+		return
+	}
+
 	user := model.User{
 		Username: req.Username,
 		Password: req.Password,
+		Name:     req.Name,
+		Email:    req.Email,
+		OrgID:    organization.ID,
 	}
 
 	_, err = h.AuthService.RegisterUser(request.Context(), user)
+	if writePasswordPolicyError(writer, err) {
+		return
+	}
 	if err != nil {
 		http.Error(writer, "Internal server error "+err.Error(), http.StatusInternalServerError)
 		return
@@ -69,7 +111,7 @@ func (h *Handler) RegisterHandler(writer http.ResponseWriter, request *http.Requ
 
 // LoginHandler godoc
 // @Summary      User login
-// @Description  Login with username and password, returns access and refresh tokens
+// @Description  Login with username and password, returns access and refresh tokens. The organization is taken from the request, else from the host name, else the default one. Users with two-factor authentication get an mfa_token to complete the login at /login/mfa instead. Repeated failures for a username or from an IP address are answered with 429 and Retry-After until a backoff or lockout ends
 // @Tags         auth
 // @Accept       json
 // @Produce      json
@@ -77,6 +119,8 @@ func (h *Handler) RegisterHandler(writer http.ResponseWriter, request *http.Requ
 // @Success      200  {object}  map[string]interface{}
 // @Failure      400  {object}  HTTPError
 // @Failure      401  {object}  HTTPError
+// @Failure      403  {object}  HTTPError
+// @Failure      429  {object}  HTTPError
 // @Router       /login [post]
 func (h *Handler) LoginHandler(writer http.ResponseWriter, request *http.Request) {
 	if request.Method != http.MethodPost {
@@ -90,19 +134,55 @@ func (h *Handler) LoginHandler(writer http.ResponseWriter, request *http.Request
 		http.Error(writer, "Invalid JSON", http.StatusBadRequest)
 	}
 
+	organization, err := h.resolveTenant(request, req.Organization)
+	if errors.Is(err, service.ErrOrganizationNotFound) {
+		http.Error(writer, "Unknown organization", http.StatusBadRequest)
+		return
+	}
+	if err != nil {
+		http.Error(writer, "Internal error", http.StatusInternalServerError)
+		return
+	}
+
 	user := model.User{
 		Username: req.Username,
 		Password: req.Password,
+		OrgID:    organization.ID,
 	}
 
 	ip, _, _ := net.SplitHostPort(request.RemoteAddr)
 
 	userId, accessToken, refreshToken, err := h.AuthService.LoginUser(request.Context(), user, request.Header.Get("User-Agent"), ip)
+	var challenge *service.MFARequiredError
+	if errors.As(err, &challenge) {
+		writer.Header().Set("Content-Type", "application/json")
+		writer.Header().Set("Cache-Control", "no-store")
+		writer.WriteHeader(http.StatusOK)
+		json.NewEncoder(writer).Encode(map[string]interface{}{
+			"mfa_required": true,
+			"mfa_token":    challenge.ChallengeToken,
+			"expires_in":   int64(time.Until(challenge.ExpiresAt).Seconds()),
+		})
+		return
+	}
+	if writeLoginThrottled(writer, err) {
+		return
+	}
+	if errors.Is(err, service.ErrUserBanned) {
+		http.Error(writer, err.Error(), http.StatusForbidden)
+		return
+	}
 	if err != nil {
-		http.Error(writer, "Invalid username or password: "+err.Error(), http.StatusUnauthorized)
+		http.Error(writer, "Invalid username or password", http.StatusUnauthorized)
 		return
 	}
 
+	writeLogin(writer, userId, accessToken, refreshToken)
+}
+
+// writeLogin answers a successful login with the refresh token as a cookie
+// and the access token in the Authorization header.
+func writeLogin(writer http.ResponseWriter, userId int64, accessToken, refreshToken string) {
 	http.SetCookie(writer, &http.Cookie{
 		Name:     "refresh_token",
 		Value:    refreshToken,
@@ -149,7 +229,7 @@ func (h *Handler) RefreshTokensHandler(writer http.ResponseWriter, request *http
 	refreshTokenString := cookie.Value
 	accessTokenHeader := request.Header.Get("Authorization")
 	accessToken := strings.TrimPrefix(accessTokenHeader, "Bearer ")
-	newAccessToken, newRefreshToken, err := h.AuthService.RefreshTokens(request.Context(), accessToken, request.Header.Get("User-Agent"), refreshTokenString, ip)
+	newAccessToken, newRefreshToken, err := h.AuthService.RefreshTokens(request.Context(), accessToken, request.Header.Get("User-Agent"), ip, refreshTokenString)
 	if err != nil {
 		http.Error(writer, "Unauthorized: "+err.Error(), http.StatusUnauthorized)
 		return
@@ -206,11 +286,11 @@ func (h *Handler) LogoutHandler(writer http.ResponseWriter, request *http.Reques
 }
 
 // UserAccessPointHandler godoc
-// @Summary      Get user ID from access token
-// @Description  Retrieves the user ID from the access token in Authorization header
+// @Summary      Get principal from access token
+// @Description  Retrieves the user ID, or the client ID of a client_credentials token, from the access token in Authorization header
 // @Tags         auth
 // @Produce      json
-// @Success      200  {object}  map[string]interface{}
+// @Success      200  {object}  model.Principal
 // @Failure      401  {object}  HTTPError
 // @Failure      405  {object}  HTTPError
 // @Router       /user [get]
@@ -221,14 +301,44 @@ func (h *Handler) UserAccessPointHandler(writer http.ResponseWriter, request *ht
 	}
 	accessTokenHeader := request.Header.Get("Authorization")
 	accessToken := strings.TrimPrefix(accessTokenHeader, "Bearer ")
-	userId, err := h.AuthService.UserAccessPoint(request.Context(), accessToken)
+	ip, _, _ := net.SplitHostPort(request.RemoteAddr)
+	principal, err := h.AuthService.UserAccessPoint(request.Context(), accessToken, ip)
 	if err != nil {
 		http.Error(writer, "Access denied", http.StatusUnauthorized)
 		return
 	}
 	writer.Header().Set("Content-Type", "application/json")
 	writer.WriteHeader(http.StatusOK)
-	json.NewEncoder(writer).Encode(map[string]interface{}{
-		"userId": userId,
-	})
+	json.NewEncoder(writer).Encode(principal)
+}
+
+// JWKSHandler godoc
+// @Summary      JSON Web Key Set
+// @Description  Publishes the public keys used to verify access tokens
+// @Tags         auth
+// @Produce      json
+// @Success      200  {object}  auth.JWKS
+// @Failure      405  {object}  HTTPError
+// @Router       /.well-known/jwks.json [get]
+func (h *Handler) JWKSHandler(writer http.ResponseWriter, request *http.Request) {
+	if request.Method != http.MethodGet {
+		http.Error(writer, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	writer.Header().Set("Content-Type", "application/json")
+	writer.Header().Set("Cache-Control", "public, max-age=300")
+	writer.WriteHeader(http.StatusOK)
+	json.NewEncoder(writer).Encode(h.AuthService.JWKS())
+}
+
+// writeLoginThrottled answers a *service.LoginThrottledError with 429 and
+// Retry-After, reporting whether err was one.
+func writeLoginThrottled(writer http.ResponseWriter, err error) bool {
+	var throttled *service.LoginThrottledError
+	if !errors.As(err, &throttled) {
+		return false
+	}
+	writer.Header().Set("Retry-After", strconv.FormatInt(int64(math.Ceil(throttled.RetryAfter.Seconds())), 10))
+	http.Error(writer, throttled.Error(), http.StatusTooManyRequests)
+	return true
 }
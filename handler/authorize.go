@@ -0,0 +1,238 @@
+package handler
+
+import (
+	"embed"
+	"errors"
+	"html/template"
+	"jwt-auth/model"
+	"jwt-auth/service"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+)
+
+//go:embed templates/*.html
+var templates embed.FS
+
+var authorizeTemplate = template.Must(template.ParseFS(templates, "templates/authorize.html"))
+
+type authorizePage struct {
+	ClientName string
+	Scopes     []string
+	Action     string
+	Params     map[string]string
+	LoggedIn   bool
+	Error      string
+}
+
+func authorizationRequest(values url.Values) model.AuthorizationRequest {
+	return model.AuthorizationRequest{
+		ResponseType:        values.Get("response_type"),
+		ClientID:            values.Get("client_id"),
+		RedirectURI:         values.Get("redirect_uri"),
+		Scope:               values.Get("scope"),
+		State:               values.Get("state"),
+		CodeChallenge:       values.Get("code_challenge"),
+		CodeChallengeMethod: values.Get("code_challenge_method"),
+		Nonce:               values.Get("nonce"),
+	}
+}
+
+func authorizationParams(req model.AuthorizationRequest) map[string]string {
+	return map[string]string{
+		"response_type":         req.ResponseType,
+		"client_id":             req.ClientID,
+		"redirect_uri":          req.RedirectURI,
+		"scope":                 req.Scope,
+		"state":                 req.State,
+		"code_challenge":        req.CodeChallenge,
+		"code_challenge_method": req.CodeChallengeMethod,
+		"nonce":                 req.Nonce,
+	}
+}
+
+// AuthorizeHandler godoc
+// @Summary      Authorization endpoint
+// @Description  Authorization code flow with mandatory PKCE (S256). GET renders the login and consent page, POST submits it and redirects back to the client with a code
+// @Tags         oauth
+// @Produce      html
+// @Param        response_type query string true "Must be code"
+// @Param        client_id query string true "Client ID"
+// @Param        redirect_uri query string true "Registered redirect URI"
+// @Param        scope query string false "Space separated scopes"
+// @Param        state query string false "Opaque client state"
+// @Param        code_challenge query string true "PKCE code challenge"
+// @Param        code_challenge_method query string true "Must be S256"
+// @Param        nonce query string false "OpenID Connect nonce, echoed in the ID token"
+// @Success      200
+// @Success      302
+// @Failure      400  {object}  HTTPError
+// @Router       /authorize [get]
+// @Router       /authorize [post]
+func (h *Handler) AuthorizeHandler(writer http.ResponseWriter, request *http.Request) {
+	if request.Method != http.MethodGet && request.Method != http.MethodPost {
+		http.Error(writer, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	err := request.ParseForm()
+	if err != nil {
+		http.Error(writer, "Bad request", http.StatusBadRequest)
+		return
+	}
+
+	req := authorizationRequest(request.Form)
+	client, err := h.OAuthService.ValidateAuthorizationRequest(request.Context(), req)
+	if errors.Is(err, service.ErrInvalidClient) || errors.Is(err, service.ErrInvalidRedirectURI) {
+		http.Error(writer, "Invalid client or redirect URI", http.StatusBadRequest)
+		return
+	}
+	var protocolErr *service.ProtocolError
+	if errors.As(err, &protocolErr) {
+		redirectWithParams(writer, request, req.RedirectURI, map[string]string{
+			"error":             protocolErr.Code,
+			"error_description": protocolErr.Description,
+			"state":             req.State,
+		})
+		return
+	}
+	if err != nil {
+		http.Error(writer, "Internal error", http.StatusInternalServerError)
+		return
+	}
+
+	// Requests without a scope are granted the client's own.
+	scopes := strings.Fields(req.Scope)
+	if len(scopes) == 0 {
+		scopes = strings.Fields(client.Scope)
+	}
+	userId, authTime, loggedIn := h.browserSession(request)
+	page := authorizePage{
+		ClientName: client.Name,
+		Scopes:     scopes,
+		Action:     "/authorize",
+		Params:     authorizationParams(req),
+		LoggedIn:   loggedIn,
+	}
+
+	if request.Method == http.MethodGet {
+		renderPage(writer, http.StatusOK, authorizeTemplate, page)
+		return
+	}
+
+	if request.PostFormValue("decision") != "approve" {
+		redirectWithParams(writer, request, req.RedirectURI, map[string]string{
+			"error": "access_denied",
+			"state": req.State,
+		})
+		return
+	}
+
+	if !loggedIn {
+		userId, authTime, loggedIn = h.browserLogin(writer, request)
+		if !loggedIn {
+			page.Error = "Invalid username, password or authentication code"
+			renderPage(writer, http.StatusUnauthorized, authorizeTemplate, page)
+			return
+		}
+	}
+
+	code, err := h.OAuthService.CreateAuthorizationCode(request.Context(), req, userId, authTime)
+	if err != nil {
+		redirectWithParams(writer, request, req.RedirectURI, map[string]string{
+			"error": "server_error",
+			"state": req.State,
+		})
+		return
+	}
+	redirectWithParams(writer, request, req.RedirectURI, map[string]string{
+		"code":  code,
+		"state": req.State,
+	})
+}
+
+// browserSession identifies the user signed in to the authorization pages
+// through the access_token cookie. The token was issued at sign in, so its
+// iat is the time the user authenticated.
+func (h *Handler) browserSession(request *http.Request) (int64, time.Time, bool) {
+	cookie, err := request.Cookie("access_token")
+	if err != nil {
+		return 0, time.Time{}, false
+	}
+	claims, err := h.AuthService.AuthenticateAccessToken(request.Context(), cookie.Value)
+	if err != nil || claims.IsClient() {
+		return 0, time.Time{}, false
+	}
+	return claims.UserID, claims.IssuedAt.Time, true
+}
+
+// browserLogin signs the user in with the submitted username and password,
+// and the authentication code for users with two-factor authentication, and
+// stores the resulting token pair in cookies, which then serve as the
+// browser session for later authorization requests.
+func (h *Handler) browserLogin(writer http.ResponseWriter, request *http.Request) (int64, time.Time, bool) {
+	organization, err := h.resolveTenant(request, request.PostFormValue("organization"))
+	if err != nil {
+		return 0, time.Time{}, false
+	}
+	user := model.User{
+		Username: request.PostFormValue("username"),
+		Password: request.PostFormValue("password"),
+		OrgID:    organization.ID,
+	}
+	ip, _, _ := net.SplitHostPort(request.RemoteAddr)
+
+	userId, accessToken, refreshToken, err := h.AuthService.LoginUser(request.Context(), user, request.Header.Get("User-Agent"), ip)
+	var challenge *service.MFARequiredError
+	if errors.As(err, &challenge) {
+		userId, accessToken, refreshToken, err = h.MFAService.CompleteLogin(request.Context(), challenge.ChallengeToken, request.PostFormValue("mfa_code"), request.Header.Get("User-Agent"), ip)
+	}
+	if err != nil {
+		return 0, time.Time{}, false
+	}
+
+	http.SetCookie(writer, &http.Cookie{
+		Name:     "refresh_token",
+		Value:    refreshToken,
+		Path:     "/",
+		Expires:  time.Now().Add(7 * 24 * time.Hour),
+		HttpOnly: true,
+		Secure:   true,
+		SameSite: http.SameSiteStrictMode,
+	})
+	http.SetCookie(writer, &http.Cookie{
+		Name:     "access_token",
+		Value:    accessToken,
+		Path:     "/",
+		HttpOnly: true,
+		Secure:   true,
+		SameSite: http.SameSiteStrictMode,
+	})
+	return userId, time.Now(), true
+}
+
+func renderPage(writer http.ResponseWriter, status int, page *template.Template, data interface{}) {
+	writer.Header().Set("Content-Type", "text/html; charset=utf-8")
+	writer.Header().Set("Cache-Control", "no-store")
+	writer.Header().Set("X-Frame-Options", "DENY")
+	writer.Header().Set("Content-Security-Policy", "frame-ancestors 'none'")
+	writer.WriteHeader(status)
+	page.Execute(writer, data)
+}
+
+func redirectWithParams(writer http.ResponseWriter, request *http.Request, redirectURI string, params map[string]string) {
+	target, err := url.Parse(redirectURI)
+	if err != nil {
+		http.Error(writer, "Invalid redirect URI", http.StatusBadRequest)
+		return
+	}
+	query := target.Query()
+	for name, value := range params {
+		if value != "" {
+			query.Set(name, value)
+		}
+	}
+	target.RawQuery = query.Encode()
+	http.Redirect(writer, request, target.String(), http.StatusFound)
+}
@@ -0,0 +1,137 @@
+package handler
+
+import (
+	"encoding/json"
+	"errors"
+	"html/template"
+	"jwt-auth/service"
+	"net/http"
+)
+
+var deviceTemplate = template.Must(template.ParseFS(templates, "templates/device.html"))
+
+type devicePage struct {
+	ClientName string
+	UserCode   string
+	LoggedIn   bool
+	Error      string
+	Message    string
+}
+
+// DeviceCodeHandler godoc
+// @Summary      Device authorization
+// @Description  RFC 8628 device authorization request. Returns a device code to poll /token with and a user code to enter at the verification URI
+// @Tags         oauth
+// @Accept       x-www-form-urlencoded
+// @Produce      json
+// @Param        client_id formData string false "Client ID, unless sent with HTTP Basic auth"
+// @Success      200  {object}  model.DeviceAuthorization
+// @Failure      401  {object}  OAuthError
+// @Failure      500  {object}  OAuthError
+// @Router       /device/code [post]
+func (h *Handler) DeviceCodeHandler(writer http.ResponseWriter, request *http.Request) {
+	if request.Method != http.MethodPost {
+		http.Error(writer, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	client, ok := h.identifyClient(writer, request)
+	if !ok {
+		return
+	}
+
+	authorization, err := h.OAuthService.CreateDeviceAuthorization(request.Context(), client)
+	if err != nil {
+		writeOAuthError(writer, http.StatusInternalServerError, "server_error", "")
+		return
+	}
+	writer.Header().Set("Content-Type", "application/json")
+	writer.Header().Set("Cache-Control", "no-store")
+	writer.WriteHeader(http.StatusOK)
+	json.NewEncoder(writer).Encode(authorization)
+}
+
+// DeviceVerificationHandler godoc
+// @Summary      Device verification page
+// @Description  GET asks for the user code shown on the device and, once entered, which client it belongs to. POST approves or denies it, signing the user in if needed either way
+// @Tags         oauth
+// @Produce      html
+// @Param        user_code query string false "User code shown on the device"
+// @Success      200
+// @Failure      400
+// @Failure      401
+// @Router       /device [get]
+// @Router       /device [post]
+func (h *Handler) DeviceVerificationHandler(writer http.ResponseWriter, request *http.Request) {
+	if request.Method != http.MethodGet && request.Method != http.MethodPost {
+		http.Error(writer, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	err := request.ParseForm()
+	if err != nil {
+		http.Error(writer, "Bad request", http.StatusBadRequest)
+		return
+	}
+
+	userCode := request.Form.Get("user_code")
+	if userCode == "" {
+		renderPage(writer, http.StatusOK, deviceTemplate, devicePage{})
+		return
+	}
+
+	client, err := h.OAuthService.LookupUserCode(request.Context(), userCode)
+	if errors.Is(err, service.ErrInvalidUserCode) || errors.Is(err, service.ErrInvalidClient) {
+		renderPage(writer, http.StatusBadRequest, deviceTemplate, devicePage{
+			UserCode: userCode,
+			Error:    "This code is invalid or has expired",
+		})
+		return
+	}
+	if err != nil {
+		http.Error(writer, "Internal error", http.StatusInternalServerError)
+		return
+	}
+
+	userId, _, loggedIn := h.browserSession(request)
+	page := devicePage{
+		ClientName: client.Name,
+		UserCode:   userCode,
+		LoggedIn:   loggedIn,
+	}
+
+	if request.Method == http.MethodGet {
+		renderPage(writer, http.StatusOK, deviceTemplate, page)
+		return
+	}
+
+	// Denying needs a signed in user too, or anyone who saw the user code
+	// could cancel the device's request.
+	approve := request.PostFormValue("decision") == "approve"
+	if !loggedIn {
+		userId, _, loggedIn = h.browserLogin(writer, request)
+		if !loggedIn {
+			page.Error = "Invalid username, password or authentication code"
+			renderPage(writer, http.StatusUnauthorized, deviceTemplate, page)
+			return
+		}
+	}
+
+	err = h.OAuthService.DecideDeviceAuthorization(request.Context(), userCode, userId, approve)
+	if errors.Is(err, service.ErrInvalidUserCode) {
+		renderPage(writer, http.StatusBadRequest, deviceTemplate, devicePage{
+			UserCode: userCode,
+			Error:    "This code is invalid or has expired",
+		})
+		return
+	}
+	if err != nil {
+		http.Error(writer, "Internal error", http.StatusInternalServerError)
+		return
+	}
+
+	page.Message = "Device connected"
+	if !approve {
+		page.Message = "Request denied"
+	}
+	renderPage(writer, http.StatusOK, deviceTemplate, page)
+}
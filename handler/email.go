@@ -0,0 +1,230 @@
+package handler
+
+import (
+	"encoding/json"
+	"errors"
+	"jwt-auth/service"
+	"net"
+	"net/http"
+	"strings"
+)
+
+type ForgotPasswordRequest struct {
+	Email        string `json:"email"`
+	Organization string `json:"organization,omitempty"`
+}
+
+type AccountUnlockRequest struct {
+	Email        string `json:"email"`
+	Organization string `json:"organization,omitempty"`
+}
+
+type ResetPasswordRequest struct {
+	Token    string `json:"token"`
+	Password string `json:"password"`
+}
+
+// VerifyEmailHandler godoc
+// @Summary      Verify the caller's email
+// @Description  GET verifies the address the token of the verification link was sent to. POST, with an access token, sends a new verification link to the caller's address; earlier links stop working
+// @Tags         auth
+// @Produce      json
+// @Param        token query string false "Verification token (GET)"
+// @Param        Authorization header string false "Bearer access token (POST)"
+// @Success      200  {object}  map[string]interface{}
+// @Success      202  {object}  map[string]interface{}
+// @Failure      400  {object}  HTTPError
+// @Failure      401  {object}  HTTPError
+// @Failure      405  {object}  HTTPError
+// @Failure      409  {object}  HTTPError
+// @Failure      500  {object}  HTTPError
+// @Router       /verify-email [get]
+// @Router       /verify-email [post]
+func (h *Handler) VerifyEmailHandler(writer http.ResponseWriter, request *http.Request) {
+	switch request.Method {
+	case http.MethodGet:
+		err := h.EmailService.VerifyEmail(request.Context(), request.URL.Query().Get("token"))
+		if errors.Is(err, service.ErrInvalidEmailToken) {
+			http.Error(writer, err.Error(), http.StatusBadRequest)
+			return
+		}
+		if err != nil {
+			http.Error(writer, "Internal error", http.StatusInternalServerError)
+			return
+		}
+		writer.Header().Set("Content-Type", "application/json")
+		writer.WriteHeader(http.StatusOK)
+		json.NewEncoder(writer).Encode(map[string]interface{}{
+			"email_verified": true,
+		})
+	case http.MethodPost:
+		accessToken := strings.TrimPrefix(request.Header.Get("Authorization"), "Bearer ")
+		err := h.EmailService.RequestVerificationEmail(request.Context(), accessToken)
+		if errors.Is(err, service.ErrEmailAlreadyVerified) {
+			http.Error(writer, err.Error(), http.StatusConflict)
+			return
+		}
+		if errors.Is(err, service.ErrNoEmail) {
+			http.Error(writer, err.Error(), http.StatusBadRequest)
+			return
+		}
+		if err != nil {
+			http.Error(writer, "Access denied", http.StatusUnauthorized)
+			return
+		}
+		writer.Header().Set("Content-Type", "application/json")
+		writer.WriteHeader(http.StatusAccepted)
+		json.NewEncoder(writer).Encode(map[string]interface{}{})
+	default:
+		http.Error(writer, "Method not allowed", http.StatusMethodNotAllowed)
+	}
+}
+
+// ForgotPasswordHandler godoc
+// @Summary      Request a password reset
+// @Description  Mails a password reset token to the user of the organization with the address. The answer is the same whether or not there is one
+// @Tags         auth
+// @Accept       json
+// @Produce      json
+// @Param        forgotPasswordRequest body ForgotPasswordRequest true "Email and organization"
+// @Success      202  {object}  map[string]interface{}
+// @Failure      400  {object}  HTTPError
+// @Failure      405  {object}  HTTPError
+// @Failure      500  {object}  HTTPError
+// @Router       /password/forgot [post]
+func (h *Handler) ForgotPasswordHandler(writer http.ResponseWriter, request *http.Request) {
+	if request.Method != http.MethodPost {
+		http.Error(writer, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	var req ForgotPasswordRequest
+	err := json.NewDecoder(request.Body).Decode(&req)
+	if err != nil || req.Email == "" {
+		http.Error(writer, "Invalid JSON", http.StatusBadRequest)
+		return
+	}
+
+	organization, err := h.resolveTenant(request, req.Organization)
+	if errors.Is(err, service.ErrOrganizationNotFound) {
+		http.Error(writer, "Unknown organization", http.StatusBadRequest)
+		return
+	}
+	if err != nil {
+		http.Error(writer, "Internal error", http.StatusInternalServerError)
+		return
+	}
+
+	err = h.EmailService.ForgotPassword(request.Context(), organization.ID, req.Email)
+	if err != nil {
+		http.Error(writer, "Internal error", http.StatusInternalServerError)
+		return
+	}
+	writer.Header().Set("Content-Type", "application/json")
+	writer.WriteHeader(http.StatusAccepted)
+	json.NewEncoder(writer).Encode(map[string]interface{}{})
+}
+
+// ResetPasswordHandler godoc
+// @Summary      Reset a password
+// @Description  Sets a new password with a token from /password/forgot and signs the user out of every session. Tokens expire after an hour and work once
+// @Tags         auth
+// @Accept       json
+// @Produce      json
+// @Param        resetPasswordRequest body ResetPasswordRequest true "Reset token and new password"
+// @Success      200  {object}  map[string]interface{}
+// @Failure      400  {object}  PasswordPolicyHTTPError
+// @Failure      405  {object}  HTTPError
+// @Failure      500  {object}  HTTPError
+// @Router       /password/reset [post]
+func (h *Handler) ResetPasswordHandler(writer http.ResponseWriter, request *http.Request) {
+	if request.Method != http.MethodPost {
+		http.Error(writer, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	var req ResetPasswordRequest
+	err := json.NewDecoder(request.Body).Decode(&req)
+	if err != nil {
+		http.Error(writer, "Invalid JSON", http.StatusBadRequest)
+		return
+	}
+
+	ip, _, _ := net.SplitHostPort(request.RemoteAddr)
+	err = h.EmailService.ResetPassword(request.Context(), req.Token, req.Password, ip)
+	if writePasswordPolicyError(writer, err) {
+		return
+	}
+	if errors.Is(err, service.ErrInvalidEmailToken) {
+		http.Error(writer, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if err != nil {
+		http.Error(writer, "Internal error", http.StatusInternalServerError)
+		return
+	}
+	writer.Header().Set("Content-Type", "application/json")
+	writer.WriteHeader(http.StatusOK)
+	json.NewEncoder(writer).Encode(map[string]interface{}{})
+}
+
+// AccountUnlockHandler godoc
+// @Summary      Unlock an account
+// @Description  POST mails an unlock link to the user of the organization with the address; the answer is the same whether or not there is one. GET, with the token of the link, clears the failed logins of the account. Tokens expire after an hour and work once
+// @Tags         auth
+// @Accept       json
+// @Produce      json
+// @Param        token query string false "Unlock token (GET)"
+// @Param        accountUnlockRequest body AccountUnlockRequest false "Email and organization (POST)"
+// @Success      200  {object}  map[string]interface{}
+// @Success      202  {object}  map[string]interface{}
+// @Failure      400  {object}  HTTPError
+// @Failure      405  {object}  HTTPError
+// @Failure      500  {object}  HTTPError
+// @Router       /account/unlock [get]
+// @Router       /account/unlock [post]
+func (h *Handler) AccountUnlockHandler(writer http.ResponseWriter, request *http.Request) {
+	switch request.Method {
+	case http.MethodGet:
+		err := h.EmailService.UnlockAccount(request.Context(), request.URL.Query().Get("token"))
+		if errors.Is(err, service.ErrInvalidEmailToken) {
+			http.Error(writer, err.Error(), http.StatusBadRequest)
+			return
+		}
+		if err != nil {
+			http.Error(writer, "Internal error", http.StatusInternalServerError)
+			return
+		}
+		writer.Header().Set("Content-Type", "application/json")
+		writer.WriteHeader(http.StatusOK)
+		json.NewEncoder(writer).Encode(map[string]interface{}{})
+	case http.MethodPost:
+		var req AccountUnlockRequest
+		err := json.NewDecoder(request.Body).Decode(&req)
+		if err != nil || req.Email == "" {
+			http.Error(writer, "Invalid JSON", http.StatusBadRequest)
+			return
+		}
+
+		organization, err := h.resolveTenant(request, req.Organization)
+		if errors.Is(err, service.ErrOrganizationNotFound) {
+			http.Error(writer, "Unknown organization", http.StatusBadRequest)
+			return
+		}
+		if err != nil {
+			http.Error(writer, "Internal error", http.StatusInternalServerError)
+			return
+		}
+
+		err = h.EmailService.RequestAccountUnlock(request.Context(), organization.ID, req.Email)
+		if err != nil {
+			http.Error(writer, "Internal error", http.StatusInternalServerError)
+			return
+		}
+		writer.Header().Set("Content-Type", "application/json")
+		writer.WriteHeader(http.StatusAccepted)
+		json.NewEncoder(writer).Encode(map[string]interface{}{})
+	default:
+		http.Error(writer, "Method not allowed", http.StatusMethodNotAllowed)
+	}
+}
@@ -0,0 +1,264 @@
+package handler
+
+import (
+	"encoding/json"
+	"errors"
+	"jwt-auth/service"
+	"net/http"
+	"strconv"
+)
+
+type GroupRequest struct {
+	Name string `json:"name"`
+}
+
+// GroupsHandler godoc
+// @Summary      List or create groups
+// @Description  GET lists the groups with their direct members and roles. POST creates an empty group
+// @Tags         admin
+// @Accept       json
+// @Produce      json
+// @Param        X-Admin-Key header string true "Admin API key"
+// @Param        groupRequest body GroupRequest false "Group name"
+// @Success      200  {array}   model.Group
+// @Success      201  {object}  model.Group
+// @Failure      400  {object}  HTTPError
+// @Failure      401  {object}  HTTPError
+// @Failure      403  {object}  HTTPError
+// @Failure      409  {object}  HTTPError
+// @Failure      500  {object}  HTTPError
+// @Router       /admin/groups [get]
+// @Router       /admin/groups [post]
+func (h *Handler) GroupsHandler(writer http.ResponseWriter, request *http.Request) {
+	if request.Method != http.MethodGet && request.Method != http.MethodPost {
+		http.Error(writer, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	if !h.requireAdmin(writer, request) {
+		return
+	}
+
+	if request.Method == http.MethodGet {
+		groups, err := h.GroupService.ListGroups(request.Context())
+		if err != nil {
+			http.Error(writer, "Internal error", http.StatusInternalServerError)
+			return
+		}
+		writer.Header().Set("Content-Type", "application/json")
+		writer.WriteHeader(http.StatusOK)
+		json.NewEncoder(writer).Encode(groups)
+		return
+	}
+
+	var req GroupRequest
+	err := json.NewDecoder(request.Body).Decode(&req)
+	if err != nil {
+		http.Error(writer, "Invalid JSON", http.StatusBadRequest)
+		return
+	}
+	group, err := h.GroupService.CreateGroup(request.Context(), req.Name)
+	if errors.Is(err, service.ErrInvalidGroupName) {
+		http.Error(writer, "Invalid group name", http.StatusBadRequest)
+		return
+	}
+	if errors.Is(err, service.ErrGroupExists) {
+		http.Error(writer, "Group already exists", http.StatusConflict)
+		return
+	}
+	if err != nil {
+		http.Error(writer, "Internal error", http.StatusInternalServerError)
+		return
+	}
+	writer.Header().Set("Content-Type", "application/json")
+	writer.WriteHeader(http.StatusCreated)
+	json.NewEncoder(writer).Encode(group)
+}
+
+// GroupHandler godoc
+// @Summary      Inspect or delete a group
+// @Description  GET returns a group with its direct members and roles. DELETE removes the group; its members lose the roles they inherited through it
+// @Tags         admin
+// @Produce      json
+// @Param        X-Admin-Key header string true "Admin API key"
+// @Param        name path string true "Group name"
+// @Success      200  {object}  model.Group
+// @Failure      401  {object}  HTTPError
+// @Failure      403  {object}  HTTPError
+// @Failure      404  {object}  HTTPError
+// @Failure      500  {object}  HTTPError
+// @Router       /admin/groups/{name} [get]
+// @Router       /admin/groups/{name} [delete]
+func (h *Handler) GroupHandler(writer http.ResponseWriter, request *http.Request) {
+	if request.Method != http.MethodGet && request.Method != http.MethodDelete {
+		http.Error(writer, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	if !h.requireAdmin(writer, request) {
+		return
+	}
+	name := request.PathValue("name")
+
+	if request.Method == http.MethodDelete {
+		err := h.GroupService.DeleteGroup(request.Context(), name)
+		if errors.Is(err, service.ErrGroupNotFound) {
+			http.Error(writer, "Group not found", http.StatusNotFound)
+			return
+		}
+		if err != nil {
+			http.Error(writer, "Internal error", http.StatusInternalServerError)
+			return
+		}
+		writer.Header().Set("Content-Type", "application/json")
+		writer.WriteHeader(http.StatusOK)
+		json.NewEncoder(writer).Encode(map[string]interface{}{})
+		return
+	}
+
+	group, err := h.GroupService.GetGroup(request.Context(), name)
+	if errors.Is(err, service.ErrGroupNotFound) {
+		http.Error(writer, "Group not found", http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		http.Error(writer, "Internal error", http.StatusInternalServerError)
+		return
+	}
+	writer.Header().Set("Content-Type", "application/json")
+	writer.WriteHeader(http.StatusOK)
+	json.NewEncoder(writer).Encode(group)
+}
+
+// GroupUserHandler godoc
+// @Summary      Add or remove a user
+// @Description  PUT adds the user to the group, DELETE removes them. The change shows up in the user's next access token
+// @Tags         admin
+// @Produce      json
+// @Param        X-Admin-Key header string true "Admin API key"
+// @Param        name path string true "Group name"
+// @Param        id path int true "User ID"
+// @Success      200  {object}  map[string]interface{}
+// @Failure      400  {object}  HTTPError
+// @Failure      401  {object}  HTTPError
+// @Failure      403  {object}  HTTPError
+// @Failure      404  {object}  HTTPError
+// @Failure      500  {object}  HTTPError
+// @Router       /admin/groups/{name}/users/{id} [put]
+// @Router       /admin/groups/{name}/users/{id} [delete]
+func (h *Handler) GroupUserHandler(writer http.ResponseWriter, request *http.Request) {
+	if request.Method != http.MethodPut && request.Method != http.MethodDelete {
+		http.Error(writer, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	if !h.requireAdmin(writer, request) {
+		return
+	}
+
+	userId, err := strconv.ParseInt(request.PathValue("id"), 10, 64)
+	if err != nil {
+		http.Error(writer, "Invalid user ID", http.StatusBadRequest)
+		return
+	}
+
+	name := request.PathValue("name")
+	if request.Method == http.MethodPut {
+		err = h.GroupService.AddUser(request.Context(), name, userId)
+	} else {
+		err = h.GroupService.RemoveUser(request.Context(), name, userId)
+	}
+	writeGroupMembershipResult(writer, err)
+}
+
+// GroupSubgroupHandler godoc
+// @Summary      Add or remove a member group
+// @Description  PUT makes the member group part of the group, so its users inherit the group's roles. Memberships that would make a group contain itself are rejected. DELETE removes the member group
+// @Tags         admin
+// @Produce      json
+// @Param        X-Admin-Key header string true "Admin API key"
+// @Param        name path string true "Group name"
+// @Param        member path string true "Member group name"
+// @Success      200  {object}  map[string]interface{}
+// @Failure      401  {object}  HTTPError
+// @Failure      403  {object}  HTTPError
+// @Failure      404  {object}  HTTPError
+// @Failure      409  {object}  HTTPError
+// @Failure      500  {object}  HTTPError
+// @Router       /admin/groups/{name}/groups/{member} [put]
+// @Router       /admin/groups/{name}/groups/{member} [delete]
+func (h *Handler) GroupSubgroupHandler(writer http.ResponseWriter, request *http.Request) {
+	if request.Method != http.MethodPut && request.Method != http.MethodDelete {
+		http.Error(writer, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	if !h.requireAdmin(writer, request) {
+		return
+	}
+
+	var err error
+	name, member := request.PathValue("name"), request.PathValue("member")
+	if request.Method == http.MethodPut {
+		err = h.GroupService.AddSubgroup(request.Context(), name, member)
+	} else {
+		err = h.GroupService.RemoveSubgroup(request.Context(), name, member)
+	}
+	writeGroupMembershipResult(writer, err)
+}
+
+// GroupRoleHandler godoc
+// @Summary      Assign or unassign a group role
+// @Description  PUT assigns the role to the group, DELETE takes it away. Every user in the group or its member groups sees the change in their next access token
+// @Tags         admin
+// @Produce      json
+// @Param        X-Admin-Key header string true "Admin API key"
+// @Param        name path string true "Group name"
+// @Param        role path string true "Role name"
+// @Success      200  {object}  map[string]interface{}
+// @Failure      401  {object}  HTTPError
+// @Failure      403  {object}  HTTPError
+// @Failure      404  {object}  HTTPError
+// @Failure      500  {object}  HTTPError
+// @Router       /admin/groups/{name}/roles/{role} [put]
+// @Router       /admin/groups/{name}/roles/{role} [delete]
+func (h *Handler) GroupRoleHandler(writer http.ResponseWriter, request *http.Request) {
+	if request.Method != http.MethodPut && request.Method != http.MethodDelete {
+		http.Error(writer, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	if !h.requireAdmin(writer, request) {
+		return
+	}
+
+	var err error
+	name, role := request.PathValue("name"), request.PathValue("role")
+	if request.Method == http.MethodPut {
+		err = h.GroupService.AssignRole(request.Context(), name, role)
+	} else {
+		err = h.GroupService.UnassignRole(request.Context(), name, role)
+	}
+	writeGroupMembershipResult(writer, err)
+}
+
+func writeGroupMembershipResult(writer http.ResponseWriter, err error) {
+	if errors.Is(err, service.ErrGroupNotFound) {
+		http.Error(writer, "Group not found", http.StatusNotFound)
+		return
+	}
+	if errors.Is(err, service.ErrUserNotFound) {
+		http.Error(writer, "User not found", http.StatusNotFound)
+		return
+	}
+	if errors.Is(err, service.ErrRoleNotFound) {
+		http.Error(writer, "Role not found", http.StatusNotFound)
+		return
+	}
+	if errors.Is(err, service.ErrGroupCycle) {
+		http.Error(writer, "Group membership would create a cycle", http.StatusConflict)
+		return
+	}
+	if err != nil {
+		http.Error(writer, "Internal error", http.StatusInternalServerError)
+		return
+	}
+	writer.Header().Set("Content-Type", "application/json")
+	writer.WriteHeader(http.StatusOK)
+	json.NewEncoder(writer).Encode(map[string]interface{}{})
+}
@@ -0,0 +1,222 @@
+package handler
+
+import (
+	"encoding/json"
+	"errors"
+	"jwt-auth/service"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+type MFALoginRequest struct {
+	MFAToken string `json:"mfa_token"`
+	// Code is a TOTP code or a recovery code.
+	Code string `json:"code"`
+}
+
+type MFACodeRequest struct {
+	Code string `json:"code"`
+}
+
+// MFALoginHandler godoc
+// @Summary      Complete a two-factor login
+// @Description  Exchanges the mfa_token returned by /login and a TOTP code or recovery code for access and refresh tokens. Recovery codes are used up. Wrong codes count as failed logins of the account
+// @Tags         auth
+// @Accept       json
+// @Produce      json
+// @Param        mfaLoginRequest body MFALoginRequest true "Challenge and code"
+// @Success      200  {object}  map[string]interface{}
+// @Failure      400  {object}  HTTPError
+// @Failure      401  {object}  HTTPError
+// @Failure      405  {object}  HTTPError
+// @Failure      429  {object}  HTTPError
+// @Router       /login/mfa [post]
+func (h *Handler) MFALoginHandler(writer http.ResponseWriter, request *http.Request) {
+	if request.Method != http.MethodPost {
+		http.Error(writer, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	var req MFALoginRequest
+	err := json.NewDecoder(request.Body).Decode(&req)
+	if err != nil {
+		http.Error(writer, "Invalid JSON", http.StatusBadRequest)
+		return
+	}
+
+	ip, _, _ := net.SplitHostPort(request.RemoteAddr)
+	userId, accessToken, refreshToken, err := h.MFAService.CompleteLogin(request.Context(), req.MFAToken, req.Code, request.Header.Get("User-Agent"), ip)
+	if writeLoginThrottled(writer, err) {
+		return
+	}
+	if errors.Is(err, service.ErrInvalidMFAChallenge) {
+		http.Error(writer, "Invalid or expired MFA token", http.StatusUnauthorized)
+		return
+	}
+	if err != nil {
+		http.Error(writer, "Invalid authentication code", http.StatusUnauthorized)
+		return
+	}
+
+	writeLogin(writer, userId, accessToken, refreshToken)
+}
+
+// TOTPEnrollmentHandler godoc
+// @Summary      Enroll a TOTP authenticator
+// @Description  Generates a TOTP secret for the caller, returned as is and as an otpauth:// URI. Two-factor authentication is enabled once /mfa/totp/confirm is given a code from it
+// @Tags         mfa
+// @Produce      json
+// @Param        Authorization header string true "Bearer access token"
+// @Success      200  {object}  model.TOTPEnrollment
+// @Failure      401  {object}  HTTPError
+// @Failure      405  {object}  HTTPError
+// @Failure      409  {object}  HTTPError
+// @Router       /mfa/totp [post]
+func (h *Handler) TOTPEnrollmentHandler(writer http.ResponseWriter, request *http.Request) {
+	if request.Method != http.MethodPost {
+		http.Error(writer, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	accessToken := strings.TrimPrefix(request.Header.Get("Authorization"), "Bearer ")
+
+	enrollment, err := h.MFAService.EnrollTOTP(request.Context(), accessToken)
+	if errors.Is(err, service.ErrMFAAlreadyEnabled) {
+		http.Error(writer, err.Error(), http.StatusConflict)
+		return
+	}
+	if err != nil {
+		http.Error(writer, "Access denied", http.StatusUnauthorized)
+		return
+	}
+	writer.Header().Set("Content-Type", "application/json")
+	writer.Header().Set("Cache-Control", "no-store")
+	writer.WriteHeader(http.StatusOK)
+	json.NewEncoder(writer).Encode(enrollment)
+}
+
+// TOTPConfirmHandler godoc
+// @Summary      Confirm a TOTP authenticator
+// @Description  Enables two-factor authentication given a code from the enrolled secret, and returns single-use recovery codes, which are only shown once
+// @Tags         mfa
+// @Accept       json
+// @Produce      json
+// @Param        Authorization header string true "Bearer access token"
+// @Param        mfaCodeRequest body MFACodeRequest true "TOTP code"
+// @Success      200  {object}  map[string]interface{}
+// @Failure      400  {object}  HTTPError
+// @Failure      401  {object}  HTTPError
+// @Failure      405  {object}  HTTPError
+// @Failure      409  {object}  HTTPError
+// @Router       /mfa/totp/confirm [post]
+func (h *Handler) TOTPConfirmHandler(writer http.ResponseWriter, request *http.Request) {
+	if request.Method != http.MethodPost {
+		http.Error(writer, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	accessToken := strings.TrimPrefix(request.Header.Get("Authorization"), "Bearer ")
+
+	var req MFACodeRequest
+	err := json.NewDecoder(request.Body).Decode(&req)
+	if err != nil {
+		http.Error(writer, "Invalid JSON", http.StatusBadRequest)
+		return
+	}
+	codes, err := h.MFAService.ConfirmTOTP(request.Context(), accessToken, req.Code)
+	writeRecoveryCodes(writer, codes, err)
+}
+
+// RecoveryCodesHandler godoc
+// @Summary      Regenerate recovery codes
+// @Description  Replaces the caller's recovery codes given a current TOTP code
+// @Tags         mfa
+// @Accept       json
+// @Produce      json
+// @Param        Authorization header string true "Bearer access token"
+// @Param        mfaCodeRequest body MFACodeRequest true "TOTP code"
+// @Success      200  {object}  map[string]interface{}
+// @Failure      400  {object}  HTTPError
+// @Failure      401  {object}  HTTPError
+// @Failure      405  {object}  HTTPError
+// @Failure      409  {object}  HTTPError
+// @Router       /mfa/recovery_codes [post]
+func (h *Handler) RecoveryCodesHandler(writer http.ResponseWriter, request *http.Request) {
+	if request.Method != http.MethodPost {
+		http.Error(writer, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	accessToken := strings.TrimPrefix(request.Header.Get("Authorization"), "Bearer ")
+
+	var req MFACodeRequest
+	err := json.NewDecoder(request.Body).Decode(&req)
+	if err != nil {
+		http.Error(writer, "Invalid JSON", http.StatusBadRequest)
+		return
+	}
+	codes, err := h.MFAService.RegenerateRecoveryCodes(request.Context(), accessToken, req.Code)
+	writeRecoveryCodes(writer, codes, err)
+}
+
+func writeRecoveryCodes(writer http.ResponseWriter, codes []string, err error) {
+	if errors.Is(err, service.ErrInvalidMFACode) {
+		http.Error(writer, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if errors.Is(err, service.ErrMFAAlreadyEnabled) || errors.Is(err, service.ErrMFANotEnrolled) {
+		http.Error(writer, err.Error(), http.StatusConflict)
+		return
+	}
+	if err != nil {
+		http.Error(writer, "Access denied", http.StatusUnauthorized)
+		return
+	}
+	writer.Header().Set("Content-Type", "application/json")
+	writer.Header().Set("Cache-Control", "no-store")
+	writer.WriteHeader(http.StatusOK)
+	json.NewEncoder(writer).Encode(map[string]interface{}{
+		"recovery_codes": codes,
+	})
+}
+
+// ResetMFAHandler godoc
+// @Summary      Reset a user's two-factor authentication
+// @Description  Removes the user's authenticator and recovery codes, so that they sign in with their password alone until they enroll again
+// @Tags         admin
+// @Produce      json
+// @Param        X-Admin-Key header string true "Admin API key"
+// @Param        id path int true "User ID"
+// @Success      200  {object}  map[string]interface{}
+// @Failure      400  {object}  HTTPError
+// @Failure      401  {object}  HTTPError
+// @Failure      403  {object}  HTTPError
+// @Failure      404  {object}  HTTPError
+// @Failure      500  {object}  HTTPError
+// @Router       /admin/users/{id}/mfa [delete]
+func (h *Handler) ResetMFAHandler(writer http.ResponseWriter, request *http.Request) {
+	if request.Method != http.MethodDelete {
+		http.Error(writer, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	if !h.requireAdmin(writer, request) {
+		return
+	}
+
+	userId, err := strconv.ParseInt(request.PathValue("id"), 10, 64)
+	if err != nil {
+		http.Error(writer, "Invalid user ID", http.StatusBadRequest)
+		return
+	}
+	err = h.MFAService.ResetMFA(request.Context(), userId)
+	if errors.Is(err, service.ErrUserNotFound) {
+		http.Error(writer, "User not found", http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		http.Error(writer, "Internal error", http.StatusInternalServerError)
+		return
+	}
+	writer.Header().Set("Content-Type", "application/json")
+	writer.WriteHeader(http.StatusOK)
+	json.NewEncoder(writer).Encode(map[string]interface{}{})
+}
@@ -0,0 +1,242 @@
+package handler
+
+import (
+	"encoding/json"
+	"errors"
+	"jwt-auth/model"
+	"jwt-auth/service"
+	"net"
+	"net/http"
+	"net/url"
+)
+
+type OAuthError struct {
+	Error            string `json:"error" example:"invalid_request"`
+	ErrorDescription string `json:"error_description,omitempty"`
+}
+
+// writeOAuthError writes the JSON error body defined by RFC 6749 section 5.2.
+func writeOAuthError(writer http.ResponseWriter, status int, code, description string) {
+	if status == http.StatusUnauthorized {
+		writer.Header().Set("WWW-Authenticate", `Basic realm="oauth"`)
+	}
+	writer.Header().Set("Content-Type", "application/json")
+	writer.Header().Set("Cache-Control", "no-store")
+	writer.WriteHeader(status)
+	json.NewEncoder(writer).Encode(OAuthError{
+		Error:            code,
+		ErrorDescription: description,
+	})
+}
+
+// clientCredentials reads the client credentials from HTTP Basic auth or,
+// failing that, from the client_id and client_secret form fields.
+func clientCredentials(request *http.Request) (string, string, bool) {
+	if clientID, clientSecret, ok := request.BasicAuth(); ok {
+		clientID, err := url.QueryUnescape(clientID)
+		if err != nil {
+			return "", "", false
+		}
+		clientSecret, err = url.QueryUnescape(clientSecret)
+		if err != nil {
+			return "", "", false
+		}
+		return clientID, clientSecret, true
+	}
+	clientID := request.PostFormValue("client_id")
+	if clientID == "" {
+		return "", "", false
+	}
+	return clientID, request.PostFormValue("client_secret"), true
+}
+
+// IntrospectHandler godoc
+// @Summary      Token introspection
+// @Description  RFC 7662 introspection of access tokens, refresh tokens and personal access tokens, for authenticated clients
+// @Tags         oauth
+// @Accept       x-www-form-urlencoded
+// @Produce      json
+// @Param        token formData string true "Access token, refresh token or personal access token"
+// @Param        token_type_hint formData string false "access_token or refresh_token"
+// @Success      200  {object}  model.Introspection
+// @Failure      400  {object}  OAuthError
+// @Failure      401  {object}  OAuthError
+// @Router       /introspect [post]
+func (h *Handler) IntrospectHandler(writer http.ResponseWriter, request *http.Request) {
+	if request.Method != http.MethodPost {
+		http.Error(writer, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	clientID, clientSecret, ok := clientCredentials(request)
+	if !ok {
+		writeOAuthError(writer, http.StatusUnauthorized, "invalid_client", "Client authentication required")
+		return
+	}
+	_, err := h.ClientService.AuthenticateClient(request.Context(), clientID, clientSecret)
+	if err != nil {
+		writeOAuthError(writer, http.StatusUnauthorized, "invalid_client", "Client authentication failed")
+		return
+	}
+
+	token := request.PostFormValue("token")
+	if token == "" {
+		writeOAuthError(writer, http.StatusBadRequest, "invalid_request", "Missing token")
+		return
+	}
+
+	introspection := h.AuthService.IntrospectToken(request.Context(), token, request.PostFormValue("token_type_hint"))
+	writer.Header().Set("Content-Type", "application/json")
+	writer.Header().Set("Cache-Control", "no-store")
+	writer.WriteHeader(http.StatusOK)
+	json.NewEncoder(writer).Encode(introspection)
+}
+
+// RevokeHandler godoc
+// @Summary      Token revocation
+// @Description  RFC 7009 revocation of refresh tokens and access tokens issued to the calling client or to no client. Confidential clients authenticate, public clients identify themselves with client_id. Responds 200 whether or not the token was valid or issued to the client
+// @Tags         oauth
+// @Accept       x-www-form-urlencoded
+// @Produce      json
+// @Param        token formData string true "Access token or refresh token"
+// @Param        token_type_hint formData string false "access_token or refresh_token"
+// @Success      200  {object}  map[string]interface{}
+// @Failure      400  {object}  OAuthError
+// @Failure      401  {object}  OAuthError
+// @Failure      500  {object}  OAuthError
+// @Router       /revoke [post]
+func (h *Handler) RevokeHandler(writer http.ResponseWriter, request *http.Request) {
+	if request.Method != http.MethodPost {
+		http.Error(writer, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	client, ok := h.identifyClient(writer, request)
+	if !ok {
+		return
+	}
+
+	token := request.PostFormValue("token")
+	if token == "" {
+		writeOAuthError(writer, http.StatusBadRequest, "invalid_request", "Missing token")
+		return
+	}
+
+	err := h.AuthService.RevokeToken(request.Context(), client, token, request.PostFormValue("token_type_hint"))
+	if err != nil {
+		writeOAuthError(writer, http.StatusInternalServerError, "server_error", "")
+		return
+	}
+	writer.Header().Set("Content-Type", "application/json")
+	writer.Header().Set("Cache-Control", "no-store")
+	writer.WriteHeader(http.StatusOK)
+	json.NewEncoder(writer).Encode(map[string]interface{}{})
+}
+
+// identifyClient authenticates confidential clients and accepts a bare
+// client_id from public ones, writing the error response on failure.
+func (h *Handler) identifyClient(writer http.ResponseWriter, request *http.Request) (model.Client, bool) {
+	clientID, clientSecret, ok := clientCredentials(request)
+	if !ok {
+		writeOAuthError(writer, http.StatusUnauthorized, "invalid_client", "Client identification required")
+		return model.Client{}, false
+	}
+	if clientSecret != "" {
+		client, err := h.ClientService.AuthenticateClient(request.Context(), clientID, clientSecret)
+		if err != nil {
+			writeOAuthError(writer, http.StatusUnauthorized, "invalid_client", "Client authentication failed")
+			return model.Client{}, false
+		}
+		return client, true
+	}
+	client, err := h.ClientService.GetClient(request.Context(), clientID)
+	if err != nil || client.Confidential {
+		writeOAuthError(writer, http.StatusUnauthorized, "invalid_client", "Client authentication failed")
+		return model.Client{}, false
+	}
+	return client, true
+}
+
+// TokenHandler godoc
+// @Summary      Token endpoint
+// @Description  Exchanges an authorization code (with its PKCE code_verifier), a refresh token or an approved device code for a new token pair, or issues a confidential client a token of its own with client_credentials. With token-exchange a confidential client trades a user's access token for a short-lived token bound to another service (audience) with a narrower scope. Devices poll with the device_code grant and get authorization_pending or slow_down until the user decides
+// @Tags         oauth
+// @Accept       x-www-form-urlencoded
+// @Produce      json
+// @Param        grant_type formData string true "authorization_code, refresh_token, client_credentials, urn:ietf:params:oauth:grant-type:device_code or urn:ietf:params:oauth:grant-type:token-exchange"
+// @Param        code formData string false "Authorization code"
+// @Param        redirect_uri formData string false "Redirect URI used for the authorization request"
+// @Param        code_verifier formData string false "PKCE code verifier"
+// @Param        refresh_token formData string false "Refresh token"
+// @Param        device_code formData string false "Device code"
+// @Param        subject_token formData string false "Access token to exchange"
+// @Param        subject_token_type formData string false "urn:ietf:params:oauth:token-type:access_token"
+// @Param        audience formData string false "Client ID of the service the exchanged token is for"
+// @Param        scope formData string false "Narrower scope for the refreshed access token, or the scope requested by the client"
+// @Param        client_id formData string false "Client ID, unless sent with HTTP Basic auth"
+// @Success      200  {object}  model.TokenResponse
+// @Failure      400  {object}  OAuthError
+// @Failure      401  {object}  OAuthError
+// @Failure      500  {object}  OAuthError
+// @Router       /token [post]
+func (h *Handler) TokenHandler(writer http.ResponseWriter, request *http.Request) {
+	if request.Method != http.MethodPost {
+		http.Error(writer, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	client, ok := h.identifyClient(writer, request)
+	if !ok {
+		return
+	}
+
+	ip, _, _ := net.SplitHostPort(request.RemoteAddr)
+	userAgent := request.Header.Get("User-Agent")
+
+	var response model.TokenResponse
+	var err error
+	switch request.PostFormValue("grant_type") {
+	case "authorization_code":
+		response, err = h.OAuthService.ExchangeAuthorizationCode(
+			request.Context(), client,
+			request.PostFormValue("code"), request.PostFormValue("redirect_uri"), request.PostFormValue("code_verifier"),
+			userAgent, ip,
+		)
+	case "refresh_token":
+		response, err = h.OAuthService.RefreshClientTokens(
+			request.Context(), client,
+			request.PostFormValue("refresh_token"), request.PostFormValue("scope"),
+			userAgent, ip,
+		)
+	case "client_credentials":
+		response, err = h.OAuthService.ClientCredentials(request.Context(), client, request.PostFormValue("scope"))
+	case service.DeviceCodeGrantType:
+		response, err = h.OAuthService.PollDeviceToken(request.Context(), client, request.PostFormValue("device_code"), userAgent, ip)
+	case service.TokenExchangeGrantType:
+		response, err = h.OAuthService.ExchangeToken(request.Context(), client, model.TokenExchangeRequest{
+			SubjectToken:       request.PostFormValue("subject_token"),
+			SubjectTokenType:   request.PostFormValue("subject_token_type"),
+			RequestedTokenType: request.PostFormValue("requested_token_type"),
+			Audience:           request.PostFormValue("audience"),
+			Scope:              request.PostFormValue("scope"),
+		})
+	default:
+		writeOAuthError(writer, http.StatusBadRequest, "unsupported_grant_type", "")
+		return
+	}
+
+	var protocolErr *service.ProtocolError
+	if errors.As(err, &protocolErr) {
+		writeOAuthError(writer, http.StatusBadRequest, protocolErr.Code, protocolErr.Description)
+		return
+	}
+	if err != nil {
+		writeOAuthError(writer, http.StatusInternalServerError, "server_error", "")
+		return
+	}
+
+	writer.Header().Set("Content-Type", "application/json")
+	writer.Header().Set("Cache-Control", "no-store")
+	writer.WriteHeader(http.StatusOK)
+	json.NewEncoder(writer).Encode(response)
+}
@@ -0,0 +1,70 @@
+package handler
+
+import (
+	"encoding/json"
+	"errors"
+	"jwt-auth/service"
+	"net/http"
+	"strings"
+)
+
+// OpenIDConfigurationHandler godoc
+// @Summary      OpenID Connect discovery
+// @Description  Publishes the OpenID Provider metadata
+// @Tags         oidc
+// @Produce      json
+// @Success      200  {object}  model.OpenIDConfiguration
+// @Failure      405  {object}  HTTPError
+// @Failure      500  {object}  HTTPError
+// @Router       /.well-known/openid-configuration [get]
+func (h *Handler) OpenIDConfigurationHandler(writer http.ResponseWriter, request *http.Request) {
+	if request.Method != http.MethodGet {
+		http.Error(writer, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	configuration, err := h.OAuthService.OpenIDConfiguration()
+	if err != nil {
+		http.Error(writer, "Internal error", http.StatusInternalServerError)
+		return
+	}
+	writer.Header().Set("Content-Type", "application/json")
+	writer.Header().Set("Cache-Control", "public, max-age=300")
+	writer.WriteHeader(http.StatusOK)
+	json.NewEncoder(writer).Encode(configuration)
+}
+
+// UserInfoHandler godoc
+// @Summary      OpenID Connect userinfo
+// @Description  Returns the claims of the user the access token in the Authorization header was issued for, limited to its openid, profile and email scopes
+// @Tags         oidc
+// @Produce      json
+// @Success      200  {object}  model.UserInfo
+// @Failure      401  {object}  HTTPError
+// @Failure      403  {object}  HTTPError
+// @Failure      405  {object}  HTTPError
+// @Router       /userinfo [get]
+// @Router       /userinfo [post]
+func (h *Handler) UserInfoHandler(writer http.ResponseWriter, request *http.Request) {
+	if request.Method != http.MethodGet && request.Method != http.MethodPost {
+		http.Error(writer, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	accessTokenHeader := request.Header.Get("Authorization")
+	accessToken := strings.TrimPrefix(accessTokenHeader, "Bearer ")
+
+	userInfo, err := h.OAuthService.UserInfo(request.Context(), accessToken)
+	if errors.Is(err, service.ErrInsufficientScope) {
+		writer.Header().Set("WWW-Authenticate", `Bearer error="insufficient_scope", scope="openid"`)
+		http.Error(writer, "Insufficient scope", http.StatusForbidden)
+		return
+	}
+	if err != nil {
+		writer.Header().Set("WWW-Authenticate", `Bearer error="invalid_token"`)
+		http.Error(writer, "Access denied", http.StatusUnauthorized)
+		return
+	}
+	writer.Header().Set("Content-Type", "application/json")
+	writer.Header().Set("Cache-Control", "no-store")
+	writer.WriteHeader(http.StatusOK)
+	json.NewEncoder(writer).Encode(userInfo)
+}
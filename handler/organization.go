@@ -0,0 +1,237 @@
+package handler
+
+import (
+	"encoding/json"
+	"errors"
+	"jwt-auth/model"
+	"jwt-auth/service"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+type OrganizationRequest struct {
+	Slug string `json:"slug"`
+	Name string `json:"name"`
+}
+
+type MemberRoleRequest struct {
+	Role string `json:"role" example:"admin"`
+}
+
+// resolveTenant picks the organization a sign in or registration is for: the
+// one named in the request, else the one whose slug is the first label of
+// the host name, else the default organization.
+func (h *Handler) resolveTenant(request *http.Request, slug string) (model.Organization, error) {
+	if slug != "" {
+		return h.OrganizationService.ResolveOrganization(request.Context(), slug)
+	}
+
+	host := request.Host
+	if hostname, _, err := net.SplitHostPort(host); err == nil {
+		host = hostname
+	}
+	if label, _, found := strings.Cut(host, "."); found {
+		organization, err := h.OrganizationService.ResolveOrganization(request.Context(), strings.ToLower(label))
+		if err == nil {
+			return organization, nil
+		}
+		if !errors.Is(err, service.ErrOrganizationNotFound) {
+			return model.Organization{}, err
+		}
+	}
+	return h.OrganizationService.ResolveOrganization(request.Context(), service.DefaultOrganization)
+}
+
+// OrganizationsHandler godoc
+// @Summary      List or create organizations
+// @Description  GET lists the organizations. POST creates one; its slug can be sent as the organization field at sign in or used as the first label of the host name
+// @Tags         admin
+// @Accept       json
+// @Produce      json
+// @Param        X-Admin-Key header string true "Admin API key"
+// @Param        organizationRequest body OrganizationRequest false "Organization slug and name"
+// @Success      200  {array}   model.Organization
+// @Success      201  {object}  model.Organization
+// @Failure      400  {object}  HTTPError
+// @Failure      401  {object}  HTTPError
+// @Failure      403  {object}  HTTPError
+// @Failure      409  {object}  HTTPError
+// @Failure      500  {object}  HTTPError
+// @Router       /admin/organizations [get]
+// @Router       /admin/organizations [post]
+func (h *Handler) OrganizationsHandler(writer http.ResponseWriter, request *http.Request) {
+	if request.Method != http.MethodGet && request.Method != http.MethodPost {
+		http.Error(writer, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	if !h.requireAdmin(writer, request) {
+		return
+	}
+
+	if request.Method == http.MethodGet {
+		organizations, err := h.OrganizationService.ListOrganizations(request.Context())
+		if err != nil {
+			http.Error(writer, "Internal error", http.StatusInternalServerError)
+			return
+		}
+		writer.Header().Set("Content-Type", "application/json")
+		writer.WriteHeader(http.StatusOK)
+		json.NewEncoder(writer).Encode(organizations)
+		return
+	}
+
+	var req OrganizationRequest
+	err := json.NewDecoder(request.Body).Decode(&req)
+	if err != nil {
+		http.Error(writer, "Invalid JSON", http.StatusBadRequest)
+		return
+	}
+	organization, err := h.OrganizationService.CreateOrganization(request.Context(), req.Slug, req.Name)
+	if errors.Is(err, service.ErrInvalidOrganization) {
+		http.Error(writer, "Invalid organization slug", http.StatusBadRequest)
+		return
+	}
+	if errors.Is(err, service.ErrOrganizationExists) {
+		http.Error(writer, "Organization already exists", http.StatusConflict)
+		return
+	}
+	if err != nil {
+		http.Error(writer, "Internal error", http.StatusInternalServerError)
+		return
+	}
+	writer.Header().Set("Content-Type", "application/json")
+	writer.WriteHeader(http.StatusCreated)
+	json.NewEncoder(writer).Encode(organization)
+}
+
+// OrganizationMemberHandler godoc
+// @Summary      Set a member's role
+// @Description  Makes a user of the organization an owner, admin or member. Owners and admins can list and revoke the sessions of everyone in their organization
+// @Tags         admin
+// @Accept       json
+// @Produce      json
+// @Param        X-Admin-Key header string true "Admin API key"
+// @Param        slug path string true "Organization slug"
+// @Param        id path int true "User ID"
+// @Param        memberRoleRequest body MemberRoleRequest true "Role"
+// @Success      200  {object}  map[string]interface{}
+// @Failure      400  {object}  HTTPError
+// @Failure      401  {object}  HTTPError
+// @Failure      403  {object}  HTTPError
+// @Failure      404  {object}  HTTPError
+// @Failure      500  {object}  HTTPError
+// @Router       /admin/organizations/{slug}/members/{id} [put]
+func (h *Handler) OrganizationMemberHandler(writer http.ResponseWriter, request *http.Request) {
+	if request.Method != http.MethodPut {
+		http.Error(writer, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	if !h.requireAdmin(writer, request) {
+		return
+	}
+
+	userId, err := strconv.ParseInt(request.PathValue("id"), 10, 64)
+	if err != nil {
+		http.Error(writer, "Invalid user ID", http.StatusBadRequest)
+		return
+	}
+	var req MemberRoleRequest
+	err = json.NewDecoder(request.Body).Decode(&req)
+	if err != nil {
+		http.Error(writer, "Invalid JSON", http.StatusBadRequest)
+		return
+	}
+
+	err = h.OrganizationService.SetMemberRole(request.Context(), request.PathValue("slug"), userId, req.Role)
+	if errors.Is(err, service.ErrInvalidMemberRole) {
+		http.Error(writer, "Invalid member role", http.StatusBadRequest)
+		return
+	}
+	if errors.Is(err, service.ErrOrganizationNotFound) {
+		http.Error(writer, "Organization not found", http.StatusNotFound)
+		return
+	}
+	if errors.Is(err, service.ErrUserNotFound) {
+		http.Error(writer, "User not found", http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		http.Error(writer, "Internal error", http.StatusInternalServerError)
+		return
+	}
+	writer.Header().Set("Content-Type", "application/json")
+	writer.WriteHeader(http.StatusOK)
+	json.NewEncoder(writer).Encode(map[string]interface{}{})
+}
+
+// OrganizationSessionsHandler godoc
+// @Summary      List the organization's sessions
+// @Description  Lists the active sessions of every user in the caller's organization. Requires the owner or admin role in it
+// @Tags         sessions
+// @Produce      json
+// @Param        Authorization header string true "Bearer access token"
+// @Success      200  {array}   model.Session
+// @Failure      401  {object}  HTTPError
+// @Failure      403  {object}  HTTPError
+// @Failure      405  {object}  HTTPError
+// @Router       /org/sessions [get]
+func (h *Handler) OrganizationSessionsHandler(writer http.ResponseWriter, request *http.Request) {
+	if request.Method != http.MethodGet {
+		http.Error(writer, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	accessToken := strings.TrimPrefix(request.Header.Get("Authorization"), "Bearer ")
+
+	sessions, err := h.OrganizationService.ListSessions(request.Context(), accessToken)
+	if errors.Is(err, service.ErrNotOrganizationAdmin) {
+		http.Error(writer, "Forbidden", http.StatusForbidden)
+		return
+	}
+	if err != nil {
+		http.Error(writer, "Access denied", http.StatusUnauthorized)
+		return
+	}
+	writer.Header().Set("Content-Type", "application/json")
+	writer.WriteHeader(http.StatusOK)
+	json.NewEncoder(writer).Encode(sessions)
+}
+
+// OrganizationSessionHandler godoc
+// @Summary      Revoke a session in the organization
+// @Description  Signs out a session of any user in the caller's organization. Sessions of other organizations are reported as not found
+// @Tags         sessions
+// @Produce      json
+// @Param        Authorization header string true "Bearer access token"
+// @Param        id path string true "Session ID"
+// @Success      200  {object}  map[string]interface{}
+// @Failure      401  {object}  HTTPError
+// @Failure      403  {object}  HTTPError
+// @Failure      404  {object}  HTTPError
+// @Failure      405  {object}  HTTPError
+// @Router       /org/sessions/{id} [delete]
+func (h *Handler) OrganizationSessionHandler(writer http.ResponseWriter, request *http.Request) {
+	if request.Method != http.MethodDelete {
+		http.Error(writer, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	accessToken := strings.TrimPrefix(request.Header.Get("Authorization"), "Bearer ")
+
+	err := h.OrganizationService.RevokeSession(request.Context(), accessToken, request.PathValue("id"))
+	if errors.Is(err, service.ErrNotOrganizationAdmin) {
+		http.Error(writer, "Forbidden", http.StatusForbidden)
+		return
+	}
+	if errors.Is(err, service.ErrSessionNotFound) {
+		http.Error(writer, "Session not found", http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		http.Error(writer, "Access denied", http.StatusUnauthorized)
+		return
+	}
+	writer.Header().Set("Content-Type", "application/json")
+	writer.WriteHeader(http.StatusOK)
+	json.NewEncoder(writer).Encode(map[string]interface{}{})
+}
@@ -0,0 +1,212 @@
+package handler
+
+import (
+	"encoding/json"
+	"errors"
+	"jwt-auth/service"
+	"jwt-auth/webauthn"
+	"net"
+	"net/http"
+	"strings"
+)
+
+type PasskeyRegistrationRequest struct {
+	Name       string                        `json:"name,omitempty"`
+	Credential webauthn.RegistrationResponse `json:"credential"`
+}
+
+// PasskeysHandler godoc
+// @Summary      List passkeys
+// @Description  Lists the caller's passkeys
+// @Tags         passkeys
+// @Produce      json
+// @Param        Authorization header string true "Bearer access token"
+// @Success      200  {array}   model.Passkey
+// @Failure      401  {object}  HTTPError
+// @Failure      405  {object}  HTTPError
+// @Router       /passkeys [get]
+func (h *Handler) PasskeysHandler(writer http.ResponseWriter, request *http.Request) {
+	if request.Method != http.MethodGet {
+		http.Error(writer, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	accessToken := strings.TrimPrefix(request.Header.Get("Authorization"), "Bearer ")
+
+	passkeys, err := h.PasskeyService.ListPasskeys(request.Context(), accessToken)
+	if err != nil {
+		http.Error(writer, "Access denied", http.StatusUnauthorized)
+		return
+	}
+	writer.Header().Set("Content-Type", "application/json")
+	writer.WriteHeader(http.StatusOK)
+	json.NewEncoder(writer).Encode(passkeys)
+}
+
+// PasskeyHandler godoc
+// @Summary      Delete a passkey
+// @Description  Deletes one of the caller's passkeys, which can no longer sign in
+// @Tags         passkeys
+// @Produce      json
+// @Param        Authorization header string true "Bearer access token"
+// @Param        id path string true "Passkey ID"
+// @Success      200  {object}  map[string]interface{}
+// @Failure      401  {object}  HTTPError
+// @Failure      404  {object}  HTTPError
+// @Failure      405  {object}  HTTPError
+// @Router       /passkeys/{id} [delete]
+func (h *Handler) PasskeyHandler(writer http.ResponseWriter, request *http.Request) {
+	if request.Method != http.MethodDelete {
+		http.Error(writer, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	accessToken := strings.TrimPrefix(request.Header.Get("Authorization"), "Bearer ")
+
+	err := h.PasskeyService.DeletePasskey(request.Context(), accessToken, request.PathValue("id"))
+	if errors.Is(err, service.ErrPasskeyNotFound) {
+		http.Error(writer, "Passkey not found", http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		http.Error(writer, "Access denied", http.StatusUnauthorized)
+		return
+	}
+	writer.Header().Set("Content-Type", "application/json")
+	writer.WriteHeader(http.StatusOK)
+	json.NewEncoder(writer).Encode(map[string]interface{}{})
+}
+
+// PasskeyRegistrationBeginHandler godoc
+// @Summary      Start a passkey registration
+// @Description  Returns the options to pass to navigator.credentials.create(), with a challenge valid for five minutes
+// @Tags         passkeys
+// @Produce      json
+// @Param        Authorization header string true "Bearer access token"
+// @Success      200  {object}  webauthn.CreationOptions
+// @Failure      401  {object}  HTTPError
+// @Failure      405  {object}  HTTPError
+// @Router       /passkeys/register/begin [post]
+func (h *Handler) PasskeyRegistrationBeginHandler(writer http.ResponseWriter, request *http.Request) {
+	if request.Method != http.MethodPost {
+		http.Error(writer, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	accessToken := strings.TrimPrefix(request.Header.Get("Authorization"), "Bearer ")
+
+	options, err := h.PasskeyService.BeginRegistration(request.Context(), accessToken)
+	if err != nil {
+		http.Error(writer, "Access denied", http.StatusUnauthorized)
+		return
+	}
+	writer.Header().Set("Content-Type", "application/json")
+	writer.Header().Set("Cache-Control", "no-store")
+	writer.WriteHeader(http.StatusOK)
+	json.NewEncoder(writer).Encode(options)
+}
+
+// PasskeyRegistrationFinishHandler godoc
+// @Summary      Finish a passkey registration
+// @Description  Verifies and stores the credential navigator.credentials.create() returned, in the form of its toJSON()
+// @Tags         passkeys
+// @Accept       json
+// @Produce      json
+// @Param        Authorization header string true "Bearer access token"
+// @Param        passkeyRegistrationRequest body PasskeyRegistrationRequest true "Passkey name and credential"
+// @Success      201  {object}  model.Passkey
+// @Failure      400  {object}  HTTPError
+// @Failure      401  {object}  HTTPError
+// @Failure      405  {object}  HTTPError
+// @Failure      409  {object}  HTTPError
+// @Router       /passkeys/register/finish [post]
+func (h *Handler) PasskeyRegistrationFinishHandler(writer http.ResponseWriter, request *http.Request) {
+	if request.Method != http.MethodPost {
+		http.Error(writer, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	accessToken := strings.TrimPrefix(request.Header.Get("Authorization"), "Bearer ")
+
+	var req PasskeyRegistrationRequest
+	err := json.NewDecoder(request.Body).Decode(&req)
+	if err != nil {
+		http.Error(writer, "Invalid JSON", http.StatusBadRequest)
+		return
+	}
+	passkey, err := h.PasskeyService.FinishRegistration(request.Context(), accessToken, req.Name, &req.Credential)
+	if errors.Is(err, service.ErrPasskeyExists) {
+		http.Error(writer, err.Error(), http.StatusConflict)
+		return
+	}
+	if errors.Is(err, service.ErrInvalidPasskeyName) || errors.Is(err, service.ErrInvalidPasskeyChallenge) ||
+		errors.Is(err, webauthn.ErrInvalidResponse) || errors.Is(err, webauthn.ErrChallengeMismatch) ||
+		errors.Is(err, webauthn.ErrOriginMismatch) || errors.Is(err, webauthn.ErrUnsupportedKey) {
+		http.Error(writer, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if err != nil {
+		http.Error(writer, "Access denied", http.StatusUnauthorized)
+		return
+	}
+	writer.Header().Set("Content-Type", "application/json")
+	writer.WriteHeader(http.StatusCreated)
+	json.NewEncoder(writer).Encode(passkey)
+}
+
+// PasskeyLoginBeginHandler godoc
+// @Summary      Start a passkey login
+// @Description  Returns the options to pass to navigator.credentials.get(), with a challenge valid for five minutes. Any passkey of the site can answer it
+// @Tags         auth
+// @Produce      json
+// @Success      200  {object}  webauthn.RequestOptions
+// @Failure      405  {object}  HTTPError
+// @Failure      500  {object}  HTTPError
+// @Router       /login/passkey/begin [post]
+func (h *Handler) PasskeyLoginBeginHandler(writer http.ResponseWriter, request *http.Request) {
+	if request.Method != http.MethodPost {
+		http.Error(writer, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	options, err := h.PasskeyService.BeginLogin(request.Context())
+	if err != nil {
+		http.Error(writer, "Internal error", http.StatusInternalServerError)
+		return
+	}
+	writer.Header().Set("Content-Type", "application/json")
+	writer.Header().Set("Cache-Control", "no-store")
+	writer.WriteHeader(http.StatusOK)
+	json.NewEncoder(writer).Encode(options)
+}
+
+// PasskeyLoginFinishHandler godoc
+// @Summary      Finish a passkey login
+// @Description  Verifies the credential navigator.credentials.get() returned, in the form of its toJSON(), and returns access and refresh tokens like /login
+// @Tags         auth
+// @Accept       json
+// @Produce      json
+// @Param        credential body webauthn.AssertionResponse true "Assertion"
+// @Success      200  {object}  map[string]interface{}
+// @Failure      400  {object}  HTTPError
+// @Failure      401  {object}  HTTPError
+// @Failure      405  {object}  HTTPError
+// @Router       /login/passkey/finish [post]
+func (h *Handler) PasskeyLoginFinishHandler(writer http.ResponseWriter, request *http.Request) {
+	if request.Method != http.MethodPost {
+		http.Error(writer, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	var req webauthn.AssertionResponse
+	err := json.NewDecoder(request.Body).Decode(&req)
+	if err != nil {
+		http.Error(writer, "Invalid JSON", http.StatusBadRequest)
+		return
+	}
+
+	ip, _, _ := net.SplitHostPort(request.RemoteAddr)
+	userId, accessToken, refreshToken, err := h.PasskeyService.FinishLogin(request.Context(), &req, request.Header.Get("User-Agent"), ip)
+	if err != nil {
+		http.Error(writer, "Passkey login failed", http.StatusUnauthorized)
+		return
+	}
+
+	writeLogin(writer, userId, accessToken, refreshToken)
+}
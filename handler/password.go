@@ -0,0 +1,86 @@
+package handler
+
+import (
+	"encoding/json"
+	"errors"
+	"jwt-auth/service"
+	"net"
+	"net/http"
+	"strings"
+)
+
+type PasswordPolicyHTTPError struct {
+	Message    string                      `json:"message" example:"Password does not meet the policy"`
+	Violations []service.PasswordViolation `json:"violations"`
+}
+
+type ChangePasswordRequest struct {
+	CurrentPassword   string `json:"current_password"`
+	NewPassword       string `json:"new_password"`
+	SignOutEverywhere bool   `json:"sign_out_everywhere,omitempty"`
+}
+
+// ChangePasswordHandler godoc
+// @Summary      Change password
+// @Description  Replaces the caller's password after checking the current one. Every other session is signed out, and with sign_out_everywhere the current one too. Returns how many sessions were signed out. A wrong current password counts as a failed login for the account lockout
+// @Tags         auth
+// @Accept       json
+// @Produce      json
+// @Param        Authorization header string true "Bearer access token"
+// @Param        changePasswordRequest body ChangePasswordRequest true "Current and new password"
+// @Success      200  {object}  map[string]interface{}
+// @Failure      400  {object}  PasswordPolicyHTTPError
+// @Failure      401  {object}  HTTPError
+// @Failure      403  {object}  HTTPError
+// @Failure      405  {object}  HTTPError
+// @Failure      429  {object}  HTTPError
+// @Router       /password/change [post]
+func (h *Handler) ChangePasswordHandler(writer http.ResponseWriter, request *http.Request) {
+	if request.Method != http.MethodPost {
+		http.Error(writer, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	accessToken := strings.TrimPrefix(request.Header.Get("Authorization"), "Bearer ")
+
+	var req ChangePasswordRequest
+	err := json.NewDecoder(request.Body).Decode(&req)
+	if err != nil {
+		http.Error(writer, "Invalid JSON", http.StatusBadRequest)
+		return
+	}
+
+	ip, _, _ := net.SplitHostPort(request.RemoteAddr)
+	revoked, err := h.AuthService.ChangePassword(request.Context(), accessToken, req.CurrentPassword, req.NewPassword, req.SignOutEverywhere, ip)
+	if writePasswordPolicyError(writer, err) || writeLoginThrottled(writer, err) {
+		return
+	}
+	if errors.Is(err, service.ErrInvalidCurrentPassword) {
+		http.Error(writer, err.Error(), http.StatusForbidden)
+		return
+	}
+	if err != nil {
+		http.Error(writer, "Access denied", http.StatusUnauthorized)
+		return
+	}
+	writer.Header().Set("Content-Type", "application/json")
+	writer.WriteHeader(http.StatusOK)
+	json.NewEncoder(writer).Encode(map[string]interface{}{
+		"revoked": revoked,
+	})
+}
+
+// writePasswordPolicyError answers a *service.PasswordPolicyError with the
+// rules the password broke, reporting whether err was one.
+func writePasswordPolicyError(writer http.ResponseWriter, err error) bool {
+	var policyErr *service.PasswordPolicyError
+	if !errors.As(err, &policyErr) {
+		return false
+	}
+	writer.Header().Set("Content-Type", "application/json")
+	writer.WriteHeader(http.StatusBadRequest)
+	json.NewEncoder(writer).Encode(PasswordPolicyHTTPError{
+		Message:    "Password does not meet the policy",
+		Violations: policyErr.Violations,
+	})
+	return true
+}
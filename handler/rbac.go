@@ -0,0 +1,240 @@
+package handler
+
+import (
+	"encoding/json"
+	"errors"
+	"jwt-auth/service"
+	"net/http"
+	"strconv"
+)
+
+type RoleRequest struct {
+	Name        string   `json:"name"`
+	Permissions []string `json:"permissions"`
+}
+
+// RolesHandler godoc
+// @Summary      List or create roles
+// @Description  GET lists the roles with their permissions. POST creates a role
+// @Tags         admin
+// @Accept       json
+// @Produce      json
+// @Param        X-Admin-Key header string true "Admin API key"
+// @Param        roleRequest body RoleRequest false "Role name and permissions"
+// @Success      200  {array}   model.Role
+// @Success      201  {object}  model.Role
+// @Failure      400  {object}  HTTPError
+// @Failure      401  {object}  HTTPError
+// @Failure      403  {object}  HTTPError
+// @Failure      409  {object}  HTTPError
+// @Failure      500  {object}  HTTPError
+// @Router       /admin/roles [get]
+// @Router       /admin/roles [post]
+func (h *Handler) RolesHandler(writer http.ResponseWriter, request *http.Request) {
+	if request.Method != http.MethodGet && request.Method != http.MethodPost {
+		http.Error(writer, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	if !h.requireAdmin(writer, request) {
+		return
+	}
+
+	if request.Method == http.MethodGet {
+		roles, err := h.RBACService.ListRoles(request.Context())
+		if err != nil {
+			http.Error(writer, "Internal error", http.StatusInternalServerError)
+			return
+		}
+		writer.Header().Set("Content-Type", "application/json")
+		writer.WriteHeader(http.StatusOK)
+		json.NewEncoder(writer).Encode(roles)
+		return
+	}
+
+	var req RoleRequest
+	err := json.NewDecoder(request.Body).Decode(&req)
+	if err != nil {
+		http.Error(writer, "Invalid JSON", http.StatusBadRequest)
+		return
+	}
+	role, err := h.RBACService.CreateRole(request.Context(), req.Name, req.Permissions)
+	if errors.Is(err, service.ErrInvalidRoleName) {
+		http.Error(writer, "Invalid role or permission name", http.StatusBadRequest)
+		return
+	}
+	if errors.Is(err, service.ErrRoleExists) {
+		http.Error(writer, "Role already exists", http.StatusConflict)
+		return
+	}
+	if err != nil {
+		http.Error(writer, "Internal error", http.StatusInternalServerError)
+		return
+	}
+	writer.Header().Set("Content-Type", "application/json")
+	writer.WriteHeader(http.StatusCreated)
+	json.NewEncoder(writer).Encode(role)
+}
+
+// RoleHandler godoc
+// @Summary      Update or delete a role
+// @Description  PUT replaces the permissions of a role. DELETE removes the role from every user and deletes it. Changes show up in the next access tokens of the users holding the role
+// @Tags         admin
+// @Accept       json
+// @Produce      json
+// @Param        X-Admin-Key header string true "Admin API key"
+// @Param        name path string true "Role name"
+// @Param        roleRequest body RoleRequest false "Permissions"
+// @Success      200  {object}  model.Role
+// @Failure      400  {object}  HTTPError
+// @Failure      401  {object}  HTTPError
+// @Failure      403  {object}  HTTPError
+// @Failure      404  {object}  HTTPError
+// @Failure      500  {object}  HTTPError
+// @Router       /admin/roles/{name} [put]
+// @Router       /admin/roles/{name} [delete]
+func (h *Handler) RoleHandler(writer http.ResponseWriter, request *http.Request) {
+	if request.Method != http.MethodPut && request.Method != http.MethodDelete {
+		http.Error(writer, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	if !h.requireAdmin(writer, request) {
+		return
+	}
+	name := request.PathValue("name")
+
+	if request.Method == http.MethodDelete {
+		err := h.RBACService.DeleteRole(request.Context(), name)
+		if errors.Is(err, service.ErrRoleNotFound) {
+			http.Error(writer, "Role not found", http.StatusNotFound)
+			return
+		}
+		if err != nil {
+			http.Error(writer, "Internal error", http.StatusInternalServerError)
+			return
+		}
+		writer.Header().Set("Content-Type", "application/json")
+		writer.WriteHeader(http.StatusOK)
+		json.NewEncoder(writer).Encode(map[string]interface{}{})
+		return
+	}
+
+	var req RoleRequest
+	err := json.NewDecoder(request.Body).Decode(&req)
+	if err != nil {
+		http.Error(writer, "Invalid JSON", http.StatusBadRequest)
+		return
+	}
+	role, err := h.RBACService.SetRolePermissions(request.Context(), name, req.Permissions)
+	if errors.Is(err, service.ErrInvalidRoleName) {
+		http.Error(writer, "Invalid role or permission name", http.StatusBadRequest)
+		return
+	}
+	if errors.Is(err, service.ErrRoleNotFound) {
+		http.Error(writer, "Role not found", http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		http.Error(writer, "Internal error", http.StatusInternalServerError)
+		return
+	}
+	writer.Header().Set("Content-Type", "application/json")
+	writer.WriteHeader(http.StatusOK)
+	json.NewEncoder(writer).Encode(role)
+}
+
+// UserRolesHandler godoc
+// @Summary      List a user's roles
+// @Description  Lists the roles assigned to a user
+// @Tags         admin
+// @Produce      json
+// @Param        X-Admin-Key header string true "Admin API key"
+// @Param        id path int true "User ID"
+// @Success      200  {array}   model.Role
+// @Failure      400  {object}  HTTPError
+// @Failure      401  {object}  HTTPError
+// @Failure      403  {object}  HTTPError
+// @Failure      404  {object}  HTTPError
+// @Failure      500  {object}  HTTPError
+// @Router       /admin/users/{id}/roles [get]
+func (h *Handler) UserRolesHandler(writer http.ResponseWriter, request *http.Request) {
+	if request.Method != http.MethodGet {
+		http.Error(writer, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	if !h.requireAdmin(writer, request) {
+		return
+	}
+
+	userId, err := strconv.ParseInt(request.PathValue("id"), 10, 64)
+	if err != nil {
+		http.Error(writer, "Invalid user ID", http.StatusBadRequest)
+		return
+	}
+
+	roles, err := h.RBACService.ListUserRoles(request.Context(), userId)
+	if errors.Is(err, service.ErrUserNotFound) {
+		http.Error(writer, "User not found", http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		http.Error(writer, "Internal error", http.StatusInternalServerError)
+		return
+	}
+	writer.Header().Set("Content-Type", "application/json")
+	writer.WriteHeader(http.StatusOK)
+	json.NewEncoder(writer).Encode(roles)
+}
+
+// UserRoleHandler godoc
+// @Summary      Assign or unassign a role
+// @Description  PUT assigns the role to the user, DELETE takes it away. The change shows up in the user's next access token
+// @Tags         admin
+// @Produce      json
+// @Param        X-Admin-Key header string true "Admin API key"
+// @Param        id path int true "User ID"
+// @Param        role path string true "Role name"
+// @Success      200  {object}  map[string]interface{}
+// @Failure      400  {object}  HTTPError
+// @Failure      401  {object}  HTTPError
+// @Failure      403  {object}  HTTPError
+// @Failure      404  {object}  HTTPError
+// @Failure      500  {object}  HTTPError
+// @Router       /admin/users/{id}/roles/{role} [put]
+// @Router       /admin/users/{id}/roles/{role} [delete]
+func (h *Handler) UserRoleHandler(writer http.ResponseWriter, request *http.Request) {
+	if request.Method != http.MethodPut && request.Method != http.MethodDelete {
+		http.Error(writer, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	if !h.requireAdmin(writer, request) {
+		return
+	}
+
+	userId, err := strconv.ParseInt(request.PathValue("id"), 10, 64)
+	if err != nil {
+		http.Error(writer, "Invalid user ID", http.StatusBadRequest)
+		return
+	}
+
+	role := request.PathValue("role")
+	if request.Method == http.MethodPut {
+		err = h.RBACService.AssignRole(request.Context(), userId, role)
+	} else {
+		err = h.RBACService.UnassignRole(request.Context(), userId, role)
+	}
+	if errors.Is(err, service.ErrUserNotFound) {
+		http.Error(writer, "User not found", http.StatusNotFound)
+		return
+	}
+	if errors.Is(err, service.ErrRoleNotFound) {
+		http.Error(writer, "Role not found", http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		http.Error(writer, "Internal error", http.StatusInternalServerError)
+		return
+	}
+	writer.Header().Set("Content-Type", "application/json")
+	writer.WriteHeader(http.StatusOK)
+	json.NewEncoder(writer).Encode(map[string]interface{}{})
+}
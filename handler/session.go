@@ -0,0 +1,99 @@
+package handler
+
+import (
+	"encoding/json"
+	"errors"
+	"jwt-auth/service"
+	"net/http"
+	"strings"
+)
+
+// SessionsHandler godoc
+// @Summary      List or revoke sessions
+// @Description  GET lists the caller's active sessions, DELETE signs out every session except the current one
+// @Tags         sessions
+// @Produce      json
+// @Param        Authorization header string true "Bearer access token"
+// @Success      200  {array}   model.Session
+// @Failure      401  {object}  HTTPError
+// @Failure      405  {object}  HTTPError
+// @Failure      500  {object}  HTTPError
+// @Router       /sessions [get]
+// @Router       /sessions [delete]
+func (h *Handler) SessionsHandler(writer http.ResponseWriter, request *http.Request) {
+	accessToken := strings.TrimPrefix(request.Header.Get("Authorization"), "Bearer ")
+
+	switch request.Method {
+	case http.MethodGet:
+		sessions, err := h.AuthService.ListSessions(request.Context(), accessToken)
+		if err != nil {
+			http.Error(writer, "Access denied", http.StatusUnauthorized)
+			return
+		}
+		writer.Header().Set("Content-Type", "application/json")
+		writer.WriteHeader(http.StatusOK)
+		json.NewEncoder(writer).Encode(sessions)
+	case http.MethodDelete:
+		revoked, err := h.AuthService.RevokeOtherSessions(request.Context(), accessToken)
+		if err != nil {
+			http.Error(writer, "Access denied", http.StatusUnauthorized)
+			return
+		}
+		writer.Header().Set("Content-Type", "application/json")
+		writer.WriteHeader(http.StatusOK)
+		json.NewEncoder(writer).Encode(map[string]interface{}{
+			"revoked": revoked,
+		})
+	default:
+		http.Error(writer, "Method not allowed", http.StatusMethodNotAllowed)
+	}
+}
+
+// SessionHandler godoc
+// @Summary      Inspect or revoke a session
+// @Description  GET returns one of the caller's sessions, DELETE signs it out
+// @Tags         sessions
+// @Produce      json
+// @Param        Authorization header string true "Bearer access token"
+// @Param        id path string true "Session ID"
+// @Success      200  {object}  model.Session
+// @Failure      401  {object}  HTTPError
+// @Failure      404  {object}  HTTPError
+// @Failure      405  {object}  HTTPError
+// @Router       /sessions/{id} [get]
+// @Router       /sessions/{id} [delete]
+func (h *Handler) SessionHandler(writer http.ResponseWriter, request *http.Request) {
+	accessToken := strings.TrimPrefix(request.Header.Get("Authorization"), "Bearer ")
+	sessionID := request.PathValue("id")
+
+	switch request.Method {
+	case http.MethodGet:
+		session, err := h.AuthService.GetSession(request.Context(), accessToken, sessionID)
+		if errors.Is(err, service.ErrSessionNotFound) {
+			http.Error(writer, "Session not found", http.StatusNotFound)
+			return
+		}
+		if err != nil {
+			http.Error(writer, "Access denied", http.StatusUnauthorized)
+			return
+		}
+		writer.Header().Set("Content-Type", "application/json")
+		writer.WriteHeader(http.StatusOK)
+		json.NewEncoder(writer).Encode(session)
+	case http.MethodDelete:
+		err := h.AuthService.RevokeSession(request.Context(), accessToken, sessionID)
+		if errors.Is(err, service.ErrSessionNotFound) {
+			http.Error(writer, "Session not found", http.StatusNotFound)
+			return
+		}
+		if err != nil {
+			http.Error(writer, "Access denied", http.StatusUnauthorized)
+			return
+		}
+		writer.Header().Set("Content-Type", "application/json")
+		writer.WriteHeader(http.StatusOK)
+		json.NewEncoder(writer).Encode(map[string]interface{}{})
+	default:
+		http.Error(writer, "Method not allowed", http.StatusMethodNotAllowed)
+	}
+}
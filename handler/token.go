@@ -0,0 +1,108 @@
+package handler
+
+import (
+	"encoding/json"
+	"errors"
+	"jwt-auth/service"
+	"net/http"
+	"strings"
+	"time"
+)
+
+type PersonalAccessTokenRequest struct {
+	Name  string `json:"name"`
+	Scope string `json:"scope"`
+	// ExpiresIn is the lifetime in seconds. Tokens without one do not expire.
+	ExpiresIn int64 `json:"expires_in,omitempty"`
+}
+
+// PersonalAccessTokensHandler godoc
+// @Summary      List or create personal access tokens
+// @Description  GET lists the caller's personal access tokens. POST creates one; the token is only returned in this response. Both require an access token, not a personal access token
+// @Tags         tokens
+// @Accept       json
+// @Produce      json
+// @Param        Authorization header string true "Bearer access token"
+// @Param        tokenRequest body PersonalAccessTokenRequest false "Name, scope and lifetime"
+// @Success      200  {array}   model.PersonalAccessToken
+// @Success      201  {object}  model.CreatedPersonalAccessToken
+// @Failure      400  {object}  HTTPError
+// @Failure      401  {object}  HTTPError
+// @Failure      405  {object}  HTTPError
+// @Failure      409  {object}  HTTPError
+// @Router       /personal_access_tokens [get]
+// @Router       /personal_access_tokens [post]
+func (h *Handler) PersonalAccessTokensHandler(writer http.ResponseWriter, request *http.Request) {
+	accessToken := strings.TrimPrefix(request.Header.Get("Authorization"), "Bearer ")
+
+	switch request.Method {
+	case http.MethodGet:
+		tokens, err := h.PersonalAccessTokenService.ListTokens(request.Context(), accessToken)
+		if err != nil {
+			http.Error(writer, "Access denied", http.StatusUnauthorized)
+			return
+		}
+		writer.Header().Set("Content-Type", "application/json")
+		writer.WriteHeader(http.StatusOK)
+		json.NewEncoder(writer).Encode(tokens)
+	case http.MethodPost:
+		var req PersonalAccessTokenRequest
+		err := json.NewDecoder(request.Body).Decode(&req)
+		if err != nil {
+			http.Error(writer, "Invalid JSON", http.StatusBadRequest)
+			return
+		}
+		token, err := h.PersonalAccessTokenService.CreateToken(request.Context(), accessToken, req.Name, req.Scope, time.Duration(req.ExpiresIn)*time.Second)
+		if errors.Is(err, service.ErrInvalidTokenName) || errors.Is(err, service.ErrInvalidTokenScope) || errors.Is(err, service.ErrInvalidTokenTTL) {
+			http.Error(writer, err.Error(), http.StatusBadRequest)
+			return
+		}
+		if errors.Is(err, service.ErrTokenExists) {
+			http.Error(writer, err.Error(), http.StatusConflict)
+			return
+		}
+		if err != nil {
+			http.Error(writer, "Access denied", http.StatusUnauthorized)
+			return
+		}
+		writer.Header().Set("Content-Type", "application/json")
+		writer.Header().Set("Cache-Control", "no-store")
+		writer.WriteHeader(http.StatusCreated)
+		json.NewEncoder(writer).Encode(token)
+	default:
+		http.Error(writer, "Method not allowed", http.StatusMethodNotAllowed)
+	}
+}
+
+// PersonalAccessTokenHandler godoc
+// @Summary      Revoke a personal access token
+// @Description  Deletes one of the caller's personal access tokens
+// @Tags         tokens
+// @Produce      json
+// @Param        Authorization header string true "Bearer access token"
+// @Param        id path string true "Token ID"
+// @Success      200
+// @Failure      401  {object}  HTTPError
+// @Failure      404  {object}  HTTPError
+// @Failure      405  {object}  HTTPError
+// @Router       /personal_access_tokens/{id} [delete]
+func (h *Handler) PersonalAccessTokenHandler(writer http.ResponseWriter, request *http.Request) {
+	if request.Method != http.MethodDelete {
+		http.Error(writer, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	accessToken := strings.TrimPrefix(request.Header.Get("Authorization"), "Bearer ")
+
+	err := h.PersonalAccessTokenService.RevokeToken(request.Context(), accessToken, request.PathValue("id"))
+	if errors.Is(err, service.ErrTokenNotFound) {
+		http.Error(writer, "Token not found", http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		http.Error(writer, "Access denied", http.StatusUnauthorized)
+		return
+	}
+	writer.Header().Set("Content-Type", "application/json")
+	writer.WriteHeader(http.StatusOK)
+	json.NewEncoder(writer).Encode(map[string]interface{}{})
+}
@@ -3,34 +3,143 @@ package main
 import (
 	"database/sql"
 	"log"
+	"net"
 	"net/http"
 
 	"jwt-auth/auth"
 	"jwt-auth/config"
 	"jwt-auth/db"
+	"jwt-auth/email"
+	"jwt-auth/grpcserver"
+	"jwt-auth/handler"
 	"jwt-auth/router"
 	"jwt-auth/service"
+	"jwt-auth/webauthn"
 )
 
 func main() {
+	config.LoadEnvFile()
+
 	var DB *sql.DB
 	dbConfig := config.LoadDBConfig()
 	db.Init(dbConfig, &DB)
 
 	jwtConfig, err := config.LoadJWTConfig()
 	if err != nil {
-		log.Fatalf("Failed to read JWT env variables: %w", err)
+		log.Fatalf("Failed to read JWT env variables: %v", err)
 		return
 	}
-	jwtManager := auth.NewJWTManager(jwtConfig, DB)
-	authService := service.NewAuthService(DB, jwtManager)
+	jwtManager, err := auth.NewJWTManager(jwtConfig, DB)
+	if err != nil {
+		log.Fatalf("Failed to load JWT signing key: %v", err)
+		return
+	}
+	passwordPolicyConfig, err := config.LoadPasswordPolicyConfig()
+	if err != nil {
+		log.Fatalf("Failed to read password policy env variables: %v", err)
+	}
+	passwordPolicy := &service.PasswordPolicy{
+		MinLength:           passwordPolicyConfig.MinLength,
+		MaxLength:           passwordPolicyConfig.MaxLength,
+		MinCharacterClasses: passwordPolicyConfig.MinCharacterClasses,
+		RejectUsername:      passwordPolicyConfig.RejectUsername,
+		HistorySize:         passwordPolicyConfig.HistorySize,
+	}
+	if passwordPolicyConfig.BreachedListPath != "" {
+		passwordPolicy.Breached, err = service.LoadBreachedPasswords(passwordPolicyConfig.BreachedListPath)
+		if err != nil {
+			log.Fatalf("Failed to load breached passwords: %v", err)
+		}
+	}
+	passwordHashConfig, err := config.LoadPasswordHashConfig()
+	if err != nil {
+		log.Fatalf("Failed to read password hashing env variables: %v", err)
+	}
+	passwordHasher, err := service.NewPasswordHasher(service.PasswordHasherConfig{
+		Algorithm:     passwordHashConfig.Algorithm,
+		Argon2Memory:  passwordHashConfig.Argon2Memory,
+		Argon2Time:    passwordHashConfig.Argon2Time,
+		Argon2Threads: passwordHashConfig.Argon2Threads,
+		BcryptCost:    passwordHashConfig.BcryptCost,
+		ScryptLogN:    passwordHashConfig.ScryptLogN,
+		ScryptR:       passwordHashConfig.ScryptR,
+		ScryptP:       passwordHashConfig.ScryptP,
+		Pepper:        []byte(passwordHashConfig.Pepper),
+	})
+	if err != nil {
+		log.Fatalf("Failed to set up password hashing: %v", err)
+	}
+	loginThrottleConfig, err := config.LoadLoginThrottleConfig()
+	if err != nil {
+		log.Fatalf("Failed to read login throttle env variables: %v", err)
+	}
+	loginThrottle := &service.LoginThrottle{
+		AccountThreshold: loginThrottleConfig.AccountThreshold,
+		IPThreshold:      loginThrottleConfig.IPThreshold,
+		BackoffBase:      loginThrottleConfig.BackoffBase,
+		BackoffMax:       loginThrottleConfig.BackoffMax,
+		LockoutDuration:  loginThrottleConfig.LockoutDuration,
+	}
+	mailConfig := config.LoadMailConfig()
+	var mailer email.Mailer
+	switch mailConfig.Transport {
+	case "smtp":
+		mailer = email.NewSMTPMailer(mailConfig.SMTPHost, mailConfig.SMTPPort, mailConfig.SMTPUsername, mailConfig.SMTPPassword, mailConfig.From)
+	case "file":
+		mailer = email.NewFileMailer(mailConfig.DropDir, mailConfig.From)
+	default:
+		log.Fatalf("Unknown MAIL_TRANSPORT %q", mailConfig.Transport)
+	}
+	emailService := service.NewEmailService(DB, jwtManager, mailer, mailConfig.VerifyEmailURL, mailConfig.PasswordResetURL, mailConfig.UnlockAccountURL, passwordPolicy, passwordHasher)
+	authService := service.NewAuthService(DB, jwtManager, passwordPolicy, passwordHasher, loginThrottle, emailService)
+	clientService := service.NewClientService(DB)
+	oauthService := service.NewOAuthService(DB, jwtManager, clientService)
+	rbacService := service.NewRBACService(DB, jwtManager)
+	groupService := service.NewGroupService(DB, jwtManager)
+	organizationService := service.NewOrganizationService(DB, jwtManager)
+	personalAccessTokenService := service.NewPersonalAccessTokenService(DB, jwtManager)
+	mfaService := service.NewMFAService(DB, jwtManager, config.GetMFAIssuer(), loginThrottle)
+	webAuthnConfig := config.LoadWebAuthnConfig()
+	passkeyService := service.NewPasskeyService(DB, jwtManager, &webauthn.RelyingParty{
+		ID:      webAuthnConfig.RPID,
+		Name:    webAuthnConfig.RPName,
+		Origins: webAuthnConfig.Origins,
+	})
 
-	handler := router.SetupRoutes(authService)
+	routes := router.SetupRoutes(&handler.Handler{
+		AuthService:                authService,
+		ClientService:              clientService,
+		OAuthService:               oauthService,
+		RBACService:                rbacService,
+		GroupService:               groupService,
+		OrganizationService:        organizationService,
+		PersonalAccessTokenService: personalAccessTokenService,
+		MFAService:                 mfaService,
+		PasskeyService:             passkeyService,
+		EmailService:               emailService,
+		AdminAPIKey:                config.GetAdminAPIKey(),
+	})
+
+	grpcPort := config.GetGRPCPort()
+	if grpcPort != "" {
+		listener, err := net.Listen("tcp", ":"+grpcPort)
+		if err != nil {
+			log.Fatalf("Failed to listen on gRPC port: %v", err)
+		}
+		grpcServer := grpcserver.NewServer(authService, organizationService, mfaService)
+		go func() {
+			log.Printf("gRPC server running on port %s", grpcPort)
+			err := grpcServer.Serve(listener)
+			if err != nil {
+				log.Fatalf("gRPC server failed: %v", err)
+			}
+		}()
+	}
 
 	serverPort := config.GetServerPort()
 	log.Printf("Server running on port %s", serverPort)
-	err = http.ListenAndServe(":"+serverPort, handler)
+	err = http.ListenAndServe(":"+serverPort, routes)
 	if err != nil {
-		log.Fatalf("Server failed: %w", err)
+		log.Fatalf("Server failed: %v", err)
 	}
 }
@@ -0,0 +1,208 @@
+package middleware
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/golang-jwt/jwt/v5"
+)
+
+// Config describes the tokens a resource server accepts.
+type Config struct {
+	// Keys verifies token signatures, with StaticKey or NewJWKS.
+	Keys KeySource
+	// Issuer, when set, must match the iss claim.
+	Issuer string
+	// Audience is the resource server's own client id. Tokens exchanged for
+	// it carry it as their aud claim. When empty, tokens bound to any
+	// audience are rejected, as the issuer does for its own endpoints.
+	Audience string
+	// Introspector, when set, verifies personal access tokens, which are
+	// opaque, for instance with NewIntrospector. Without it they are
+	// rejected.
+	Introspector TokenVerifier
+	// Realm is sent in WWW-Authenticate challenges.
+	Realm  string
+	Leeway time.Duration
+}
+
+// Authenticator verifies access tokens without a database, so revoking a
+// session only takes effect here once its access token expires. Personal
+// access tokens are the exception, checked with the issuer.
+type Authenticator struct {
+	config Config
+	parser *jwt.Parser
+}
+
+var (
+	ErrMissingToken = errors.New("Missing access token")
+	ErrInvalidToken = errors.New("Invalid access token")
+)
+
+type accessTokenClaims struct {
+	UserID      int64    `json:"user_id,omitempty"`
+	KeyPairID   string   `json:"KeyPairID"`
+	OrgID       int64    `json:"org_id,omitempty"`
+	ClientID    string   `json:"client_id,omitempty"`
+	Scope       string   `json:"scope,omitempty"`
+	Roles       []string `json:"roles,omitempty"`
+	Permissions []string `json:"permissions,omitempty"`
+	Act         *struct {
+		Sub string `json:"sub"`
+	} `json:"act,omitempty"`
+	jwt.RegisteredClaims
+}
+
+func NewAuthenticator(config Config) (*Authenticator, error) {
+	if config.Keys == nil {
+		return nil, fmt.Errorf("A key source is required")
+	}
+	options := []jwt.ParserOption{
+		jwt.WithExpirationRequired(),
+		jwt.WithLeeway(config.Leeway),
+	}
+	if config.Issuer != "" {
+		options = append(options, jwt.WithIssuer(config.Issuer))
+	}
+	if config.Audience != "" {
+		options = append(options, jwt.WithAudience(config.Audience))
+	}
+	return &Authenticator{
+		config: config,
+		parser: jwt.NewParser(options...),
+	}, nil
+}
+
+// Verify checks an access token, or a personal access token through the
+// Introspector, and returns its principal.
+func (a *Authenticator) Verify(ctx context.Context, accessToken string) (*Principal, error) {
+	if accessToken == "" {
+		return nil, ErrMissingToken
+	}
+	if strings.HasPrefix(accessToken, PersonalAccessTokenPrefix) {
+		if a.config.Introspector == nil {
+			return nil, fmt.Errorf("%w: personal access tokens are not accepted", ErrInvalidToken)
+		}
+		return a.config.Introspector.Verify(ctx, accessToken)
+	}
+
+	claims := &accessTokenClaims{}
+	_, err := a.parser.ParseWithClaims(accessToken, claims, func(token *jwt.Token) (interface{}, error) {
+		kid, _ := token.Header["kid"].(string)
+		return a.config.Keys.Key(ctx, kid, token.Method.Alg())
+	})
+	if err != nil {
+		return nil, fmt.Errorf("%w: %w", ErrInvalidToken, err)
+	}
+	// ID tokens share the signing keys but carry no key pair.
+	if claims.KeyPairID == "" {
+		return nil, fmt.Errorf("%w: not an access token", ErrInvalidToken)
+	}
+	if a.config.Audience == "" && len(claims.Audience) > 0 {
+		return nil, fmt.Errorf("%w: restricted to another audience", ErrInvalidToken)
+	}
+
+	principal := &Principal{
+		Subject:     claims.Subject,
+		UserID:      claims.UserID,
+		ClientID:    claims.ClientID,
+		OrgID:       claims.OrgID,
+		Scope:       strings.Fields(claims.Scope),
+		Roles:       claims.Roles,
+		Permissions: claims.Permissions,
+		TokenID:     claims.ID,
+	}
+	if principal.Subject == "" && principal.UserID != 0 {
+		principal.Subject = strconv.FormatInt(principal.UserID, 10)
+	}
+	if claims.Act != nil {
+		principal.Actor = claims.Act.Sub
+	}
+	if claims.IssuedAt != nil {
+		principal.IssuedAt = claims.IssuedAt.Time
+	}
+	if claims.ExpiresAt != nil {
+		principal.ExpiresAt = claims.ExpiresAt.Time
+	}
+	return principal, nil
+}
+
+// Authenticate verifies the bearer token of every request and stores its
+// principal in the request context. Requests without a valid token get the
+// RFC 6750 challenge.
+func (a *Authenticator) Authenticate(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(writer http.ResponseWriter, request *http.Request) {
+		accessToken, ok := bearerToken(request)
+		if !ok {
+			a.challenge(writer, http.StatusBadRequest, "invalid_request", "Malformed Authorization header", "")
+			return
+		}
+
+		principal, err := a.Verify(request.Context(), accessToken)
+		if errors.Is(err, ErrMissingToken) {
+			a.challenge(writer, http.StatusUnauthorized, "", "", "")
+			return
+		}
+		if errors.Is(err, jwt.ErrTokenExpired) {
+			a.challenge(writer, http.StatusUnauthorized, "invalid_token", "The access token expired", "")
+			return
+		}
+		if err != nil {
+			a.challenge(writer, http.StatusUnauthorized, "invalid_token", "The access token is invalid", "")
+			return
+		}
+		next.ServeHTTP(writer, request.WithContext(WithPrincipal(request.Context(), principal)))
+	})
+}
+
+// bearerToken extracts the token of an Authorization header using the
+// Bearer scheme. Requests without credentials yield an empty token, while
+// a Bearer header without a token is malformed.
+func bearerToken(request *http.Request) (string, bool) {
+	header := request.Header.Get("Authorization")
+	scheme, token, _ := strings.Cut(header, " ")
+	if !strings.EqualFold(scheme, "Bearer") {
+		return "", true
+	}
+	token = strings.TrimSpace(token)
+	return token, token != ""
+}
+
+// challenge writes an RFC 6750 error response. Without an error code it is
+// a bare challenge asking for credentials.
+func (a *Authenticator) challenge(writer http.ResponseWriter, status int, code, description, scope string) {
+	writeChallenge(writer, a.config.Realm, status, code, description, scope)
+}
+
+func writeChallenge(writer http.ResponseWriter, realm string, status int, code, description, scope string) {
+	var params []string
+	if realm != "" {
+		params = append(params, "realm="+strconv.Quote(realm))
+	}
+	if code != "" {
+		params = append(params, "error="+strconv.Quote(code))
+	}
+	if description != "" {
+		params = append(params, "error_description="+strconv.Quote(description))
+	}
+	if scope != "" {
+		params = append(params, "scope="+strconv.Quote(scope))
+	}
+
+	challenge := "Bearer"
+	if len(params) > 0 {
+		challenge += " " + strings.Join(params, ", ")
+	}
+	writer.Header().Set("WWW-Authenticate", challenge)
+
+	message := "Access denied"
+	if description != "" {
+		message = description
+	}
+	http.Error(writer, message, status)
+}
@@ -0,0 +1,85 @@
+package middleware
+
+import (
+	"context"
+	"slices"
+	"strings"
+
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+)
+
+// TokenVerifier checks an access token and returns its principal.
+// *Authenticator is one.
+type TokenVerifier interface {
+	Verify(ctx context.Context, accessToken string) (*Principal, error)
+}
+
+// BearerTokenFromMetadata returns the token of the "authorization: Bearer"
+// metadata of an incoming call.
+func BearerTokenFromMetadata(ctx context.Context) string {
+	md, ok := metadata.FromIncomingContext(ctx)
+	if !ok {
+		return ""
+	}
+	for _, value := range md.Get("authorization") {
+		scheme, token, _ := strings.Cut(value, " ")
+		if strings.EqualFold(scheme, "Bearer") {
+			return strings.TrimSpace(token)
+		}
+	}
+	return ""
+}
+
+// UnaryServerInterceptor verifies the bearer token in the metadata of every
+// call except those to publicMethods, given as full method names such as
+// "/auth.v1.AuthService/Login", and stores its principal in the context.
+func UnaryServerInterceptor(verifier TokenVerifier, publicMethods ...string) grpc.UnaryServerInterceptor {
+	return func(ctx context.Context, req interface{}, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (interface{}, error) {
+		if slices.Contains(publicMethods, info.FullMethod) {
+			return handler(ctx, req)
+		}
+		ctx, err := authenticateCall(ctx, verifier)
+		if err != nil {
+			return nil, err
+		}
+		return handler(ctx, req)
+	}
+}
+
+// StreamServerInterceptor is UnaryServerInterceptor for streaming calls.
+func StreamServerInterceptor(verifier TokenVerifier, publicMethods ...string) grpc.StreamServerInterceptor {
+	return func(srv interface{}, stream grpc.ServerStream, info *grpc.StreamServerInfo, handler grpc.StreamHandler) error {
+		if slices.Contains(publicMethods, info.FullMethod) {
+			return handler(srv, stream)
+		}
+		ctx, err := authenticateCall(stream.Context(), verifier)
+		if err != nil {
+			return err
+		}
+		return handler(srv, &authenticatedStream{ServerStream: stream, ctx: ctx})
+	}
+}
+
+func authenticateCall(ctx context.Context, verifier TokenVerifier) (context.Context, error) {
+	accessToken := BearerTokenFromMetadata(ctx)
+	if accessToken == "" {
+		return nil, status.Error(codes.Unauthenticated, "Missing access token")
+	}
+	principal, err := verifier.Verify(ctx, accessToken)
+	if err != nil {
+		return nil, status.Error(codes.Unauthenticated, "Access denied")
+	}
+	return WithPrincipal(ctx, principal), nil
+}
+
+type authenticatedStream struct {
+	grpc.ServerStream
+	ctx context.Context
+}
+
+func (s *authenticatedStream) Context() context.Context {
+	return s.ctx
+}
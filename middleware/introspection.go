@@ -0,0 +1,153 @@
+package middleware
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// PersonalAccessTokenPrefix starts the issuer's personal access tokens. They
+// are opaque, so only the issuer can check them.
+const PersonalAccessTokenPrefix = "jwtpat_"
+
+// introspectionCacheTTL bounds how long a revoked token keeps being accepted.
+const introspectionCacheTTL = 30 * time.Second
+
+// Introspector verifies opaque tokens with the issuer's RFC 7662
+// introspection endpoint, authenticating as a confidential client. Set it as
+// Config.Introspector to accept personal access tokens alongside JWTs.
+type Introspector struct {
+	endpoint     string
+	clientID     string
+	clientSecret string
+	client       *http.Client
+
+	mu        sync.Mutex
+	cache     map[[sha256.Size]byte]cachedIntrospection
+	lastPrune time.Time
+}
+
+type cachedIntrospection struct {
+	principal *Principal
+	expiresAt time.Time
+}
+
+type introspectionResponse struct {
+	Active      bool     `json:"active"`
+	Sub         string   `json:"sub"`
+	ClientID    string   `json:"client_id"`
+	Scope       string   `json:"scope"`
+	Exp         int64    `json:"exp"`
+	Iat         int64    `json:"iat"`
+	Jti         string   `json:"jti"`
+	OrgID       int64    `json:"org_id"`
+	Roles       []string `json:"roles"`
+	Permissions []string `json:"permissions"`
+}
+
+func NewIntrospector(endpoint, clientID, clientSecret string) *Introspector {
+	return &Introspector{
+		endpoint:     endpoint,
+		clientID:     clientID,
+		clientSecret: clientSecret,
+		client:       &http.Client{Timeout: 10 * time.Second},
+		cache:        map[[sha256.Size]byte]cachedIntrospection{},
+	}
+}
+
+// Verify introspects a token and returns its principal. Active tokens are
+// remembered for a short while so that not every request reaches the issuer.
+func (i *Introspector) Verify(ctx context.Context, accessToken string) (*Principal, error) {
+	if accessToken == "" {
+		return nil, ErrMissingToken
+	}
+
+	key := sha256.Sum256([]byte(accessToken))
+	if principal, ok := i.cached(key); ok {
+		return principal, nil
+	}
+
+	form := url.Values{"token": {accessToken}}
+	request, err := http.NewRequestWithContext(ctx, http.MethodPost, i.endpoint, strings.NewReader(form.Encode()))
+	if err != nil {
+		return nil, err
+	}
+	request.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	request.SetBasicAuth(url.QueryEscape(i.clientID), url.QueryEscape(i.clientSecret))
+
+	response, err := i.client.Do(request)
+	if err != nil {
+		return nil, fmt.Errorf("Failed to introspect token: %w", err)
+	}
+	defer response.Body.Close()
+	if response.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("Failed to introspect token: %s", response.Status)
+	}
+
+	var introspection introspectionResponse
+	err = json.NewDecoder(response.Body).Decode(&introspection)
+	if err != nil {
+		return nil, fmt.Errorf("Failed to introspect token: %w", err)
+	}
+	if !introspection.Active {
+		return nil, ErrInvalidToken
+	}
+
+	principal := &Principal{
+		Subject:     introspection.Sub,
+		ClientID:    introspection.ClientID,
+		OrgID:       introspection.OrgID,
+		Scope:       strings.Fields(introspection.Scope),
+		Roles:       introspection.Roles,
+		Permissions: introspection.Permissions,
+		TokenID:     introspection.Jti,
+	}
+	if introspection.ClientID == "" {
+		principal.UserID, _ = strconv.ParseInt(introspection.Sub, 10, 64)
+	}
+	if introspection.Iat != 0 {
+		principal.IssuedAt = time.Unix(introspection.Iat, 0)
+	}
+
+	expiresAt := time.Now().Add(introspectionCacheTTL)
+	if introspection.Exp != 0 {
+		principal.ExpiresAt = time.Unix(introspection.Exp, 0)
+		if principal.ExpiresAt.Before(expiresAt) {
+			expiresAt = principal.ExpiresAt
+		}
+	}
+	i.put(key, principal, expiresAt)
+	return principal, nil
+}
+
+func (i *Introspector) cached(key [sha256.Size]byte) (*Principal, bool) {
+	i.mu.Lock()
+	defer i.mu.Unlock()
+	entry, ok := i.cache[key]
+	if !ok || time.Now().After(entry.expiresAt) {
+		return nil, false
+	}
+	return entry.principal, true
+}
+
+func (i *Introspector) put(key [sha256.Size]byte, principal *Principal, expiresAt time.Time) {
+	now := time.Now()
+	i.mu.Lock()
+	defer i.mu.Unlock()
+	if now.Sub(i.lastPrune) > introspectionCacheTTL {
+		for k, entry := range i.cache {
+			if now.After(entry.expiresAt) {
+				delete(i.cache, k)
+			}
+		}
+		i.lastPrune = now
+	}
+	i.cache[key] = cachedIntrospection{principal: principal, expiresAt: expiresAt}
+}
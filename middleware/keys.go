@@ -0,0 +1,231 @@
+package middleware
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/rsa"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"math/big"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// KeySource resolves the key that verifies a token, given the kid and alg
+// from its header.
+type KeySource interface {
+	Key(ctx context.Context, kid, alg string) (interface{}, error)
+}
+
+var ErrUnknownKey = errors.New("Unknown signing key")
+
+type staticKey struct {
+	alg string
+	key interface{}
+}
+
+// StaticKey verifies tokens with a single key held locally: the shared
+// secret as a []byte for the HMAC algorithms, otherwise the public key.
+func StaticKey(alg string, key interface{}) KeySource {
+	return &staticKey{alg: alg, key: key}
+}
+
+func (s *staticKey) Key(ctx context.Context, kid, alg string) (interface{}, error) {
+	if alg != s.alg {
+		return nil, fmt.Errorf("unexpected signing method: %v", alg)
+	}
+	return s.key, nil
+}
+
+// jwksRefreshInterval bounds how long a key rotation takes to be picked up.
+// Tokens naming an unknown kid trigger an earlier fetch, but at most once
+// per jwksMinRefetchInterval so that forged kids cannot flood the issuer.
+const (
+	jwksRefreshInterval    = 5 * time.Minute
+	jwksMinRefetchInterval = 10 * time.Second
+	jwksFetchTimeout       = 10 * time.Second
+)
+
+// JWKS fetches the public keys published at the issuer's
+// /.well-known/jwks.json and caches them. Keys that fail to refresh stay in
+// use until a fetch succeeds.
+type JWKS struct {
+	url       string
+	client    *http.Client
+	mu        sync.RWMutex
+	keys      map[string]jwksKey
+	fetchedAt time.Time
+	fetchMu   sync.Mutex
+}
+
+type jwksKey struct {
+	alg string
+	key interface{}
+}
+
+type jwk struct {
+	Kty string `json:"kty"`
+	Use string `json:"use"`
+	Alg string `json:"alg"`
+	Kid string `json:"kid"`
+	N   string `json:"n"`
+	E   string `json:"e"`
+	Crv string `json:"crv"`
+	X   string `json:"x"`
+	Y   string `json:"y"`
+}
+
+func NewJWKS(url string) *JWKS {
+	return &JWKS{
+		url:    url,
+		client: &http.Client{Timeout: jwksFetchTimeout},
+		keys:   map[string]jwksKey{},
+	}
+}
+
+func (j *JWKS) Key(ctx context.Context, kid, alg string) (interface{}, error) {
+	if kid == "" {
+		return nil, fmt.Errorf("Token has no key id")
+	}
+
+	key, found, fetchedAt := j.lookup(kid)
+	stale := time.Since(fetchedAt) > jwksRefreshInterval
+	if stale || (!found && time.Since(fetchedAt) > jwksMinRefetchInterval) {
+		err := j.refresh(ctx, fetchedAt)
+		if err != nil {
+			log.Printf("Failed to fetch JWKS from %s: %v", j.url, err)
+		}
+		key, found, _ = j.lookup(kid)
+	}
+	if !found {
+		return nil, ErrUnknownKey
+	}
+	if key.alg != "" && key.alg != alg {
+		return nil, fmt.Errorf("unexpected signing method: %v", alg)
+	}
+	return key.key, nil
+}
+
+func (j *JWKS) lookup(kid string) (jwksKey, bool, time.Time) {
+	j.mu.RLock()
+	defer j.mu.RUnlock()
+	key, ok := j.keys[kid]
+	return key, ok, j.fetchedAt
+}
+
+// refresh fetches the key set unless another request already did since
+// seenFetchedAt.
+func (j *JWKS) refresh(ctx context.Context, seenFetchedAt time.Time) error {
+	j.fetchMu.Lock()
+	defer j.fetchMu.Unlock()
+
+	j.mu.RLock()
+	fetchedAt := j.fetchedAt
+	j.mu.RUnlock()
+	if fetchedAt.After(seenFetchedAt) {
+		return nil
+	}
+
+	// Failed fetches count as fetches too, so an unreachable issuer is not
+	// retried on every request.
+	defer func() {
+		j.mu.Lock()
+		j.fetchedAt = time.Now()
+		j.mu.Unlock()
+	}()
+
+	request, err := http.NewRequestWithContext(ctx, http.MethodGet, j.url, nil)
+	if err != nil {
+		return err
+	}
+	response, err := j.client.Do(request)
+	if err != nil {
+		return err
+	}
+	defer response.Body.Close()
+	if response.StatusCode != http.StatusOK {
+		return fmt.Errorf("Unexpected status %s", response.Status)
+	}
+
+	var set struct {
+		Keys []jwk `json:"keys"`
+	}
+	err = json.NewDecoder(response.Body).Decode(&set)
+	if err != nil {
+		return fmt.Errorf("Invalid JWKS: %w", err)
+	}
+
+	keys := map[string]jwksKey{}
+	for _, k := range set.Keys {
+		if k.Kid == "" || (k.Use != "" && k.Use != "sig") {
+			continue
+		}
+		publicKey, err := k.publicKey()
+		if err != nil {
+			log.Printf("Skipping JWKS key %s: %v", k.Kid, err)
+			continue
+		}
+		keys[k.Kid] = jwksKey{alg: k.Alg, key: publicKey}
+	}
+
+	j.mu.Lock()
+	j.keys = keys
+	j.mu.Unlock()
+	return nil
+}
+
+func (k jwk) publicKey() (interface{}, error) {
+	decode := base64.RawURLEncoding.DecodeString
+	switch k.Kty {
+	case "RSA":
+		n, err := decode(k.N)
+		if err != nil {
+			return nil, err
+		}
+		e, err := decode(k.E)
+		if err != nil {
+			return nil, err
+		}
+		return &rsa.PublicKey{N: new(big.Int).SetBytes(n), E: int(new(big.Int).SetBytes(e).Int64())}, nil
+	case "EC":
+		var curve elliptic.Curve
+		switch k.Crv {
+		case "P-256":
+			curve = elliptic.P256()
+		case "P-384":
+			curve = elliptic.P384()
+		case "P-521":
+			curve = elliptic.P521()
+		default:
+			return nil, fmt.Errorf("Unsupported curve %s", k.Crv)
+		}
+		x, err := decode(k.X)
+		if err != nil {
+			return nil, err
+		}
+		y, err := decode(k.Y)
+		if err != nil {
+			return nil, err
+		}
+		return &ecdsa.PublicKey{Curve: curve, X: new(big.Int).SetBytes(x), Y: new(big.Int).SetBytes(y)}, nil
+	case "OKP":
+		if k.Crv != "Ed25519" {
+			return nil, fmt.Errorf("Unsupported curve %s", k.Crv)
+		}
+		x, err := decode(k.X)
+		if err != nil {
+			return nil, err
+		}
+		if len(x) != ed25519.PublicKeySize {
+			return nil, fmt.Errorf("Invalid Ed25519 key")
+		}
+		return ed25519.PublicKey(x), nil
+	}
+	return nil, fmt.Errorf("Unsupported key type %s", k.Kty)
+}
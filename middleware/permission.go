@@ -0,0 +1,132 @@
+package middleware
+
+import (
+	"context"
+	"jwt-auth/auth"
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+// ClaimsVerifier validates an access token and returns its claims.
+// *auth.JWTManager is one.
+type ClaimsVerifier interface {
+	ParseAccessToken(accessToken string) (*auth.Claims, error)
+}
+
+type claimsKey struct{}
+
+// Authenticate verifies the bearer token of every request against the
+// issuer's own key ring and denylist, and stores its claims and principal
+// in the request context. Like Authenticator without an Audience, it refuses
+// audience-bound tokens. Services without the issuer's database use
+// Authenticator instead.
+//
+//	mux.Handle("/orders", middleware.Authenticate(jwtManager)(
+//		middleware.RequirePermission("orders:read")(ordersHandler)))
+func Authenticate(verifier ClaimsVerifier) func(http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(writer http.ResponseWriter, request *http.Request) {
+			accessToken, ok := bearerToken(request)
+			if !ok {
+				writeChallenge(writer, "", http.StatusBadRequest, "invalid_request", "Malformed Authorization header", "")
+				return
+			}
+			if accessToken == "" {
+				writeChallenge(writer, "", http.StatusUnauthorized, "", "", "")
+				return
+			}
+			claims, err := verifier.ParseAccessToken(accessToken)
+			if err != nil {
+				writeChallenge(writer, "", http.StatusUnauthorized, "invalid_token", "The access token is invalid", "")
+				return
+			}
+			// Tokens exchanged for an audience are meant for that resource
+			// server, which verifies them with Authenticator.
+			if len(claims.Audience) > 0 {
+				writeChallenge(writer, "", http.StatusUnauthorized, "invalid_token", "The access token is restricted to another audience", "")
+				return
+			}
+			ctx := context.WithValue(request.Context(), claimsKey{}, claims)
+			next.ServeHTTP(writer, request.WithContext(WithPrincipal(ctx, claimsPrincipal(claims))))
+		})
+	}
+}
+
+// ClaimsFromContext returns the claims stored by Authenticate.
+func ClaimsFromContext(ctx context.Context) (*auth.Claims, bool) {
+	claims, ok := ctx.Value(claimsKey{}).(*auth.Claims)
+	return claims, ok
+}
+
+func claimsPrincipal(claims *auth.Claims) *Principal {
+	principal := &Principal{
+		Subject:     claims.Subject,
+		UserID:      claims.UserID,
+		ClientID:    claims.ClientID,
+		OrgID:       claims.OrgID,
+		Scope:       strings.Fields(claims.Scope),
+		Roles:       claims.Roles,
+		Permissions: claims.Permissions,
+		TokenID:     claims.ID,
+	}
+	if principal.Subject == "" && principal.UserID != 0 {
+		principal.Subject = strconv.FormatInt(principal.UserID, 10)
+	}
+	if claims.Act != nil {
+		principal.Actor = claims.Act.Sub
+	}
+	if claims.IssuedAt != nil {
+		principal.IssuedAt = claims.IssuedAt.Time
+	}
+	if claims.ExpiresAt != nil {
+		principal.ExpiresAt = claims.ExpiresAt.Time
+	}
+	return principal
+}
+
+// RequirePermission lets a request through only if its token grants every
+// one of the permissions. It must be wrapped by Authenticate or
+// Authenticator.Authenticate:
+//
+//	mux.Handle("/orders", authenticator.Authenticate(
+//		middleware.RequirePermission("orders:read")(ordersHandler)))
+func RequirePermission(permissions ...string) func(http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(writer http.ResponseWriter, request *http.Request) {
+			principal, ok := PrincipalFromContext(request.Context())
+			if !ok {
+				writeChallenge(writer, "", http.StatusUnauthorized, "", "", "")
+				return
+			}
+			for _, permission := range permissions {
+				if !principal.HasPermission(permission) {
+					writeChallenge(writer, "", http.StatusForbidden, "insufficient_scope", "Missing permission "+permission, "")
+					return
+				}
+			}
+			next.ServeHTTP(writer, request)
+		})
+	}
+}
+
+// RequireScope is RequirePermission for OAuth scopes, for tokens issued to
+// clients.
+func RequireScope(scopes ...string) func(http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(writer http.ResponseWriter, request *http.Request) {
+			principal, ok := PrincipalFromContext(request.Context())
+			if !ok {
+				writeChallenge(writer, "", http.StatusUnauthorized, "", "", "")
+				return
+			}
+			for _, scope := range scopes {
+				if !principal.HasScope(scope) {
+					writeChallenge(writer, "", http.StatusForbidden, "insufficient_scope", "", strings.Join(scopes, " "))
+					return
+				}
+			}
+			next.ServeHTTP(writer, request)
+		})
+	}
+}
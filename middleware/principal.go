@@ -0,0 +1,56 @@
+package middleware
+
+import (
+	"context"
+	"slices"
+	"time"
+)
+
+// Principal is the verified caller of a request: a user, or a client that
+// authenticated with the client_credentials grant.
+type Principal struct {
+	Subject     string
+	UserID      int64
+	ClientID    string
+	OrgID       int64
+	Scope       []string
+	Roles       []string
+	Permissions []string
+	// Actor is the client acting on the user's behalf in a token obtained
+	// through token exchange.
+	Actor     string
+	TokenID   string
+	IssuedAt  time.Time
+	ExpiresAt time.Time
+}
+
+// IsClient reports whether the principal is a client rather than a user.
+func (p *Principal) IsClient() bool {
+	return p.UserID == 0 && p.ClientID != ""
+}
+
+func (p *Principal) HasPermission(permission string) bool {
+	return slices.Contains(p.Permissions, permission)
+}
+
+// HasScope reports whether the token was granted scope. Tokens a user got
+// from /login directly carry no scope and are not limited by one.
+func (p *Principal) HasScope(scope string) bool {
+	if len(p.Scope) == 0 && p.ClientID == "" {
+		return true
+	}
+	return slices.Contains(p.Scope, scope)
+}
+
+type principalKey struct{}
+
+// WithPrincipal returns a copy of ctx carrying principal.
+func WithPrincipal(ctx context.Context, principal *Principal) context.Context {
+	return context.WithValue(ctx, principalKey{}, principal)
+}
+
+// PrincipalFromContext returns the principal stored by Authenticate.
+func PrincipalFromContext(ctx context.Context) (*Principal, bool) {
+	principal, ok := ctx.Value(principalKey{}).(*Principal)
+	return principal, ok
+}
@@ -0,0 +1,9 @@
+CREATE TABLE signing_keys(
+    id VARCHAR(255) PRIMARY KEY,
+    algorithm VARCHAR(16) NOT NULL,
+    key_material TEXT NOT NULL,
+    state VARCHAR(16) NOT NULL,
+    activates_at TIMESTAMP NOT NULL,
+    expires_at TIMESTAMP,
+    created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP
+);
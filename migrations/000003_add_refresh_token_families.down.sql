@@ -0,0 +1,5 @@
+DROP INDEX refresh_tokens_family_id_idx;
+
+ALTER TABLE refresh_tokens DROP COLUMN used_at;
+ALTER TABLE refresh_tokens DROP COLUMN parent_id;
+ALTER TABLE refresh_tokens DROP COLUMN family_id;
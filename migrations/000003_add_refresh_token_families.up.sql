@@ -0,0 +1,8 @@
+ALTER TABLE refresh_tokens ADD COLUMN family_id VARCHAR(255);
+ALTER TABLE refresh_tokens ADD COLUMN parent_id VARCHAR(255);
+ALTER TABLE refresh_tokens ADD COLUMN used_at TIMESTAMP;
+
+UPDATE refresh_tokens SET family_id = id;
+ALTER TABLE refresh_tokens ALTER COLUMN family_id SET NOT NULL;
+
+CREATE INDEX refresh_tokens_family_id_idx ON refresh_tokens(family_id);
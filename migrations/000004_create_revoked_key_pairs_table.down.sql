@@ -0,0 +1,3 @@
+ALTER TABLE users DROP COLUMN banned_at;
+
+DROP TABLE revoked_key_pairs;
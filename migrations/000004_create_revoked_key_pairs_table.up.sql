@@ -0,0 +1,9 @@
+CREATE TABLE revoked_key_pairs(
+    keyPairId VARCHAR(255) PRIMARY KEY,
+    expires_at TIMESTAMP NOT NULL,
+    revoked_at TIMESTAMP NOT NULL
+);
+
+CREATE INDEX revoked_key_pairs_revoked_at_idx ON revoked_key_pairs(revoked_at);
+
+ALTER TABLE users ADD COLUMN banned_at TIMESTAMP;
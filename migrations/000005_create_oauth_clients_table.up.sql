@@ -0,0 +1,6 @@
+CREATE TABLE oauth_clients(
+    id VARCHAR(255) PRIMARY KEY,
+    secret TEXT,
+    name VARCHAR(255) NOT NULL,
+    created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP
+);
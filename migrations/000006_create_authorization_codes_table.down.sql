@@ -0,0 +1,5 @@
+ALTER TABLE refresh_tokens DROP COLUMN scope;
+ALTER TABLE refresh_tokens DROP COLUMN client_id;
+
+DROP TABLE authorization_codes;
+DROP TABLE oauth_client_redirect_uris;
@@ -0,0 +1,21 @@
+CREATE TABLE oauth_client_redirect_uris(
+    client_id VARCHAR(255) REFERENCES oauth_clients(id) ON DELETE CASCADE,
+    redirect_uri TEXT NOT NULL,
+    PRIMARY KEY (client_id, redirect_uri)
+);
+
+CREATE TABLE authorization_codes(
+    code VARCHAR(255) PRIMARY KEY,
+    client_id VARCHAR(255) NOT NULL REFERENCES oauth_clients(id) ON DELETE CASCADE,
+    userId INTEGER NOT NULL REFERENCES users(id),
+    redirect_uri TEXT NOT NULL,
+    scope TEXT NOT NULL,
+    code_challenge VARCHAR(255) NOT NULL,
+    family_id VARCHAR(255),
+    issued_at TIMESTAMP NOT NULL,
+    expires_at TIMESTAMP NOT NULL,
+    used_at TIMESTAMP
+);
+
+ALTER TABLE refresh_tokens ADD COLUMN client_id VARCHAR(255);
+ALTER TABLE refresh_tokens ADD COLUMN scope TEXT;
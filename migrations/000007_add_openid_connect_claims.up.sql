@@ -0,0 +1,6 @@
+ALTER TABLE users ADD COLUMN name VARCHAR(255);
+ALTER TABLE users ADD COLUMN email VARCHAR(255) UNIQUE;
+ALTER TABLE users ADD COLUMN email_verified BOOLEAN NOT NULL DEFAULT FALSE;
+
+ALTER TABLE authorization_codes ADD COLUMN nonce TEXT;
+ALTER TABLE authorization_codes ADD COLUMN auth_time TIMESTAMP;
@@ -0,0 +1,2 @@
+ALTER TABLE oauth_clients DROP COLUMN access_token_lifetime;
+ALTER TABLE oauth_clients DROP COLUMN scope;
@@ -0,0 +1,2 @@
+ALTER TABLE oauth_clients ADD COLUMN scope TEXT NOT NULL DEFAULT '';
+ALTER TABLE oauth_clients ADD COLUMN access_token_lifetime INTEGER;
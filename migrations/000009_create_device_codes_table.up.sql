@@ -0,0 +1,12 @@
+CREATE TABLE device_codes(
+    device_code VARCHAR(255) PRIMARY KEY,
+    user_code VARCHAR(16) UNIQUE NOT NULL,
+    client_id VARCHAR(255) NOT NULL REFERENCES oauth_clients(id) ON DELETE CASCADE,
+    userId INTEGER REFERENCES users(id),
+    status VARCHAR(16) NOT NULL DEFAULT 'pending',
+    poll_interval INTEGER NOT NULL,
+    last_polled_at TIMESTAMP,
+    family_id VARCHAR(255),
+    issued_at TIMESTAMP NOT NULL,
+    expires_at TIMESTAMP NOT NULL
+);
@@ -0,0 +1,12 @@
+DROP INDEX refresh_tokens_org_id_idx;
+ALTER TABLE refresh_tokens DROP COLUMN org_id;
+
+DROP TABLE organization_members;
+
+ALTER TABLE users DROP CONSTRAINT users_org_id_email_key;
+ALTER TABLE users ADD CONSTRAINT users_email_key UNIQUE (email);
+ALTER TABLE users DROP CONSTRAINT users_org_id_username_key;
+ALTER TABLE users ADD CONSTRAINT users_username_key UNIQUE (username);
+ALTER TABLE users DROP COLUMN org_id;
+
+DROP TABLE organizations;
@@ -0,0 +1,32 @@
+CREATE TABLE organizations(
+    id SERIAL PRIMARY KEY,
+    slug VARCHAR(63) UNIQUE NOT NULL,
+    name VARCHAR(255) NOT NULL,
+    created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP
+);
+
+INSERT INTO organizations (slug, name) VALUES ('default', 'Default');
+
+ALTER TABLE users ADD COLUMN org_id INTEGER REFERENCES organizations(id);
+UPDATE users SET org_id = (SELECT id FROM organizations WHERE slug = 'default');
+ALTER TABLE users ALTER COLUMN org_id SET NOT NULL;
+
+ALTER TABLE users DROP CONSTRAINT users_username_key;
+ALTER TABLE users ADD CONSTRAINT users_org_id_username_key UNIQUE (org_id, username);
+ALTER TABLE users DROP CONSTRAINT users_email_key;
+ALTER TABLE users ADD CONSTRAINT users_org_id_email_key UNIQUE (org_id, email);
+
+CREATE TABLE organization_members(
+    org_id INTEGER REFERENCES organizations(id) ON DELETE CASCADE,
+    userId INTEGER REFERENCES users(id) ON DELETE CASCADE,
+    role VARCHAR(16) NOT NULL DEFAULT 'member',
+    created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+    PRIMARY KEY (org_id, userId)
+);
+
+INSERT INTO organization_members (org_id, userId) SELECT org_id, id FROM users;
+
+ALTER TABLE refresh_tokens ADD COLUMN org_id INTEGER REFERENCES organizations(id);
+UPDATE refresh_tokens SET org_id = users.org_id FROM users WHERE users.id = refresh_tokens.userId;
+
+CREATE INDEX refresh_tokens_org_id_idx ON refresh_tokens(org_id);
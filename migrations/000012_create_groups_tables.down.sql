@@ -0,0 +1,4 @@
+DROP TABLE group_roles;
+DROP TABLE group_subgroups;
+DROP TABLE group_members;
+DROP TABLE groups;
@@ -0,0 +1,26 @@
+CREATE TABLE groups(
+    id SERIAL PRIMARY KEY,
+    name VARCHAR(64) UNIQUE NOT NULL,
+    created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP
+);
+
+CREATE TABLE group_members(
+    group_id INTEGER REFERENCES groups(id) ON DELETE CASCADE,
+    userId INTEGER REFERENCES users(id) ON DELETE CASCADE,
+    PRIMARY KEY (group_id, userId)
+);
+
+CREATE TABLE group_subgroups(
+    group_id INTEGER REFERENCES groups(id) ON DELETE CASCADE,
+    member_group_id INTEGER REFERENCES groups(id) ON DELETE CASCADE,
+    PRIMARY KEY (group_id, member_group_id),
+    CHECK (group_id <> member_group_id)
+);
+
+CREATE INDEX group_subgroups_member_group_id_idx ON group_subgroups(member_group_id);
+
+CREATE TABLE group_roles(
+    group_id INTEGER REFERENCES groups(id) ON DELETE CASCADE,
+    role_id INTEGER REFERENCES roles(id) ON DELETE CASCADE,
+    PRIMARY KEY (group_id, role_id)
+);
@@ -0,0 +1,22 @@
+CREATE TABLE webauthn_credentials(
+    id VARCHAR(255) PRIMARY KEY,
+    credential_id BYTEA UNIQUE NOT NULL,
+    userId INTEGER NOT NULL REFERENCES users(id) ON DELETE CASCADE,
+    name VARCHAR(64) NOT NULL,
+    public_key BYTEA NOT NULL,
+    algorithm INTEGER NOT NULL,
+    sign_count BIGINT NOT NULL DEFAULT 0,
+    transports VARCHAR(255) NOT NULL DEFAULT '',
+    aaguid VARCHAR(36) NOT NULL,
+    created_at TIMESTAMP NOT NULL DEFAULT CURRENT_TIMESTAMP,
+    last_used_at TIMESTAMP
+);
+
+CREATE INDEX webauthn_credentials_userId_idx ON webauthn_credentials(userId);
+
+CREATE TABLE webauthn_challenges(
+    challenge_hash VARCHAR(64) PRIMARY KEY,
+    ceremony VARCHAR(16) NOT NULL,
+    userId INTEGER REFERENCES users(id) ON DELETE CASCADE,
+    expires_at TIMESTAMP NOT NULL
+);
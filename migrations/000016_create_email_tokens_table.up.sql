@@ -0,0 +1,10 @@
+CREATE TABLE email_tokens(
+    token_hash VARCHAR(64) PRIMARY KEY,
+    userId INTEGER NOT NULL REFERENCES users(id) ON DELETE CASCADE,
+    purpose VARCHAR(16) NOT NULL,
+    email VARCHAR(255) NOT NULL,
+    created_at TIMESTAMP NOT NULL DEFAULT CURRENT_TIMESTAMP,
+    expires_at TIMESTAMP NOT NULL
+);
+
+CREATE INDEX email_tokens_userId_purpose_idx ON email_tokens(userId, purpose);
@@ -0,0 +1,10 @@
+CREATE TABLE login_throttles(
+    scope VARCHAR(8) NOT NULL,
+    key VARCHAR(320) NOT NULL,
+    failures INTEGER NOT NULL DEFAULT 0,
+    last_failure_at TIMESTAMP NOT NULL,
+    blocked_until TIMESTAMP NOT NULL,
+    PRIMARY KEY (scope, key)
+);
+
+CREATE INDEX login_throttles_last_failure_at_idx ON login_throttles(last_failure_at);
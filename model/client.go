@@ -0,0 +1,13 @@
+package model
+
+import "time"
+
+type Client struct {
+	ID                  string    `json:"client_id"`
+	Name                string    `json:"name"`
+	Confidential        bool      `json:"confidential"`
+	RedirectURIs        []string  `json:"redirect_uris"`
+	Scope               string    `json:"scope"`
+	AccessTokenLifetime int64     `json:"access_token_lifetime,omitempty"`
+	CreatedAt           time.Time `json:"created_at"`
+}
@@ -0,0 +1,13 @@
+package model
+
+import "time"
+
+// Group lists its direct members only. Users of member groups, and of their
+// member groups in turn, inherit the group's roles as well.
+type Group struct {
+	Name      string    `json:"name"`
+	Users     []int64   `json:"users"`
+	Groups    []string  `json:"groups"`
+	Roles     []string  `json:"roles"`
+	CreatedAt time.Time `json:"created_at"`
+}
@@ -0,0 +1,8 @@
+package model
+
+// TOTPEnrollment is the secret to add to an authenticator app, as is and as
+// an otpauth:// URI for QR codes.
+type TOTPEnrollment struct {
+	Secret string `json:"secret"`
+	URI    string `json:"uri"`
+}
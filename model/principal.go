@@ -0,0 +1,9 @@
+package model
+
+// Principal is whoever an access token was issued to: a user, or a client
+// acting on its own behalf through the client_credentials grant.
+type Principal struct {
+	UserID   int64  `json:"userId,omitempty"`
+	ClientID string `json:"clientId,omitempty"`
+	Scope    string `json:"scope,omitempty"`
+}
@@ -0,0 +1,9 @@
+package model
+
+import "time"
+
+type Role struct {
+	Name        string    `json:"name"`
+	Permissions []string  `json:"permissions"`
+	CreatedAt   time.Time `json:"created_at"`
+}
@@ -0,0 +1,14 @@
+package model
+
+import "time"
+
+type Session struct {
+	ID         string    `json:"id"`
+	UserID     int64     `json:"user_id,omitempty"`
+	UserAgent  string    `json:"user_agent"`
+	AgentIp    string    `json:"agent_ip"`
+	SignedInAt time.Time `json:"signed_in_at"`
+	IssuedAt   time.Time `json:"issued_at"`
+	ExpiresAt  time.Time `json:"expires_at"`
+	Current    bool      `json:"current"`
+}
@@ -4,4 +4,7 @@ type User struct {
 	ID int `json:"id"`
 	Username string`json:"username"`
 	Password string `json:"password"`
+	Name string `json:"name,omitempty"`
+	Email string `json:"email,omitempty"`
+	OrgID int64 `json:"org_id,omitempty"`
 }
@@ -2,23 +2,67 @@ package router
 
 import (
 	"jwt-auth/handler"
-	"jwt-auth/service"
 	"net/http"
 
 	"github.com/swaggo/http-swagger"
 	_ "jwt-auth/docs"
 )
 
-func SetupRoutes(authService service.AuthService) http.Handler {
-	handler := &handler.Handler{
-		AuthService: authService,
-	}
+func SetupRoutes(handler *handler.Handler) http.Handler {
 	mux := http.NewServeMux()
 	mux.HandleFunc("/register", handler.RegisterHandler)
 	mux.HandleFunc("/login", handler.LoginHandler)
+	mux.HandleFunc("/login/mfa", handler.MFALoginHandler)
+	mux.HandleFunc("/login/passkey/begin", handler.PasskeyLoginBeginHandler)
+	mux.HandleFunc("/login/passkey/finish", handler.PasskeyLoginFinishHandler)
+	mux.HandleFunc("/verify-email", handler.VerifyEmailHandler)
+	mux.HandleFunc("/password/forgot", handler.ForgotPasswordHandler)
+	mux.HandleFunc("/password/reset", handler.ResetPasswordHandler)
+	mux.HandleFunc("/password/change", handler.ChangePasswordHandler)
+	mux.HandleFunc("/account/unlock", handler.AccountUnlockHandler)
 	mux.HandleFunc("/refresh_tokens", handler.RefreshTokensHandler)
 	mux.HandleFunc("/logout", handler.LogoutHandler)
 	mux.HandleFunc("/user", handler.UserAccessPointHandler)
+	mux.HandleFunc("/sessions", handler.SessionsHandler)
+	mux.HandleFunc("/sessions/{id}", handler.SessionHandler)
+	mux.HandleFunc("/mfa/totp", handler.TOTPEnrollmentHandler)
+	mux.HandleFunc("/mfa/totp/confirm", handler.TOTPConfirmHandler)
+	mux.HandleFunc("/mfa/recovery_codes", handler.RecoveryCodesHandler)
+	mux.HandleFunc("/passkeys", handler.PasskeysHandler)
+	mux.HandleFunc("/passkeys/{id}", handler.PasskeyHandler)
+	mux.HandleFunc("/passkeys/register/begin", handler.PasskeyRegistrationBeginHandler)
+	mux.HandleFunc("/passkeys/register/finish", handler.PasskeyRegistrationFinishHandler)
+	mux.HandleFunc("/personal_access_tokens", handler.PersonalAccessTokensHandler)
+	mux.HandleFunc("/personal_access_tokens/{id}", handler.PersonalAccessTokenHandler)
+	mux.HandleFunc("/org/sessions", handler.OrganizationSessionsHandler)
+	mux.HandleFunc("/org/sessions/{id}", handler.OrganizationSessionHandler)
+	mux.HandleFunc("/.well-known/jwks.json", handler.JWKSHandler)
+	mux.HandleFunc("/.well-known/openid-configuration", handler.OpenIDConfigurationHandler)
+	mux.HandleFunc("/userinfo", handler.UserInfoHandler)
+	mux.HandleFunc("/authorize", handler.AuthorizeHandler)
+	mux.HandleFunc("/token", handler.TokenHandler)
+	mux.HandleFunc("/device/code", handler.DeviceCodeHandler)
+	mux.HandleFunc("/device", handler.DeviceVerificationHandler)
+	mux.HandleFunc("/introspect", handler.IntrospectHandler)
+	mux.HandleFunc("/revoke", handler.RevokeHandler)
+
+	mux.HandleFunc("/admin/clients", handler.ClientsHandler)
+	mux.HandleFunc("/admin/keys", handler.SigningKeysHandler)
+	mux.HandleFunc("/admin/keys/rotate", handler.RotateSigningKeyHandler)
+	mux.HandleFunc("/admin/groups", handler.GroupsHandler)
+	mux.HandleFunc("/admin/groups/{name}", handler.GroupHandler)
+	mux.HandleFunc("/admin/groups/{name}/users/{id}", handler.GroupUserHandler)
+	mux.HandleFunc("/admin/groups/{name}/groups/{member}", handler.GroupSubgroupHandler)
+	mux.HandleFunc("/admin/groups/{name}/roles/{role}", handler.GroupRoleHandler)
+	mux.HandleFunc("/admin/organizations", handler.OrganizationsHandler)
+	mux.HandleFunc("/admin/organizations/{slug}/members/{id}", handler.OrganizationMemberHandler)
+	mux.HandleFunc("/admin/roles", handler.RolesHandler)
+	mux.HandleFunc("/admin/roles/{name}", handler.RoleHandler)
+	mux.HandleFunc("/admin/users/{id}/ban", handler.BanUserHandler)
+	mux.HandleFunc("/admin/users/{id}/mfa", handler.ResetMFAHandler)
+	mux.HandleFunc("/admin/users/{id}/lockout", handler.UnlockUserHandler)
+	mux.HandleFunc("/admin/users/{id}/roles", handler.UserRolesHandler)
+	mux.HandleFunc("/admin/users/{id}/roles/{role}", handler.UserRoleHandler)
 
 	mux.HandleFunc("/swagger/", httpSwagger.WrapHandler)
 
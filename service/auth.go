@@ -3,11 +3,15 @@ package service
 import (
 	"context"
 	"database/sql"
+	"errors"
 	"jwt-auth/auth"
 	"jwt-auth/model"
+	"log"
+	"strconv"
+	"sync"
+	"time"
 
 	"github.com/google/uuid"
-	"golang.org/x/crypto/bcrypt"
 )
 
 type AuthService interface {
@@ -15,28 +19,80 @@ type AuthService interface {
 	LoginUser(ctx context.Context, user model.User, userAgent, agentIp string) (int64, string, string, error)
 	RefreshTokens(ctx context.Context, accessToken, userAgent, agentIp, refreshToken string) (string, string, error)
 	LogoutUser(ctx context.Context, refreshTokenString string) error
-	UserAccessPoint(ctx context.Context, accessToken string) (int64, error)
+	UserAccessPoint(ctx context.Context, accessToken, agentIp string) (model.Principal, error)
+	AuthenticateAccessToken(ctx context.Context, accessToken string) (*auth.Claims, error)
+	AuthenticateBearerToken(ctx context.Context, token, agentIp string) (*auth.Claims, error)
+	ListSessions(ctx context.Context, accessToken string) ([]model.Session, error)
+	GetSession(ctx context.Context, accessToken, sessionID string) (model.Session, error)
+	RevokeSession(ctx context.Context, accessToken, sessionID string) error
+	RevokeOtherSessions(ctx context.Context, accessToken string) (int64, error)
+	ChangePassword(ctx context.Context, accessToken, currentPassword, newPassword string, signOutEverywhere bool, agentIp string) (int64, error)
+	IntrospectToken(ctx context.Context, token, tokenTypeHint string) model.Introspection
+	RevokeToken(ctx context.Context, client model.Client, token, tokenTypeHint string) error
+	BanUser(ctx context.Context, userId int64) error
+	UnbanUser(ctx context.Context, userId int64) error
+	UnlockUser(ctx context.Context, userId int64) error
+	JWKS() auth.JWKS
+	ListSigningKeys(ctx context.Context) ([]auth.KeyInfo, error)
+	RotateSigningKey(ctx context.Context, activateAt time.Time) (auth.KeyInfo, error)
 }
 
+var (
+	ErrSessionNotFound    = errors.New("Session not found")
+	ErrUserNotFound       = errors.New("User not found")
+	ErrUserBanned         = errors.New("User is banned")
+	ErrInvalidCredentials = errors.New("Invalid username or password")
+)
+
 type authService struct {
-	db         *sql.DB
-	jwtManager *auth.JWTManager
+	db             *sql.DB
+	jwtManager     *auth.JWTManager
+	passwordPolicy *PasswordPolicy
+	passwordHasher PasswordHasher
+	loginThrottle  *LoginThrottle
+	emailService   EmailService
+
+	dummyPasswordOnce sync.Once
+	dummyPassword     string
 }
 
-func NewAuthService(db *sql.DB, jwtManager *auth.JWTManager) AuthService {
+func NewAuthService(db *sql.DB, jwtManager *auth.JWTManager, passwordPolicy *PasswordPolicy, passwordHasher PasswordHasher, loginThrottle *LoginThrottle, emailService EmailService) AuthService {
 	return &authService{
-		db:         db,
-		jwtManager: jwtManager,
+		db:             db,
+		jwtManager:     jwtManager,
+		passwordPolicy: passwordPolicy,
+		passwordHasher: passwordHasher,
+		loginThrottle:  loginThrottle,
+		emailService:   emailService,
 	}
 }
 
+// RegisterUser creates the user and, when they gave an email, sends them a
+// verification link. A failed email can be sent again through
+// EmailService.RequestVerificationEmail.
 func (a *authService) RegisterUser(ctx context.Context, user model.User) (int64, error) {
-	hashedPassword, err := bcrypt.GenerateFromPassword([]byte(user.Password), bcrypt.DefaultCost)
+	userId, err := a.registerUser(ctx, user)
 	if err != nil {
 		return 0, err
 	}
+	if user.Email != "" {
+		err = a.emailService.SendVerificationEmail(ctx, userId)
+		if err != nil {
+			log.Printf("Failed to send a verification email: %v", err)
+		}
+	}
+	return userId, nil
+}
 
-	var userId int64
+func (a *authService) registerUser(ctx context.Context, user model.User) (userId int64, err error) {
+	err = a.passwordPolicy.Validate(user.Password, user.Username)
+	if err != nil {
+		return 0, err
+	}
+	hashedPassword, err := a.passwordHasher.Hash(user.Password)
+	if err != nil {
+		return 0, err
+	}
 
 	tx, err := a.db.Begin()
 	if err != nil {
@@ -54,34 +110,87 @@ func (a *authService) RegisterUser(ctx context.Context, user model.User) (int64,
 		}
 	}()
 	err = tx.QueryRowContext(ctx,
-		"INSERT INTO users (username, password) VALUES ($1, $2) RETURNING id",
-		user.Username, string(hashedPassword),
+		"INSERT INTO users (username, password, name, email, org_id) VALUES ($1, $2, $3, $4, $5) RETURNING id",
+		user.Username, hashedPassword,
+		sql.NullString{String: user.Name, Valid: user.Name != ""},
+		sql.NullString{String: user.Email, Valid: user.Email != ""},
+		user.OrgID,
 	).Scan(&userId)
 	if err != nil {
 		return 0, err
 	}
 
+	_, err = tx.ExecContext(ctx,
+		"INSERT INTO organization_members (org_id, userId) VALUES ($1, $2)",
+		user.OrgID, userId,
+	)
+	if err != nil {
+		return 0, err
+	}
+
 	return userId, nil
 }
 
+// LoginUser checks the user's password and issues a token pair, or for users
+// with two-factor authentication returns an *MFARequiredError. Unknown
+// usernames and wrong passwords both give ErrInvalidCredentials, after the
+// same work, and count as failures for the login throttle.
 func (a *authService) LoginUser(ctx context.Context, user model.User, userAgent, agentIp string) (int64, string, string, error) {
+	accountKey := loginAccountKey(user.OrgID, user.Username)
+	err := a.loginThrottle.check(ctx, a.db, accountKey, agentIp)
+	if err != nil {
+		return 0, "", "", err
+	}
+
 	var userId int64
 	var storedPassword string
-	err := a.db.QueryRowContext(ctx,
-		"SELECT id, password FROM users WHERE username = $1",
-		user.Username,
-	).Scan(&userId, &storedPassword)
-	if err != nil {
+	var bannedAt sql.NullTime
+	var mfaEnabled bool
+	err = a.db.QueryRowContext(ctx,
+		`SELECT u.id, u.password, u.banned_at, t.confirmed_at IS NOT NULL
+		FROM users u LEFT JOIN user_totp t ON t.userId = u.id
+		WHERE u.username = $1 AND u.org_id = $2`,
+		user.Username, user.OrgID,
+	).Scan(&userId, &storedPassword, &bannedAt, &mfaEnabled)
+	found := err == nil
+	if errors.Is(err, sql.ErrNoRows) {
+		storedPassword = a.dummyPasswordHash()
+	} else if err != nil {
 		return 0, "", "", err
 	}
 
-	err = bcrypt.CompareHashAndPassword([]byte(storedPassword), []byte(user.Password))
+	valid, err := a.passwordHasher.Verify(user.Password, storedPassword)
+	if err != nil {
+		return 0, "", "", err
+	}
+	if !found || !valid {
+		err = a.loginThrottle.recordFailure(ctx, a.db, accountKey, agentIp)
+		if err != nil {
+			return 0, "", "", err
+		}
+		return 0, "", "", ErrInvalidCredentials
+	}
+	if bannedAt.Valid {
+		return 0, "", "", ErrUserBanned
+	}
+	if a.passwordHasher.NeedsRehash(storedPassword) {
+		a.rehashPassword(ctx, userId, user.Password, storedPassword)
+	}
+	// With two-factor authentication, CompleteLogin clears the failures.
+	if mfaEnabled {
+		challenge, err := createMFAChallenge(ctx, a.db, userId)
+		if err != nil {
+			return 0, "", "", err
+		}
+		return userId, "", "", challenge
+	}
+	err = clearLoginFailures(ctx, a.db, accountKey)
 	if err != nil {
 		return 0, "", "", err
 	}
 
 	pairID := uuid.New().String()
-	accessToken, err := a.jwtManager.GenerateAccessToken(userId, pairID)
+	accessToken, err := a.jwtManager.GenerateAccessToken(ctx, userId, pairID)
 	if err != nil {
 		return 0, "", "", err
 	}
@@ -95,23 +204,19 @@ func (a *authService) LoginUser(ctx context.Context, user model.User, userAgent,
 }
 
 func (a *authService) RefreshTokens(ctx context.Context, accessToken, userAgent, agentIp, refreshToken string) (string, string, error) {
-	userId, keyPairID, err := a.jwtManager.ValidateAccessToken(accessToken)
-	if err != nil {
-		return "", "", err
-	}
-	err = a.jwtManager.ValidateRefreshToken(ctx, userId, refreshToken, userAgent, keyPairID, agentIp)
+	userId, keyPairID, err := a.jwtManager.ValidateRefreshableAccessToken(accessToken)
 	if err != nil {
 		return "", "", err
 	}
 
 	pairID := uuid.New().String()
 
-	newAccessToken, err := a.jwtManager.GenerateAccessToken(userId, pairID)
+	newRefreshToken, err := a.jwtManager.RotateRefreshToken(ctx, userId, keyPairID, pairID, userAgent, agentIp, refreshToken)
 	if err != nil {
 		return "", "", err
 	}
 
-	newRefreshToken, err := a.jwtManager.GenerateRefreshToken(userId, pairID, userAgent, agentIp)
+	newAccessToken, err := a.jwtManager.GenerateAccessToken(ctx, userId, pairID)
 	if err != nil {
 		return "", "", err
 	}
@@ -127,19 +232,354 @@ func (a *authService) LogoutUser(ctx context.Context, refreshTokenString string)
 	return nil
 }
 
-func (a *authService) UserAccessPoint(ctx context.Context, accessToken string) (int64, error) {
-	extractedUserId, _, err := a.jwtManager.ValidateAccessToken(accessToken)
+func (a *authService) UserAccessPoint(ctx context.Context, accessToken, agentIp string) (model.Principal, error) {
+	claims, err := a.AuthenticateBearerToken(ctx, accessToken, agentIp)
 	if err != nil {
-		return 0, err
+		return model.Principal{}, err
+	}
+	return model.Principal{
+		UserID:   claims.UserID,
+		ClientID: claims.ClientID,
+		Scope:    claims.Scope,
+	}, nil
+}
+
+// AuthenticateAccessToken validates an access token meant for this service
+// and checks that its principal still exists: an unbanned user, or for
+// client tokens the client.
+func (a *authService) AuthenticateAccessToken(ctx context.Context, accessToken string) (*auth.Claims, error) {
+	claims, err := a.jwtManager.ParseAccessToken(accessToken)
+	if err != nil {
+		return nil, err
+	}
+	if len(claims.Audience) > 0 {
+		return nil, auth.ErrAudienceRestricted
+	}
+	if claims.IsClient() {
+		var clientID string
+		err = a.db.QueryRowContext(
+			ctx,
+			"select id from oauth_clients where id = $1",
+			claims.ClientID,
+		).Scan(&clientID)
+		if err != nil {
+			return nil, err
+		}
+		return claims, nil
 	}
 	var userId int64
 	err = a.db.QueryRowContext(
 		ctx,
-		"select id from users where id = $1",
-		extractedUserId,
+		"select id from users where id = $1 and banned_at is null",
+		claims.UserID,
 	).Scan(&userId)
+	if err != nil {
+		return nil, err
+	}
+	return claims, nil
+}
+
+// AuthenticateBearerToken is AuthenticateAccessToken for callers that also
+// accept personal access tokens, whose use from agentIp is recorded.
+func (a *authService) AuthenticateBearerToken(ctx context.Context, token, agentIp string) (*auth.Claims, error) {
+	if auth.IsPersonalAccessToken(token) {
+		return a.jwtManager.ParsePersonalAccessToken(ctx, token, agentIp)
+	}
+	return a.AuthenticateAccessToken(ctx, token)
+}
+
+func (a *authService) ListSessions(ctx context.Context, accessToken string) ([]model.Session, error) {
+	userId, keyPairID, err := a.jwtManager.ValidateAccessToken(accessToken)
+	if err != nil {
+		return nil, err
+	}
+	records, err := a.jwtManager.ListRefreshTokens(ctx, userId)
+	if err != nil {
+		return nil, err
+	}
+
+	sessions := []model.Session{}
+	for _, record := range records {
+		sessions = append(sessions, model.Session{
+			ID:         record.FamilyID,
+			UserAgent:  record.UserAgent,
+			AgentIp:    record.AgentIp,
+			SignedInAt: record.FamilyStartedAt,
+			IssuedAt:   record.IssuedAt,
+			ExpiresAt:  record.ExpiresAt,
+			Current:    record.KeyPairID == keyPairID,
+		})
+	}
+	return sessions, nil
+}
+
+func (a *authService) GetSession(ctx context.Context, accessToken, sessionID string) (model.Session, error) {
+	sessions, err := a.ListSessions(ctx, accessToken)
+	if err != nil {
+		return model.Session{}, err
+	}
+	for _, session := range sessions {
+		if session.ID == sessionID {
+			return session, nil
+		}
+	}
+	return model.Session{}, ErrSessionNotFound
+}
+
+func (a *authService) RevokeSession(ctx context.Context, accessToken, sessionID string) error {
+	userId, _, err := a.jwtManager.ValidateAccessToken(accessToken)
+	if err != nil {
+		return err
+	}
+	revoked, err := a.jwtManager.RevokeUserRefreshTokenFamily(ctx, userId, sessionID)
+	if err != nil {
+		return err
+	}
+	if !revoked {
+		return ErrSessionNotFound
+	}
+	return nil
+}
+
+func (a *authService) RevokeOtherSessions(ctx context.Context, accessToken string) (int64, error) {
+	userId, keyPairID, err := a.jwtManager.ValidateAccessToken(accessToken)
 	if err != nil {
 		return 0, err
 	}
-	return userId, nil
+	familyIDs, err := a.jwtManager.RevokeOtherRefreshTokenFamilies(ctx, userId, keyPairID)
+	if err != nil {
+		return 0, err
+	}
+	return int64(len(familyIDs)), nil
+}
+
+// IntrospectToken reports whether an access token or a refresh token is
+// active. The hint only decides which kind is tried first.
+func (a *authService) IntrospectToken(ctx context.Context, token, tokenTypeHint string) model.Introspection {
+	if auth.IsPersonalAccessToken(token) {
+		return a.introspectPersonalAccessToken(ctx, token)
+	}
+	if tokenTypeHint == "refresh_token" {
+		if introspection, ok := a.introspectRefreshToken(ctx, token); ok {
+			return introspection
+		}
+		introspection, _ := a.introspectAccessToken(token)
+		return introspection
+	}
+	if introspection, ok := a.introspectAccessToken(token); ok {
+		return introspection
+	}
+	introspection, _ := a.introspectRefreshToken(ctx, token)
+	return introspection
+}
+
+func (a *authService) introspectAccessToken(token string) (model.Introspection, bool) {
+	claims, err := a.jwtManager.ParseAccessToken(token)
+	if err != nil {
+		return model.Introspection{Active: false}, false
+	}
+	introspection := model.Introspection{
+		Active:      true,
+		TokenType:   "access_token",
+		Sub:         strconv.FormatInt(claims.UserID, 10),
+		ClientID:    claims.ClientID,
+		Scope:       claims.Scope,
+		Jti:         claims.ID,
+		KeyPairID:   claims.KeyPairID,
+		OrgID:       claims.OrgID,
+		Roles:       claims.Roles,
+		Permissions: claims.Permissions,
+	}
+	if claims.IsClient() {
+		introspection.Sub = claims.Subject
+	}
+	if len(claims.Audience) > 0 {
+		introspection.Aud = claims.Audience
+	}
+	if claims.ExpiresAt != nil {
+		introspection.Exp = claims.ExpiresAt.Unix()
+	}
+	if claims.IssuedAt != nil {
+		introspection.Iat = claims.IssuedAt.Unix()
+	}
+	return introspection, true
+}
+
+func (a *authService) introspectRefreshToken(ctx context.Context, token string) (model.Introspection, bool) {
+	record, err := a.jwtManager.InspectRefreshToken(ctx, token)
+	if err != nil {
+		return model.Introspection{Active: false}, false
+	}
+	return model.Introspection{
+		Active:    true,
+		TokenType: "refresh_token",
+		Sub:       strconv.FormatInt(record.UserID, 10),
+		ClientID:  record.ClientID,
+		Scope:     record.Scope,
+		Exp:       record.ExpiresAt.Unix(),
+		Iat:       record.IssuedAt.Unix(),
+		Jti:       record.ID,
+		KeyPairID: record.KeyPairID,
+	}, true
+}
+
+// RevokeToken revokes a refresh token's whole session, or denylists the key
+// pair of an access token. Tokens that are unknown, invalid, already revoked
+// or issued to another client are ignored, as RFC 7009 requires. Tokens of
+// sessions signed in directly belong to no client and any client may revoke
+// them. Personal access tokens are revoked through their own endpoint.
+func (a *authService) RevokeToken(ctx context.Context, client model.Client, token, tokenTypeHint string) error {
+	if auth.IsPersonalAccessToken(token) {
+		return nil
+	}
+	if tokenTypeHint == "access_token" {
+		if found, err := a.revokeAccessToken(ctx, client, token); found || err != nil {
+			return err
+		}
+		_, err := a.revokeRefreshToken(ctx, client, token)
+		return err
+	}
+	if found, err := a.revokeRefreshToken(ctx, client, token); found || err != nil {
+		return err
+	}
+	_, err := a.revokeAccessToken(ctx, client, token)
+	return err
+}
+
+// introspectPersonalAccessToken describes a personal access token like an
+// access token of its user. The use is recorded without an address, since
+// the caller is the resource server rather than the token's holder.
+func (a *authService) introspectPersonalAccessToken(ctx context.Context, token string) model.Introspection {
+	claims, err := a.jwtManager.ParsePersonalAccessToken(ctx, token, "")
+	if err != nil {
+		return model.Introspection{Active: false}
+	}
+	introspection := model.Introspection{
+		Active:      true,
+		TokenType:   "personal_access_token",
+		Sub:         claims.Subject,
+		Scope:       claims.Scope,
+		Iat:         claims.IssuedAt.Unix(),
+		Jti:         claims.ID,
+		OrgID:       claims.OrgID,
+		Roles:       claims.Roles,
+		Permissions: claims.Permissions,
+	}
+	if claims.ExpiresAt != nil {
+		introspection.Exp = claims.ExpiresAt.Unix()
+	}
+	return introspection
+}
+
+// revokeAccessToken and revokeRefreshToken report whether the token was
+// found, revoking it only when it was issued to client or to no client.
+func (a *authService) revokeAccessToken(ctx context.Context, client model.Client, token string) (bool, error) {
+	claims, err := a.jwtManager.ParseAccessToken(token)
+	if err != nil {
+		return false, nil
+	}
+	if claims.ClientID != "" && claims.ClientID != client.ID {
+		return true, nil
+	}
+	// A token without an expiry is denylisted for good.
+	expiresAt := time.Date(9999, time.December, 31, 0, 0, 0, 0, time.UTC)
+	if claims.ExpiresAt != nil {
+		expiresAt = claims.ExpiresAt.Time
+	}
+	return true, a.jwtManager.RevokeKeyPair(ctx, claims.KeyPairID, expiresAt)
+}
+
+func (a *authService) revokeRefreshToken(ctx context.Context, client model.Client, token string) (bool, error) {
+	record, err := a.jwtManager.InspectRefreshToken(ctx, token)
+	if err != nil {
+		return false, nil
+	}
+	if record.ClientID != "" && record.ClientID != client.ID {
+		return true, nil
+	}
+	return true, a.jwtManager.InvalidateRefreshToken(ctx, token)
+}
+
+// BanUser blocks the user from logging in and revokes every session along
+// with the access tokens issued for them.
+func (a *authService) BanUser(ctx context.Context, userId int64) error {
+	result, err := a.db.ExecContext(ctx,
+		"UPDATE users SET banned_at = $1 WHERE id = $2 AND banned_at IS NULL",
+		time.Now(), userId,
+	)
+	if err != nil {
+		return err
+	}
+	affected, err := result.RowsAffected()
+	if err != nil {
+		return err
+	}
+	if affected == 0 {
+		var exists bool
+		err = a.db.QueryRowContext(ctx, "SELECT EXISTS(SELECT 1 FROM users WHERE id = $1)", userId).Scan(&exists)
+		if err != nil {
+			return err
+		}
+		if !exists {
+			return ErrUserNotFound
+		}
+	}
+	_, err = a.jwtManager.RevokeUserRefreshTokens(ctx, userId)
+	return err
+}
+
+func (a *authService) UnbanUser(ctx context.Context, userId int64) error {
+	result, err := a.db.ExecContext(ctx,
+		"UPDATE users SET banned_at = NULL WHERE id = $1",
+		userId,
+	)
+	if err != nil {
+		return err
+	}
+	affected, err := result.RowsAffected()
+	if err != nil {
+		return err
+	}
+	if affected == 0 {
+		return ErrUserNotFound
+	}
+	return nil
+}
+
+// UnlockUser clears the failed logins of a user's account.
+func (a *authService) UnlockUser(ctx context.Context, userId int64) error {
+	var orgID int64
+	var username string
+	err := a.db.QueryRowContext(ctx,
+		"SELECT org_id, username FROM users WHERE id = $1",
+		userId,
+	).Scan(&orgID, &username)
+	if errors.Is(err, sql.ErrNoRows) {
+		return ErrUserNotFound
+	}
+	if err != nil {
+		return err
+	}
+	return clearLoginFailures(ctx, a.db, loginAccountKey(orgID, username))
+}
+
+func (a *authService) JWKS() auth.JWKS {
+	return a.jwtManager.PublicJWKS()
+}
+
+func (a *authService) ListSigningKeys(ctx context.Context) ([]auth.KeyInfo, error) {
+	return a.jwtManager.SigningKeys(ctx)
+}
+
+func (a *authService) RotateSigningKey(ctx context.Context, activateAt time.Time) (auth.KeyInfo, error) {
+	return a.jwtManager.RotateSigningKey(ctx, activateAt)
+}
+
+// dummyPasswordHash is verified against for unknown usernames, so that they
+// take as long to reject as wrong passwords.
+func (a *authService) dummyPasswordHash() string {
+	a.dummyPasswordOnce.Do(func() {
+		a.dummyPassword, _ = a.passwordHasher.Hash(uuid.New().String())
+	})
+	return a.dummyPassword
 }
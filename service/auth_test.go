@@ -0,0 +1,57 @@
+package service
+
+import (
+	"context"
+	"jwt-auth/model"
+	"regexp"
+	"testing"
+
+	"github.com/DATA-DOG/go-sqlmock"
+)
+
+// TestRegisterUserSendsVerificationEmail checks that registering with an
+// email mails the verification link, whichever API the user registered with.
+func TestRegisterUserSendsVerificationEmail(t *testing.T) {
+	emails, mock, mailer := newTestEmailService(t)
+	users := NewAuthService(emails.db, emails.jwtManager, emails.passwordPolicy, emails.passwordHasher, &LoginThrottle{}, emails)
+
+	mock.ExpectBegin()
+	mock.ExpectQuery(regexp.QuoteMeta("INSERT INTO users (username, password, name, email, org_id)")).
+		WithArgs("alice", sqlmock.AnyArg(), nil, "alice@example.com", int64(1)).
+		WillReturnRows(sqlmock.NewRows([]string{"id"}).AddRow(int64(7)))
+	mock.ExpectExec(regexp.QuoteMeta("INSERT INTO organization_members (org_id, userId)")).
+		WithArgs(int64(1), int64(7)).
+		WillReturnResult(sqlmock.NewResult(0, 1))
+	mock.ExpectCommit()
+	mock.ExpectQuery(regexp.QuoteMeta("SELECT email, email_verified FROM users WHERE id = $1")).
+		WithArgs(int64(7)).
+		WillReturnRows(sqlmock.NewRows([]string{"email", "email_verified"}).AddRow("alice@example.com", false))
+	mock.ExpectExec(regexp.QuoteMeta("DELETE FROM email_tokens WHERE userId = $1 AND purpose = $2")).
+		WithArgs(int64(7), verifyEmailPurpose).
+		WillReturnResult(sqlmock.NewResult(0, 0))
+	mock.ExpectExec(regexp.QuoteMeta("INSERT INTO email_tokens")).
+		WithArgs(sqlmock.AnyArg(), int64(7), verifyEmailPurpose, "alice@example.com", sqlmock.AnyArg()).
+		WillReturnResult(sqlmock.NewResult(0, 1))
+
+	userId, err := users.RegisterUser(context.Background(), model.User{
+		Username: "alice",
+		Password: "correct horse",
+		Email:    "alice@example.com",
+		OrgID:    1,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if userId != 7 {
+		t.Fatalf("RegisterUser() = %d, want 7", userId)
+	}
+	messages := mailer.Messages()
+	if len(messages) != 1 || messages[0].To != "alice@example.com" {
+		t.Fatalf("mailed %+v, want one message to alice@example.com", messages)
+	}
+
+	err = mock.ExpectationsWereMet()
+	if err != nil {
+		t.Fatal(err)
+	}
+}
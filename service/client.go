@@ -0,0 +1,178 @@
+package service
+
+import (
+	"context"
+	"crypto/rand"
+	"database/sql"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"jwt-auth/model"
+	"net/url"
+	"strings"
+
+	"github.com/google/uuid"
+	"golang.org/x/crypto/bcrypt"
+)
+
+var (
+	ErrInvalidClient      = errors.New("Invalid client")
+	ErrInvalidRedirectURI = errors.New("Invalid redirect URI")
+)
+
+type ClientService interface {
+	RegisterClient(ctx context.Context, client model.Client) (model.Client, string, error)
+	ListClients(ctx context.Context) ([]model.Client, error)
+	GetClient(ctx context.Context, clientID string) (model.Client, error)
+	AuthenticateClient(ctx context.Context, clientID, clientSecret string) (model.Client, error)
+}
+
+type clientService struct {
+	db *sql.DB
+}
+
+func NewClientService(db *sql.DB) ClientService {
+	return &clientService{
+		db: db,
+	}
+}
+
+// RegisterClient stores a new client described by client, whose ID is
+// generated. Confidential clients get a generated secret, which is returned
+// once and only kept as a bcrypt hash.
+func (c *clientService) RegisterClient(ctx context.Context, client model.Client) (_ model.Client, secret string, err error) {
+	for _, redirectURI := range client.RedirectURIs {
+		parsed, err := url.Parse(redirectURI)
+		if err != nil || !parsed.IsAbs() || parsed.Fragment != "" {
+			return model.Client{}, "", ErrInvalidRedirectURI
+		}
+	}
+
+	client.ID = uuid.New().String()
+	client.Scope = normalizeScope(client.Scope)
+	if client.RedirectURIs == nil {
+		client.RedirectURIs = []string{}
+	}
+
+	var hashedSecret sql.NullString
+	if client.Confidential {
+		bytes := make([]byte, 32)
+		_, err := rand.Read(bytes)
+		if err != nil {
+			return model.Client{}, "", fmt.Errorf("Failed to generate random bytes: %w", err)
+		}
+		secret = base64.RawURLEncoding.EncodeToString(bytes)
+		hashed, err := bcrypt.GenerateFromPassword([]byte(secret), bcrypt.DefaultCost)
+		if err != nil {
+			return model.Client{}, "", fmt.Errorf("Failed to hash client secret: %w", err)
+		}
+		hashedSecret = sql.NullString{String: string(hashed), Valid: true}
+	}
+
+	tx, err := c.db.BeginTx(ctx, nil)
+	if err != nil {
+		return model.Client{}, "", err
+	}
+
+	defer func() {
+		if p := recover(); p != nil {
+			tx.Rollback()
+			panic(p)
+		} else if err != nil {
+			tx.Rollback()
+		} else {
+			err = tx.Commit()
+		}
+	}()
+
+	err = tx.QueryRowContext(ctx,
+		"INSERT INTO oauth_clients (id, secret, name, scope, access_token_lifetime) VALUES ($1, $2, $3, $4, $5) RETURNING created_at",
+		client.ID, hashedSecret, client.Name, client.Scope,
+		sql.NullInt64{Int64: client.AccessTokenLifetime, Valid: client.AccessTokenLifetime > 0},
+	).Scan(&client.CreatedAt)
+	if err != nil {
+		return model.Client{}, "", err
+	}
+	for _, redirectURI := range client.RedirectURIs {
+		_, err = tx.ExecContext(ctx,
+			"INSERT INTO oauth_client_redirect_uris (client_id, redirect_uri) VALUES ($1, $2) ON CONFLICT DO NOTHING",
+			client.ID, redirectURI,
+		)
+		if err != nil {
+			return model.Client{}, "", err
+		}
+	}
+	return client, secret, nil
+}
+
+func (c *clientService) ListClients(ctx context.Context) ([]model.Client, error) {
+	rows, err := c.db.QueryContext(ctx,
+		`SELECT id, name, secret IS NOT NULL, scope, COALESCE(access_token_lifetime, 0), created_at,
+			COALESCE((SELECT string_agg(redirect_uri, E'\n') FROM oauth_client_redirect_uris WHERE client_id = oauth_clients.id), '')
+		FROM oauth_clients ORDER BY created_at`,
+	)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	clients := []model.Client{}
+	for rows.Next() {
+		var client model.Client
+		var redirectURIs string
+		err = rows.Scan(&client.ID, &client.Name, &client.Confidential, &client.Scope, &client.AccessTokenLifetime, &client.CreatedAt, &redirectURIs)
+		if err != nil {
+			return nil, err
+		}
+		client.RedirectURIs = splitLines(redirectURIs)
+		clients = append(clients, client)
+	}
+	return clients, rows.Err()
+}
+
+func (c *clientService) GetClient(ctx context.Context, clientID string) (model.Client, error) {
+	client, _, err := c.loadClient(ctx, clientID)
+	return client, err
+}
+
+// AuthenticateClient checks the secret of a confidential client. Public
+// clients have no secret and can never authenticate.
+func (c *clientService) AuthenticateClient(ctx context.Context, clientID, clientSecret string) (model.Client, error) {
+	client, hashedSecret, err := c.loadClient(ctx, clientID)
+	if err != nil || !client.Confidential {
+		return model.Client{}, ErrInvalidClient
+	}
+	err = bcrypt.CompareHashAndPassword([]byte(hashedSecret), []byte(clientSecret))
+	if err != nil {
+		return model.Client{}, ErrInvalidClient
+	}
+	return client, nil
+}
+
+func (c *clientService) loadClient(ctx context.Context, clientID string) (model.Client, string, error) {
+	var client model.Client
+	var hashedSecret sql.NullString
+	var redirectURIs string
+	err := c.db.QueryRowContext(ctx,
+		`SELECT id, name, secret, scope, COALESCE(access_token_lifetime, 0), created_at,
+			COALESCE((SELECT string_agg(redirect_uri, E'\n') FROM oauth_client_redirect_uris WHERE client_id = oauth_clients.id), '')
+		FROM oauth_clients WHERE id = $1`,
+		clientID,
+	).Scan(&client.ID, &client.Name, &hashedSecret, &client.Scope, &client.AccessTokenLifetime, &client.CreatedAt, &redirectURIs)
+	if err == sql.ErrNoRows {
+		return model.Client{}, "", ErrInvalidClient
+	}
+	if err != nil {
+		return model.Client{}, "", err
+	}
+	client.Confidential = hashedSecret.Valid
+	client.RedirectURIs = splitLines(redirectURIs)
+	return client, hashedSecret.String, nil
+}
+
+func splitLines(value string) []string {
+	if value == "" {
+		return []string{}
+	}
+	return strings.Split(value, "\n")
+}
@@ -0,0 +1,267 @@
+package service
+
+import (
+	"context"
+	"crypto/rand"
+	"database/sql"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"jwt-auth/model"
+	"log"
+	"math/big"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+// DeviceCodeGrantType is the grant_type a device polls the token endpoint with.
+const DeviceCodeGrantType = "urn:ietf:params:oauth:grant-type:device_code"
+
+const (
+	deviceCodeDuration    = 10 * time.Minute
+	deviceCodeInterval    = 5 * time.Second
+	deviceCodeSlowDown    = 5 * time.Second
+	userCodeAlphabet      = "BCDFGHJKLMNPQRSTVWXZ"
+	userCodeLength        = 8
+	userCodeGenerateTries = 3
+)
+
+var ErrInvalidUserCode = errors.New("Invalid or expired user code")
+
+// CreateDeviceAuthorization starts the device flow of RFC 8628 for a client
+// that cannot open a browser itself. The user enters the returned user code
+// on the verification page while the device polls the token endpoint with
+// the device code.
+func (o *oauthService) CreateDeviceAuthorization(ctx context.Context, client model.Client) (model.DeviceAuthorization, error) {
+	bytes := make([]byte, 32)
+	_, err := rand.Read(bytes)
+	if err != nil {
+		return model.DeviceAuthorization{}, fmt.Errorf("Failed to generate random bytes: %w", err)
+	}
+	deviceCode := base64.RawURLEncoding.EncodeToString(bytes)
+
+	// User codes are short enough to collide now and then.
+	var userCode string
+	for i := 0; i < userCodeGenerateTries && userCode == ""; i++ {
+		candidate, err := generateUserCode()
+		if err != nil {
+			return model.DeviceAuthorization{}, err
+		}
+		result, err := o.db.ExecContext(ctx,
+			"INSERT INTO device_codes (device_code, user_code, client_id, poll_interval, issued_at, expires_at) VALUES ($1, $2, $3, $4, $5, $6) ON CONFLICT (user_code) DO NOTHING",
+			hashCode(deviceCode), candidate, client.ID, int64(deviceCodeInterval.Seconds()), time.Now(), time.Now().Add(deviceCodeDuration),
+		)
+		if err != nil {
+			return model.DeviceAuthorization{}, fmt.Errorf("Failed to save device code: %w", err)
+		}
+		rows, err := result.RowsAffected()
+		if err != nil {
+			return model.DeviceAuthorization{}, err
+		}
+		if rows == 1 {
+			userCode = candidate
+		}
+	}
+	if userCode == "" {
+		return model.DeviceAuthorization{}, fmt.Errorf("Failed to allocate a unique user code")
+	}
+
+	verificationURI := o.jwtManager.Issuer() + "/device"
+	formatted := formatUserCode(userCode)
+	return model.DeviceAuthorization{
+		DeviceCode:              deviceCode,
+		UserCode:                formatted,
+		VerificationURI:         verificationURI,
+		VerificationURIComplete: verificationURI + "?user_code=" + url.QueryEscape(formatted),
+		ExpiresIn:               int64(deviceCodeDuration.Seconds()),
+		Interval:                int64(deviceCodeInterval.Seconds()),
+	}, nil
+}
+
+// LookupUserCode returns the client waiting for the user code to be approved.
+func (o *oauthService) LookupUserCode(ctx context.Context, userCode string) (model.Client, error) {
+	var clientID string
+	err := o.db.QueryRowContext(ctx,
+		"SELECT client_id FROM device_codes WHERE user_code = $1 AND status = 'pending' AND expires_at > $2",
+		normalizeUserCode(userCode), time.Now(),
+	).Scan(&clientID)
+	if err == sql.ErrNoRows {
+		return model.Client{}, ErrInvalidUserCode
+	}
+	if err != nil {
+		return model.Client{}, err
+	}
+	return o.clientService.GetClient(ctx, clientID)
+}
+
+// DecideDeviceAuthorization records the user's answer for a pending user
+// code. The device picks it up on its next poll.
+func (o *oauthService) DecideDeviceAuthorization(ctx context.Context, userCode string, userId int64, approve bool) error {
+	status := "denied"
+	if approve {
+		status = "approved"
+	}
+	result, err := o.db.ExecContext(ctx,
+		"UPDATE device_codes SET status = $1, userId = $2 WHERE user_code = $3 AND status = 'pending' AND expires_at > $4",
+		status, userId, normalizeUserCode(userCode), time.Now(),
+	)
+	if err != nil {
+		return err
+	}
+	rows, err := result.RowsAffected()
+	if err != nil {
+		return err
+	}
+	if rows == 0 {
+		return ErrInvalidUserCode
+	}
+	return nil
+}
+
+// PollDeviceToken answers a device polling the token endpoint. Once the user
+// has approved, the device receives the same access and refresh token pair
+// as a password login. A device code presented again after that revokes the
+// session it started.
+func (o *oauthService) PollDeviceToken(ctx context.Context, client model.Client, deviceCode, userAgent, agentIp string) (model.TokenResponse, error) {
+	if deviceCode == "" {
+		return model.TokenResponse{}, protocolError("invalid_request", "device_code is required")
+	}
+
+	userId, err := o.consumeDeviceCode(ctx, client, hashCode(deviceCode))
+	if err != nil {
+		return model.TokenResponse{}, err
+	}
+
+	pairID := uuid.New().String()
+	accessToken, err := o.jwtManager.GenerateAccessToken(ctx, userId, pairID)
+	if err != nil {
+		return model.TokenResponse{}, err
+	}
+	refreshToken, err := o.jwtManager.GenerateRefreshToken(userId, pairID, userAgent, agentIp)
+	if err != nil {
+		return model.TokenResponse{}, err
+	}
+	familyID, _, _ := strings.Cut(refreshToken, ":")
+
+	_, err = o.db.ExecContext(ctx,
+		"UPDATE device_codes SET family_id = $1 WHERE device_code = $2",
+		familyID, hashCode(deviceCode),
+	)
+	if err != nil {
+		return model.TokenResponse{}, err
+	}
+
+	return model.TokenResponse{
+		AccessToken:  accessToken,
+		TokenType:    "Bearer",
+		ExpiresIn:    int64(o.jwtManager.AccessTokenDuration().Seconds()),
+		RefreshToken: refreshToken,
+	}, nil
+}
+
+// consumeDeviceCode enforces the polling interval and returns the approving
+// user once, marking the code used.
+func (o *oauthService) consumeDeviceCode(ctx context.Context, client model.Client, hashedCode string) (int64, error) {
+	var clientID, status string
+	var userId sql.NullInt64
+	var familyID sql.NullString
+	var interval int64
+	var expiresAt time.Time
+	err := o.db.QueryRowContext(ctx,
+		"SELECT client_id, userId, status, poll_interval, family_id, expires_at FROM device_codes WHERE device_code = $1",
+		hashedCode,
+	).Scan(&clientID, &userId, &status, &interval, &familyID, &expiresAt)
+	if err == sql.ErrNoRows || (err == nil && clientID != client.ID) {
+		return 0, protocolError("invalid_grant", "Unknown device code")
+	}
+	if err != nil {
+		return 0, err
+	}
+
+	now := time.Now()
+	if status == "used" {
+		if familyID.Valid {
+			revokeErr := o.jwtManager.RevokeRefreshTokenFamily(ctx, familyID.String)
+			if revokeErr != nil {
+				log.Printf("Failed to revoke tokens of a replayed device code: %v", revokeErr)
+			}
+		}
+		return 0, protocolError("invalid_grant", "Device code already used")
+	}
+	if now.After(expiresAt) {
+		return 0, protocolError("expired_token", "Device code expired")
+	}
+	if status == "denied" {
+		return 0, protocolError("access_denied", "The user denied the request")
+	}
+
+	result, err := o.db.ExecContext(ctx,
+		"UPDATE device_codes SET last_polled_at = $1 WHERE device_code = $2 AND (last_polled_at IS NULL OR last_polled_at <= $3)",
+		now, hashedCode, now.Add(-time.Duration(interval)*time.Second),
+	)
+	if err != nil {
+		return 0, err
+	}
+	rows, err := result.RowsAffected()
+	if err != nil {
+		return 0, err
+	}
+	if rows == 0 {
+		_, err = o.db.ExecContext(ctx,
+			"UPDATE device_codes SET poll_interval = poll_interval + $1, last_polled_at = $2 WHERE device_code = $3",
+			int64(deviceCodeSlowDown.Seconds()), now, hashedCode,
+		)
+		if err != nil {
+			return 0, err
+		}
+		return 0, protocolError("slow_down", "")
+	}
+
+	if status == "pending" {
+		return 0, protocolError("authorization_pending", "")
+	}
+
+	result, err = o.db.ExecContext(ctx,
+		"UPDATE device_codes SET status = 'used' WHERE device_code = $1 AND status = 'approved'",
+		hashedCode,
+	)
+	if err != nil {
+		return 0, err
+	}
+	rows, err = result.RowsAffected()
+	if err != nil {
+		return 0, err
+	}
+	if rows == 0 {
+		return 0, protocolError("invalid_grant", "Device code already used")
+	}
+	return userId.Int64, nil
+}
+
+// generateUserCode picks userCodeLength consonants, which avoids ambiguous
+// characters and accidental words, as RFC 8628 section 6.1 suggests.
+func generateUserCode() (string, error) {
+	var code strings.Builder
+	max := big.NewInt(int64(len(userCodeAlphabet)))
+	for i := 0; i < userCodeLength; i++ {
+		n, err := rand.Int(rand.Reader, max)
+		if err != nil {
+			return "", fmt.Errorf("Failed to generate random bytes: %w", err)
+		}
+		code.WriteByte(userCodeAlphabet[n.Int64()])
+	}
+	return code.String(), nil
+}
+
+func formatUserCode(userCode string) string {
+	return userCode[:userCodeLength/2] + "-" + userCode[userCodeLength/2:]
+}
+
+// normalizeUserCode accepts user codes typed in lower case or with the
+// dash left out.
+func normalizeUserCode(userCode string) string {
+	return strings.ToUpper(strings.ReplaceAll(strings.TrimSpace(userCode), "-", ""))
+}
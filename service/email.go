@@ -0,0 +1,373 @@
+package service
+
+import (
+	"context"
+	"crypto/rand"
+	"database/sql"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"jwt-auth/auth"
+	"jwt-auth/email"
+	"jwt-auth/webhook"
+	"log"
+	"net/url"
+	"time"
+)
+
+const (
+	verifyEmailPurpose   = "verify_email"
+	resetPasswordPurpose = "reset_password"
+	unlockAccountPurpose = "unlock_account"
+
+	verifyEmailDuration   = 24 * time.Hour
+	resetPasswordDuration = time.Hour
+	unlockAccountDuration = time.Hour
+)
+
+var (
+	ErrInvalidEmailToken    = errors.New("Invalid or expired token")
+	ErrEmailAlreadyVerified = errors.New("Email is already verified")
+	ErrNoEmail              = errors.New("User has no email")
+)
+
+type EmailService interface {
+	SendVerificationEmail(ctx context.Context, userId int64) error
+	RequestVerificationEmail(ctx context.Context, accessToken string) error
+	VerifyEmail(ctx context.Context, token string) error
+	ForgotPassword(ctx context.Context, orgID int64, address string) error
+	ResetPassword(ctx context.Context, token, password, agentIp string) error
+	RequestAccountUnlock(ctx context.Context, orgID int64, address string) error
+	UnlockAccount(ctx context.Context, token string) error
+}
+
+type emailService struct {
+	db               *sql.DB
+	jwtManager       *auth.JWTManager
+	mailer           email.Mailer
+	verifyEmailURL   string
+	passwordResetURL string
+	unlockAccountURL string
+	passwordPolicy   *PasswordPolicy
+	passwordHasher   PasswordHasher
+}
+
+// NewEmailService returns the service behind email verification, password
+// resets and account unlocks. The token is appended to verifyEmailURL and
+// unlockAccountURL as a token query parameter, and to passwordResetURL when
+// set; otherwise the reset email only holds it.
+func NewEmailService(db *sql.DB, jwtManager *auth.JWTManager, mailer email.Mailer, verifyEmailURL, passwordResetURL, unlockAccountURL string, passwordPolicy *PasswordPolicy, passwordHasher PasswordHasher) EmailService {
+	return &emailService{
+		db:               db,
+		jwtManager:       jwtManager,
+		mailer:           mailer,
+		verifyEmailURL:   verifyEmailURL,
+		passwordResetURL: passwordResetURL,
+		unlockAccountURL: unlockAccountURL,
+		passwordPolicy:   passwordPolicy,
+		passwordHasher:   passwordHasher,
+	}
+}
+
+// SendVerificationEmail mails the user a link proving they own their
+// address. Earlier links stop working.
+func (e *emailService) SendVerificationEmail(ctx context.Context, userId int64) error {
+	var address sql.NullString
+	var verified bool
+	err := e.db.QueryRowContext(ctx,
+		"SELECT email, email_verified FROM users WHERE id = $1 AND banned_at IS NULL",
+		userId,
+	).Scan(&address, &verified)
+	if errors.Is(err, sql.ErrNoRows) {
+		return ErrUserNotFound
+	}
+	if err != nil {
+		return err
+	}
+	if !address.Valid || address.String == "" {
+		return ErrNoEmail
+	}
+	if verified {
+		return ErrEmailAlreadyVerified
+	}
+
+	token, err := e.createToken(ctx, userId, verifyEmailPurpose, address.String, verifyEmailDuration)
+	if err != nil {
+		return err
+	}
+	return e.mailer.Send(ctx, email.Message{
+		To:      address.String,
+		Subject: "Verify your email",
+		Body: "Open this link to verify your email:\n\n" + withToken(e.verifyEmailURL, token) +
+			"\n\nThe link expires in 24 hours. If you did not create an account, ignore this email.\n",
+	})
+}
+
+func (e *emailService) RequestVerificationEmail(ctx context.Context, accessToken string) error {
+	userId, _, err := e.jwtManager.ValidateFirstPartyAccessToken(accessToken)
+	if err != nil {
+		return err
+	}
+	return e.SendVerificationEmail(ctx, userId)
+}
+
+// VerifyEmail marks the address a verification token was sent to as
+// verified, unless the user changed it since.
+func (e *emailService) VerifyEmail(ctx context.Context, token string) error {
+	var userId int64
+	var address string
+	err := e.db.QueryRowContext(ctx,
+		`DELETE FROM email_tokens WHERE token_hash = $1 AND purpose = $2 AND expires_at > $3
+		RETURNING userId, email`,
+		hashCode(token), verifyEmailPurpose, time.Now(),
+	).Scan(&userId, &address)
+	if errors.Is(err, sql.ErrNoRows) {
+		return ErrInvalidEmailToken
+	}
+	if err != nil {
+		return err
+	}
+
+	result, err := e.db.ExecContext(ctx,
+		"UPDATE users SET email_verified = TRUE WHERE id = $1 AND email = $2",
+		userId, address,
+	)
+	if err != nil {
+		return err
+	}
+	affected, err := result.RowsAffected()
+	if err != nil {
+		return err
+	}
+	if affected == 0 {
+		return ErrInvalidEmailToken
+	}
+	return nil
+}
+
+// ForgotPassword mails a password reset link to the user of the organization
+// with the address, if there is one. To not reveal which addresses have an
+// account it returns before the email is sent, and nil for unknown ones.
+func (e *emailService) ForgotPassword(ctx context.Context, orgID int64, address string) error {
+	var userId int64
+	err := e.db.QueryRowContext(ctx,
+		"SELECT id FROM users WHERE org_id = $1 AND email = $2 AND banned_at IS NULL",
+		orgID, address,
+	).Scan(&userId)
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+
+	token, err := e.createToken(ctx, userId, resetPasswordPurpose, address, resetPasswordDuration)
+	if err != nil {
+		return err
+	}
+	body := "Use this code to reset your password:\n\n" + token + "\n\n"
+	if e.passwordResetURL != "" {
+		body = "Open this link to reset your password:\n\n" + withToken(e.passwordResetURL, token) + "\n\n"
+	}
+	body += "It expires in an hour. If you did not ask to reset your password, ignore this email.\n"
+
+	go func() {
+		err := e.mailer.Send(context.WithoutCancel(ctx), email.Message{
+			To:      address,
+			Subject: "Reset your password",
+			Body:    body,
+		})
+		if err != nil {
+			log.Printf("Failed to send a password reset email: %v", err)
+		}
+	}()
+	return nil
+}
+
+// ResetPassword sets a new password with a reset token and signs the user out
+// of every session. Since the token was mailed to the user's address, it
+// also verifies it and unlocks the account.
+func (e *emailService) ResetPassword(ctx context.Context, token, password, agentIp string) error {
+	userId, err := e.resetPassword(ctx, token, password)
+	if err != nil {
+		return err
+	}
+	// The revoked access tokens reach other instances with their next sync.
+	err = e.jwtManager.SyncDenylist(ctx)
+	if err != nil {
+		log.Printf("Failed to sync the denylist: %v", err)
+	}
+	go webhook.NotifySecurityEvent("password_reset", userId, agentIp, nil)
+	return nil
+}
+
+func (e *emailService) resetPassword(ctx context.Context, token, password string) (userId int64, err error) {
+	tx, err := e.db.BeginTx(ctx, nil)
+	if err != nil {
+		return 0, err
+	}
+	defer func() {
+		if p := recover(); p != nil {
+			tx.Rollback()
+			panic(p)
+		} else if err != nil {
+			tx.Rollback()
+		} else {
+			err = tx.Commit()
+		}
+	}()
+
+	var address string
+	err = tx.QueryRowContext(ctx,
+		`DELETE FROM email_tokens WHERE token_hash = $1 AND purpose = $2 AND expires_at > $3
+		RETURNING userId, email`,
+		hashCode(token), resetPasswordPurpose, time.Now(),
+	).Scan(&userId, &address)
+	if errors.Is(err, sql.ErrNoRows) {
+		err = ErrInvalidEmailToken
+		return 0, err
+	}
+	if err != nil {
+		return 0, err
+	}
+
+	var orgID int64
+	var username, storedPassword string
+	err = tx.QueryRowContext(ctx,
+		"SELECT org_id, username, password FROM users WHERE id = $1 AND banned_at IS NULL FOR UPDATE",
+		userId,
+	).Scan(&orgID, &username, &storedPassword)
+	if errors.Is(err, sql.ErrNoRows) {
+		err = ErrInvalidEmailToken
+		return 0, err
+	}
+	if err != nil {
+		return 0, err
+	}
+	err = setPassword(ctx, tx, e.passwordPolicy, e.passwordHasher, userId, username, storedPassword, password)
+	if err != nil {
+		return 0, err
+	}
+	_, err = tx.ExecContext(ctx,
+		"UPDATE users SET email_verified = TRUE WHERE id = $1 AND email = $2",
+		userId, address,
+	)
+	if err != nil {
+		return 0, err
+	}
+	err = clearLoginFailures(ctx, tx, loginAccountKey(orgID, username))
+	if err != nil {
+		return 0, err
+	}
+
+	_, err = tx.ExecContext(ctx,
+		"DELETE FROM email_tokens WHERE userId = $1 AND purpose = $2",
+		userId, resetPasswordPurpose,
+	)
+	if err != nil {
+		return 0, err
+	}
+	// Challenges were handed out for the old password.
+	_, err = tx.ExecContext(ctx, "DELETE FROM mfa_challenges WHERE userId = $1", userId)
+	if err != nil {
+		return 0, err
+	}
+
+	_, err = e.jwtManager.RevokeUserRefreshTokensTx(ctx, tx, userId)
+	if err != nil {
+		return 0, err
+	}
+	return userId, nil
+}
+
+// RequestAccountUnlock mails an unlock link to the user of the organization
+// with the address, if there is one. Like ForgotPassword it answers the same
+// for unknown addresses.
+func (e *emailService) RequestAccountUnlock(ctx context.Context, orgID int64, address string) error {
+	var userId int64
+	err := e.db.QueryRowContext(ctx,
+		"SELECT id FROM users WHERE org_id = $1 AND email = $2 AND banned_at IS NULL",
+		orgID, address,
+	).Scan(&userId)
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+
+	token, err := e.createToken(ctx, userId, unlockAccountPurpose, address, unlockAccountDuration)
+	if err != nil {
+		return err
+	}
+	go func() {
+		err := e.mailer.Send(context.WithoutCancel(ctx), email.Message{
+			To:      address,
+			Subject: "Unlock your account",
+			Body: "Open this link to unlock your account after too many failed sign in attempts:\n\n" +
+				withToken(e.unlockAccountURL, token) +
+				"\n\nIt expires in an hour. If you did not ask for it, ignore this email; someone may be guessing your password.\n",
+		})
+		if err != nil {
+			log.Printf("Failed to send an account unlock email: %v", err)
+		}
+	}()
+	return nil
+}
+
+// UnlockAccount clears the failed logins of the account an unlock token was
+// sent for.
+func (e *emailService) UnlockAccount(ctx context.Context, token string) error {
+	var orgID int64
+	var username string
+	err := e.db.QueryRowContext(ctx,
+		`DELETE FROM email_tokens t USING users u
+		WHERE t.token_hash = $1 AND t.purpose = $2 AND t.expires_at > $3 AND u.id = t.userId
+		RETURNING u.org_id, u.username`,
+		hashCode(token), unlockAccountPurpose, time.Now(),
+	).Scan(&orgID, &username)
+	if errors.Is(err, sql.ErrNoRows) {
+		return ErrInvalidEmailToken
+	}
+	if err != nil {
+		return err
+	}
+	return clearLoginFailures(ctx, e.db, loginAccountKey(orgID, username))
+}
+
+// createToken replaces the user's tokens for purpose with a new one.
+func (e *emailService) createToken(ctx context.Context, userId int64, purpose, address string, duration time.Duration) (string, error) {
+	bytes := make([]byte, 32)
+	_, err := rand.Read(bytes)
+	if err != nil {
+		return "", fmt.Errorf("Failed to generate random bytes: %w", err)
+	}
+	token := base64.RawURLEncoding.EncodeToString(bytes)
+
+	_, err = e.db.ExecContext(ctx,
+		"DELETE FROM email_tokens WHERE userId = $1 AND purpose = $2",
+		userId, purpose,
+	)
+	if err != nil {
+		return "", err
+	}
+	_, err = e.db.ExecContext(ctx,
+		"INSERT INTO email_tokens (token_hash, userId, purpose, email, expires_at) VALUES ($1, $2, $3, $4, $5)",
+		hashCode(token), userId, purpose, address, time.Now().Add(duration),
+	)
+	if err != nil {
+		return "", err
+	}
+	return token, nil
+}
+
+func withToken(link, token string) string {
+	parsed, err := url.Parse(link)
+	if err != nil {
+		return link + "?token=" + url.QueryEscape(token)
+	}
+	query := parsed.Query()
+	query.Set("token", token)
+	parsed.RawQuery = query.Encode()
+	return parsed.String()
+}
@@ -0,0 +1,256 @@
+package service
+
+import (
+	"context"
+	"database/sql"
+	"database/sql/driver"
+	"encoding/base64"
+	"errors"
+	"jwt-auth/auth"
+	"jwt-auth/config"
+	"jwt-auth/email"
+	"regexp"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/DATA-DOG/go-sqlmock"
+	"golang.org/x/crypto/bcrypt"
+)
+
+const testJWTSecret = "test-secret-test-secret-test-secret"
+
+// capture is a sqlmock argument that matches anything and keeps it.
+type capture struct {
+	value *driver.Value
+}
+
+func (c capture) Match(value driver.Value) bool {
+	*c.value = value
+	return true
+}
+
+// after matches a time later than the one pointed to.
+type after struct {
+	time *time.Time
+}
+
+func (a after) Match(value driver.Value) bool {
+	t, ok := value.(time.Time)
+	return ok && t.After(*a.time)
+}
+
+// newTestJWTManager builds a JWTManager on mock, expecting the queries it
+// makes on startup.
+func newTestJWTManager(t *testing.T, db *sql.DB, mock sqlmock.Sqlmock) *auth.JWTManager {
+	t.Helper()
+	material := base64.StdEncoding.EncodeToString([]byte(testJWTSecret))
+	mock.ExpectQuery(regexp.QuoteMeta("select id, key_material from signing_keys")).
+		WillReturnRows(sqlmock.NewRows([]string{"id", "key_material"}).AddRow("test-key", material))
+	mock.ExpectExec(regexp.QuoteMeta("update signing_keys")).WillReturnResult(sqlmock.NewResult(0, 0))
+	mock.ExpectExec(regexp.QuoteMeta("update signing_keys")).WillReturnResult(sqlmock.NewResult(0, 0))
+	mock.ExpectQuery(regexp.QuoteMeta("select id, algorithm, key_material, state, activates_at, expires_at from signing_keys")).
+		WillReturnRows(sqlmock.NewRows([]string{"id", "algorithm", "key_material", "state", "activates_at", "expires_at"}).
+			AddRow("test-key", "HS256", material, string(auth.KeyStateActive), time.Now().Add(-time.Hour), nil))
+	mock.ExpectExec(regexp.QuoteMeta("delete from revoked_key_pairs")).WillReturnResult(sqlmock.NewResult(0, 0))
+	mock.ExpectQuery(regexp.QuoteMeta("select keyPairId, expires_at, revoked_at from revoked_key_pairs")).
+		WillReturnRows(sqlmock.NewRows([]string{"keyPairId", "expires_at", "revoked_at"}))
+
+	jwtManager, err := auth.NewJWTManager(&config.JWTConfig{
+		Secret:          testJWTSecret,
+		Algorithm:       "HS256",
+		AccessDuration:  15 * time.Minute,
+		RefreshDuration: 24 * time.Hour,
+		RefreshLength:   32,
+		Issuer:          "http://localhost",
+	}, db)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return jwtManager
+}
+
+func newTestEmailService(t *testing.T) (*emailService, sqlmock.Sqlmock, *email.MemoryMailer) {
+	t.Helper()
+	db, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { db.Close() })
+	// A query made outside a transaction then waits for its connection
+	// rather than passing unnoticed.
+	db.SetMaxOpenConns(1)
+	hasher, err := NewPasswordHasher(PasswordHasherConfig{Algorithm: HashBcrypt, BcryptCost: bcrypt.MinCost})
+	if err != nil {
+		t.Fatal(err)
+	}
+	mailer := email.NewMemoryMailer()
+	service := NewEmailService(db, newTestJWTManager(t, db, mock), mailer, "", "", "", &PasswordPolicy{MinLength: 8}, hasher)
+	return service.(*emailService), mock, mailer
+}
+
+// requestPasswordReset runs ForgotPassword for user 7 and returns the token
+// mailed to them.
+func requestPasswordReset(t *testing.T, service *emailService, mock sqlmock.Sqlmock, mailer *email.MemoryMailer) string {
+	t.Helper()
+	var tokenHash driver.Value
+	mock.ExpectQuery(regexp.QuoteMeta("SELECT id FROM users WHERE org_id = $1 AND email = $2")).
+		WithArgs(int64(1), "alice@example.com").
+		WillReturnRows(sqlmock.NewRows([]string{"id"}).AddRow(int64(7)))
+	mock.ExpectExec(regexp.QuoteMeta("DELETE FROM email_tokens WHERE userId = $1 AND purpose = $2")).
+		WithArgs(int64(7), resetPasswordPurpose).
+		WillReturnResult(sqlmock.NewResult(0, 0))
+	mock.ExpectExec(regexp.QuoteMeta("INSERT INTO email_tokens")).
+		WithArgs(capture{&tokenHash}, int64(7), resetPasswordPurpose, "alice@example.com", sqlmock.AnyArg()).
+		WillReturnResult(sqlmock.NewResult(0, 1))
+
+	err := service.ForgotPassword(context.Background(), 1, "alice@example.com")
+	if err != nil {
+		t.Fatal(err)
+	}
+	deadline := time.Now().Add(time.Second)
+	for len(mailer.Messages()) == 0 && time.Now().Before(deadline) {
+		time.Sleep(time.Millisecond)
+	}
+	messages := mailer.Messages()
+	if len(messages) != 1 || messages[0].To != "alice@example.com" {
+		t.Fatalf("mailed %+v, want one message to alice@example.com", messages)
+	}
+	token := strings.Split(messages[0].Body, "\n")[2]
+	if hashCode(token) != tokenHash {
+		t.Fatalf("mailed token %q does not match the stored hash", token)
+	}
+	return token
+}
+
+func expectConsumeResetToken(mock sqlmock.Sqlmock, token string) *sqlmock.ExpectedQuery {
+	return mock.ExpectQuery(regexp.QuoteMeta("DELETE FROM email_tokens WHERE token_hash = $1 AND purpose = $2 AND expires_at > $3")).
+		WithArgs(hashCode(token), resetPasswordPurpose, sqlmock.AnyArg())
+}
+
+func TestResetPassword(t *testing.T) {
+	service, mock, mailer := newTestEmailService(t)
+	token := requestPasswordReset(t, service, mock, mailer)
+
+	mock.ExpectBegin()
+	expectConsumeResetToken(mock, token).
+		WillReturnRows(sqlmock.NewRows([]string{"userId", "email"}).AddRow(int64(7), "alice@example.com"))
+	mock.ExpectQuery(regexp.QuoteMeta("SELECT org_id, username, password FROM users WHERE id = $1")).
+		WithArgs(int64(7)).
+		WillReturnRows(sqlmock.NewRows([]string{"org_id", "username", "password"}).AddRow(int64(1), "alice", "old-hash"))
+	mock.ExpectExec(regexp.QuoteMeta("DELETE FROM password_history WHERE userId = $1")).
+		WithArgs(int64(7)).
+		WillReturnResult(sqlmock.NewResult(0, 0))
+	mock.ExpectExec(regexp.QuoteMeta("UPDATE users SET password = $1 WHERE id = $2")).
+		WithArgs(sqlmock.AnyArg(), int64(7)).
+		WillReturnResult(sqlmock.NewResult(0, 1))
+	mock.ExpectExec(regexp.QuoteMeta("UPDATE users SET email_verified = TRUE")).
+		WithArgs(int64(7), "alice@example.com").
+		WillReturnResult(sqlmock.NewResult(0, 1))
+	mock.ExpectExec(regexp.QuoteMeta("DELETE FROM login_throttles")).
+		WithArgs(loginThrottleAccount, loginAccountKey(1, "alice")).
+		WillReturnResult(sqlmock.NewResult(0, 0))
+	mock.ExpectExec(regexp.QuoteMeta("DELETE FROM email_tokens WHERE userId = $1 AND purpose = $2")).
+		WithArgs(int64(7), resetPasswordPurpose).
+		WillReturnResult(sqlmock.NewResult(0, 0))
+	mock.ExpectExec(regexp.QuoteMeta("DELETE FROM mfa_challenges WHERE userId = $1")).
+		WithArgs(int64(7)).
+		WillReturnResult(sqlmock.NewResult(0, 0))
+	// Every session of the user ends in the same transaction.
+	mock.ExpectQuery(regexp.QuoteMeta("delete from refresh_tokens where userId = $1")).
+		WithArgs(int64(7)).
+		WillReturnRows(sqlmock.NewRows([]string{"family_id", "keyPairId", "issued_at"}).
+			AddRow("family-1", "pair-1", time.Now()).
+			AddRow("family-2", "pair-2", time.Now()))
+	mock.ExpectExec(regexp.QuoteMeta("insert into revoked_key_pairs")).
+		WithArgs(sqlmock.AnyArg(), sqlmock.AnyArg(), sqlmock.AnyArg()).
+		WillReturnResult(sqlmock.NewResult(0, 1))
+	mock.ExpectExec(regexp.QuoteMeta("insert into revoked_key_pairs")).
+		WithArgs(sqlmock.AnyArg(), sqlmock.AnyArg(), sqlmock.AnyArg()).
+		WillReturnResult(sqlmock.NewResult(0, 1))
+	mock.ExpectCommit()
+	// The revocations reach memory only once they are committed.
+	mock.ExpectExec(regexp.QuoteMeta("delete from revoked_key_pairs")).WillReturnResult(sqlmock.NewResult(0, 0))
+	mock.ExpectQuery(regexp.QuoteMeta("select keyPairId, expires_at, revoked_at from revoked_key_pairs")).
+		WillReturnRows(sqlmock.NewRows([]string{"keyPairId", "expires_at", "revoked_at"}).
+			AddRow("pair-1", time.Now().Add(time.Hour), time.Now()).
+			AddRow("pair-2", time.Now().Add(time.Hour), time.Now()))
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	err := service.ResetPassword(ctx, token, "correct horse", "127.0.0.1")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// The token was deleted when used.
+	mock.ExpectBegin()
+	expectConsumeResetToken(mock, token).WillReturnRows(sqlmock.NewRows([]string{"userId", "email"}))
+	mock.ExpectRollback()
+	err = service.ResetPassword(context.Background(), token, "another horse", "127.0.0.1")
+	if !errors.Is(err, ErrInvalidEmailToken) {
+		t.Fatalf("second ResetPassword() error = %v, want %v", err, ErrInvalidEmailToken)
+	}
+
+	err = mock.ExpectationsWereMet()
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestResetPasswordExpiredToken(t *testing.T) {
+	service, mock, _ := newTestEmailService(t)
+	var expiresAt driver.Value
+	mock.ExpectExec(regexp.QuoteMeta("DELETE FROM email_tokens WHERE userId = $1 AND purpose = $2")).
+		WillReturnResult(sqlmock.NewResult(0, 0))
+	mock.ExpectExec(regexp.QuoteMeta("INSERT INTO email_tokens")).
+		WithArgs(sqlmock.AnyArg(), int64(7), resetPasswordPurpose, "alice@example.com", capture{&expiresAt}).
+		WillReturnResult(sqlmock.NewResult(0, 1))
+	token, err := service.createToken(context.Background(), 7, resetPasswordPurpose, "alice@example.com", -time.Second)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expiry := expiresAt.(time.Time)
+
+	// The lookup only matches tokens expiring after now, which this one
+	// does not.
+	mock.ExpectBegin()
+	mock.ExpectQuery(regexp.QuoteMeta("DELETE FROM email_tokens WHERE token_hash = $1 AND purpose = $2 AND expires_at > $3")).
+		WithArgs(hashCode(token), resetPasswordPurpose, after{&expiry}).
+		WillReturnRows(sqlmock.NewRows([]string{"userId", "email"}))
+	mock.ExpectRollback()
+	err = service.ResetPassword(context.Background(), token, "correct horse", "127.0.0.1")
+	if !errors.Is(err, ErrInvalidEmailToken) {
+		t.Fatalf("ResetPassword() error = %v, want %v", err, ErrInvalidEmailToken)
+	}
+
+	err = mock.ExpectationsWereMet()
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+// A reset that fails leaves the token and every session in place.
+func TestResetPasswordRejectedKeepsSessions(t *testing.T) {
+	service, mock, mailer := newTestEmailService(t)
+	token := requestPasswordReset(t, service, mock, mailer)
+
+	mock.ExpectBegin()
+	expectConsumeResetToken(mock, token).
+		WillReturnRows(sqlmock.NewRows([]string{"userId", "email"}).AddRow(int64(7), "alice@example.com"))
+	mock.ExpectQuery(regexp.QuoteMeta("SELECT org_id, username, password FROM users WHERE id = $1")).
+		WithArgs(int64(7)).
+		WillReturnRows(sqlmock.NewRows([]string{"org_id", "username", "password"}).AddRow(int64(1), "alice", "old-hash"))
+	mock.ExpectRollback()
+
+	err := service.ResetPassword(context.Background(), token, "short", "127.0.0.1")
+	var policyErr *PasswordPolicyError
+	if !errors.As(err, &policyErr) {
+		t.Fatalf("ResetPassword() error = %v, want a PasswordPolicyError", err)
+	}
+
+	err = mock.ExpectationsWereMet()
+	if err != nil {
+		t.Fatal(err)
+	}
+}
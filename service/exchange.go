@@ -0,0 +1,112 @@
+package service
+
+import (
+	"context"
+	"jwt-auth/auth"
+	"jwt-auth/model"
+	"slices"
+	"time"
+
+	"github.com/golang-jwt/jwt/v5"
+)
+
+// TokenExchangeGrantType is the grant_type of an RFC 8693 token exchange.
+const TokenExchangeGrantType = "urn:ietf:params:oauth:grant-type:token-exchange"
+
+const (
+	accessTokenType        = "urn:ietf:params:oauth:token-type:access_token"
+	exchangedTokenDuration = 5 * time.Minute
+)
+
+// ExchangeToken trades a user's access token, presented by a confidential
+// client calling another service on the user's behalf, for a short-lived
+// token bound to that service. The new token keeps the subject and key pair
+// of the original, so revoking the user's session revokes it as well, while
+// its scope can only shrink and its act claim records the client.
+func (o *oauthService) ExchangeToken(ctx context.Context, client model.Client, req model.TokenExchangeRequest) (model.TokenResponse, error) {
+	if !client.Confidential {
+		return model.TokenResponse{}, protocolError("unauthorized_client", "Public clients cannot exchange tokens")
+	}
+	if req.SubjectToken == "" || req.SubjectTokenType == "" {
+		return model.TokenResponse{}, protocolError("invalid_request", "subject_token and subject_token_type are required")
+	}
+	if req.SubjectTokenType != accessTokenType {
+		return model.TokenResponse{}, protocolError("invalid_request", "Only access tokens can be exchanged")
+	}
+	if req.RequestedTokenType != "" && req.RequestedTokenType != accessTokenType {
+		return model.TokenResponse{}, protocolError("invalid_request", "Only access tokens can be requested")
+	}
+	if req.Audience == "" {
+		return model.TokenResponse{}, protocolError("invalid_request", "audience is required")
+	}
+	_, err := o.clientService.GetClient(ctx, req.Audience)
+	if err != nil {
+		return model.TokenResponse{}, protocolError("invalid_target", "Unknown audience")
+	}
+
+	subject, err := o.jwtManager.ParseAccessToken(req.SubjectToken)
+	if err != nil {
+		return model.TokenResponse{}, protocolError("invalid_grant", "Invalid subject token")
+	}
+	if subject.IsClient() {
+		return model.TokenResponse{}, protocolError("invalid_grant", "Subject token was not issued to a user")
+	}
+	// An exchanged token can only be exchanged again by the service it is
+	// bound to, which then shows up as the next actor. Delegation chains
+	// always start from a token of this service's own, without an actor.
+	if len(subject.Audience) > 0 && !slices.Contains(subject.Audience, client.ID) {
+		return model.TokenResponse{}, protocolError("invalid_grant", "Subject token is bound to another audience")
+	}
+	if subject.Act != nil && len(subject.Audience) == 0 {
+		return model.TokenResponse{}, protocolError("invalid_grant", "Subject token carries an actor but no audience")
+	}
+
+	// Tokens from /login carry no scope and grant everything, so the
+	// exchanged token has to name its scope.
+	scope := normalizeScope(req.Scope)
+	if subject.Scope == "" && scope == "" {
+		return model.TokenResponse{}, protocolError("invalid_scope", "scope is required")
+	}
+	if subject.Scope != "" {
+		if scope == "" {
+			scope = subject.Scope
+		}
+		if !scopeSubset(scope, subject.Scope) {
+			return model.TokenResponse{}, protocolError("invalid_scope", "Requested scope exceeds the scope of the subject token")
+		}
+	}
+
+	expiresAt := time.Now().Add(exchangedTokenDuration)
+	if subject.ExpiresAt != nil && subject.ExpiresAt.Before(expiresAt) {
+		expiresAt = subject.ExpiresAt.Time
+	}
+
+	// The subject token's roles and permissions, not the user's current ones,
+	// are narrowed, so an exchange never widens what was granted.
+	roles, permissions := auth.ScopePermissions(subject.Roles, subject.Permissions, scope)
+	accessToken, err := o.jwtManager.IssueAccessToken(ctx, &auth.Claims{
+		UserID:      subject.UserID,
+		KeyPairID:   subject.KeyPairID,
+		ClientID:    client.ID,
+		Scope:       scope,
+		Roles:       roles,
+		Permissions: permissions,
+		Act:         &auth.Actor{Sub: client.ID, Act: subject.Act},
+		RegisteredClaims: jwt.RegisteredClaims{
+			Subject:   subject.Subject,
+			Audience:  jwt.ClaimStrings{req.Audience},
+			ExpiresAt: jwt.NewNumericDate(expiresAt),
+		},
+	})
+	if err != nil {
+		return model.TokenResponse{}, err
+	}
+
+	return model.TokenResponse{
+		AccessToken:     accessToken,
+		IssuedTokenType: accessTokenType,
+		TokenType:       "Bearer",
+		ExpiresIn:       int64(time.Until(expiresAt).Seconds()),
+		Scope:           scope,
+	}, nil
+}
@@ -0,0 +1,118 @@
+package service
+
+import (
+	"context"
+	"errors"
+	"jwt-auth/auth"
+	"jwt-auth/model"
+	"regexp"
+	"slices"
+	"testing"
+	"time"
+
+	"github.com/DATA-DOG/go-sqlmock"
+	"github.com/golang-jwt/jwt/v5"
+)
+
+func expectClient(mock sqlmock.Sqlmock, clientID string) {
+	mock.ExpectQuery(regexp.QuoteMeta("FROM oauth_clients WHERE id = $1")).
+		WithArgs(clientID).
+		WillReturnRows(sqlmock.NewRows([]string{"id", "name", "secret", "scope", "access_token_lifetime", "created_at", "redirect_uris"}).
+			AddRow(clientID, clientID, "hash", "", 0, time.Now(), ""))
+}
+
+func expectUserOrganization(mock sqlmock.Sqlmock) {
+	mock.ExpectQuery(regexp.QuoteMeta("SELECT org_id FROM users WHERE id = $1")).
+		WithArgs(int64(7)).
+		WillReturnRows(sqlmock.NewRows([]string{"org_id"}).AddRow(int64(1)))
+}
+
+func TestExchangeToken(t *testing.T) {
+	db, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	jwtManager := newTestJWTManager(t, db, mock)
+	oauth := NewOAuthService(db, jwtManager, NewClientService(db))
+	ctx := context.Background()
+	gateway := model.Client{ID: "gateway", Confidential: true}
+
+	issue := func(scope string, permissions []string) string {
+		t.Helper()
+		expectUserOrganization(mock)
+		token, err := jwtManager.IssueAccessToken(ctx, &auth.Claims{
+			UserID:      7,
+			KeyPairID:   "pair-1",
+			Scope:       scope,
+			Roles:       []string{"editor"},
+			Permissions: permissions,
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		return token
+	}
+	request := func(subjectToken, scope string) model.TokenExchangeRequest {
+		return model.TokenExchangeRequest{
+			SubjectToken:     subjectToken,
+			SubjectTokenType: accessTokenType,
+			Audience:         "reports",
+			Scope:            scope,
+		}
+	}
+
+	subjectToken := issue("reports:read reports:write", []string{"reports:read", "reports:write"})
+	expectClient(mock, "reports")
+	expectUserOrganization(mock)
+	response, err := oauth.ExchangeToken(ctx, gateway, request(subjectToken, "reports:read"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if response.Scope != "reports:read" || response.ExpiresIn > int64(exchangedTokenDuration.Seconds()) {
+		t.Fatalf("ExchangeToken() = %+v", response)
+	}
+	claims, err := jwtManager.ParseAccessToken(response.AccessToken)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !slices.Equal(claims.Audience, jwt.ClaimStrings{"reports"}) || claims.Act == nil || claims.Act.Sub != "gateway" ||
+		claims.UserID != 7 || claims.KeyPairID != "pair-1" || claims.ClientID != "gateway" {
+		t.Fatalf("exchanged claims = %+v", claims)
+	}
+	if len(claims.Roles) != 0 || !slices.Equal(claims.Permissions, []string{"reports:read"}) {
+		t.Fatalf("exchanged roles %v, permissions %v, want none and [reports:read]", claims.Roles, claims.Permissions)
+	}
+	// The exchanged token only works at the audience.
+	_, _, err = jwtManager.ValidateAccessToken(response.AccessToken)
+	if !errors.Is(err, auth.ErrAudienceRestricted) {
+		t.Fatalf("ValidateAccessToken(exchanged) error = %v, want %v", err, auth.ErrAudienceRestricted)
+	}
+
+	tests := []struct {
+		name     string
+		client   model.Client
+		request  model.TokenExchangeRequest
+		wantCode string
+	}{
+		{"public client", model.Client{ID: "spa"}, request(subjectToken, "reports:read"), "unauthorized_client"},
+		{"wider scope", gateway, request(subjectToken, "reports:read reports:delete"), "invalid_scope"},
+		{"unscoped subject", gateway, request(issue("", []string{"reports:read"}), ""), "invalid_scope"},
+		{"exchanged for another audience", gateway, request(response.AccessToken, "reports:read"), "invalid_grant"},
+	}
+	for _, test := range tests {
+		if test.client.Confidential {
+			expectClient(mock, "reports")
+		}
+		_, err = oauth.ExchangeToken(ctx, test.client, test.request)
+		var protocolErr *ProtocolError
+		if !errors.As(err, &protocolErr) || protocolErr.Code != test.wantCode {
+			t.Errorf("%s: ExchangeToken() error = %v, want %s", test.name, err, test.wantCode)
+		}
+	}
+
+	err = mock.ExpectationsWereMet()
+	if err != nil {
+		t.Fatal(err)
+	}
+}
@@ -0,0 +1,300 @@
+package service
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"jwt-auth/auth"
+	"jwt-auth/model"
+	"strconv"
+)
+
+var (
+	ErrInvalidGroupName = errors.New("Invalid group name")
+	ErrGroupNotFound    = errors.New("Group not found")
+	ErrGroupExists      = errors.New("Group already exists")
+	ErrGroupCycle       = errors.New("Group membership would create a cycle")
+)
+
+// GroupService manages groups of users and other groups. Roles assigned to a
+// group apply to its users and, transitively, to the users of its member
+// groups.
+type GroupService interface {
+	ListGroups(ctx context.Context) ([]model.Group, error)
+	CreateGroup(ctx context.Context, name string) (model.Group, error)
+	GetGroup(ctx context.Context, name string) (model.Group, error)
+	DeleteGroup(ctx context.Context, name string) error
+	AddUser(ctx context.Context, name string, userId int64) error
+	RemoveUser(ctx context.Context, name string, userId int64) error
+	AddSubgroup(ctx context.Context, name, member string) error
+	RemoveSubgroup(ctx context.Context, name, member string) error
+	AssignRole(ctx context.Context, name, role string) error
+	UnassignRole(ctx context.Context, name, role string) error
+}
+
+type groupService struct {
+	db         *sql.DB
+	jwtManager *auth.JWTManager
+}
+
+func NewGroupService(db *sql.DB, jwtManager *auth.JWTManager) GroupService {
+	return &groupService{
+		db:         db,
+		jwtManager: jwtManager,
+	}
+}
+
+func (g *groupService) ListGroups(ctx context.Context) ([]model.Group, error) {
+	return g.queryGroups(ctx, "")
+}
+
+func (g *groupService) CreateGroup(ctx context.Context, name string) (model.Group, error) {
+	if !roleNamePattern.MatchString(name) {
+		return model.Group{}, ErrInvalidGroupName
+	}
+
+	group := model.Group{
+		Name:   name,
+		Users:  []int64{},
+		Groups: []string{},
+		Roles:  []string{},
+	}
+	err := g.db.QueryRowContext(ctx,
+		"INSERT INTO groups (name) VALUES ($1) ON CONFLICT (name) DO NOTHING RETURNING created_at",
+		name,
+	).Scan(&group.CreatedAt)
+	if err == sql.ErrNoRows {
+		return model.Group{}, ErrGroupExists
+	}
+	if err != nil {
+		return model.Group{}, err
+	}
+	return group, nil
+}
+
+func (g *groupService) GetGroup(ctx context.Context, name string) (model.Group, error) {
+	groups, err := g.queryGroups(ctx, "WHERE g.name = $1", name)
+	if err != nil {
+		return model.Group{}, err
+	}
+	if len(groups) == 0 {
+		return model.Group{}, ErrGroupNotFound
+	}
+	return groups[0], nil
+}
+
+func (g *groupService) DeleteGroup(ctx context.Context, name string) error {
+	result, err := g.db.ExecContext(ctx, "DELETE FROM groups WHERE name = $1", name)
+	if err != nil {
+		return err
+	}
+	rows, err := result.RowsAffected()
+	if err != nil {
+		return err
+	}
+	if rows == 0 {
+		return ErrGroupNotFound
+	}
+	g.jwtManager.InvalidateAuthorizations()
+	return nil
+}
+
+func (g *groupService) AddUser(ctx context.Context, name string, userId int64) error {
+	groupID, err := lookupGroupID(ctx, g.db, name)
+	if err != nil {
+		return err
+	}
+	var exists bool
+	err = g.db.QueryRowContext(ctx, "SELECT EXISTS (SELECT 1 FROM users WHERE id = $1)", userId).Scan(&exists)
+	if err != nil {
+		return err
+	}
+	if !exists {
+		return ErrUserNotFound
+	}
+	return g.exec(ctx,
+		"INSERT INTO group_members (group_id, userId) VALUES ($1, $2) ON CONFLICT DO NOTHING",
+		groupID, userId,
+	)
+}
+
+func (g *groupService) RemoveUser(ctx context.Context, name string, userId int64) error {
+	groupID, err := lookupGroupID(ctx, g.db, name)
+	if err != nil {
+		return err
+	}
+	return g.exec(ctx,
+		"DELETE FROM group_members WHERE group_id = $1 AND userId = $2",
+		groupID, userId,
+	)
+}
+
+// AddSubgroup makes member a member of the group, unless the group already
+// is a member of member, directly or through other groups.
+func (g *groupService) AddSubgroup(ctx context.Context, name, member string) (err error) {
+	// Registered first so that it runs after the commit below.
+	defer func() {
+		if err == nil {
+			g.jwtManager.InvalidateAuthorizations()
+		}
+	}()
+
+	tx, err := g.db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+
+	defer func() {
+		if p := recover(); p != nil {
+			tx.Rollback()
+			panic(p)
+		} else if err != nil {
+			tx.Rollback()
+		} else {
+			err = tx.Commit()
+		}
+	}()
+
+	// Two concurrent additions could each pass the cycle check below and
+	// close a cycle together, so they take turns.
+	_, err = tx.ExecContext(ctx, "LOCK TABLE group_subgroups IN SHARE ROW EXCLUSIVE MODE")
+	if err != nil {
+		return err
+	}
+
+	groupID, err := lookupGroupID(ctx, tx, name)
+	if err != nil {
+		return err
+	}
+	memberID, err := lookupGroupID(ctx, tx, member)
+	if err != nil {
+		return err
+	}
+
+	var cycle bool
+	err = tx.QueryRowContext(ctx,
+		`WITH RECURSIVE descendants(group_id) AS (
+			SELECT $2::integer
+			UNION
+			SELECT gs.member_group_id FROM group_subgroups gs JOIN descendants d ON gs.group_id = d.group_id
+		)
+		SELECT EXISTS (SELECT 1 FROM descendants WHERE group_id = $1)`,
+		groupID, memberID,
+	).Scan(&cycle)
+	if err != nil {
+		return err
+	}
+	if cycle {
+		return ErrGroupCycle
+	}
+
+	_, err = tx.ExecContext(ctx,
+		"INSERT INTO group_subgroups (group_id, member_group_id) VALUES ($1, $2) ON CONFLICT DO NOTHING",
+		groupID, memberID,
+	)
+	return err
+}
+
+func (g *groupService) RemoveSubgroup(ctx context.Context, name, member string) error {
+	groupID, err := lookupGroupID(ctx, g.db, name)
+	if err != nil {
+		return err
+	}
+	memberID, err := lookupGroupID(ctx, g.db, member)
+	if err != nil {
+		return err
+	}
+	return g.exec(ctx,
+		"DELETE FROM group_subgroups WHERE group_id = $1 AND member_group_id = $2",
+		groupID, memberID,
+	)
+}
+
+func (g *groupService) AssignRole(ctx context.Context, name, role string) error {
+	groupID, err := lookupGroupID(ctx, g.db, name)
+	if err != nil {
+		return err
+	}
+	roleID, err := lookupRoleID(ctx, g.db, role)
+	if err != nil {
+		return err
+	}
+	return g.exec(ctx,
+		"INSERT INTO group_roles (group_id, role_id) VALUES ($1, $2) ON CONFLICT DO NOTHING",
+		groupID, roleID,
+	)
+}
+
+func (g *groupService) UnassignRole(ctx context.Context, name, role string) error {
+	groupID, err := lookupGroupID(ctx, g.db, name)
+	if err != nil {
+		return err
+	}
+	roleID, err := lookupRoleID(ctx, g.db, role)
+	if err != nil {
+		return err
+	}
+	return g.exec(ctx,
+		"DELETE FROM group_roles WHERE group_id = $1 AND role_id = $2",
+		groupID, roleID,
+	)
+}
+
+// exec runs a membership change and drops the cached authorizations it may
+// affect.
+func (g *groupService) exec(ctx context.Context, query string, args ...interface{}) error {
+	_, err := g.db.ExecContext(ctx, query, args...)
+	if err != nil {
+		return err
+	}
+	g.jwtManager.InvalidateAuthorizations()
+	return nil
+}
+
+func lookupGroupID(ctx context.Context, db queryRower, name string) (int64, error) {
+	var groupID int64
+	err := db.QueryRowContext(ctx, "SELECT id FROM groups WHERE name = $1", name).Scan(&groupID)
+	if err == sql.ErrNoRows {
+		return 0, ErrGroupNotFound
+	}
+	return groupID, err
+}
+
+// queryGroups lists groups with their direct members and roles, optionally
+// narrowed by a where clause on groups g.
+func (g *groupService) queryGroups(ctx context.Context, where string, args ...interface{}) ([]model.Group, error) {
+	rows, err := g.db.QueryContext(ctx,
+		`SELECT g.name, g.created_at,
+			COALESCE((SELECT string_agg(gm.userId::text, E'\n' ORDER BY gm.userId) FROM group_members gm WHERE gm.group_id = g.id), ''),
+			COALESCE((SELECT string_agg(m.name, E'\n' ORDER BY m.name) FROM group_subgroups gs JOIN groups m ON m.id = gs.member_group_id WHERE gs.group_id = g.id), ''),
+			COALESCE((SELECT string_agg(r.name, E'\n' ORDER BY r.name) FROM group_roles gr JOIN roles r ON r.id = gr.role_id WHERE gr.group_id = g.id), '')
+		FROM groups g `+where+` ORDER BY g.name`,
+		args...,
+	)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	groups := []model.Group{}
+	for rows.Next() {
+		var group model.Group
+		var users, subgroups, roles string
+		err = rows.Scan(&group.Name, &group.CreatedAt, &users, &subgroups, &roles)
+		if err != nil {
+			return nil, err
+		}
+		group.Users = []int64{}
+		for _, user := range splitLines(users) {
+			userId, err := strconv.ParseInt(user, 10, 64)
+			if err != nil {
+				return nil, err
+			}
+			group.Users = append(group.Users, userId)
+		}
+		group.Groups = splitLines(subgroups)
+		group.Roles = splitLines(roles)
+		groups = append(groups, group)
+	}
+	return groups, rows.Err()
+}
@@ -0,0 +1,273 @@
+package service
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+
+	"golang.org/x/crypto/argon2"
+	"golang.org/x/crypto/bcrypt"
+	"golang.org/x/crypto/scrypt"
+)
+
+// Password hashing algorithms of PasswordHasherConfig.
+const (
+	HashArgon2id = "argon2id"
+	HashBcrypt   = "bcrypt"
+	HashScrypt   = "scrypt"
+)
+
+const (
+	passwordSaltLength = 16
+	passwordKeyLength  = 32
+)
+
+var (
+	ErrUnsupportedPasswordHash = errors.New("Unsupported password hash")
+	ErrPasswordPepperMismatch  = errors.New("Password hash was made with another pepper")
+)
+
+// PasswordHasher hashes passwords into PHC strings
+// ($argon2id$v=19$m=19456,t=2,p=1$salt$hash, $scrypt$ln=17,r=8,p=1$salt$hash)
+// or bcrypt's own format, and verifies hashes of every algorithm.
+// NeedsRehash reports whether a hash was made with other settings than the
+// current ones.
+type PasswordHasher interface {
+	Hash(password string) (string, error)
+	Verify(password, encoded string) (bool, error)
+	NeedsRehash(encoded string) bool
+}
+
+type PasswordHasherConfig struct {
+	Algorithm string
+	// Argon2Memory is in KiB.
+	Argon2Memory  uint32
+	Argon2Time    uint32
+	Argon2Threads uint8
+	BcryptCost    int
+	// ScryptLogN is the base 2 logarithm of the scrypt cost N.
+	ScryptLogN int
+	ScryptR    int
+	ScryptP    int
+	// Pepper is mixed into argon2id and scrypt hashes with HMAC-SHA256. It is
+	// kept out of the database, and hashes record which pepper they use.
+	Pepper []byte
+}
+
+type passwordHasher struct {
+	config   PasswordHasherConfig
+	pepperID string
+}
+
+func NewPasswordHasher(config PasswordHasherConfig) (PasswordHasher, error) {
+	switch config.Algorithm {
+	case HashArgon2id:
+		if config.Argon2Memory < 8*uint32(config.Argon2Threads) || config.Argon2Time == 0 || config.Argon2Threads == 0 {
+			return nil, errors.New("Invalid argon2id parameters")
+		}
+	case HashBcrypt:
+		if config.BcryptCost < bcrypt.MinCost || config.BcryptCost > bcrypt.MaxCost {
+			return nil, errors.New("Invalid bcrypt cost")
+		}
+		if len(config.Pepper) > 0 {
+			return nil, errors.New("A pepper needs argon2id or scrypt")
+		}
+	case HashScrypt:
+		if config.ScryptLogN < 1 || config.ScryptLogN > 30 || config.ScryptR < 1 || config.ScryptP < 1 {
+			return nil, errors.New("Invalid scrypt parameters")
+		}
+	default:
+		return nil, fmt.Errorf("Unknown password hash algorithm %q", config.Algorithm)
+	}
+
+	hasher := &passwordHasher{config: config}
+	if len(config.Pepper) > 0 {
+		sum := sha256.Sum256(config.Pepper)
+		hasher.pepperID = base64.RawURLEncoding.EncodeToString(sum[:6])
+	}
+	return hasher, nil
+}
+
+func (h *passwordHasher) Hash(password string) (string, error) {
+	if h.config.Algorithm == HashBcrypt {
+		hashed, err := bcrypt.GenerateFromPassword([]byte(password), h.config.BcryptCost)
+		if err != nil {
+			return "", err
+		}
+		return string(hashed), nil
+	}
+
+	salt := make([]byte, passwordSaltLength)
+	_, err := rand.Read(salt)
+	if err != nil {
+		return "", fmt.Errorf("Failed to generate random bytes: %w", err)
+	}
+	hash := phcHash{
+		algorithm: h.config.Algorithm,
+		keyID:     h.pepperID,
+		salt:      salt,
+	}
+	if h.config.Algorithm == HashArgon2id {
+		hash.params = []int{int(h.config.Argon2Memory), int(h.config.Argon2Time), int(h.config.Argon2Threads)}
+	} else {
+		hash.params = []int{h.config.ScryptLogN, h.config.ScryptR, h.config.ScryptP}
+	}
+	hash.key, err = hash.derive(h.pepper(password, hash.keyID), passwordKeyLength)
+	if err != nil {
+		return "", err
+	}
+	return hash.String(), nil
+}
+
+func (h *passwordHasher) Verify(password, encoded string) (bool, error) {
+	if isBcryptHash(encoded) {
+		err := bcrypt.CompareHashAndPassword([]byte(encoded), []byte(password))
+		if errors.Is(err, bcrypt.ErrMismatchedHashAndPassword) {
+			return false, nil
+		}
+		return err == nil, err
+	}
+
+	hash, err := parsePHCHash(encoded)
+	if err != nil {
+		return false, err
+	}
+	// Hashes from before a pepper was configured are verified without it.
+	if hash.keyID != "" && hash.keyID != h.pepperID {
+		return false, ErrPasswordPepperMismatch
+	}
+	key, err := hash.derive(h.pepper(password, hash.keyID), len(hash.key))
+	if err != nil {
+		return false, err
+	}
+	return subtle.ConstantTimeCompare(key, hash.key) == 1, nil
+}
+
+func (h *passwordHasher) NeedsRehash(encoded string) bool {
+	if isBcryptHash(encoded) {
+		if h.config.Algorithm != HashBcrypt {
+			return true
+		}
+		cost, err := bcrypt.Cost([]byte(encoded))
+		return err != nil || cost != h.config.BcryptCost
+	}
+
+	hash, err := parsePHCHash(encoded)
+	if err != nil || hash.algorithm != h.config.Algorithm || hash.keyID != h.pepperID ||
+		len(hash.salt) != passwordSaltLength || len(hash.key) != passwordKeyLength {
+		return true
+	}
+	if hash.algorithm == HashArgon2id {
+		return hash.params[0] != int(h.config.Argon2Memory) || hash.params[1] != int(h.config.Argon2Time) ||
+			hash.params[2] != int(h.config.Argon2Threads)
+	}
+	return hash.params[0] != h.config.ScryptLogN || hash.params[1] != h.config.ScryptR || hash.params[2] != h.config.ScryptP
+}
+
+func (h *passwordHasher) pepper(password, keyID string) []byte {
+	if keyID == "" {
+		return []byte(password)
+	}
+	mac := hmac.New(sha256.New, h.config.Pepper)
+	mac.Write([]byte(password))
+	return mac.Sum(nil)
+}
+
+func isBcryptHash(encoded string) bool {
+	return strings.HasPrefix(encoded, "$2a$") || strings.HasPrefix(encoded, "$2b$") || strings.HasPrefix(encoded, "$2y$")
+}
+
+// phcHash is an argon2id or scrypt hash. params are m, t, p for argon2id and
+// ln, r, p for scrypt; keyID names the pepper, if any.
+type phcHash struct {
+	algorithm string
+	params    []int
+	keyID     string
+	salt      []byte
+	key       []byte
+}
+
+var phcParamNames = map[string][]string{
+	HashArgon2id: {"m", "t", "p"},
+	HashScrypt:   {"ln", "r", "p"},
+}
+
+func (p *phcHash) String() string {
+	names := phcParamNames[p.algorithm]
+	params := make([]string, 0, len(names)+1)
+	for i, name := range names {
+		params = append(params, name+"="+strconv.Itoa(p.params[i]))
+	}
+	if p.keyID != "" {
+		params = append(params, "keyid="+p.keyID)
+	}
+	version := ""
+	if p.algorithm == HashArgon2id {
+		version = "$v=" + strconv.Itoa(argon2.Version)
+	}
+	return "$" + p.algorithm + version + "$" + strings.Join(params, ",") + "$" +
+		base64.RawStdEncoding.EncodeToString(p.salt) + "$" + base64.RawStdEncoding.EncodeToString(p.key)
+}
+
+func parsePHCHash(encoded string) (*phcHash, error) {
+	fields := strings.Split(encoded, "$")
+	if len(fields) < 5 || fields[0] != "" {
+		return nil, ErrUnsupportedPasswordHash
+	}
+	hash := &phcHash{algorithm: fields[1]}
+	names, ok := phcParamNames[hash.algorithm]
+	if !ok {
+		return nil, ErrUnsupportedPasswordHash
+	}
+	fields = fields[2:]
+	if hash.algorithm == HashArgon2id {
+		if fields[0] != "v="+strconv.Itoa(argon2.Version) {
+			return nil, ErrUnsupportedPasswordHash
+		}
+		fields = fields[1:]
+	}
+	if len(fields) != 3 {
+		return nil, ErrUnsupportedPasswordHash
+	}
+
+	values := map[string]string{}
+	for _, param := range strings.Split(fields[0], ",") {
+		name, value, _ := strings.Cut(param, "=")
+		values[name] = value
+	}
+	hash.keyID = values["keyid"]
+	for _, name := range names {
+		value, err := strconv.Atoi(values[name])
+		if err != nil || value < 1 {
+			return nil, ErrUnsupportedPasswordHash
+		}
+		hash.params = append(hash.params, value)
+	}
+	if hash.algorithm == HashArgon2id && hash.params[2] > 255 || hash.algorithm == HashScrypt && hash.params[0] > 30 {
+		return nil, ErrUnsupportedPasswordHash
+	}
+
+	var err error
+	hash.salt, err = base64.RawStdEncoding.DecodeString(fields[1])
+	if err != nil {
+		return nil, ErrUnsupportedPasswordHash
+	}
+	hash.key, err = base64.RawStdEncoding.DecodeString(fields[2])
+	if err != nil || len(hash.key) == 0 {
+		return nil, ErrUnsupportedPasswordHash
+	}
+	return hash, nil
+}
+
+func (p *phcHash) derive(password []byte, keyLength int) ([]byte, error) {
+	if p.algorithm == HashArgon2id {
+		return argon2.IDKey(password, p.salt, uint32(p.params[1]), uint32(p.params[0]), uint8(p.params[2]), uint32(keyLength)), nil
+	}
+	return scrypt.Key(password, p.salt, 1<<p.params[0], p.params[1], p.params[2], keyLength)
+}
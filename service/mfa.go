@@ -0,0 +1,418 @@
+package service
+
+import (
+	"context"
+	"crypto/rand"
+	"database/sql"
+	"encoding/base32"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"jwt-auth/auth"
+	"jwt-auth/model"
+	"strings"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+const (
+	mfaChallengeDuration = 5 * time.Minute
+	// mfaChallengeAttempts is how many codes can be tried against one
+	// challenge before the password has to be entered again.
+	mfaChallengeAttempts = 5
+	recoveryCodeCount    = 10
+)
+
+var (
+	ErrMFAAlreadyEnabled   = errors.New("Two-factor authentication is already enabled")
+	ErrMFANotEnrolled      = errors.New("Two-factor authentication is not enrolled")
+	ErrInvalidMFACode      = errors.New("Invalid authentication code")
+	ErrInvalidMFAChallenge = errors.New("Invalid or expired MFA challenge")
+)
+
+var recoveryCodeEncoding = base32.StdEncoding.WithPadding(base32.NoPadding)
+
+// MFARequiredError is returned by LoginUser instead of a token pair when the
+// password was right but the user has two-factor authentication enabled.
+// The login is completed by MFAService.CompleteLogin with ChallengeToken.
+type MFARequiredError struct {
+	ChallengeToken string
+	ExpiresAt      time.Time
+}
+
+func (e *MFARequiredError) Error() string {
+	return "Two-factor authentication required"
+}
+
+type MFAService interface {
+	EnrollTOTP(ctx context.Context, accessToken string) (model.TOTPEnrollment, error)
+	ConfirmTOTP(ctx context.Context, accessToken, code string) ([]string, error)
+	RegenerateRecoveryCodes(ctx context.Context, accessToken, code string) ([]string, error)
+	CompleteLogin(ctx context.Context, challengeToken, code, userAgent, agentIp string) (int64, string, string, error)
+	ResetMFA(ctx context.Context, userId int64) error
+}
+
+type mfaService struct {
+	db            *sql.DB
+	jwtManager    *auth.JWTManager
+	issuer        string
+	loginThrottle *LoginThrottle
+}
+
+func NewMFAService(db *sql.DB, jwtManager *auth.JWTManager, issuer string, loginThrottle *LoginThrottle) MFAService {
+	return &mfaService{
+		db:            db,
+		jwtManager:    jwtManager,
+		issuer:        issuer,
+		loginThrottle: loginThrottle,
+	}
+}
+
+// EnrollTOTP generates a new TOTP secret for the caller. It only takes
+// effect once ConfirmTOTP is given a code generated from it, and enrolling
+// again before that replaces the secret.
+func (m *mfaService) EnrollTOTP(ctx context.Context, accessToken string) (model.TOTPEnrollment, error) {
+	userId, _, err := m.jwtManager.ValidateFirstPartyAccessToken(accessToken)
+	if err != nil {
+		return model.TOTPEnrollment{}, err
+	}
+	secret, err := generateTOTPSecret()
+	if err != nil {
+		return model.TOTPEnrollment{}, err
+	}
+
+	var username string
+	err = m.db.QueryRowContext(ctx,
+		`INSERT INTO user_totp (userId, secret) VALUES ($1, $2)
+		ON CONFLICT (userId) DO UPDATE SET secret = EXCLUDED.secret, created_at = CURRENT_TIMESTAMP
+		WHERE user_totp.confirmed_at IS NULL
+		RETURNING (SELECT username FROM users WHERE id = $1)`,
+		userId, secret,
+	).Scan(&username)
+	if err == sql.ErrNoRows {
+		return model.TOTPEnrollment{}, ErrMFAAlreadyEnabled
+	}
+	if err != nil {
+		return model.TOTPEnrollment{}, err
+	}
+	return model.TOTPEnrollment{
+		Secret: secret,
+		URI:    totpURI(m.issuer, username, secret),
+	}, nil
+}
+
+// ConfirmTOTP enables two-factor authentication with the enrolled secret
+// and returns a fresh set of recovery codes.
+func (m *mfaService) ConfirmTOTP(ctx context.Context, accessToken, code string) (codes []string, err error) {
+	userId, _, err := m.jwtManager.ValidateFirstPartyAccessToken(accessToken)
+	if err != nil {
+		return nil, err
+	}
+
+	var secret string
+	var confirmedAt sql.NullTime
+	err = m.db.QueryRowContext(ctx,
+		"SELECT secret, confirmed_at FROM user_totp WHERE userId = $1",
+		userId,
+	).Scan(&secret, &confirmedAt)
+	if err == sql.ErrNoRows {
+		return nil, ErrMFANotEnrolled
+	}
+	if err != nil {
+		return nil, err
+	}
+	if confirmedAt.Valid {
+		return nil, ErrMFAAlreadyEnabled
+	}
+	step, ok := matchTOTP(secret, code, time.Now())
+	if !ok {
+		return nil, ErrInvalidMFACode
+	}
+
+	tx, err := m.db.BeginTx(ctx, nil)
+	if err != nil {
+		return nil, err
+	}
+	defer func() {
+		if p := recover(); p != nil {
+			tx.Rollback()
+			panic(p)
+		} else if err != nil {
+			tx.Rollback()
+		} else {
+			err = tx.Commit()
+		}
+	}()
+
+	result, err := tx.ExecContext(ctx,
+		"UPDATE user_totp SET confirmed_at = $2, last_used_step = $3 WHERE userId = $1 AND secret = $4 AND confirmed_at IS NULL",
+		userId, time.Now(), step, secret,
+	)
+	if err != nil {
+		return nil, err
+	}
+	affected, err := result.RowsAffected()
+	if err != nil {
+		return nil, err
+	}
+	if affected == 0 {
+		err = ErrInvalidMFACode
+		return nil, err
+	}
+	return replaceRecoveryCodes(ctx, tx, userId)
+}
+
+// RegenerateRecoveryCodes replaces the caller's recovery codes, for instance
+// once most of them are used up. It takes a current TOTP code.
+func (m *mfaService) RegenerateRecoveryCodes(ctx context.Context, accessToken, code string) (codes []string, err error) {
+	userId, _, err := m.jwtManager.ValidateFirstPartyAccessToken(accessToken)
+	if err != nil {
+		return nil, err
+	}
+
+	tx, err := m.db.BeginTx(ctx, nil)
+	if err != nil {
+		return nil, err
+	}
+	defer func() {
+		if p := recover(); p != nil {
+			tx.Rollback()
+			panic(p)
+		} else if err != nil {
+			tx.Rollback()
+		} else {
+			err = tx.Commit()
+		}
+	}()
+
+	ok, err := verifyTOTP(ctx, tx, userId, code)
+	if err != nil {
+		return nil, err
+	}
+	if !ok {
+		err = ErrInvalidMFACode
+		return nil, err
+	}
+	return replaceRecoveryCodes(ctx, tx, userId)
+}
+
+// CompleteLogin finishes a login LoginUser answered with MFARequiredError,
+// given a TOTP code or one of the user's recovery codes, which is used up.
+// Each challenge allows a few attempts and is single use. Wrong codes count
+// as failed logins of the account, which LoginUser only clears once the
+// second factor succeeds, so new challenges do not buy more guesses.
+func (m *mfaService) CompleteLogin(ctx context.Context, challengeToken, code, userAgent, agentIp string) (int64, string, string, error) {
+	challengeHash := hashCode(challengeToken)
+
+	var userId, orgID int64
+	var username string
+	err := m.db.QueryRowContext(ctx,
+		`UPDATE mfa_challenges c SET attempts = c.attempts + 1
+		FROM users u
+		WHERE c.token_hash = $1 AND c.expires_at > $2 AND c.attempts < $3
+		AND u.id = c.userId AND u.banned_at IS NULL
+		RETURNING c.userId, u.org_id, u.username`,
+		challengeHash, time.Now(), mfaChallengeAttempts,
+	).Scan(&userId, &orgID, &username)
+	if err == sql.ErrNoRows {
+		return 0, "", "", ErrInvalidMFAChallenge
+	}
+	if err != nil {
+		return 0, "", "", err
+	}
+	accountKey := loginAccountKey(orgID, username)
+	err = m.loginThrottle.check(ctx, m.db, accountKey, agentIp)
+	if err != nil {
+		return 0, "", "", err
+	}
+
+	ok, err := verifyTOTP(ctx, m.db, userId, code)
+	if err != nil {
+		return 0, "", "", err
+	}
+	if !ok {
+		ok, err = useRecoveryCode(ctx, m.db, userId, code)
+		if err != nil {
+			return 0, "", "", err
+		}
+	}
+	if !ok {
+		err = m.loginThrottle.recordFailure(ctx, m.db, accountKey, agentIp)
+		if err != nil {
+			return 0, "", "", err
+		}
+		return 0, "", "", ErrInvalidMFACode
+	}
+
+	result, err := m.db.ExecContext(ctx, "DELETE FROM mfa_challenges WHERE token_hash = $1", challengeHash)
+	if err != nil {
+		return 0, "", "", err
+	}
+	affected, err := result.RowsAffected()
+	if err != nil {
+		return 0, "", "", err
+	}
+	if affected == 0 {
+		return 0, "", "", ErrInvalidMFAChallenge
+	}
+	err = clearLoginFailures(ctx, m.db, accountKey)
+	if err != nil {
+		return 0, "", "", err
+	}
+
+	pairID := uuid.New().String()
+	accessToken, err := m.jwtManager.GenerateAccessToken(ctx, userId, pairID)
+	if err != nil {
+		return 0, "", "", err
+	}
+	refreshToken, err := m.jwtManager.GenerateRefreshToken(userId, pairID, userAgent, agentIp)
+	if err != nil {
+		return 0, "", "", err
+	}
+	return userId, accessToken, refreshToken, nil
+}
+
+// ResetMFA turns off two-factor authentication for a user who lost both
+// their authenticator and recovery codes, so that they can enroll again.
+func (m *mfaService) ResetMFA(ctx context.Context, userId int64) (err error) {
+	tx, err := m.db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer func() {
+		if p := recover(); p != nil {
+			tx.Rollback()
+			panic(p)
+		} else if err != nil {
+			tx.Rollback()
+		} else {
+			err = tx.Commit()
+		}
+	}()
+
+	var exists bool
+	err = tx.QueryRowContext(ctx, "SELECT EXISTS(SELECT 1 FROM users WHERE id = $1)", userId).Scan(&exists)
+	if err != nil {
+		return err
+	}
+	if !exists {
+		err = ErrUserNotFound
+		return err
+	}
+	for _, table := range []string{"user_totp", "mfa_recovery_codes", "mfa_challenges"} {
+		_, err = tx.ExecContext(ctx, "DELETE FROM "+table+" WHERE userId = $1", userId)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// createMFAChallenge starts the second step of a login for a user with
+// two-factor authentication.
+func createMFAChallenge(ctx context.Context, db *sql.DB, userId int64) (*MFARequiredError, error) {
+	bytes := make([]byte, 32)
+	_, err := rand.Read(bytes)
+	if err != nil {
+		return nil, fmt.Errorf("Failed to generate random bytes: %w", err)
+	}
+	token := base64.RawURLEncoding.EncodeToString(bytes)
+	expiresAt := time.Now().Add(mfaChallengeDuration)
+
+	_, err = db.ExecContext(ctx,
+		"DELETE FROM mfa_challenges WHERE userId = $1 AND expires_at <= $2",
+		userId, time.Now(),
+	)
+	if err != nil {
+		return nil, err
+	}
+	_, err = db.ExecContext(ctx,
+		"INSERT INTO mfa_challenges (token_hash, userId, expires_at) VALUES ($1, $2, $3)",
+		hashCode(token), userId, expiresAt,
+	)
+	if err != nil {
+		return nil, err
+	}
+	return &MFARequiredError{ChallengeToken: token, ExpiresAt: expiresAt}, nil
+}
+
+type execQueryer interface {
+	queryRower
+	ExecContext(ctx context.Context, query string, args ...interface{}) (sql.Result, error)
+}
+
+// verifyTOTP checks a code against the user's confirmed secret and records
+// its time step, so that each code is only accepted once.
+func verifyTOTP(ctx context.Context, db execQueryer, userId int64, code string) (bool, error) {
+	var secret string
+	err := db.QueryRowContext(ctx,
+		"SELECT secret FROM user_totp WHERE userId = $1 AND confirmed_at IS NOT NULL",
+		userId,
+	).Scan(&secret)
+	if err == sql.ErrNoRows {
+		return false, ErrMFANotEnrolled
+	}
+	if err != nil {
+		return false, err
+	}
+	step, ok := matchTOTP(secret, strings.TrimSpace(code), time.Now())
+	if !ok {
+		return false, nil
+	}
+	result, err := db.ExecContext(ctx,
+		"UPDATE user_totp SET last_used_step = $2 WHERE userId = $1 AND last_used_step < $2",
+		userId, step,
+	)
+	if err != nil {
+		return false, err
+	}
+	affected, err := result.RowsAffected()
+	return affected > 0, err
+}
+
+func useRecoveryCode(ctx context.Context, db execQueryer, userId int64, code string) (bool, error) {
+	result, err := db.ExecContext(ctx,
+		"DELETE FROM mfa_recovery_codes WHERE userId = $1 AND code_hash = $2",
+		userId, hashCode(normalizeRecoveryCode(code)),
+	)
+	if err != nil {
+		return false, err
+	}
+	affected, err := result.RowsAffected()
+	return affected > 0, err
+}
+
+// replaceRecoveryCodes generates recovery codes of 80 random bits, written
+// as xxxx-xxxx-xxxx-xxxx, and stores their hashes in place of the old ones.
+func replaceRecoveryCodes(ctx context.Context, tx *sql.Tx, userId int64) ([]string, error) {
+	_, err := tx.ExecContext(ctx, "DELETE FROM mfa_recovery_codes WHERE userId = $1", userId)
+	if err != nil {
+		return nil, err
+	}
+
+	codes := make([]string, 0, recoveryCodeCount)
+	for len(codes) < recoveryCodeCount {
+		bytes := make([]byte, 10)
+		_, err = rand.Read(bytes)
+		if err != nil {
+			return nil, fmt.Errorf("Failed to generate random bytes: %w", err)
+		}
+		code := strings.ToLower(recoveryCodeEncoding.EncodeToString(bytes))
+		_, err = tx.ExecContext(ctx,
+			"INSERT INTO mfa_recovery_codes (userId, code_hash) VALUES ($1, $2)",
+			userId, hashCode(code),
+		)
+		if err != nil {
+			return nil, err
+		}
+		codes = append(codes, code[0:4]+"-"+code[4:8]+"-"+code[8:12]+"-"+code[12:16])
+	}
+	return codes, nil
+}
+
+func normalizeRecoveryCode(code string) string {
+	code = strings.ToLower(code)
+	code = strings.ReplaceAll(code, "-", "")
+	return strings.ReplaceAll(code, " ", "")
+}
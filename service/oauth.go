@@ -0,0 +1,414 @@
+package service
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"database/sql"
+	"encoding/base64"
+	"encoding/hex"
+	"fmt"
+	"jwt-auth/auth"
+	"jwt-auth/model"
+	"log"
+	"regexp"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/golang-jwt/jwt/v5"
+	"github.com/google/uuid"
+)
+
+const authorizationCodeDuration = time.Minute
+
+var codeVerifierPattern = regexp.MustCompile(`^[A-Za-z0-9._~-]{43,128}$`)
+
+// ProtocolError is an OAuth error that is reported to the client with its
+// RFC 6749 error code.
+type ProtocolError struct {
+	Code        string
+	Description string
+}
+
+func (e *ProtocolError) Error() string {
+	if e.Description == "" {
+		return e.Code
+	}
+	return e.Code + ": " + e.Description
+}
+
+func protocolError(code, description string) *ProtocolError {
+	return &ProtocolError{Code: code, Description: description}
+}
+
+type OAuthService interface {
+	ValidateAuthorizationRequest(ctx context.Context, req model.AuthorizationRequest) (model.Client, error)
+	CreateAuthorizationCode(ctx context.Context, req model.AuthorizationRequest, userId int64, authTime time.Time) (string, error)
+	ExchangeAuthorizationCode(ctx context.Context, client model.Client, code, redirectURI, codeVerifier, userAgent, agentIp string) (model.TokenResponse, error)
+	RefreshClientTokens(ctx context.Context, client model.Client, refreshToken, scope, userAgent, agentIp string) (model.TokenResponse, error)
+	ClientCredentials(ctx context.Context, client model.Client, scope string) (model.TokenResponse, error)
+	CreateDeviceAuthorization(ctx context.Context, client model.Client) (model.DeviceAuthorization, error)
+	LookupUserCode(ctx context.Context, userCode string) (model.Client, error)
+	DecideDeviceAuthorization(ctx context.Context, userCode string, userId int64, approve bool) error
+	PollDeviceToken(ctx context.Context, client model.Client, deviceCode, userAgent, agentIp string) (model.TokenResponse, error)
+	ExchangeToken(ctx context.Context, client model.Client, req model.TokenExchangeRequest) (model.TokenResponse, error)
+	UserInfo(ctx context.Context, accessToken string) (model.UserInfo, error)
+	OpenIDConfiguration() (model.OpenIDConfiguration, error)
+}
+
+type oauthService struct {
+	db            *sql.DB
+	jwtManager    *auth.JWTManager
+	clientService ClientService
+}
+
+func NewOAuthService(db *sql.DB, jwtManager *auth.JWTManager, clientService ClientService) OAuthService {
+	return &oauthService{
+		db:            db,
+		jwtManager:    jwtManager,
+		clientService: clientService,
+	}
+}
+
+// ValidateAuthorizationRequest checks an authorization request. Errors about
+// the client or its redirect URI are returned as ErrInvalidClient and
+// ErrInvalidRedirectURI and must not be redirected; every other problem is a
+// *ProtocolError meant for the client's redirect URI.
+func (o *oauthService) ValidateAuthorizationRequest(ctx context.Context, req model.AuthorizationRequest) (model.Client, error) {
+	client, err := o.clientService.GetClient(ctx, req.ClientID)
+	if err != nil {
+		return model.Client{}, ErrInvalidClient
+	}
+	if req.RedirectURI == "" || !slices.Contains(client.RedirectURIs, req.RedirectURI) {
+		return model.Client{}, ErrInvalidRedirectURI
+	}
+	if req.ResponseType != "code" {
+		return client, protocolError("unsupported_response_type", "Only the code response type is supported")
+	}
+	if req.CodeChallenge == "" {
+		return client, protocolError("invalid_request", "PKCE code_challenge is required")
+	}
+	if req.CodeChallengeMethod != "S256" {
+		return client, protocolError("invalid_request", "code_challenge_method must be S256")
+	}
+	scope, err := authorizationScope(client, req.Scope)
+	if err != nil {
+		return client, err
+	}
+	if hasScope(scope, "openid") && !o.jwtManager.SignsIDTokens() {
+		return client, protocolError("invalid_scope", "The openid scope needs an asymmetric signing algorithm")
+	}
+	return client, nil
+}
+
+// authorizationScope is the scope a client is granted for a request: the
+// requested one if the client may ask for it, or else the client's own. A
+// grant never comes without a scope, which would carry every right of the
+// user.
+func authorizationScope(client model.Client, requested string) (string, error) {
+	if requested == "" {
+		requested = client.Scope
+	}
+	scope := normalizeScope(requested)
+	if scope == "" {
+		return "", protocolError("invalid_scope", "A scope is required")
+	}
+	if !scopeSubset(scope, client.Scope) {
+		return "", protocolError("invalid_scope", "Requested scope exceeds the scope allowed for the client")
+	}
+	return scope, nil
+}
+
+// CreateAuthorizationCode issues a single-use code for an approved request.
+// Only a hash of the code is stored. authTime is when the user last entered
+// their credentials and ends up in the ID token.
+func (o *oauthService) CreateAuthorizationCode(ctx context.Context, req model.AuthorizationRequest, userId int64, authTime time.Time) (string, error) {
+	client, err := o.clientService.GetClient(ctx, req.ClientID)
+	if err != nil {
+		return "", ErrInvalidClient
+	}
+	scope, err := authorizationScope(client, req.Scope)
+	if err != nil {
+		return "", err
+	}
+
+	bytes := make([]byte, 32)
+	_, err = rand.Read(bytes)
+	if err != nil {
+		return "", fmt.Errorf("Failed to generate random bytes: %w", err)
+	}
+	code := base64.RawURLEncoding.EncodeToString(bytes)
+
+	_, err = o.db.ExecContext(ctx,
+		"INSERT INTO authorization_codes (code, client_id, userId, redirect_uri, scope, code_challenge, nonce, auth_time, issued_at, expires_at) VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9, $10)",
+		hashCode(code), req.ClientID, userId, req.RedirectURI, scope, req.CodeChallenge,
+		sql.NullString{String: req.Nonce, Valid: req.Nonce != ""}, authTime,
+		time.Now(), time.Now().Add(authorizationCodeDuration),
+	)
+	if err != nil {
+		return "", fmt.Errorf("Failed to save authorization code: %w", err)
+	}
+	return code, nil
+}
+
+// ExchangeAuthorizationCode redeems a code for an access and refresh token
+// pair. A code presented twice revokes the tokens issued for it.
+func (o *oauthService) ExchangeAuthorizationCode(ctx context.Context, client model.Client, code, redirectURI, codeVerifier, userAgent, agentIp string) (model.TokenResponse, error) {
+	if code == "" || redirectURI == "" || codeVerifier == "" {
+		return model.TokenResponse{}, protocolError("invalid_request", "code, redirect_uri and code_verifier are required")
+	}
+	if !codeVerifierPattern.MatchString(codeVerifier) {
+		return model.TokenResponse{}, protocolError("invalid_grant", "Malformed code_verifier")
+	}
+
+	grant, err := o.consumeAuthorizationCode(ctx, hashCode(code))
+	if err != nil {
+		return model.TokenResponse{}, err
+	}
+	if grant.clientID != client.ID || grant.redirectURI != redirectURI {
+		return model.TokenResponse{}, protocolError("invalid_grant", "Code was issued to another client or redirect URI")
+	}
+	if !verifyCodeChallenge(grant.codeChallenge, codeVerifier) {
+		return model.TokenResponse{}, protocolError("invalid_grant", "PKCE verification failed")
+	}
+
+	response, familyID, err := o.issueTokens(ctx, grant.userId, client.ID, grant.scope, userAgent, agentIp)
+	if err != nil {
+		return model.TokenResponse{}, err
+	}
+	if hasScope(grant.scope, "openid") {
+		response.IDToken, err = o.issueIDToken(ctx, grant.userId, client.ID, grant.scope, grant.nonce, grant.authTime)
+		if err != nil {
+			return model.TokenResponse{}, err
+		}
+	}
+	_, err = o.db.ExecContext(ctx,
+		"UPDATE authorization_codes SET family_id = $1 WHERE code = $2",
+		familyID, hashCode(code),
+	)
+	if err != nil {
+		return model.TokenResponse{}, err
+	}
+	return response, nil
+}
+
+type authorizationGrant struct {
+	clientID      string
+	userId        int64
+	redirectURI   string
+	scope         string
+	codeChallenge string
+	nonce         string
+	authTime      time.Time
+}
+
+func (o *oauthService) consumeAuthorizationCode(ctx context.Context, hashedCode string) (grant authorizationGrant, err error) {
+	tx, err := o.db.BeginTx(ctx, nil)
+	if err != nil {
+		return authorizationGrant{}, err
+	}
+
+	defer func() {
+		if p := recover(); p != nil {
+			tx.Rollback()
+			panic(p)
+		} else if err != nil {
+			tx.Rollback()
+		} else {
+			err = tx.Commit()
+		}
+	}()
+
+	var nonce, familyID sql.NullString
+	var authTime, usedAt sql.NullTime
+	var expiresAt time.Time
+	err = tx.QueryRowContext(ctx,
+		"SELECT client_id, userId, redirect_uri, scope, code_challenge, nonce, auth_time, family_id, expires_at, used_at FROM authorization_codes WHERE code = $1 FOR UPDATE",
+		hashedCode,
+	).Scan(&grant.clientID, &grant.userId, &grant.redirectURI, &grant.scope, &grant.codeChallenge, &nonce, &authTime, &familyID, &expiresAt, &usedAt)
+	if err == sql.ErrNoRows {
+		return authorizationGrant{}, protocolError("invalid_grant", "Unknown authorization code")
+	}
+	if err != nil {
+		return authorizationGrant{}, err
+	}
+
+	if usedAt.Valid {
+		if familyID.Valid {
+			revokeErr := o.jwtManager.RevokeRefreshTokenFamily(ctx, familyID.String)
+			if revokeErr != nil {
+				log.Printf("Failed to revoke tokens of a replayed authorization code: %v", revokeErr)
+			}
+		}
+		return authorizationGrant{}, protocolError("invalid_grant", "Authorization code already used")
+	}
+	if time.Now().After(expiresAt) {
+		return authorizationGrant{}, protocolError("invalid_grant", "Authorization code expired")
+	}
+
+	_, err = tx.ExecContext(ctx,
+		"UPDATE authorization_codes SET used_at = $1 WHERE code = $2",
+		time.Now(), hashedCode,
+	)
+	if err != nil {
+		return authorizationGrant{}, err
+	}
+	grant.nonce = nonce.String
+	grant.authTime = authTime.Time
+	return grant, nil
+}
+
+// RefreshClientTokens rotates a refresh token issued through the token
+// endpoint. A narrower scope may be requested for the new access token.
+func (o *oauthService) RefreshClientTokens(ctx context.Context, client model.Client, refreshToken, scope, userAgent, agentIp string) (model.TokenResponse, error) {
+	if refreshToken == "" {
+		return model.TokenResponse{}, protocolError("invalid_request", "refresh_token is required")
+	}
+
+	if scope != "" {
+		current, err := o.jwtManager.InspectRefreshToken(ctx, refreshToken)
+		if err == nil && !scopeSubset(scope, current.Scope) {
+			return model.TokenResponse{}, protocolError("invalid_scope", "Requested scope exceeds the granted scope")
+		}
+	}
+
+	pairID := uuid.New().String()
+	record, newRefreshToken, err := o.jwtManager.RotateClientRefreshToken(ctx, client.ID, pairID, userAgent, agentIp, refreshToken)
+	if err != nil {
+		return model.TokenResponse{}, protocolError("invalid_grant", err.Error())
+	}
+
+	grantedScope := record.Scope
+	if scope != "" {
+		grantedScope = normalizeScope(scope)
+	}
+
+	accessToken, err := o.jwtManager.IssueAccessToken(ctx, &auth.Claims{
+		UserID:    record.UserID,
+		KeyPairID: pairID,
+		ClientID:  client.ID,
+		Scope:     grantedScope,
+	})
+	if err != nil {
+		return model.TokenResponse{}, err
+	}
+
+	response := model.TokenResponse{
+		AccessToken:  accessToken,
+		TokenType:    "Bearer",
+		ExpiresIn:    int64(o.jwtManager.AccessTokenDuration().Seconds()),
+		RefreshToken: newRefreshToken,
+		Scope:        grantedScope,
+	}
+	// Refresh tokens granted openid before a switch to a symmetric algorithm
+	// go on without ID tokens.
+	if hasScope(grantedScope, "openid") && o.jwtManager.SignsIDTokens() {
+		response.IDToken, err = o.issueIDToken(ctx, record.UserID, client.ID, grantedScope, "", time.Time{})
+		if err != nil {
+			return model.TokenResponse{}, err
+		}
+	}
+	return response, nil
+}
+
+// ClientCredentials issues an access token to a confidential client acting on
+// its own behalf. The token's subject is the client, it carries no user and
+// comes without a refresh token.
+func (o *oauthService) ClientCredentials(ctx context.Context, client model.Client, scope string) (model.TokenResponse, error) {
+	if !client.Confidential {
+		return model.TokenResponse{}, protocolError("unauthorized_client", "Public clients cannot use the client_credentials grant")
+	}
+	grantedScope := client.Scope
+	if scope != "" {
+		if !scopeSubset(scope, client.Scope) {
+			return model.TokenResponse{}, protocolError("invalid_scope", "Requested scope exceeds the scope allowed for the client")
+		}
+		grantedScope = normalizeScope(scope)
+	}
+
+	lifetime := o.jwtManager.AccessTokenDuration()
+	if client.AccessTokenLifetime > 0 {
+		lifetime = time.Duration(client.AccessTokenLifetime) * time.Second
+	}
+
+	accessToken, err := o.jwtManager.IssueAccessToken(ctx, &auth.Claims{
+		KeyPairID: uuid.New().String(),
+		ClientID:  client.ID,
+		Scope:     grantedScope,
+		RegisteredClaims: jwt.RegisteredClaims{
+			Subject:   client.ID,
+			ExpiresAt: jwt.NewNumericDate(time.Now().Add(lifetime)),
+		},
+	})
+	if err != nil {
+		return model.TokenResponse{}, err
+	}
+
+	return model.TokenResponse{
+		AccessToken: accessToken,
+		TokenType:   "Bearer",
+		ExpiresIn:   int64(lifetime.Seconds()),
+		Scope:       grantedScope,
+	}, nil
+}
+
+// issueTokens mints a key pair for a client and returns it together with the
+// id of the refresh token family it starts.
+func (o *oauthService) issueTokens(ctx context.Context, userId int64, clientID, scope, userAgent, agentIp string) (model.TokenResponse, string, error) {
+	pairID := uuid.New().String()
+	accessToken, err := o.jwtManager.IssueAccessToken(ctx, &auth.Claims{
+		UserID:    userId,
+		KeyPairID: pairID,
+		ClientID:  clientID,
+		Scope:     scope,
+	})
+	if err != nil {
+		return model.TokenResponse{}, "", err
+	}
+
+	refreshToken, err := o.jwtManager.GenerateClientRefreshToken(userId, pairID, clientID, scope, userAgent, agentIp)
+	if err != nil {
+		return model.TokenResponse{}, "", err
+	}
+	familyID, _, _ := strings.Cut(refreshToken, ":")
+
+	return model.TokenResponse{
+		AccessToken:  accessToken,
+		TokenType:    "Bearer",
+		ExpiresIn:    int64(o.jwtManager.AccessTokenDuration().Seconds()),
+		RefreshToken: refreshToken,
+		Scope:        scope,
+	}, familyID, nil
+}
+
+func hashCode(code string) string {
+	sum := sha256.Sum256([]byte(code))
+	return hex.EncodeToString(sum[:])
+}
+
+// verifyCodeChallenge implements the S256 PKCE method of RFC 7636.
+func verifyCodeChallenge(codeChallenge, codeVerifier string) bool {
+	sum := sha256.Sum256([]byte(codeVerifier))
+	expected := base64.RawURLEncoding.EncodeToString(sum[:])
+	return subtle.ConstantTimeCompare([]byte(expected), []byte(codeChallenge)) == 1
+}
+
+func normalizeScope(scope string) string {
+	return strings.Join(strings.Fields(scope), " ")
+}
+
+func hasScope(scope, name string) bool {
+	return slices.Contains(strings.Fields(scope), name)
+}
+
+func scopeSubset(requested, granted string) bool {
+	grantedScopes := strings.Fields(granted)
+	for _, scope := range strings.Fields(requested) {
+		if !slices.Contains(grantedScopes, scope) {
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,126 @@
+package service
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"jwt-auth/auth"
+	"jwt-auth/model"
+	"strconv"
+	"time"
+
+	"github.com/golang-jwt/jwt/v5"
+)
+
+var ErrInsufficientScope = errors.New("Insufficient scope")
+
+// firstPartyScope is granted to tokens issued by /login, which are not bound
+// to a client or a scope.
+const firstPartyScope = "openid profile email"
+
+// UserInfo returns the claims of the user an access token was issued for,
+// limited to the scopes granted to it.
+func (o *oauthService) UserInfo(ctx context.Context, accessToken string) (model.UserInfo, error) {
+	claims, err := o.jwtManager.ParseAccessToken(accessToken)
+	if err != nil {
+		return model.UserInfo{}, err
+	}
+	if claims.IsClient() {
+		return model.UserInfo{}, auth.ErrClientToken
+	}
+	scope := claims.Scope
+	if claims.ClientID == "" {
+		scope = firstPartyScope
+	}
+	if !hasScope(scope, "openid") {
+		return model.UserInfo{}, ErrInsufficientScope
+	}
+	return o.userInfo(ctx, claims.UserID, scope)
+}
+
+// OpenIDConfiguration describes the endpoints. While the signing key is
+// symmetric no ID tokens are issued, so neither the openid scope nor an ID
+// token algorithm is advertised.
+func (o *oauthService) OpenIDConfiguration() (model.OpenIDConfiguration, error) {
+	algorithm, err := o.jwtManager.SigningAlgorithm()
+	if err != nil {
+		return model.OpenIDConfiguration{}, err
+	}
+	scopes := []string{"openid", "profile", "email"}
+	algorithms := []string{algorithm}
+	if !o.jwtManager.SignsIDTokens() {
+		scopes = []string{"profile", "email"}
+		algorithms = []string{}
+	}
+	issuer := o.jwtManager.Issuer()
+	return model.OpenIDConfiguration{
+		Issuer:                            issuer,
+		AuthorizationEndpoint:             issuer + "/authorize",
+		TokenEndpoint:                     issuer + "/token",
+		UserinfoEndpoint:                  issuer + "/userinfo",
+		JwksURI:                           issuer + "/.well-known/jwks.json",
+		IntrospectionEndpoint:             issuer + "/introspect",
+		RevocationEndpoint:                issuer + "/revoke",
+		DeviceAuthorizationEndpoint:       issuer + "/device/code",
+		ScopesSupported:                   scopes,
+		ResponseTypesSupported:            []string{"code"},
+		GrantTypesSupported:               []string{"authorization_code", "refresh_token", "client_credentials", DeviceCodeGrantType, TokenExchangeGrantType},
+		SubjectTypesSupported:             []string{"public"},
+		IDTokenSigningAlgValuesSupported:  algorithms,
+		TokenEndpointAuthMethodsSupported: []string{"client_secret_basic", "client_secret_post", "none"},
+		CodeChallengeMethodsSupported:     []string{"S256"},
+		ClaimsSupported:                   []string{"iss", "sub", "aud", "exp", "iat", "auth_time", "nonce", "name", "preferred_username", "email", "email_verified"},
+	}, nil
+}
+
+// userInfo loads the claims of a user from the users table. The profile
+// scope covers name and preferred_username, the email scope covers email
+// and email_verified.
+func (o *oauthService) userInfo(ctx context.Context, userId int64, scope string) (model.UserInfo, error) {
+	var username string
+	var name, email sql.NullString
+	var emailVerified bool
+	err := o.db.QueryRowContext(ctx,
+		"SELECT username, name, email, email_verified FROM users WHERE id = $1 AND banned_at IS NULL",
+		userId,
+	).Scan(&username, &name, &email, &emailVerified)
+	if err == sql.ErrNoRows {
+		return model.UserInfo{}, ErrUserNotFound
+	}
+	if err != nil {
+		return model.UserInfo{}, err
+	}
+
+	info := model.UserInfo{Sub: strconv.FormatInt(userId, 10)}
+	if hasScope(scope, "profile") {
+		info.Name = name.String
+		info.PreferredUsername = username
+	}
+	if hasScope(scope, "email") && email.Valid {
+		info.Email = email.String
+		info.EmailVerified = &emailVerified
+	}
+	return info, nil
+}
+
+func (o *oauthService) issueIDToken(ctx context.Context, userId int64, clientID, scope, nonce string, authTime time.Time) (string, error) {
+	info, err := o.userInfo(ctx, userId, scope)
+	if err != nil {
+		return "", err
+	}
+	claims := &auth.IDTokenClaims{
+		Nonce:             nonce,
+		Name:              info.Name,
+		PreferredUsername: info.PreferredUsername,
+		Email:             info.Email,
+		EmailVerified:     info.EmailVerified,
+		RegisteredClaims: jwt.RegisteredClaims{
+			Subject:  info.Sub,
+			Audience: jwt.ClaimStrings{clientID},
+		},
+	}
+	if !authTime.IsZero() {
+		claims.AuthTime = jwt.NewNumericDate(authTime)
+	}
+	return o.jwtManager.IssueIDToken(claims)
+}
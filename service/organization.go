@@ -0,0 +1,202 @@
+package service
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"jwt-auth/auth"
+	"jwt-auth/model"
+	"regexp"
+	"slices"
+)
+
+// DefaultOrganization is the tenant users belong to when neither the request
+// nor its host names one.
+const DefaultOrganization = "default"
+
+var (
+	ErrOrganizationNotFound = errors.New("Organization not found")
+	ErrOrganizationExists   = errors.New("Organization already exists")
+	ErrInvalidOrganization  = errors.New("Invalid organization slug")
+	ErrInvalidMemberRole    = errors.New("Invalid member role")
+	ErrNotOrganizationAdmin = errors.New("Not an organization admin")
+)
+
+// Slugs are DNS labels so that an organization can also be picked by the
+// first label of the host name.
+var organizationSlugPattern = regexp.MustCompile(`^[a-z0-9]([a-z0-9-]{0,61}[a-z0-9])?$`)
+
+var memberRoles = []string{"owner", "admin", "member"}
+
+type OrganizationService interface {
+	CreateOrganization(ctx context.Context, slug, name string) (model.Organization, error)
+	ListOrganizations(ctx context.Context) ([]model.Organization, error)
+	ResolveOrganization(ctx context.Context, slug string) (model.Organization, error)
+	SetMemberRole(ctx context.Context, slug string, userId int64, role string) error
+	ListSessions(ctx context.Context, accessToken string) ([]model.Session, error)
+	RevokeSession(ctx context.Context, accessToken, sessionID string) error
+}
+
+type organizationService struct {
+	db         *sql.DB
+	jwtManager *auth.JWTManager
+}
+
+func NewOrganizationService(db *sql.DB, jwtManager *auth.JWTManager) OrganizationService {
+	return &organizationService{
+		db:         db,
+		jwtManager: jwtManager,
+	}
+}
+
+func (o *organizationService) CreateOrganization(ctx context.Context, slug, name string) (model.Organization, error) {
+	if !organizationSlugPattern.MatchString(slug) {
+		return model.Organization{}, ErrInvalidOrganization
+	}
+	if name == "" {
+		name = slug
+	}
+
+	organization := model.Organization{Slug: slug, Name: name}
+	err := o.db.QueryRowContext(ctx,
+		"INSERT INTO organizations (slug, name) VALUES ($1, $2) ON CONFLICT (slug) DO NOTHING RETURNING id, created_at",
+		slug, name,
+	).Scan(&organization.ID, &organization.CreatedAt)
+	if err == sql.ErrNoRows {
+		return model.Organization{}, ErrOrganizationExists
+	}
+	if err != nil {
+		return model.Organization{}, err
+	}
+	return organization, nil
+}
+
+func (o *organizationService) ListOrganizations(ctx context.Context) ([]model.Organization, error) {
+	rows, err := o.db.QueryContext(ctx, "SELECT id, slug, name, created_at FROM organizations ORDER BY slug")
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	organizations := []model.Organization{}
+	for rows.Next() {
+		var organization model.Organization
+		err = rows.Scan(&organization.ID, &organization.Slug, &organization.Name, &organization.CreatedAt)
+		if err != nil {
+			return nil, err
+		}
+		organizations = append(organizations, organization)
+	}
+	return organizations, rows.Err()
+}
+
+func (o *organizationService) ResolveOrganization(ctx context.Context, slug string) (model.Organization, error) {
+	var organization model.Organization
+	err := o.db.QueryRowContext(ctx,
+		"SELECT id, slug, name, created_at FROM organizations WHERE slug = $1",
+		slug,
+	).Scan(&organization.ID, &organization.Slug, &organization.Name, &organization.CreatedAt)
+	if err == sql.ErrNoRows {
+		return model.Organization{}, ErrOrganizationNotFound
+	}
+	if err != nil {
+		return model.Organization{}, err
+	}
+	return organization, nil
+}
+
+// SetMemberRole changes the role a user holds in the organization they
+// belong to. Users of other organizations are reported as not found.
+func (o *organizationService) SetMemberRole(ctx context.Context, slug string, userId int64, role string) error {
+	if !slices.Contains(memberRoles, role) {
+		return ErrInvalidMemberRole
+	}
+	organization, err := o.ResolveOrganization(ctx, slug)
+	if err != nil {
+		return err
+	}
+
+	result, err := o.db.ExecContext(ctx,
+		"UPDATE organization_members SET role = $1 WHERE org_id = $2 AND userId = $3",
+		role, organization.ID, userId,
+	)
+	if err != nil {
+		return err
+	}
+	rows, err := result.RowsAffected()
+	if err != nil {
+		return err
+	}
+	if rows == 0 {
+		return ErrUserNotFound
+	}
+	return nil
+}
+
+// ListSessions lists the sessions of every user in the caller's
+// organization. Only its owners and admins may do so.
+func (o *organizationService) ListSessions(ctx context.Context, accessToken string) ([]model.Session, error) {
+	orgID, keyPairID, err := o.organizationAdmin(ctx, accessToken)
+	if err != nil {
+		return nil, err
+	}
+	records, err := o.jwtManager.ListOrganizationRefreshTokens(ctx, orgID)
+	if err != nil {
+		return nil, err
+	}
+
+	sessions := []model.Session{}
+	for _, record := range records {
+		sessions = append(sessions, model.Session{
+			ID:         record.FamilyID,
+			UserID:     record.UserID,
+			UserAgent:  record.UserAgent,
+			AgentIp:    record.AgentIp,
+			SignedInAt: record.FamilyStartedAt,
+			IssuedAt:   record.IssuedAt,
+			ExpiresAt:  record.ExpiresAt,
+			Current:    record.KeyPairID == keyPairID,
+		})
+	}
+	return sessions, nil
+}
+
+func (o *organizationService) RevokeSession(ctx context.Context, accessToken, sessionID string) error {
+	orgID, _, err := o.organizationAdmin(ctx, accessToken)
+	if err != nil {
+		return err
+	}
+	revoked, err := o.jwtManager.RevokeOrganizationRefreshTokenFamily(ctx, orgID, sessionID)
+	if err != nil {
+		return err
+	}
+	if !revoked {
+		return ErrSessionNotFound
+	}
+	return nil
+}
+
+// organizationAdmin returns the organization the caller administers, looked
+// up from the database rather than the token so that a demoted admin loses
+// access right away.
+func (o *organizationService) organizationAdmin(ctx context.Context, accessToken string) (int64, string, error) {
+	userId, keyPairID, err := o.jwtManager.ValidateAccessToken(accessToken)
+	if err != nil {
+		return 0, "", err
+	}
+
+	var orgID int64
+	err = o.db.QueryRowContext(ctx,
+		`SELECT m.org_id FROM organization_members m
+		JOIN users u ON u.id = m.userId AND u.org_id = m.org_id
+		WHERE m.userId = $1 AND m.role IN ('owner', 'admin') AND u.banned_at IS NULL`,
+		userId,
+	).Scan(&orgID)
+	if err == sql.ErrNoRows {
+		return 0, "", ErrNotOrganizationAdmin
+	}
+	if err != nil {
+		return 0, "", err
+	}
+	return orgID, keyPairID, nil
+}
@@ -0,0 +1,341 @@
+package service
+
+import (
+	"context"
+	"database/sql"
+	"encoding/hex"
+	"errors"
+	"jwt-auth/auth"
+	"jwt-auth/model"
+	"jwt-auth/webauthn"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+	"unicode/utf8"
+
+	"github.com/google/uuid"
+)
+
+const webauthnChallengeDuration = 5 * time.Minute
+
+var (
+	ErrPasskeyNotFound           = errors.New("Passkey not found")
+	ErrPasskeyExists             = errors.New("Passkey already registered")
+	ErrInvalidPasskeyName        = errors.New("Invalid passkey name")
+	ErrInvalidPasskeyChallenge   = errors.New("Invalid or expired WebAuthn challenge")
+	ErrPasskeyUserHandleMismatch = errors.New("Passkey belongs to another user")
+)
+
+// webauthnTransports are the authenticator transports worth remembering, as
+// hints for later ceremonies.
+var webauthnTransports = []string{"ble", "hybrid", "internal", "nfc", "smart-card", "usb"}
+
+// PasskeyService runs the WebAuthn ceremonies. Registration takes an access
+// token; login needs nothing but the passkey, which identifies the user.
+type PasskeyService interface {
+	BeginRegistration(ctx context.Context, accessToken string) (webauthn.CreationOptions, error)
+	FinishRegistration(ctx context.Context, accessToken, name string, response *webauthn.RegistrationResponse) (model.Passkey, error)
+	ListPasskeys(ctx context.Context, accessToken string) ([]model.Passkey, error)
+	DeletePasskey(ctx context.Context, accessToken, id string) error
+	BeginLogin(ctx context.Context) (webauthn.RequestOptions, error)
+	FinishLogin(ctx context.Context, response *webauthn.AssertionResponse, userAgent, agentIp string) (int64, string, string, error)
+}
+
+type passkeyService struct {
+	db           *sql.DB
+	jwtManager   *auth.JWTManager
+	relyingParty *webauthn.RelyingParty
+}
+
+func NewPasskeyService(db *sql.DB, jwtManager *auth.JWTManager, relyingParty *webauthn.RelyingParty) PasskeyService {
+	return &passkeyService{
+		db:           db,
+		jwtManager:   jwtManager,
+		relyingParty: relyingParty,
+	}
+}
+
+func (p *passkeyService) BeginRegistration(ctx context.Context, accessToken string) (webauthn.CreationOptions, error) {
+	userId, _, err := p.jwtManager.ValidateFirstPartyAccessToken(accessToken)
+	if err != nil {
+		return webauthn.CreationOptions{}, err
+	}
+
+	var username, name string
+	err = p.db.QueryRowContext(ctx,
+		"SELECT username, COALESCE(name, '') FROM users WHERE id = $1",
+		userId,
+	).Scan(&username, &name)
+	if err != nil {
+		return webauthn.CreationOptions{}, err
+	}
+	if name == "" {
+		name = username
+	}
+
+	rows, err := p.db.QueryContext(ctx,
+		"SELECT credential_id, transports FROM webauthn_credentials WHERE userId = $1",
+		userId,
+	)
+	if err != nil {
+		return webauthn.CreationOptions{}, err
+	}
+	defer rows.Close()
+	var exclude []webauthn.CredentialDescriptor
+	for rows.Next() {
+		var credentialID []byte
+		var transports string
+		err = rows.Scan(&credentialID, &transports)
+		if err != nil {
+			return webauthn.CreationOptions{}, err
+		}
+		exclude = append(exclude, webauthn.CredentialDescriptor{
+			Type:       "public-key",
+			ID:         credentialID,
+			Transports: strings.Fields(transports),
+		})
+	}
+	if err = rows.Err(); err != nil {
+		return webauthn.CreationOptions{}, err
+	}
+
+	challenge, err := p.createChallenge(ctx, "registration", sql.NullInt64{Int64: userId, Valid: true})
+	if err != nil {
+		return webauthn.CreationOptions{}, err
+	}
+	return p.relyingParty.NewCreationOptions(challenge, webauthn.UserEntity{
+		ID:          userHandle(userId),
+		Name:        username,
+		DisplayName: name,
+	}, exclude), nil
+}
+
+func (p *passkeyService) FinishRegistration(ctx context.Context, accessToken, name string, response *webauthn.RegistrationResponse) (model.Passkey, error) {
+	userId, _, err := p.jwtManager.ValidateFirstPartyAccessToken(accessToken)
+	if err != nil {
+		return model.Passkey{}, err
+	}
+	name = strings.TrimSpace(name)
+	if name == "" {
+		name = "Passkey"
+	}
+	if utf8.RuneCountInString(name) > 64 {
+		return model.Passkey{}, ErrInvalidPasskeyName
+	}
+
+	challenge, err := webauthn.ClientChallenge(response.Response.ClientDataJSON)
+	if err != nil {
+		return model.Passkey{}, err
+	}
+	challengeUser, err := p.consumeChallenge(ctx, "registration", challenge)
+	if err != nil {
+		return model.Passkey{}, err
+	}
+	if challengeUser.Int64 != userId {
+		return model.Passkey{}, ErrInvalidPasskeyChallenge
+	}
+	credential, err := p.relyingParty.VerifyRegistration(challenge, response)
+	if err != nil {
+		return model.Passkey{}, err
+	}
+
+	var transports []string
+	for _, transport := range credential.Transports {
+		if slices.Contains(webauthnTransports, transport) && !slices.Contains(transports, transport) {
+			transports = append(transports, transport)
+		}
+	}
+	passkey := model.Passkey{
+		ID:         uuid.New().String(),
+		Name:       name,
+		AAGUID:     credential.AAGUID,
+		Transports: transports,
+	}
+	if passkey.Transports == nil {
+		passkey.Transports = []string{}
+	}
+	err = p.db.QueryRowContext(ctx,
+		`INSERT INTO webauthn_credentials (id, credential_id, userId, name, public_key, algorithm, sign_count, transports, aaguid)
+		VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9)
+		ON CONFLICT (credential_id) DO NOTHING
+		RETURNING created_at`,
+		passkey.ID, credential.ID, userId, name, credential.PublicKey, credential.Algorithm,
+		int64(credential.SignCount), strings.Join(transports, " "), credential.AAGUID,
+	).Scan(&passkey.CreatedAt)
+	if err == sql.ErrNoRows {
+		return model.Passkey{}, ErrPasskeyExists
+	}
+	if err != nil {
+		return model.Passkey{}, err
+	}
+	return passkey, nil
+}
+
+func (p *passkeyService) ListPasskeys(ctx context.Context, accessToken string) ([]model.Passkey, error) {
+	userId, _, err := p.jwtManager.ValidateFirstPartyAccessToken(accessToken)
+	if err != nil {
+		return nil, err
+	}
+
+	rows, err := p.db.QueryContext(ctx,
+		"SELECT id, name, aaguid, transports, created_at, last_used_at FROM webauthn_credentials WHERE userId = $1 ORDER BY created_at",
+		userId,
+	)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	passkeys := []model.Passkey{}
+	for rows.Next() {
+		var passkey model.Passkey
+		var transports string
+		var lastUsedAt sql.NullTime
+		err = rows.Scan(&passkey.ID, &passkey.Name, &passkey.AAGUID, &transports, &passkey.CreatedAt, &lastUsedAt)
+		if err != nil {
+			return nil, err
+		}
+		passkey.Transports = strings.Fields(transports)
+		if lastUsedAt.Valid {
+			passkey.LastUsedAt = &lastUsedAt.Time
+		}
+		passkeys = append(passkeys, passkey)
+	}
+	return passkeys, rows.Err()
+}
+
+func (p *passkeyService) DeletePasskey(ctx context.Context, accessToken, id string) error {
+	userId, _, err := p.jwtManager.ValidateFirstPartyAccessToken(accessToken)
+	if err != nil {
+		return err
+	}
+	result, err := p.db.ExecContext(ctx,
+		"DELETE FROM webauthn_credentials WHERE id = $1 AND userId = $2",
+		id, userId,
+	)
+	if err != nil {
+		return err
+	}
+	affected, err := result.RowsAffected()
+	if err != nil {
+		return err
+	}
+	if affected == 0 {
+		return ErrPasskeyNotFound
+	}
+	return nil
+}
+
+func (p *passkeyService) BeginLogin(ctx context.Context) (webauthn.RequestOptions, error) {
+	challenge, err := p.createChallenge(ctx, "login", sql.NullInt64{})
+	if err != nil {
+		return webauthn.RequestOptions{}, err
+	}
+	return p.relyingParty.NewRequestOptions(challenge), nil
+}
+
+// FinishLogin signs in the owner of the passkey that answered a login
+// challenge, issuing the same token pair as LoginUser. User verification by
+// the authenticator stands in for both the password and a second factor.
+func (p *passkeyService) FinishLogin(ctx context.Context, response *webauthn.AssertionResponse, userAgent, agentIp string) (int64, string, string, error) {
+	challenge, err := webauthn.ClientChallenge(response.Response.ClientDataJSON)
+	if err != nil {
+		return 0, "", "", err
+	}
+	_, err = p.consumeChallenge(ctx, "login", challenge)
+	if err != nil {
+		return 0, "", "", err
+	}
+
+	var id string
+	var userId, signCount int64
+	credential := &webauthn.Credential{ID: response.RawID}
+	err = p.db.QueryRowContext(ctx,
+		`SELECT c.id, c.userId, c.public_key, c.algorithm, c.sign_count
+		FROM webauthn_credentials c JOIN users u ON u.id = c.userId
+		WHERE c.credential_id = $1 AND u.banned_at IS NULL`,
+		[]byte(response.RawID),
+	).Scan(&id, &userId, &credential.PublicKey, &credential.Algorithm, &signCount)
+	if err == sql.ErrNoRows {
+		return 0, "", "", ErrPasskeyNotFound
+	}
+	if err != nil {
+		return 0, "", "", err
+	}
+	if len(response.Response.UserHandle) > 0 && string(response.Response.UserHandle) != string(userHandle(userId)) {
+		return 0, "", "", ErrPasskeyUserHandleMismatch
+	}
+	credential.SignCount = uint32(signCount)
+
+	newSignCount, err := p.relyingParty.VerifyAssertion(challenge, credential, response)
+	if err != nil {
+		return 0, "", "", err
+	}
+	// The counter guards against two logins racing with the same assertion
+	// counter, one of which a clone would have produced.
+	result, err := p.db.ExecContext(ctx,
+		"UPDATE webauthn_credentials SET sign_count = $2, last_used_at = $3 WHERE id = $1 AND sign_count = $4",
+		id, int64(newSignCount), time.Now(), signCount,
+	)
+	if err != nil {
+		return 0, "", "", err
+	}
+	affected, err := result.RowsAffected()
+	if err != nil {
+		return 0, "", "", err
+	}
+	if affected == 0 {
+		return 0, "", "", webauthn.ErrSignCount
+	}
+
+	pairID := uuid.New().String()
+	accessToken, err := p.jwtManager.GenerateAccessToken(ctx, userId, pairID)
+	if err != nil {
+		return 0, "", "", err
+	}
+	refreshToken, err := p.jwtManager.GenerateRefreshToken(userId, pairID, userAgent, agentIp)
+	if err != nil {
+		return 0, "", "", err
+	}
+	return userId, accessToken, refreshToken, nil
+}
+
+func (p *passkeyService) createChallenge(ctx context.Context, ceremony string, userId sql.NullInt64) ([]byte, error) {
+	challenge, err := webauthn.NewChallenge()
+	if err != nil {
+		return nil, err
+	}
+	_, err = p.db.ExecContext(ctx, "DELETE FROM webauthn_challenges WHERE expires_at <= $1", time.Now())
+	if err != nil {
+		return nil, err
+	}
+	_, err = p.db.ExecContext(ctx,
+		"INSERT INTO webauthn_challenges (challenge_hash, ceremony, userId, expires_at) VALUES ($1, $2, $3, $4)",
+		hashCode(hex.EncodeToString(challenge)), ceremony, userId, time.Now().Add(webauthnChallengeDuration),
+	)
+	if err != nil {
+		return nil, err
+	}
+	return challenge, nil
+}
+
+// consumeChallenge deletes an unexpired challenge handed out for ceremony,
+// returning the user it was issued to, so that each is answered only once.
+func (p *passkeyService) consumeChallenge(ctx context.Context, ceremony string, challenge []byte) (sql.NullInt64, error) {
+	var userId sql.NullInt64
+	err := p.db.QueryRowContext(ctx,
+		"DELETE FROM webauthn_challenges WHERE challenge_hash = $1 AND ceremony = $2 AND expires_at > $3 RETURNING userId",
+		hashCode(hex.EncodeToString(challenge)), ceremony, time.Now(),
+	).Scan(&userId)
+	if err == sql.ErrNoRows {
+		return sql.NullInt64{}, ErrInvalidPasskeyChallenge
+	}
+	return userId, err
+}
+
+// userHandle is the WebAuthn user ID of a user, which authenticators return
+// when signing in with a discoverable credential.
+func userHandle(userId int64) []byte {
+	return []byte(strconv.FormatInt(userId, 10))
+}
@@ -0,0 +1,66 @@
+package service
+
+import (
+	"context"
+	"database/sql"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"jwt-auth/webauthn"
+	"regexp"
+	"testing"
+
+	"github.com/DATA-DOG/go-sqlmock"
+)
+
+// TestPasskeyChallengeReuse checks that a challenge is consumed before the
+// response is looked at, so that a second answer to it is refused whatever
+// became of the first.
+func TestPasskeyChallengeReuse(t *testing.T) {
+	db, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	passkeys := NewPasskeyService(db, nil, &webauthn.RelyingParty{
+		ID:      "login.example.com",
+		Origins: []string{"https://login.example.com"},
+	})
+
+	challenge, err := webauthn.NewChallenge()
+	if err != nil {
+		t.Fatal(err)
+	}
+	response := &webauthn.AssertionResponse{RawID: []byte("credential")}
+	response.Response.ClientDataJSON = []byte(fmt.Sprintf(
+		`{"type":"webauthn.get","challenge":%q,"origin":"https://login.example.com"}`,
+		base64.RawURLEncoding.EncodeToString(challenge),
+	))
+	consume := regexp.QuoteMeta("DELETE FROM webauthn_challenges WHERE challenge_hash = $1 AND ceremony = $2")
+	challengeHash := hashCode(hex.EncodeToString(challenge))
+
+	mock.ExpectQuery(consume).
+		WithArgs(challengeHash, "login", sqlmock.AnyArg()).
+		WillReturnRows(sqlmock.NewRows([]string{"userId"}).AddRow(nil))
+	mock.ExpectQuery(regexp.QuoteMeta("FROM webauthn_credentials c JOIN users u")).
+		WithArgs([]byte("credential")).
+		WillReturnError(sql.ErrNoRows)
+	_, _, _, err = passkeys.FinishLogin(context.Background(), response, "test", "127.0.0.1")
+	if !errors.Is(err, ErrPasskeyNotFound) {
+		t.Fatalf("first FinishLogin() error = %v, want %v", err, ErrPasskeyNotFound)
+	}
+
+	mock.ExpectQuery(consume).
+		WithArgs(challengeHash, "login", sqlmock.AnyArg()).
+		WillReturnRows(sqlmock.NewRows([]string{"userId"}))
+	_, _, _, err = passkeys.FinishLogin(context.Background(), response, "test", "127.0.0.1")
+	if !errors.Is(err, ErrInvalidPasskeyChallenge) {
+		t.Fatalf("second FinishLogin() error = %v, want %v", err, ErrInvalidPasskeyChallenge)
+	}
+
+	err = mock.ExpectationsWereMet()
+	if err != nil {
+		t.Fatal(err)
+	}
+}
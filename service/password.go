@@ -0,0 +1,152 @@
+package service
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"jwt-auth/webhook"
+	"log"
+)
+
+var ErrInvalidCurrentPassword = errors.New("Invalid current password")
+
+// ChangePassword replaces the caller's password after checking the current
+// one. It signs out every other session, or with signOutEverywhere the
+// caller's too, and returns how many sessions were signed out. A wrong
+// current password counts as a failed login, and while the account or IP
+// address is blocked a *LoginThrottledError is returned whatever the
+// password.
+func (a *authService) ChangePassword(ctx context.Context, accessToken, currentPassword, newPassword string, signOutEverywhere bool, agentIp string) (int64, error) {
+	userId, keyPairID, err := a.jwtManager.ValidateFirstPartyAccessToken(accessToken)
+	if err != nil {
+		return 0, err
+	}
+
+	err = a.changePassword(ctx, userId, currentPassword, newPassword, agentIp)
+	if err != nil {
+		return 0, err
+	}
+
+	var familyIDs []string
+	if signOutEverywhere {
+		familyIDs, err = a.jwtManager.RevokeUserRefreshTokens(ctx, userId)
+	} else {
+		familyIDs, err = a.jwtManager.RevokeOtherRefreshTokenFamilies(ctx, userId, keyPairID)
+	}
+	if err != nil {
+		return 0, err
+	}
+
+	go webhook.NotifySecurityEvent("password_changed", userId, agentIp, map[string]interface{}{
+		"signed_out_everywhere": signOutEverywhere,
+		"revoked_sessions":      len(familyIDs),
+	})
+	return int64(len(familyIDs)), nil
+}
+
+func (a *authService) changePassword(ctx context.Context, userId int64, currentPassword, newPassword, agentIp string) (err error) {
+	tx, err := a.db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer func() {
+		if p := recover(); p != nil {
+			tx.Rollback()
+			panic(p)
+		} else if err != nil {
+			tx.Rollback()
+		} else {
+			err = tx.Commit()
+		}
+	}()
+
+	var orgID int64
+	var username, storedPassword string
+	err = tx.QueryRowContext(ctx,
+		"SELECT org_id, username, password FROM users WHERE id = $1 AND banned_at IS NULL FOR UPDATE",
+		userId,
+	).Scan(&orgID, &username, &storedPassword)
+	if errors.Is(err, sql.ErrNoRows) {
+		err = ErrUserNotFound
+		return err
+	}
+	if err != nil {
+		return err
+	}
+	accountKey := loginAccountKey(orgID, username)
+	err = a.loginThrottle.check(ctx, a.db, accountKey, agentIp)
+	if err != nil {
+		return err
+	}
+	valid, err := a.passwordHasher.Verify(currentPassword, storedPassword)
+	if err != nil {
+		return err
+	}
+	if !valid {
+		// Recorded outside tx, which is rolled back.
+		err = a.loginThrottle.recordFailure(ctx, a.db, accountKey, agentIp)
+		if err != nil {
+			return err
+		}
+		err = ErrInvalidCurrentPassword
+		return err
+	}
+
+	err = setPassword(ctx, tx, a.passwordPolicy, a.passwordHasher, userId, username, storedPassword, newPassword)
+	if err != nil {
+		return err
+	}
+	_, err = tx.ExecContext(ctx,
+		"DELETE FROM email_tokens WHERE userId = $1 AND purpose = $2",
+		userId, resetPasswordPurpose,
+	)
+	if err != nil {
+		return err
+	}
+	_, err = tx.ExecContext(ctx, "DELETE FROM mfa_challenges WHERE userId = $1", userId)
+	if err != nil {
+		return err
+	}
+	return clearLoginFailures(ctx, tx, accountKey)
+}
+
+// setPassword replaces a password that passes the policy, keeping the old
+// hash in the history. The users row must be locked by tx.
+func setPassword(ctx context.Context, tx *sql.Tx, policy *PasswordPolicy, hasher PasswordHasher, userId int64, username, storedPassword, password string) error {
+	err := policy.Validate(password, username)
+	if err != nil {
+		return err
+	}
+	err = policy.checkPasswordHistory(ctx, tx, hasher, userId, password)
+	if err != nil {
+		return err
+	}
+	hashedPassword, err := hasher.Hash(password)
+	if err != nil {
+		return err
+	}
+	err = policy.recordPasswordHistory(ctx, tx, userId, storedPassword)
+	if err != nil {
+		return err
+	}
+	_, err = tx.ExecContext(ctx,
+		"UPDATE users SET password = $1 WHERE id = $2",
+		hashedPassword, userId,
+	)
+	return err
+}
+
+// rehashPassword replaces a hash made with outdated settings after a
+// successful login. Failing to is not fatal; the next login tries again.
+func (a *authService) rehashPassword(ctx context.Context, userId int64, password, storedPassword string) {
+	hashedPassword, err := a.passwordHasher.Hash(password)
+	if err == nil {
+		_, err = a.db.ExecContext(ctx,
+			"UPDATE users SET password = $1 WHERE id = $2 AND password = $3",
+			hashedPassword, userId, storedPassword,
+		)
+	}
+	if err != nil {
+		log.Printf("Failed to rehash a password: %v", err)
+	}
+}
@@ -0,0 +1,288 @@
+package service
+
+import (
+	"bufio"
+	"context"
+	"crypto/sha1"
+	"database/sql"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"unicode"
+	"unicode/utf8"
+)
+
+// Rules of PasswordViolation.
+const (
+	PasswordRuleMinLength        = "min_length"
+	PasswordRuleMaxLength        = "max_length"
+	PasswordRuleCharacterClasses = "character_classes"
+	PasswordRuleUsername         = "username"
+	PasswordRuleHistory          = "history"
+	PasswordRuleBreached         = "breached"
+)
+
+type PasswordViolation struct {
+	Rule    string `json:"rule"`
+	Message string `json:"message"`
+}
+
+// PasswordPolicyError lists every rule a password breaks.
+type PasswordPolicyError struct {
+	Violations []PasswordViolation
+}
+
+func (e *PasswordPolicyError) Error() string {
+	messages := make([]string, len(e.Violations))
+	for i, violation := range e.Violations {
+		messages[i] = violation.Message
+	}
+	return "Password rejected: " + strings.Join(messages, "; ")
+}
+
+// PasswordPolicy is checked whenever a password is set. Lengths count
+// characters; MinCharacterClasses counts which of lower case, upper case,
+// digits and symbols appear. HistorySize passwords, the current one
+// included, cannot be reused. Breached is optional.
+type PasswordPolicy struct {
+	MinLength           int
+	MaxLength           int
+	MinCharacterClasses int
+	RejectUsername      bool
+	HistorySize         int
+	Breached            BreachedPasswords
+}
+
+// Validate checks the rules that need no history, returning a
+// *PasswordPolicyError when some are broken.
+func (p *PasswordPolicy) Validate(password, username string) error {
+	var violations []PasswordViolation
+
+	length := utf8.RuneCountInString(password)
+	if length == 0 || length < p.MinLength {
+		violations = append(violations, PasswordViolation{
+			Rule:    PasswordRuleMinLength,
+			Message: fmt.Sprintf("Password must be at least %d characters long", max(p.MinLength, 1)),
+		})
+	}
+	if p.MaxLength > 0 && length > p.MaxLength {
+		violations = append(violations, PasswordViolation{
+			Rule:    PasswordRuleMaxLength,
+			Message: fmt.Sprintf("Password must be at most %d characters long", p.MaxLength),
+		})
+	}
+	if characterClasses(password) < p.MinCharacterClasses {
+		violations = append(violations, PasswordViolation{
+			Rule:    PasswordRuleCharacterClasses,
+			Message: fmt.Sprintf("Password must mix at least %d of lower case letters, upper case letters, digits and symbols", p.MinCharacterClasses),
+		})
+	}
+	if p.RejectUsername && username != "" && strings.Contains(strings.ToLower(password), strings.ToLower(username)) {
+		violations = append(violations, PasswordViolation{
+			Rule:    PasswordRuleUsername,
+			Message: "Password must not contain the username",
+		})
+	}
+	if p.Breached != nil && password != "" {
+		breached, err := isBreached(p.Breached, password)
+		if err != nil {
+			return err
+		}
+		if breached {
+			violations = append(violations, PasswordViolation{
+				Rule:    PasswordRuleBreached,
+				Message: "Password appears in a known data breach",
+			})
+		}
+	}
+
+	if len(violations) > 0 {
+		return &PasswordPolicyError{Violations: violations}
+	}
+	return nil
+}
+
+func characterClasses(password string) int {
+	var lower, upper, digit, symbol bool
+	for _, r := range password {
+		switch {
+		case unicode.IsLower(r):
+			lower = true
+		case unicode.IsUpper(r):
+			upper = true
+		case unicode.IsDigit(r):
+			digit = true
+		default:
+			symbol = true
+		}
+	}
+	count := 0
+	for _, present := range []bool{lower, upper, digit, symbol} {
+		if present {
+			count++
+		}
+	}
+	return count
+}
+
+// checkPasswordHistory rejects a password matching the user's current one or
+// one of their last HistorySize - 1.
+func (p *PasswordPolicy) checkPasswordHistory(ctx context.Context, tx *sql.Tx, hasher PasswordHasher, userId int64, password string) error {
+	if p.HistorySize <= 0 {
+		return nil
+	}
+	rows, err := tx.QueryContext(ctx,
+		`(SELECT password FROM users WHERE id = $1)
+		UNION ALL
+		(SELECT password_hash FROM password_history WHERE userId = $1 ORDER BY created_at DESC, id DESC LIMIT $2)`,
+		userId, p.HistorySize-1,
+	)
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var hash string
+		err = rows.Scan(&hash)
+		if err != nil {
+			return err
+		}
+		// Hashes made with a former pepper cannot be compared and are skipped.
+		if reused, _ := hasher.Verify(password, hash); reused {
+			return &PasswordPolicyError{Violations: []PasswordViolation{{
+				Rule:    PasswordRuleHistory,
+				Message: fmt.Sprintf("Password must differ from the last %d", p.HistorySize),
+			}}}
+		}
+	}
+	return rows.Err()
+}
+
+// recordPasswordHistory keeps the hash of a password being replaced, pruning
+// what the policy no longer needs.
+func (p *PasswordPolicy) recordPasswordHistory(ctx context.Context, tx *sql.Tx, userId int64, oldHash string) error {
+	if p.HistorySize <= 1 {
+		_, err := tx.ExecContext(ctx, "DELETE FROM password_history WHERE userId = $1", userId)
+		return err
+	}
+	_, err := tx.ExecContext(ctx,
+		"INSERT INTO password_history (userId, password_hash) VALUES ($1, $2)",
+		userId, oldHash,
+	)
+	if err != nil {
+		return err
+	}
+	_, err = tx.ExecContext(ctx,
+		`DELETE FROM password_history WHERE userId = $1 AND id NOT IN
+		(SELECT id FROM password_history WHERE userId = $1 ORDER BY created_at DESC, id DESC LIMIT $2)`,
+		userId, p.HistorySize-1,
+	)
+	return err
+}
+
+// BreachedPasswords looks up breached SHA-1 password hashes by k-anonymity:
+// Range returns the upper case hex suffixes of the hashes starting with a
+// five character prefix, as the Pwned Passwords range API does.
+type BreachedPasswords interface {
+	Range(prefix string) ([]string, error)
+}
+
+func isBreached(breached BreachedPasswords, password string) (bool, error) {
+	sum := sha1.Sum([]byte(password))
+	hash := strings.ToUpper(hex.EncodeToString(sum[:]))
+	suffixes, err := breached.Range(hash[:5])
+	if err != nil {
+		return false, fmt.Errorf("Failed to look up breached passwords: %w", err)
+	}
+	for _, suffix := range suffixes {
+		if suffix == hash[5:] {
+			return true, nil
+		}
+	}
+	return false, nil
+}
+
+// LoadBreachedPasswords reads a Pwned Passwords SHA-1 list. path is either one
+// file of HASH:COUNT lines, loaded into memory, or a directory of range files
+// named after their prefix (00000.txt, ...) holding SUFFIX:COUNT lines, read
+// when needed.
+func LoadBreachedPasswords(path string) (BreachedPasswords, error) {
+	info, err := os.Stat(path)
+	if err != nil {
+		return nil, err
+	}
+	if info.IsDir() {
+		return breachedPasswordDirectory(path), nil
+	}
+
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	ranges := breachedPasswordRanges{}
+	scanner := bufio.NewScanner(file)
+	for line := 1; scanner.Scan(); line++ {
+		hash, err := parseBreachedHash(scanner.Text(), 40)
+		if err != nil {
+			return nil, fmt.Errorf("%s:%d: %w", path, line, err)
+		}
+		if hash != "" {
+			ranges[hash[:5]] = append(ranges[hash[:5]], hash[5:])
+		}
+	}
+	if err = scanner.Err(); err != nil {
+		return nil, err
+	}
+	return ranges, nil
+}
+
+type breachedPasswordRanges map[string][]string
+
+func (r breachedPasswordRanges) Range(prefix string) ([]string, error) {
+	return r[prefix], nil
+}
+
+type breachedPasswordDirectory string
+
+func (d breachedPasswordDirectory) Range(prefix string) ([]string, error) {
+	file, err := os.Open(filepath.Join(string(d), prefix+".txt"))
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	var suffixes []string
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		suffix, err := parseBreachedHash(scanner.Text(), 35)
+		if err != nil {
+			return nil, fmt.Errorf("%s: %w", file.Name(), err)
+		}
+		if suffix != "" {
+			suffixes = append(suffixes, suffix)
+		}
+	}
+	return suffixes, scanner.Err()
+}
+
+// parseBreachedHash returns the hash of a HASH:COUNT line, or "" for a blank
+// line.
+func parseBreachedHash(line string, length int) (string, error) {
+	hash, _, _ := strings.Cut(strings.TrimSpace(line), ":")
+	if hash == "" {
+		return "", nil
+	}
+	hash = strings.ToUpper(hash)
+	if len(hash) != length || strings.Trim(hash, "0123456789ABCDEF") != "" {
+		return "", errors.New("Invalid SHA-1 hash")
+	}
+	return hash, nil
+}
@@ -0,0 +1,299 @@
+package service
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"jwt-auth/auth"
+	"jwt-auth/model"
+	"regexp"
+	"slices"
+)
+
+var (
+	ErrInvalidRoleName = errors.New("Invalid role or permission name")
+	ErrRoleNotFound    = errors.New("Role not found")
+	ErrRoleExists      = errors.New("Role already exists")
+)
+
+var roleNamePattern = regexp.MustCompile(`^[A-Za-z0-9_.:*-]{1,64}$`)
+
+type RBACService interface {
+	ListRoles(ctx context.Context) ([]model.Role, error)
+	CreateRole(ctx context.Context, name string, permissions []string) (model.Role, error)
+	SetRolePermissions(ctx context.Context, name string, permissions []string) (model.Role, error)
+	DeleteRole(ctx context.Context, name string) error
+	ListUserRoles(ctx context.Context, userId int64) ([]model.Role, error)
+	AssignRole(ctx context.Context, userId int64, name string) error
+	UnassignRole(ctx context.Context, userId int64, name string) error
+}
+
+type rbacService struct {
+	db         *sql.DB
+	jwtManager *auth.JWTManager
+}
+
+func NewRBACService(db *sql.DB, jwtManager *auth.JWTManager) RBACService {
+	return &rbacService{
+		db:         db,
+		jwtManager: jwtManager,
+	}
+}
+
+func (r *rbacService) ListRoles(ctx context.Context) ([]model.Role, error) {
+	return r.queryRoles(ctx, "")
+}
+
+func (r *rbacService) CreateRole(ctx context.Context, name string, permissions []string) (role model.Role, err error) {
+	if !validRoleNames(name, permissions) {
+		return model.Role{}, ErrInvalidRoleName
+	}
+
+	tx, err := r.db.BeginTx(ctx, nil)
+	if err != nil {
+		return model.Role{}, err
+	}
+
+	defer func() {
+		if p := recover(); p != nil {
+			tx.Rollback()
+			panic(p)
+		} else if err != nil {
+			tx.Rollback()
+		} else {
+			err = tx.Commit()
+		}
+	}()
+
+	var roleID int64
+	err = tx.QueryRowContext(ctx,
+		"INSERT INTO roles (name) VALUES ($1) ON CONFLICT (name) DO NOTHING RETURNING id, created_at",
+		name,
+	).Scan(&roleID, &role.CreatedAt)
+	if err == sql.ErrNoRows {
+		return model.Role{}, ErrRoleExists
+	}
+	if err != nil {
+		return model.Role{}, err
+	}
+
+	err = replaceRolePermissions(ctx, tx, roleID, permissions)
+	if err != nil {
+		return model.Role{}, err
+	}
+
+	role.Name = name
+	role.Permissions = sortedPermissions(permissions)
+	return role, nil
+}
+
+// SetRolePermissions replaces the permissions of a role. Users holding the
+// role see the change in their next access token.
+func (r *rbacService) SetRolePermissions(ctx context.Context, name string, permissions []string) (role model.Role, err error) {
+	if !validRoleNames(name, permissions) {
+		return model.Role{}, ErrInvalidRoleName
+	}
+
+	// Registered first so that it runs after the commit below.
+	defer func() {
+		if err == nil {
+			r.jwtManager.InvalidateAuthorizations()
+		}
+	}()
+
+	tx, err := r.db.BeginTx(ctx, nil)
+	if err != nil {
+		return model.Role{}, err
+	}
+
+	defer func() {
+		if p := recover(); p != nil {
+			tx.Rollback()
+			panic(p)
+		} else if err != nil {
+			tx.Rollback()
+		} else {
+			err = tx.Commit()
+		}
+	}()
+
+	var roleID int64
+	err = tx.QueryRowContext(ctx,
+		"SELECT id, created_at FROM roles WHERE name = $1 FOR UPDATE",
+		name,
+	).Scan(&roleID, &role.CreatedAt)
+	if err == sql.ErrNoRows {
+		return model.Role{}, ErrRoleNotFound
+	}
+	if err != nil {
+		return model.Role{}, err
+	}
+
+	err = replaceRolePermissions(ctx, tx, roleID, permissions)
+	if err != nil {
+		return model.Role{}, err
+	}
+
+	role.Name = name
+	role.Permissions = sortedPermissions(permissions)
+	return role, nil
+}
+
+func (r *rbacService) DeleteRole(ctx context.Context, name string) error {
+	result, err := r.db.ExecContext(ctx, "DELETE FROM roles WHERE name = $1", name)
+	if err != nil {
+		return err
+	}
+	rows, err := result.RowsAffected()
+	if err != nil {
+		return err
+	}
+	if rows == 0 {
+		return ErrRoleNotFound
+	}
+	r.jwtManager.InvalidateAuthorizations()
+	return nil
+}
+
+func (r *rbacService) ListUserRoles(ctx context.Context, userId int64) ([]model.Role, error) {
+	err := r.userExists(ctx, userId)
+	if err != nil {
+		return nil, err
+	}
+	return r.queryRoles(ctx, "WHERE r.id IN (SELECT role_id FROM user_roles WHERE userId = $1)", userId)
+}
+
+func (r *rbacService) AssignRole(ctx context.Context, userId int64, name string) error {
+	err := r.userExists(ctx, userId)
+	if err != nil {
+		return err
+	}
+	roleID, err := lookupRoleID(ctx, r.db, name)
+	if err != nil {
+		return err
+	}
+	_, err = r.db.ExecContext(ctx,
+		"INSERT INTO user_roles (userId, role_id) VALUES ($1, $2) ON CONFLICT DO NOTHING",
+		userId, roleID,
+	)
+	if err != nil {
+		return err
+	}
+	r.jwtManager.InvalidateAuthorizations()
+	return nil
+}
+
+func (r *rbacService) UnassignRole(ctx context.Context, userId int64, name string) error {
+	roleID, err := lookupRoleID(ctx, r.db, name)
+	if err != nil {
+		return err
+	}
+	_, err = r.db.ExecContext(ctx,
+		"DELETE FROM user_roles WHERE userId = $1 AND role_id = $2",
+		userId, roleID,
+	)
+	if err != nil {
+		return err
+	}
+	r.jwtManager.InvalidateAuthorizations()
+	return nil
+}
+
+func (r *rbacService) userExists(ctx context.Context, userId int64) error {
+	var exists bool
+	err := r.db.QueryRowContext(ctx, "SELECT EXISTS (SELECT 1 FROM users WHERE id = $1)", userId).Scan(&exists)
+	if err != nil {
+		return err
+	}
+	if !exists {
+		return ErrUserNotFound
+	}
+	return nil
+}
+
+type queryRower interface {
+	QueryRowContext(ctx context.Context, query string, args ...interface{}) *sql.Row
+}
+
+func lookupRoleID(ctx context.Context, db queryRower, name string) (int64, error) {
+	var roleID int64
+	err := db.QueryRowContext(ctx, "SELECT id FROM roles WHERE name = $1", name).Scan(&roleID)
+	if err == sql.ErrNoRows {
+		return 0, ErrRoleNotFound
+	}
+	return roleID, err
+}
+
+// queryRoles lists roles with their permissions, optionally narrowed by a
+// where clause on roles r.
+func (r *rbacService) queryRoles(ctx context.Context, where string, args ...interface{}) ([]model.Role, error) {
+	rows, err := r.db.QueryContext(ctx,
+		`SELECT r.name, r.created_at,
+			COALESCE((SELECT string_agg(p.name, E'\n' ORDER BY p.name) FROM role_permissions rp JOIN permissions p ON p.id = rp.permission_id WHERE rp.role_id = r.id), '')
+		FROM roles r `+where+` ORDER BY r.name`,
+		args...,
+	)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	roles := []model.Role{}
+	for rows.Next() {
+		var role model.Role
+		var permissions string
+		err = rows.Scan(&role.Name, &role.CreatedAt, &permissions)
+		if err != nil {
+			return nil, err
+		}
+		role.Permissions = splitLines(permissions)
+		roles = append(roles, role)
+	}
+	return roles, rows.Err()
+}
+
+func replaceRolePermissions(ctx context.Context, tx *sql.Tx, roleID int64, permissions []string) error {
+	_, err := tx.ExecContext(ctx, "DELETE FROM role_permissions WHERE role_id = $1", roleID)
+	if err != nil {
+		return err
+	}
+	for _, permission := range permissions {
+		_, err = tx.ExecContext(ctx,
+			"INSERT INTO permissions (name) VALUES ($1) ON CONFLICT (name) DO NOTHING",
+			permission,
+		)
+		if err != nil {
+			return err
+		}
+		_, err = tx.ExecContext(ctx,
+			"INSERT INTO role_permissions (role_id, permission_id) SELECT $1, id FROM permissions WHERE name = $2 ON CONFLICT DO NOTHING",
+			roleID, permission,
+		)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func validRoleNames(name string, permissions []string) bool {
+	if !roleNamePattern.MatchString(name) {
+		return false
+	}
+	for _, permission := range permissions {
+		if !roleNamePattern.MatchString(permission) {
+			return false
+		}
+	}
+	return true
+}
+
+func sortedPermissions(permissions []string) []string {
+	sorted := slices.Clone(permissions)
+	slices.Sort(sorted)
+	sorted = slices.Compact(sorted)
+	if sorted == nil {
+		return []string{}
+	}
+	return sorted
+}
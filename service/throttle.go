@@ -0,0 +1,118 @@
+package service
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"math"
+	"strings"
+	"time"
+)
+
+const (
+	loginThrottleAccount = "account"
+	loginThrottleIP      = "ip"
+	// loginFailureWindow is how long failures are remembered after the last
+	// one.
+	loginFailureWindow = time.Hour
+)
+
+// LoginThrottle slows down password guessing per account and per source IP.
+// Each failed login blocks further attempts for BackoffBase, doubling with
+// every failure up to BackoffMax, and at AccountThreshold or IPThreshold
+// failures for LockoutDuration. A threshold of zero disables that lockout.
+// Accounts are keyed by organization and username, so unknown usernames are
+// throttled exactly like existing ones.
+type LoginThrottle struct {
+	AccountThreshold int
+	IPThreshold      int
+	BackoffBase      time.Duration
+	BackoffMax       time.Duration
+	LockoutDuration  time.Duration
+}
+
+// LoginThrottledError is returned by LoginUser, whatever the password, while
+// the account or the client's IP address is blocked.
+type LoginThrottledError struct {
+	RetryAfter time.Duration
+}
+
+func (e *LoginThrottledError) Error() string {
+	return "Too many failed login attempts"
+}
+
+func loginAccountKey(orgID int64, username string) string {
+	return fmt.Sprintf("%d:%s", orgID, strings.ToLower(username))
+}
+
+func (t *LoginThrottle) check(ctx context.Context, db *sql.DB, accountKey, agentIp string) error {
+	var blockedUntil sql.NullTime
+	err := db.QueryRowContext(ctx,
+		`SELECT MAX(blocked_until) FROM login_throttles
+		WHERE (scope = $1 AND key = $2) OR (scope = $3 AND key = $4)`,
+		loginThrottleAccount, accountKey, loginThrottleIP, agentIp,
+	).Scan(&blockedUntil)
+	if err != nil {
+		return err
+	}
+	if retryAfter := time.Until(blockedUntil.Time); blockedUntil.Valid && retryAfter > 0 {
+		return &LoginThrottledError{RetryAfter: retryAfter}
+	}
+	return nil
+}
+
+func (t *LoginThrottle) recordFailure(ctx context.Context, db *sql.DB, accountKey, agentIp string) error {
+	_, err := db.ExecContext(ctx,
+		"DELETE FROM login_throttles WHERE last_failure_at < $1 AND blocked_until < $2",
+		time.Now().Add(-loginFailureWindow), time.Now(),
+	)
+	if err != nil {
+		return err
+	}
+	err = t.recordFailureOf(ctx, db, loginThrottleAccount, accountKey, t.AccountThreshold)
+	if err != nil || agentIp == "" {
+		return err
+	}
+	return t.recordFailureOf(ctx, db, loginThrottleIP, agentIp, t.IPThreshold)
+}
+
+func (t *LoginThrottle) recordFailureOf(ctx context.Context, db *sql.DB, scope, key string, threshold int) error {
+	lockAt := threshold
+	if lockAt <= 0 {
+		lockAt = math.MaxInt32
+	}
+	firstDelay := min(t.BackoffBase, t.BackoffMax)
+	if lockAt <= 1 {
+		firstDelay = t.LockoutDuration
+	}
+	now := time.Now()
+
+	// Counting starts over once a block has run out and the failures are old
+	// or ended in a lockout. Failures while blocked never shorten the block.
+	// Parameters used in more than one place are cast so that Postgres infers
+	// the same type for each use.
+	_, err := db.ExecContext(ctx,
+		`INSERT INTO login_throttles (scope, key, failures, last_failure_at, blocked_until)
+		VALUES ($1, $2, 1, $3::timestamp, $3::timestamp + $6::float8 * interval '1 second')
+		ON CONFLICT (scope, key) DO UPDATE SET
+			failures = CASE WHEN login_throttles.blocked_until < $3::timestamp AND (login_throttles.last_failure_at < $4::timestamp OR login_throttles.failures >= $5::integer)
+				THEN 1 ELSE login_throttles.failures + 1 END,
+			last_failure_at = $3::timestamp,
+			blocked_until = GREATEST(login_throttles.blocked_until, $3::timestamp + interval '1 second' * CASE
+				WHEN login_throttles.blocked_until < $3::timestamp AND (login_throttles.last_failure_at < $4::timestamp OR login_throttles.failures >= $5::integer) THEN $6::float8
+				WHEN login_throttles.failures + 1 >= $5::integer THEN $7::float8
+				ELSE LEAST($8::float8 * power(2, LEAST(login_throttles.failures, 30)), $9::float8) END)`,
+		scope, key, now, now.Add(-loginFailureWindow), lockAt,
+		firstDelay.Seconds(), t.LockoutDuration.Seconds(), t.BackoffBase.Seconds(), t.BackoffMax.Seconds(),
+	)
+	return err
+}
+
+// clearLoginFailures unlocks an account.
+func clearLoginFailures(ctx context.Context, db execQueryer, accountKey string) error {
+	_, err := db.ExecContext(ctx,
+		"DELETE FROM login_throttles WHERE scope = $1 AND key = $2",
+		loginThrottleAccount, accountKey,
+	)
+	return err
+}
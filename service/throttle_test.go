@@ -0,0 +1,186 @@
+package service
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"math"
+	"os"
+	"regexp"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/DATA-DOG/go-sqlmock"
+	_ "github.com/lib/pq"
+)
+
+// newTestThrottleDB connects to the Postgres database in TEST_DATABASE_URL
+// and creates login_throttles as a temporary table, so that the statements
+// are checked by the server rather than a mock.
+func newTestThrottleDB(t *testing.T) *sql.DB {
+	t.Helper()
+	url := os.Getenv("TEST_DATABASE_URL")
+	if url == "" {
+		t.Skip("TEST_DATABASE_URL is not set")
+	}
+	db, err := sql.Open("postgres", url)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { db.Close() })
+	// The temporary table only exists on the connection that created it.
+	db.SetMaxOpenConns(1)
+
+	migration, err := os.ReadFile("../migrations/000018_create_login_throttles_table.up.sql")
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = db.Exec(strings.ReplaceAll(string(migration), "CREATE TABLE", "CREATE TEMPORARY TABLE"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return db
+}
+
+func throttleState(t *testing.T, db *sql.DB, scope, key string) (int, time.Duration) {
+	t.Helper()
+	var failures int
+	var lastFailureAt, blockedUntil time.Time
+	err := db.QueryRow(
+		"SELECT failures, last_failure_at, blocked_until FROM login_throttles WHERE scope = $1 AND key = $2",
+		scope, key,
+	).Scan(&failures, &lastFailureAt, &blockedUntil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return failures, blockedUntil.Sub(lastFailureAt)
+}
+
+func TestLoginThrottlePostgres(t *testing.T) {
+	db := newTestThrottleDB(t)
+	ctx := context.Background()
+	throttle := &LoginThrottle{
+		AccountThreshold: 3,
+		IPThreshold:      10,
+		BackoffBase:      time.Second,
+		BackoffMax:       90 * time.Second,
+		LockoutDuration:  time.Hour,
+	}
+	accountKey := loginAccountKey(1, "Alice")
+
+	err := throttle.check(ctx, db, accountKey, "192.0.2.1")
+	if err != nil {
+		t.Fatalf("check() before any failure = %v", err)
+	}
+	for i, want := range []time.Duration{time.Second, 2 * time.Second, time.Hour} {
+		err = throttle.recordFailure(ctx, db, accountKey, "192.0.2.1")
+		if err != nil {
+			t.Fatalf("recordFailure() #%d = %v", i+1, err)
+		}
+		failures, blocked := throttleState(t, db, loginThrottleAccount, accountKey)
+		if failures != i+1 || blocked.Round(time.Second) != want {
+			t.Fatalf("after failure #%d: failures = %d, blocked for %v, want %d and %v", i+1, failures, blocked, i+1, want)
+		}
+	}
+	failures, blocked := throttleState(t, db, loginThrottleIP, "192.0.2.1")
+	if failures != 3 || blocked.Round(time.Second) != 4*time.Second {
+		t.Fatalf("IP: failures = %d, blocked for %v, want 3 and 4s", failures, blocked)
+	}
+
+	var throttled *LoginThrottledError
+	err = throttle.check(ctx, db, loginAccountKey(1, "alice"), "198.51.100.1")
+	if !errors.As(err, &throttled) || throttled.RetryAfter < 59*time.Minute {
+		t.Fatalf("check() after lockout = %v, want a LoginThrottledError for about an hour", err)
+	}
+
+	err = clearLoginFailures(ctx, db, accountKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = throttle.check(ctx, db, accountKey, "198.51.100.1")
+	if err != nil {
+		t.Fatalf("check() after clearLoginFailures() = %v", err)
+	}
+}
+
+func TestLoginThrottleCheck(t *testing.T) {
+	db, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	throttle := &LoginThrottle{}
+	query := regexp.QuoteMeta("SELECT MAX(blocked_until) FROM login_throttles")
+	accountKey := loginAccountKey(1, "Alice")
+	if accountKey != "1:alice" {
+		t.Fatalf("loginAccountKey() = %q, want usernames compared case-insensitively", accountKey)
+	}
+
+	tests := []struct {
+		name         string
+		blockedUntil interface{}
+		wantBlocked  bool
+	}{
+		{"never failed", nil, false},
+		{"block over", time.Now().Add(-time.Second), false},
+		{"blocked", time.Now().Add(time.Minute), true},
+	}
+	for _, test := range tests {
+		mock.ExpectQuery(query).
+			WithArgs(loginThrottleAccount, accountKey, loginThrottleIP, "192.0.2.1").
+			WillReturnRows(sqlmock.NewRows([]string{"max"}).AddRow(test.blockedUntil))
+		err = throttle.check(context.Background(), db, accountKey, "192.0.2.1")
+		var throttled *LoginThrottledError
+		blocked := errors.As(err, &throttled)
+		if blocked != test.wantBlocked || (!blocked && err != nil) {
+			t.Errorf("%s: check() error = %v, want blocked %v", test.name, err, test.wantBlocked)
+		}
+		if blocked && (throttled.RetryAfter <= 0 || throttled.RetryAfter > time.Minute) {
+			t.Errorf("%s: RetryAfter = %v", test.name, throttled.RetryAfter)
+		}
+	}
+
+	err = mock.ExpectationsWereMet()
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+// TestRecordFailureThresholds checks the lockout threshold and first delay
+// passed to the statement: a threshold of zero never locks out and one locks
+// out on the first failure.
+func TestRecordFailureThresholds(t *testing.T) {
+	db, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	throttle := &LoginThrottle{
+		AccountThreshold: 1,
+		BackoffBase:      2 * time.Second,
+		BackoffMax:       time.Minute,
+		LockoutDuration:  time.Hour,
+	}
+	insert := regexp.QuoteMeta("INSERT INTO login_throttles (scope, key, failures, last_failure_at, blocked_until)")
+
+	mock.ExpectExec(regexp.QuoteMeta("DELETE FROM login_throttles WHERE last_failure_at < $1 AND blocked_until < $2")).
+		WillReturnResult(sqlmock.NewResult(0, 0))
+	mock.ExpectExec(insert).
+		WithArgs(loginThrottleAccount, "1:alice", sqlmock.AnyArg(), sqlmock.AnyArg(), 1,
+			time.Hour.Seconds(), time.Hour.Seconds(), 2.0, 60.0).
+		WillReturnResult(sqlmock.NewResult(0, 1))
+	mock.ExpectExec(insert).
+		WithArgs(loginThrottleIP, "192.0.2.1", sqlmock.AnyArg(), sqlmock.AnyArg(), math.MaxInt32,
+			2.0, time.Hour.Seconds(), 2.0, 60.0).
+		WillReturnResult(sqlmock.NewResult(0, 1))
+	err = throttle.recordFailure(context.Background(), db, "1:alice", "192.0.2.1")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = mock.ExpectationsWereMet()
+	if err != nil {
+		t.Fatal(err)
+	}
+}
@@ -0,0 +1,131 @@
+package service
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"jwt-auth/auth"
+	"jwt-auth/model"
+	"regexp"
+	"strings"
+	"time"
+	"unicode/utf8"
+)
+
+var (
+	ErrTokenNotFound     = errors.New("Token not found")
+	ErrTokenExists       = errors.New("A token with this name already exists")
+	ErrInvalidTokenName  = errors.New("Invalid token name")
+	ErrInvalidTokenScope = errors.New("Invalid token scope")
+	ErrInvalidTokenTTL   = errors.New("Invalid token expiry")
+)
+
+// scopePattern is the scope syntax of RFC 6749 section 3.3, after
+// normalizeScope.
+var scopePattern = regexp.MustCompile(`^[\x21\x23-\x5B\x5D-\x7E]+( [\x21\x23-\x5B\x5D-\x7E]+)*$`)
+
+// PersonalAccessTokenService manages the caller's personal access tokens.
+// It takes an access token the user signed in for directly rather than a
+// personal access token or one issued to an OAuth client, so neither a
+// leaked token nor a client limited to a scope can mint broader ones.
+type PersonalAccessTokenService interface {
+	ListTokens(ctx context.Context, accessToken string) ([]model.PersonalAccessToken, error)
+	CreateToken(ctx context.Context, accessToken, name, scope string, expiresIn time.Duration) (model.CreatedPersonalAccessToken, error)
+	RevokeToken(ctx context.Context, accessToken, id string) error
+}
+
+type personalAccessTokenService struct {
+	db         *sql.DB
+	jwtManager *auth.JWTManager
+}
+
+func NewPersonalAccessTokenService(db *sql.DB, jwtManager *auth.JWTManager) PersonalAccessTokenService {
+	return &personalAccessTokenService{
+		db:         db,
+		jwtManager: jwtManager,
+	}
+}
+
+func (p *personalAccessTokenService) ListTokens(ctx context.Context, accessToken string) ([]model.PersonalAccessToken, error) {
+	userId, _, err := p.jwtManager.ValidateFirstPartyAccessToken(accessToken)
+	if err != nil {
+		return nil, err
+	}
+	records, err := p.jwtManager.ListPersonalAccessTokens(ctx, userId)
+	if err != nil {
+		return nil, err
+	}
+
+	tokens := []model.PersonalAccessToken{}
+	for _, record := range records {
+		tokens = append(tokens, personalAccessToken(record))
+	}
+	return tokens, nil
+}
+
+// CreateToken issues a token limited to scope, which is required so that a
+// token never carries every right of its user. A zero expiresIn creates a
+// token that does not expire.
+func (p *personalAccessTokenService) CreateToken(ctx context.Context, accessToken, name, scope string, expiresIn time.Duration) (model.CreatedPersonalAccessToken, error) {
+	userId, _, err := p.jwtManager.ValidateFirstPartyAccessToken(accessToken)
+	if err != nil {
+		return model.CreatedPersonalAccessToken{}, err
+	}
+
+	name = strings.TrimSpace(name)
+	if name == "" || utf8.RuneCountInString(name) > 64 {
+		return model.CreatedPersonalAccessToken{}, ErrInvalidTokenName
+	}
+	scope = normalizeScope(scope)
+	if len(scope) > 255 || !scopePattern.MatchString(scope) {
+		return model.CreatedPersonalAccessToken{}, ErrInvalidTokenScope
+	}
+	if expiresIn < 0 {
+		return model.CreatedPersonalAccessToken{}, ErrInvalidTokenTTL
+	}
+	var expiresAt *time.Time
+	if expiresIn > 0 {
+		expiry := time.Now().Add(expiresIn)
+		expiresAt = &expiry
+	}
+
+	token, record, err := p.jwtManager.CreatePersonalAccessToken(ctx, userId, name, scope, expiresAt)
+	if errors.Is(err, auth.ErrPersonalAccessTokenExists) {
+		return model.CreatedPersonalAccessToken{}, ErrTokenExists
+	}
+	if err != nil {
+		return model.CreatedPersonalAccessToken{}, err
+	}
+	return model.CreatedPersonalAccessToken{
+		PersonalAccessToken: personalAccessToken(record),
+		Token:               token,
+	}, nil
+}
+
+func (p *personalAccessTokenService) RevokeToken(ctx context.Context, accessToken, id string) error {
+	userId, _, err := p.jwtManager.ValidateFirstPartyAccessToken(accessToken)
+	if err != nil {
+		return err
+	}
+	revoked, err := p.jwtManager.RevokePersonalAccessToken(ctx, userId, id)
+	if err != nil {
+		return err
+	}
+	if !revoked {
+		return ErrTokenNotFound
+	}
+	return nil
+}
+
+func personalAccessToken(record *auth.PersonalAccessTokenRecord) model.PersonalAccessToken {
+	return model.PersonalAccessToken{
+		ID:         record.ID,
+		Name:       record.Name,
+		Prefix:     record.Prefix,
+		Scope:      record.Scope,
+		CreatedAt:  record.CreatedAt,
+		ExpiresAt:  record.ExpiresAt,
+		LastUsedAt: record.LastUsedAt,
+		LastUsedIp: record.LastUsedIp,
+	}
+}
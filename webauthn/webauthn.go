@@ -0,0 +1,387 @@
+// Package webauthn implements the relying party side of the WebAuthn
+// registration and authentication ceremonies. It keeps no state: callers
+// store the challenges they hand out and the credentials they get back, so
+// a software authenticator can drive it as well as a browser.
+package webauthn
+
+import (
+	"bytes"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"slices"
+	"strings"
+
+	"github.com/google/uuid"
+)
+
+// ceremonyTimeout is the timeout hint sent to clients, in milliseconds.
+const ceremonyTimeout = 5 * 60 * 1000
+
+// Authenticator data flags.
+const (
+	flagUserPresent   = 0x01
+	flagUserVerified  = 0x04
+	flagAttestedData  = 0x40
+	flagExtensionData = 0x80
+)
+
+var (
+	ErrInvalidResponse   = errors.New("Invalid WebAuthn response")
+	ErrChallengeMismatch = errors.New("WebAuthn challenge mismatch")
+	ErrOriginMismatch    = errors.New("WebAuthn origin not allowed")
+	ErrInvalidSignature  = errors.New("Invalid WebAuthn signature")
+	// ErrSignCount is returned when an authenticator's signature counter
+	// did not increase, a sign that the credential was cloned.
+	ErrSignCount = errors.New("WebAuthn signature counter did not increase")
+)
+
+// RelyingParty is the site credentials are scoped to. ID is a host name
+// and Origins the exact origins, such as "https://login.example.com", that
+// ceremonies may run on.
+type RelyingParty struct {
+	ID      string
+	Name    string
+	Origins []string
+}
+
+// Bytes is a binary value encoded as unpadded base64url in JSON, as in the
+// JSON forms of WebAuthn options and credentials.
+type Bytes []byte
+
+func (b Bytes) MarshalJSON() ([]byte, error) {
+	return json.Marshal(base64.RawURLEncoding.EncodeToString(b))
+}
+
+func (b *Bytes) UnmarshalJSON(data []byte) error {
+	var encoded string
+	err := json.Unmarshal(data, &encoded)
+	if err != nil {
+		return err
+	}
+	decoded, err := base64.RawURLEncoding.DecodeString(strings.TrimRight(encoded, "="))
+	if err != nil {
+		return err
+	}
+	*b = decoded
+	return nil
+}
+
+type RPEntity struct {
+	ID   string `json:"id"`
+	Name string `json:"name"`
+}
+
+type UserEntity struct {
+	ID          Bytes  `json:"id"`
+	Name        string `json:"name"`
+	DisplayName string `json:"displayName"`
+}
+
+type CredentialParameter struct {
+	Type string `json:"type"`
+	Alg  int64  `json:"alg"`
+}
+
+type CredentialDescriptor struct {
+	Type       string   `json:"type"`
+	ID         Bytes    `json:"id"`
+	Transports []string `json:"transports,omitempty"`
+}
+
+type AuthenticatorSelection struct {
+	ResidentKey        string `json:"residentKey"`
+	RequireResidentKey bool   `json:"requireResidentKey"`
+	UserVerification   string `json:"userVerification"`
+}
+
+// CreationOptions are the options of navigator.credentials.create() in the
+// form PublicKeyCredential.parseCreationOptionsFromJSON() takes.
+type CreationOptions struct {
+	Challenge              Bytes                  `json:"challenge"`
+	RP                     RPEntity               `json:"rp"`
+	User                   UserEntity             `json:"user"`
+	PubKeyCredParams       []CredentialParameter  `json:"pubKeyCredParams"`
+	Timeout                int64                  `json:"timeout"`
+	ExcludeCredentials     []CredentialDescriptor `json:"excludeCredentials"`
+	AuthenticatorSelection AuthenticatorSelection `json:"authenticatorSelection"`
+	Attestation            string                 `json:"attestation"`
+}
+
+// RequestOptions are the options of navigator.credentials.get() in the
+// form PublicKeyCredential.parseRequestOptionsFromJSON() takes.
+type RequestOptions struct {
+	Challenge        Bytes                  `json:"challenge"`
+	Timeout          int64                  `json:"timeout"`
+	RPID             string                 `json:"rpId"`
+	AllowCredentials []CredentialDescriptor `json:"allowCredentials"`
+	UserVerification string                 `json:"userVerification"`
+}
+
+// RegistrationResponse is the credential navigator.credentials.create()
+// returns, in the form of its toJSON().
+type RegistrationResponse struct {
+	ID       string `json:"id"`
+	RawID    Bytes  `json:"rawId"`
+	Type     string `json:"type"`
+	Response struct {
+		ClientDataJSON    Bytes    `json:"clientDataJSON"`
+		AttestationObject Bytes    `json:"attestationObject"`
+		Transports        []string `json:"transports,omitempty"`
+	} `json:"response"`
+}
+
+// AssertionResponse is the credential navigator.credentials.get() returns,
+// in the form of its toJSON().
+type AssertionResponse struct {
+	ID       string `json:"id"`
+	RawID    Bytes  `json:"rawId"`
+	Type     string `json:"type"`
+	Response struct {
+		ClientDataJSON    Bytes `json:"clientDataJSON"`
+		AuthenticatorData Bytes `json:"authenticatorData"`
+		Signature         Bytes `json:"signature"`
+		UserHandle        Bytes `json:"userHandle,omitempty"`
+	} `json:"response"`
+}
+
+// Credential is a registered public key credential.
+type Credential struct {
+	ID []byte
+	// PublicKey is PKIX encoded.
+	PublicKey  []byte
+	Algorithm  int64
+	SignCount  uint32
+	AAGUID     string
+	Transports []string
+}
+
+type clientData struct {
+	Type        string `json:"type"`
+	Challenge   string `json:"challenge"`
+	Origin      string `json:"origin"`
+	CrossOrigin bool   `json:"crossOrigin"`
+}
+
+type authenticatorData struct {
+	rpIDHash  []byte
+	flags     byte
+	signCount uint32
+	rest      []byte
+}
+
+func NewChallenge() ([]byte, error) {
+	challenge := make([]byte, 32)
+	_, err := rand.Read(challenge)
+	if err != nil {
+		return nil, fmt.Errorf("Failed to generate random bytes: %w", err)
+	}
+	return challenge, nil
+}
+
+// NewCreationOptions asks for a discoverable credential with user
+// verification, so that it can sign the user in on its own. exclude lists
+// the user's existing credentials, which authenticators will not duplicate.
+func (rp *RelyingParty) NewCreationOptions(challenge []byte, user UserEntity, exclude []CredentialDescriptor) CreationOptions {
+	if exclude == nil {
+		exclude = []CredentialDescriptor{}
+	}
+	return CreationOptions{
+		Challenge: challenge,
+		RP:        RPEntity{ID: rp.ID, Name: rp.Name},
+		User:      user,
+		PubKeyCredParams: []CredentialParameter{
+			{Type: "public-key", Alg: AlgES256},
+			{Type: "public-key", Alg: AlgEdDSA},
+			{Type: "public-key", Alg: AlgRS256},
+		},
+		Timeout:            ceremonyTimeout,
+		ExcludeCredentials: exclude,
+		AuthenticatorSelection: AuthenticatorSelection{
+			ResidentKey:        "required",
+			RequireResidentKey: true,
+			UserVerification:   "required",
+		},
+		Attestation: "none",
+	}
+}
+
+// NewRequestOptions asks for any discoverable credential of the relying
+// party, letting the user pick the account.
+func (rp *RelyingParty) NewRequestOptions(challenge []byte) RequestOptions {
+	return RequestOptions{
+		Challenge:        challenge,
+		Timeout:          ceremonyTimeout,
+		RPID:             rp.ID,
+		AllowCredentials: []CredentialDescriptor{},
+		UserVerification: "required",
+	}
+}
+
+// ClientChallenge returns the challenge a response claims to answer, for
+// callers to look up before verifying it.
+func ClientChallenge(clientDataJSON []byte) ([]byte, error) {
+	var data clientData
+	err := json.Unmarshal(clientDataJSON, &data)
+	if err != nil {
+		return nil, fmt.Errorf("%w: %w", ErrInvalidResponse, err)
+	}
+	challenge, err := base64.RawURLEncoding.DecodeString(data.Challenge)
+	if err != nil {
+		return nil, fmt.Errorf("%w: %w", ErrInvalidResponse, err)
+	}
+	return challenge, nil
+}
+
+// VerifyRegistration checks a response to creation options carrying
+// challenge and returns the new credential. Attestation is not requested,
+// so attestation statements are not verified and the AAGUID is
+// informational only.
+func (rp *RelyingParty) VerifyRegistration(challenge []byte, response *RegistrationResponse) (*Credential, error) {
+	err := checkCredentialID(response.Type, response.ID, response.RawID)
+	if err != nil {
+		return nil, err
+	}
+	err = rp.checkClientData(response.Response.ClientDataJSON, "webauthn.create", challenge)
+	if err != nil {
+		return nil, err
+	}
+
+	item, rest, err := decodeCBOR(response.Response.AttestationObject)
+	if err != nil || len(rest) != 0 {
+		return nil, fmt.Errorf("%w: malformed attestation object", ErrInvalidResponse)
+	}
+	attestation, _ := item.(map[interface{}]interface{})
+	rawAuthData, _ := attestation["authData"].([]byte)
+	authData, err := rp.parseAuthenticatorData(rawAuthData)
+	if err != nil {
+		return nil, err
+	}
+	if authData.flags&flagAttestedData == 0 || len(authData.rest) < 18 {
+		return nil, fmt.Errorf("%w: no attested credential data", ErrInvalidResponse)
+	}
+
+	aaguid, err := uuid.FromBytes(authData.rest[:16])
+	if err != nil {
+		return nil, fmt.Errorf("%w: %w", ErrInvalidResponse, err)
+	}
+	idLength := int(binary.BigEndian.Uint16(authData.rest[16:18]))
+	if len(authData.rest) < 18+idLength || !bytes.Equal(authData.rest[18:18+idLength], response.RawID) {
+		return nil, fmt.Errorf("%w: credential ID mismatch", ErrInvalidResponse)
+	}
+	coseKey, extensions, err := decodeCBOR(authData.rest[18+idLength:])
+	if err != nil {
+		return nil, fmt.Errorf("%w: malformed credential public key", ErrInvalidResponse)
+	}
+	if len(extensions) > 0 && authData.flags&flagExtensionData == 0 {
+		return nil, fmt.Errorf("%w: trailing authenticator data", ErrInvalidResponse)
+	}
+	publicKey, alg, err := parseCOSEKey(coseKey)
+	if err != nil {
+		return nil, err
+	}
+	encodedKey, err := x509.MarshalPKIXPublicKey(publicKey)
+	if err != nil {
+		return nil, fmt.Errorf("%w: %w", ErrUnsupportedKey, err)
+	}
+
+	return &Credential{
+		ID:         slices.Clone([]byte(response.RawID)),
+		PublicKey:  encodedKey,
+		Algorithm:  alg,
+		SignCount:  authData.signCount,
+		AAGUID:     aaguid.String(),
+		Transports: response.Response.Transports,
+	}, nil
+}
+
+// VerifyAssertion checks a response to request options carrying challenge,
+// signed with credential, and returns the authenticator's new signature
+// counter to store. The caller checks that the response's user handle, if
+// any, names the credential's owner.
+func (rp *RelyingParty) VerifyAssertion(challenge []byte, credential *Credential, response *AssertionResponse) (uint32, error) {
+	err := checkCredentialID(response.Type, response.ID, response.RawID)
+	if err != nil {
+		return 0, err
+	}
+	if !bytes.Equal(response.RawID, credential.ID) {
+		return 0, fmt.Errorf("%w: credential ID mismatch", ErrInvalidResponse)
+	}
+	err = rp.checkClientData(response.Response.ClientDataJSON, "webauthn.get", challenge)
+	if err != nil {
+		return 0, err
+	}
+	authData, err := rp.parseAuthenticatorData(response.Response.AuthenticatorData)
+	if err != nil {
+		return 0, err
+	}
+
+	clientDataHash := sha256.Sum256(response.Response.ClientDataJSON)
+	signed := append(slices.Clone([]byte(response.Response.AuthenticatorData)), clientDataHash[:]...)
+	if !verifySignature(credential.Algorithm, credential.PublicKey, signed, response.Response.Signature) {
+		return 0, ErrInvalidSignature
+	}
+
+	// Authenticators without a counter always report zero.
+	if (authData.signCount != 0 || credential.SignCount != 0) && authData.signCount <= credential.SignCount {
+		return 0, ErrSignCount
+	}
+	return authData.signCount, nil
+}
+
+func checkCredentialID(credentialType, id string, rawID []byte) error {
+	if credentialType != "public-key" || len(rawID) == 0 || len(rawID) > 1023 {
+		return fmt.Errorf("%w: invalid credential", ErrInvalidResponse)
+	}
+	if id != base64.RawURLEncoding.EncodeToString(rawID) {
+		return fmt.Errorf("%w: credential ID mismatch", ErrInvalidResponse)
+	}
+	return nil
+}
+
+func (rp *RelyingParty) checkClientData(clientDataJSON []byte, ceremony string, challenge []byte) error {
+	var data clientData
+	err := json.Unmarshal(clientDataJSON, &data)
+	if err != nil {
+		return fmt.Errorf("%w: %w", ErrInvalidResponse, err)
+	}
+	if data.Type != ceremony {
+		return fmt.Errorf("%w: expected %s", ErrInvalidResponse, ceremony)
+	}
+	received, err := base64.RawURLEncoding.DecodeString(data.Challenge)
+	if err != nil || subtle.ConstantTimeCompare(received, challenge) != 1 {
+		return ErrChallengeMismatch
+	}
+	if data.CrossOrigin || !slices.Contains(rp.Origins, data.Origin) {
+		return ErrOriginMismatch
+	}
+	return nil
+}
+
+// parseAuthenticatorData checks that the data is scoped to the relying
+// party and that the user was both present and verified.
+func (rp *RelyingParty) parseAuthenticatorData(data []byte) (*authenticatorData, error) {
+	if len(data) < 37 {
+		return nil, fmt.Errorf("%w: short authenticator data", ErrInvalidResponse)
+	}
+	authData := &authenticatorData{
+		rpIDHash:  data[:32],
+		flags:     data[32],
+		signCount: binary.BigEndian.Uint32(data[33:37]),
+		rest:      data[37:],
+	}
+	rpIDHash := sha256.Sum256([]byte(rp.ID))
+	if subtle.ConstantTimeCompare(authData.rpIDHash, rpIDHash[:]) != 1 {
+		return nil, fmt.Errorf("%w: relying party ID mismatch", ErrInvalidResponse)
+	}
+	if authData.flags&flagUserPresent == 0 || authData.flags&flagUserVerified == 0 {
+		return nil, fmt.Errorf("%w: user not verified", ErrInvalidResponse)
+	}
+	return authData, nil
+}
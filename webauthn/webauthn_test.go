@@ -0,0 +1,308 @@
+package webauthn
+
+import (
+	"bytes"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"testing"
+)
+
+const (
+	testRPID   = "login.example.com"
+	testOrigin = "https://login.example.com"
+)
+
+func testRelyingParty() *RelyingParty {
+	return &RelyingParty{ID: testRPID, Name: "Example", Origins: []string{testOrigin}}
+}
+
+// softAuthenticator is an in-process ES256 authenticator producing the
+// responses a browser would pass on.
+type softAuthenticator struct {
+	key          *ecdsa.PrivateKey
+	credentialID []byte
+	signCount    uint32
+}
+
+func newSoftAuthenticator(t *testing.T) *softAuthenticator {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	credentialID := make([]byte, 16)
+	_, err = rand.Read(credentialID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return &softAuthenticator{key: key, credentialID: credentialID}
+}
+
+// ceremony describes what the authenticator and client report, so that
+// cases can tamper with each part.
+type ceremony struct {
+	rpID        string
+	flags       byte
+	signCount   uint32
+	challenge   []byte
+	origin      string
+	crossOrigin bool
+}
+
+func validCeremony(challenge []byte) ceremony {
+	return ceremony{
+		rpID:      testRPID,
+		flags:     flagUserPresent | flagUserVerified,
+		signCount: 1,
+		challenge: challenge,
+		origin:    testOrigin,
+	}
+}
+
+func (c ceremony) clientDataJSON(t *testing.T, ceremonyType string) []byte {
+	t.Helper()
+	data, err := json.Marshal(clientData{
+		Type:        ceremonyType,
+		Challenge:   base64.RawURLEncoding.EncodeToString(c.challenge),
+		Origin:      c.origin,
+		CrossOrigin: c.crossOrigin,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return data
+}
+
+func (c ceremony) authenticatorData(attested []byte) []byte {
+	rpIDHash := sha256.Sum256([]byte(c.rpID))
+	data := append(rpIDHash[:], c.flags)
+	data = binary.BigEndian.AppendUint32(data, c.signCount)
+	return append(data, attested...)
+}
+
+func (a *softAuthenticator) register(t *testing.T, c ceremony) *RegistrationResponse {
+	t.Helper()
+	publicKey := a.key.PublicKey
+	coseKey := encodeTestCBOR(map[int64]interface{}{
+		coseKty: int64(2),
+		coseAlg: int64(AlgES256),
+		coseCrv: int64(1),
+		coseX:   publicKey.X.FillBytes(make([]byte, 32)),
+		coseY:   publicKey.Y.FillBytes(make([]byte, 32)),
+	})
+	attested := make([]byte, 16)
+	attested = binary.BigEndian.AppendUint16(attested, uint16(len(a.credentialID)))
+	attested = append(append(attested, a.credentialID...), coseKey...)
+	c.flags |= flagAttestedData
+
+	response := &RegistrationResponse{
+		ID:    base64.RawURLEncoding.EncodeToString(a.credentialID),
+		RawID: a.credentialID,
+		Type:  "public-key",
+	}
+	response.Response.ClientDataJSON = c.clientDataJSON(t, "webauthn.create")
+	response.Response.AttestationObject = encodeTestCBOR(map[string]interface{}{
+		"fmt":      "none",
+		"attStmt":  map[string]interface{}{},
+		"authData": c.authenticatorData(attested),
+	})
+	return response
+}
+
+func (a *softAuthenticator) assert(t *testing.T, c ceremony) *AssertionResponse {
+	t.Helper()
+	response := &AssertionResponse{
+		ID:    base64.RawURLEncoding.EncodeToString(a.credentialID),
+		RawID: a.credentialID,
+		Type:  "public-key",
+	}
+	response.Response.ClientDataJSON = c.clientDataJSON(t, "webauthn.get")
+	response.Response.AuthenticatorData = c.authenticatorData(nil)
+	clientDataHash := sha256.Sum256(response.Response.ClientDataJSON)
+	digest := sha256.Sum256(append(bytes.Clone(response.Response.AuthenticatorData), clientDataHash[:]...))
+	signature, err := ecdsa.SignASN1(rand.Reader, a.key, digest[:])
+	if err != nil {
+		t.Fatal(err)
+	}
+	response.Response.Signature = signature
+	return response
+}
+
+// encodeTestCBOR encodes the subset of CBOR attestation objects and COSE
+// keys use. Maps are encoded in insertion order, which decodeCBOR accepts.
+func encodeTestCBOR(item interface{}) []byte {
+	head := func(major byte, argument uint64) []byte {
+		switch {
+		case argument < 24:
+			return []byte{major<<5 | byte(argument)}
+		case argument <= 0xff:
+			return []byte{major<<5 | 24, byte(argument)}
+		default:
+			return binary.BigEndian.AppendUint16([]byte{major<<5 | 25}, uint16(argument))
+		}
+	}
+	switch item := item.(type) {
+	case int64:
+		if item < 0 {
+			return head(1, uint64(-1-item))
+		}
+		return head(0, uint64(item))
+	case []byte:
+		return append(head(2, uint64(len(item))), item...)
+	case string:
+		return append(head(3, uint64(len(item))), item...)
+	case map[string]interface{}:
+		encoded := head(5, uint64(len(item)))
+		for _, key := range []string{"fmt", "attStmt", "authData"} {
+			if value, ok := item[key]; ok {
+				encoded = append(append(encoded, encodeTestCBOR(key)...), encodeTestCBOR(value)...)
+			}
+		}
+		return encoded
+	case map[int64]interface{}:
+		encoded := head(5, uint64(len(item)))
+		for _, key := range []int64{coseKty, coseAlg, coseCrv, coseX, coseY} {
+			if value, ok := item[key]; ok {
+				encoded = append(append(encoded, encodeTestCBOR(key)...), encodeTestCBOR(value)...)
+			}
+		}
+		return encoded
+	}
+	panic("unsupported CBOR item")
+}
+
+func mustChallenge(t *testing.T) []byte {
+	t.Helper()
+	challenge, err := NewChallenge()
+	if err != nil {
+		t.Fatal(err)
+	}
+	return challenge
+}
+
+func TestVerifyRegistration(t *testing.T) {
+	tests := []struct {
+		name    string
+		tamper  func(c *ceremony)
+		wantErr error
+	}{
+		{"valid", func(c *ceremony) {}, nil},
+		{"rpIdHash mismatch", func(c *ceremony) { c.rpID = "evil.example.com" }, ErrInvalidResponse},
+		{"user not present", func(c *ceremony) { c.flags &^= flagUserPresent }, ErrInvalidResponse},
+		{"user not verified", func(c *ceremony) { c.flags &^= flagUserVerified }, ErrInvalidResponse},
+		{"wrong origin", func(c *ceremony) { c.origin = "https://evil.example.com" }, ErrOriginMismatch},
+		{"cross origin", func(c *ceremony) { c.crossOrigin = true }, ErrOriginMismatch},
+		{"other challenge", func(c *ceremony) { c.challenge = mustChallenge(t) }, ErrChallengeMismatch},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			rp := testRelyingParty()
+			authenticator := newSoftAuthenticator(t)
+			challenge := mustChallenge(t)
+			c := validCeremony(challenge)
+			test.tamper(&c)
+
+			credential, err := rp.VerifyRegistration(challenge, authenticator.register(t, c))
+			if !errors.Is(err, test.wantErr) {
+				t.Fatalf("VerifyRegistration() error = %v, want %v", err, test.wantErr)
+			}
+			if err != nil {
+				return
+			}
+			if !bytes.Equal(credential.ID, authenticator.credentialID) || credential.Algorithm != AlgES256 || credential.SignCount != 1 {
+				t.Fatalf("VerifyRegistration() = %+v", credential)
+			}
+		})
+	}
+}
+
+func TestVerifyAssertion(t *testing.T) {
+	tests := []struct {
+		name      string
+		stored    uint32
+		tamper    func(c *ceremony)
+		wantCount uint32
+		wantErr   error
+	}{
+		{"valid", 1, func(c *ceremony) { c.signCount = 2 }, 2, nil},
+		{"no counter", 0, func(c *ceremony) { c.signCount = 0 }, 0, nil},
+		{"rpIdHash mismatch", 1, func(c *ceremony) { c.rpID = "evil.example.com"; c.signCount = 2 }, 0, ErrInvalidResponse},
+		{"user not present", 1, func(c *ceremony) { c.flags &^= flagUserPresent; c.signCount = 2 }, 0, ErrInvalidResponse},
+		{"user not verified", 1, func(c *ceremony) { c.flags &^= flagUserVerified; c.signCount = 2 }, 0, ErrInvalidResponse},
+		{"wrong origin", 1, func(c *ceremony) { c.origin = "https://evil.example.com"; c.signCount = 2 }, 0, ErrOriginMismatch},
+		{"cross origin", 1, func(c *ceremony) { c.crossOrigin = true; c.signCount = 2 }, 0, ErrOriginMismatch},
+		{"sign count regression", 5, func(c *ceremony) { c.signCount = 4 }, 0, ErrSignCount},
+		{"sign count repeated", 5, func(c *ceremony) { c.signCount = 5 }, 0, ErrSignCount},
+		{"counter dropped to zero", 5, func(c *ceremony) { c.signCount = 0 }, 0, ErrSignCount},
+		{"other challenge", 1, func(c *ceremony) { c.challenge = mustChallenge(t); c.signCount = 2 }, 0, ErrChallengeMismatch},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			rp := testRelyingParty()
+			authenticator := newSoftAuthenticator(t)
+			registrationChallenge := mustChallenge(t)
+			credential, err := rp.VerifyRegistration(registrationChallenge, authenticator.register(t, validCeremony(registrationChallenge)))
+			if err != nil {
+				t.Fatal(err)
+			}
+			credential.SignCount = test.stored
+
+			challenge := mustChallenge(t)
+			c := validCeremony(challenge)
+			test.tamper(&c)
+			signCount, err := rp.VerifyAssertion(challenge, credential, authenticator.assert(t, c))
+			if !errors.Is(err, test.wantErr) {
+				t.Fatalf("VerifyAssertion() error = %v, want %v", err, test.wantErr)
+			}
+			if signCount != test.wantCount {
+				t.Fatalf("VerifyAssertion() = %d, want %d", signCount, test.wantCount)
+			}
+		})
+	}
+}
+
+func TestVerifyAssertionRejectsTamperedSignature(t *testing.T) {
+	rp := testRelyingParty()
+	authenticator := newSoftAuthenticator(t)
+	challenge := mustChallenge(t)
+	credential, err := rp.VerifyRegistration(challenge, authenticator.register(t, validCeremony(challenge)))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	challenge = mustChallenge(t)
+	c := validCeremony(challenge)
+	c.signCount = 2
+	response := authenticator.assert(t, c)
+	response.Response.AuthenticatorData[len(response.Response.AuthenticatorData)-1]++
+	_, err = rp.VerifyAssertion(challenge, credential, response)
+	if !errors.Is(err, ErrInvalidSignature) {
+		t.Fatalf("VerifyAssertion() error = %v, want %v", err, ErrInvalidSignature)
+	}
+}
+
+// A registration response answered to a login challenge must not pass as an
+// assertion, nor the other way round.
+func TestCeremonyTypeMismatch(t *testing.T) {
+	rp := testRelyingParty()
+	authenticator := newSoftAuthenticator(t)
+	challenge := mustChallenge(t)
+	registration := authenticator.register(t, validCeremony(challenge))
+	credential, err := rp.VerifyRegistration(challenge, registration)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	assertion := authenticator.assert(t, validCeremony(challenge))
+	assertion.Response.ClientDataJSON = registration.Response.ClientDataJSON
+	_, err = rp.VerifyAssertion(challenge, credential, assertion)
+	if !errors.Is(err, ErrInvalidResponse) {
+		t.Fatalf("VerifyAssertion() error = %v, want %v", err, ErrInvalidResponse)
+	}
+}
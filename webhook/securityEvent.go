@@ -0,0 +1,25 @@
+package webhook
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"time"
+)
+
+func NotifySecurityEvent(event string, userID int64, ip string, details map[string]interface{}) {
+	webhookURL := "http://webhook:9000/hooks/security-event"
+
+	payload := map[string]interface{}{
+		"event":   event,
+		"user_id": userID,
+		"ip":      ip,
+		"time":    time.Now().Format(time.RFC3339),
+	}
+	for key, value := range details {
+		payload[key] = value
+	}
+
+	jsonData, _ := json.Marshal(payload)
+	http.Post(webhookURL, "application/json", bytes.NewBuffer(jsonData))
+}